@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json" // Import JSON package
 	"errors"
 	"flag"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vskvj3/geomys/internal/security"
 )
 
 type Request struct {
@@ -22,6 +24,18 @@ type Request struct {
 	Value   string      `msgpack:"value,omitempty"`
 	Exp     int         `msgpack:"exp,omitempty"`
 	Offset  interface{} `msgpack:"offset,omitempty"`
+	Path    string      `msgpack:"path,omitempty"`
+
+	Replicas    int    `msgpack:"replicas,omitempty"`
+	Timeout     int    `msgpack:"timeout,omitempty"`
+	Consistency string `msgpack:"consistency,omitempty"`
+
+	Args []string `msgpack:"args,omitempty"`
+
+	Channel string `msgpack:"channel,omitempty"`
+
+	Username string `msgpack:"username,omitempty"`
+	Password string `msgpack:"password,omitempty" json:"-"` // not echoed
 }
 
 func argParser(input string) (Request, error) {
@@ -89,10 +103,13 @@ func argParser(input string) (Request, error) {
 		}
 
 	case "GET":
-		if len(parts) < 2 {
-			return Request{}, errors.New("GET requires a key")
+		if len(parts) < 2 || len(parts) > 3 {
+			return Request{}, errors.New("GET requires a key and an optional consistency level")
 		}
 		req.Key = parts[1]
+		if len(parts) == 3 {
+			req.Consistency = parts[2]
+		}
 
 	case "INCR":
 		if len(parts) < 3 {
@@ -119,6 +136,77 @@ func argParser(input string) (Request, error) {
 			return Request{}, errors.New("FLUSHDB does not require any arguments")
 		}
 
+	case "BACKUP":
+		if len(parts) != 2 {
+			return Request{}, errors.New("BACKUP requires a target directory or .tar/.tar.gz path relative to the backup directory")
+		}
+		req.Path = parts[1]
+
+	case "WAIT":
+		if len(parts) != 3 {
+			return Request{}, errors.New("WAIT requires numreplicas and a timeout in milliseconds")
+		}
+		replicas, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return Request{}, fmt.Errorf("invalid numreplicas: %s", parts[1])
+		}
+		timeout, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return Request{}, fmt.Errorf("invalid timeout: %s", parts[2])
+		}
+		req.Replicas = replicas
+		req.Timeout = timeout
+
+	case "WRITECONCERN":
+		if len(parts) != 2 {
+			return Request{}, errors.New("WRITECONCERN requires a level: async, one, quorum or all")
+		}
+		req.Value = parts[1]
+
+	case "CLUSTER":
+		if len(parts) < 2 {
+			return Request{}, errors.New("CLUSTER requires a subcommand: SLOTS, SHARDS, KEYSLOT, ADDSLOTS, DELSLOTS or SETSLOT, MIGRATE or REBALANCE")
+		}
+		req.Args = parts[1:]
+
+	case "AUTH":
+		if len(parts) < 2 || len(parts) > 3 {
+			return Request{}, errors.New("AUTH requires a password and an optional username before it")
+		}
+		req.Password = parts[len(parts)-1]
+		if len(parts) == 3 {
+			req.Username = parts[1]
+		}
+
+	case "ACL":
+		if len(parts) < 2 {
+			return Request{}, errors.New("ACL requires a subcommand: SETUSER, DELUSER, LIST or WHOAMI")
+		}
+		req.Args = parts[1:]
+
+	case "PUBLISH":
+		if len(parts) < 3 {
+			return Request{}, errors.New("PUBLISH requires a channel and a message")
+		}
+		req.Channel = parts[1]
+		req.Message = strings.Join(parts[2:], " ")
+
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(parts) < 2 {
+			return Request{}, fmt.Errorf("%s requires at least one channel or pattern", command)
+		}
+		req.Args = parts[1:]
+
+	case "ASKING":
+		if len(parts) > 1 {
+			return Request{}, errors.New("ASKING does not require any arguments")
+		}
+
+	case "ROLE":
+		if len(parts) > 1 {
+			return Request{}, errors.New("ROLE does not require any arguments")
+		}
+
 	default:
 		return Request{}, fmt.Errorf("unknown command: %s", command)
 	}
@@ -128,10 +216,24 @@ func argParser(input string) (Request, error) {
 
 func main() {
 	port := flag.Int("port", 6379, "Port number of the server")
+	caFile := flag.String("tls-ca", "", "CA certificate to verify the server with, connects over TLS")
+	certFile := flag.String("tls-cert", "", "Client certificate, for servers that ask for one")
+	keyFile := flag.String("tls-key", "", "Key of the client certificate")
 	flag.Parse()
 
 	serverAddr := fmt.Sprintf("localhost:%d", *port)
-	conn, err := net.Dial("tcp", serverAddr)
+	var conn net.Conn
+	var err error
+	if *caFile != "" {
+		var config *tls.Config
+		if config, err = security.ClientTLS(*caFile, *certFile, *keyFile); err != nil {
+			fmt.Println("Error setting up TLS: " + err.Error())
+			return
+		}
+		conn, err = tls.Dial("tcp", serverAddr, config)
+	} else {
+		conn, err = net.Dial("tcp", serverAddr)
+	}
 	if err != nil {
 		fmt.Printf("Error connecting to server on port %d: %v\n", *port, err)
 		return
@@ -181,6 +283,12 @@ func main() {
 			continue
 		}
 
+		// A subscribed connection only receives messages from now on
+		if req.Command == "SUBSCRIBE" || req.Command == "PSUBSCRIBE" {
+			listen(conn)
+			return
+		}
+
 		buffer := make([]byte, 4096)
 		length, err := conn.Read(buffer)
 		if err != nil {
@@ -210,3 +318,23 @@ func main() {
 
 	fmt.Println("Closing connection.")
 }
+
+// listen prints the messages pushed to a subscribed connection until it is
+// closed, press Ctrl-C to stop
+func listen(conn net.Conn) {
+	fmt.Println("\nWaiting for messages, press Ctrl-C to stop.")
+	dec := msgpack.NewDecoder(conn)
+	for {
+		var message map[string]interface{}
+		if err := dec.Decode(&message); err != nil {
+			fmt.Printf("Connection closed: %v\n", err)
+			return
+		}
+		messageJSON, err := json.MarshalIndent(message, "", "  ")
+		if err != nil {
+			fmt.Printf("Error converting message to JSON: %v\n", err)
+			continue
+		}
+		fmt.Println(string(messageJSON))
+	}
+}
@@ -4,47 +4,75 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/vskvj3/geomys/internal/backup"
 	"github.com/vskvj3/geomys/internal/cluster"
-	"github.com/vskvj3/geomys/internal/cluster/election"
 	"github.com/vskvj3/geomys/internal/core"
 	"github.com/vskvj3/geomys/internal/network"
+	"github.com/vskvj3/geomys/internal/persistence"
 	"github.com/vskvj3/geomys/internal/utils"
 )
 
 func main() {
-	logger := utils.NewLogger("", true)
+	// Parse Command-Line Flags
+	nodeIdPtr := flag.String("node_id", "", "Node ID of the current node")
+	portPtr := flag.String("port", "", "Port of the server")
+	bootstrapPtr := flag.Bool("bootstrap", false, "Start a new cluster with this node as its first member")
+	joinPtr := flag.String("join", "", "Join an existing cluster (provide the gRPC address of any member in <ip:port>)")
+	peersPtr := flag.String("peers", "", "Comma-separated gRPC addresses of cluster members to join through, <id>@<address> for every voter of a new cluster")
+	learnerPtr := flag.Bool("learner", false, "Join as a learner, which receives the log without voting until promoted")
+	configPtr := flag.String("config", utils.DefaultConfigPath(), "Path of the configuration file")
+	dataDirPtr := flag.String("data-dir", "", "Directory to store persisted data in (default ~/.geomys/Node<node_id>)")
+	logFilePtr := flag.String("log-file", "", "File to write logs to (default ~/.geomys/server.log)")
+	debugPtr := flag.Bool("debug", false, "Also write debug logs")
+	restorePtr := flag.String("restore-from", "", "Seed this node from a backup directory or archive (data directory must be empty)")
+	flag.Parse()
 
 	// Load Configurations
-	homeDir, err := os.UserHomeDir()
+	config, err := utils.LoadConfig(*configPtr)
 	if err != nil {
-		logger.Error("Error getting home directory: " + err.Error())
+		fmt.Println("Error loading configuration: " + err.Error())
 		return
 	}
-	configPath := filepath.Join(homeDir, ".geomys", "geomys.conf")
-	utils.LoadConfig(configPath)
+	if *dataDirPtr != "" {
+		config.DataDir = *dataDirPtr
+	}
+	if *logFilePtr != "" {
+		config.LogFile = *logFilePtr
+	}
+	if *debugPtr {
+		config.Debug = true
+	}
+	if *peersPtr != "" {
+		config.Peers = strings.Split(*peersPtr, ",")
+	}
 
-	config, err := utils.GetConfig()
+	logger, err := utils.NewLogger(config.GetLogFile(), config.Debug)
 	if err != nil {
-		logger.Error("Error loading configuration: " + err.Error())
+		fmt.Println("Error creating logger: " + err.Error())
 		return
 	}
-	logger.Info("Loaded configurations from " + configPath)
-
-	// Parse Command-Line Flags
-	nodeIdPtr := flag.String("node_id", "", "Node ID of the current node")
-	portPtr := flag.String("port", "", "Port of the server")
-	bootstrapPtr := flag.Bool("bootstrap", false, "Start cluster in bootstrap mode (leader)")
-	joinPtr := flag.String("join", "", "Join an existing cluster (provide leader address in <ip:port>)")
-	flag.Parse()
+	defer logger.Close()
+	logger.Info("Writing logs to " + config.GetLogFile())
+	logger.Info("Loaded configurations from " + *configPtr)
 
 	if *bootstrapPtr && *joinPtr != "" {
 		logger.Error("Cannot use both -bootstrap and -join. Choose only one.")
 		return
 	}
+	if *bootstrapPtr && len(config.Peers) > 0 {
+		logger.Error("Cannot use -bootstrap with peers, list every voter as <id>@<address> to bootstrap from them.")
+		return
+	}
+	if *learnerPtr && *joinPtr == "" && len(config.Peers) == 0 {
+		logger.Error("-learner only applies with -join or -peers.")
+		return
+	}
 
 	// Determine Node ID
 	nodeID := config.NodeID
@@ -57,6 +85,17 @@ func main() {
 		nodeID = parsedID
 		config.NodeID = nodeID
 	}
+
+	// A node that belonged to a cluster remembers its id and goes back to it
+	identity, err := cluster.LoadIdentity(config.GetDataDir())
+	if err != nil {
+		logger.Error("Failed to read the cluster identity: " + err.Error())
+		return
+	}
+	if identity != nil && *nodeIdPtr == "" {
+		nodeID = int(identity.NodeID)
+		config.NodeID = nodeID
+	}
 	logger.Info(fmt.Sprintf("Node ID assigned: %d", nodeID))
 
 	// Determine Port
@@ -75,58 +114,133 @@ func main() {
 	logger.Info("gRPC Port assigned: " + strconv.Itoa(config.ExternalPort))
 
 	// Initialize Core Components
-	db := core.NewDatabase()
-	commandHandler := core.NewCommandHandler(db)
-
-	// Initialize Cluster and Replication Servers
-	clusterServer := cluster.NewClusterServer(int32(nodeID), int32(config.ExternalPort))
-
-	// Configure Node Mode (Bootstrap, Join, or Standalone)
-	if *bootstrapPtr {
-		logger.Info("Starting in bootstrap mode (leader)...")
-		config.IsLeader = true
-		config.ClusterMode = true
-		clusterServer.SetLeaderAddress("")
-		clusterServer.SetLeaderID(int32(nodeID))
-		// start grpc server in leader mode
-		go clusterServer.StartServer(commandHandler)
-
-		// wait for 15 seconds, and start monitoring followers
-		time.Sleep(15 * time.Second)
-		go clusterServer.ElectionService.MonitorFollowers()
-	} else if *joinPtr != "" {
-		logger.Info("Joining existing cluster at " + *joinPtr)
-		config.IsLeader = false
-		config.ClusterMode = true
-		clusterServer.SetLeaderAddress(*joinPtr)
-		// start grpc server in follower mode
-		go clusterServer.StartServer(commandHandler)
-
-		// wait for 15 seconds, and start monitoring leader
-		time.Sleep(15 * time.Second)
+	codec, err := persistence.LoadCodec(config.Compression, config.EncryptionKeyFile, config.EncryptionKeyEnv, config.EncryptionPreviousKeys)
+	if err != nil {
+		logger.Error("Failed to set up persistence codec: " + err.Error())
+		return
+	}
+	if codec.Encrypted() {
+		logger.Info("Encryption at rest enabled")
+	}
+	engine, err := persistence.NewEngine(config.Persistence, config.GetDataDir(), codec)
+	if err != nil {
+		logger.Error("Failed to open persistence: " + err.Error())
+		return
+	}
+	defer engine.Close()
+	logger.Info("Persistence engine " + config.Persistence + " in " + config.GetDataDir())
 
-		client, err := election.NewElectionClient(*joinPtr)
-		if err != nil {
-			logger.Error("Failed to connect to leader: " + err.Error())
+	if *restorePtr != "" {
+		if err := restoreBackup(*restorePtr, engine); err != nil {
+			logger.Error("Restore failed: " + err.Error())
 			return
 		}
-		go client.MonitorLeader(clusterServer.ElectionService)
+		logger.Info("Restored data from backup " + *restorePtr)
+	}
+
+	db := core.NewDatabase()
+	commandHandler := core.NewCommandHandler(db, engine)
+	commandHandler.WriteConcern = core.WriteConcern(config.WriteConcern)
+	commandHandler.WriteTimeout = time.Duration(config.WriteTimeout) * time.Millisecond
+	commandHandler.ReadConsistency = core.ReadConsistency(config.ReadConsistency)
+	if config.MaxStaleness > 0 {
+		commandHandler.MaxStaleness = time.Duration(config.MaxStaleness) * time.Millisecond
+	}
+	commandHandler.MaxLag = uint64(config.MaxLag)
+
+	// Configure Node Mode (Bootstrap, Join, Peers or Standalone)
+	var clusterServer *cluster.ClusterServer
+	if *bootstrapPtr || *joinPtr != "" || len(config.Peers) > 0 || identity != nil {
+		config.ClusterMode = true
+		clusterServer = cluster.NewClusterServer(config, logger, int32(nodeID), int32(config.ExternalPort))
 	} else {
-		config.IsLeader = true
 		config.ClusterMode = false
 		logger.Info("Starting standalone node...")
 	}
 
-	// Start TCP Server
+	// Start TCP Server, this rebuilds the database from persistence
 	logger.Debug("Initializing TCP server on port " + strconv.Itoa(port))
-	server, err := network.NewServer(clusterServer, strconv.Itoa(port), commandHandler)
+	server, err := network.NewServer(config, logger, clusterServer, strconv.Itoa(port), commandHandler)
 	if err != nil {
 		logger.Error("TCP Server creation failed: " + err.Error())
 		return
 	}
+
+	if clusterServer != nil {
+		if *bootstrapPtr {
+			logger.Info("Starting in bootstrap mode...")
+		}
+		if err := clusterServer.StartServer(commandHandler, *bootstrapPtr); err != nil {
+			logger.Error("Failed to start cluster server: " + err.Error())
+			return
+		}
+		defer clusterServer.Stop()
+
+		switch {
+		case *joinPtr != "":
+			logger.Info("Joining existing cluster at " + *joinPtr)
+			join := clusterServer.Join
+			if *learnerPtr {
+				join = clusterServer.JoinAsLearner
+			}
+			if err := join(*joinPtr); err != nil {
+				logger.Error("Failed to join cluster: " + err.Error())
+				return
+			}
+		case identity != nil && !*bootstrapPtr:
+			logger.Info("Rejoining cluster " + identity.ClusterID)
+			if err := clusterServer.Rejoin(); err != nil {
+				logger.Error("Failed to rejoin cluster: " + err.Error())
+				return
+			}
+		case len(config.Peers) > 0:
+			logger.Info("Joining the cluster through its peers " + strings.Join(config.Peers, ","))
+			if err := clusterServer.JoinPeers(*learnerPtr); err != nil {
+				logger.Error("Failed to join cluster: " + err.Error())
+				return
+			}
+		}
+	}
+
 	logger.Debug("Starting TCP server...")
 	go server.Start()
 
-	// Block forever to keep the server running
-	select {}
+	// Keep the server running until SIGINT or SIGTERM, returning runs the
+	// deferred closes so buffered writes reach the disk. SIGHUP rereads the
+	// TLS certificates and cluster tokens.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			logger.Info("Received " + sig.String() + ", shutting down")
+			server.Close()
+			return
+		}
+		logger.Info("Reloading TLS certificates and cluster tokens")
+		if err := server.ReloadTLS(); err != nil {
+			logger.Error("Failed to reload the client TLS certificates: " + err.Error())
+		}
+		if clusterServer != nil {
+			if err := clusterServer.ReloadTLS(); err != nil {
+				logger.Error("Failed to reload the cluster TLS certificates: " + err.Error())
+			}
+			if err := clusterServer.ReloadTokens(); err != nil {
+				logger.Error("Failed to reload the cluster tokens: " + err.Error())
+			}
+		}
+	}
+}
+
+// restoreBackup seeds an empty persistence engine from a backup
+func restoreBackup(source string, engine persistence.Engine) error {
+	existing, err := persistence.LoadRequests(engine)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("data directory already holds %d records, restore only seeds a fresh node", len(existing))
+	}
+
+	_, err = backup.Restore(source, engine)
+	return err
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"github.com/vskvj3/geomys/internal/security"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+const usage = `geomys-tool moves data in and out of Geomys.
+
+Usage:
+  geomys-tool export [flags]   dump a data directory as JSON Lines (server must be stopped)
+  geomys-tool import [flags]   load JSON Lines into a running server
+
+Run "geomys-tool <command> -h" for the flags of a command.
+`
+
+// registerFilter adds the flags of an entry filter to a flag set
+func registerFilter(flags *flag.FlagSet, f *core.EntryFilter) {
+	flags.StringVar(&f.Match, "match", "*", "Only keys matching this pattern, * matching any run of characters and ? one")
+	flags.StringVar(&f.Type, "type", "", "Only keys of this type (string or list)")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// runExport replays a data directory offline and writes every key as a JSON line
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := flags.String("config", utils.DefaultConfigPath(), "Path of the configuration file")
+	dataDir := flags.String("data-dir", "", "Data directory of the node (default from config)")
+	engineName := flags.String("engine", "", "Persistence engine of the node (default from config)")
+	outPath := flags.String("out", "", "Output file (default stdout)")
+	var f core.EntryFilter
+	registerFilter(flags, &f)
+	flags.Parse(args)
+
+	config, err := utils.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	if *dataDir != "" {
+		config.DataDir = *dataDir
+	}
+	if *engineName != "" {
+		config.Persistence = *engineName
+	}
+
+	codec, err := persistence.LoadCodec(config.Compression, config.EncryptionKeyFile, config.EncryptionKeyEnv, config.EncryptionPreviousKeys)
+	if err != nil {
+		return fmt.Errorf("failed to set up persistence codec: %v", err)
+	}
+	// Opening the engine would create a missing data directory and an empty log
+	file, err := persistence.EngineFile(config.Persistence, config.GetDataDir())
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return fmt.Errorf("the %s engine keeps no data to export", config.Persistence)
+	}
+	if _, err := os.Stat(config.GetDataDir()); err != nil {
+		return fmt.Errorf("data directory: %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return fmt.Errorf("no %s data found: %v", config.Persistence, err)
+	}
+	engine, err := persistence.NewEngine(config.Persistence, config.GetDataDir(), codec)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory: %v", err)
+	}
+	defer engine.Close()
+
+	db := core.NewDatabase()
+	if err := db.RebuildFrom(engine); err != nil {
+		return fmt.Errorf("failed to read data directory: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	writer := bufio.NewWriter(out)
+	encoder := json.NewEncoder(writer)
+	exported := 0
+	for _, entry := range db.Entries() {
+		if !f.Accepts(entry) {
+			continue
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+		exported++
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d keys from %s\n", exported, config.GetDataDir())
+	return nil
+}
+
+// runImport sends every entry of a JSON Lines file to a running server
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:6379", "Address of the server (<ip:port>)")
+	caFile := flags.String("tls-ca", "", "CA certificate to verify the server with, connects over TLS")
+	certFile := flags.String("tls-cert", "", "Client certificate, for servers that ask for one")
+	keyFile := flags.String("tls-key", "", "Key of the client certificate")
+	username := flags.String("user", "", "User to authenticate as (default the default user)")
+	password := flags.String("password", os.Getenv("GEOMYS_PASSWORD"), "Password to authenticate with, default $GEOMYS_PASSWORD")
+	inPath := flags.String("in", "", "Input file (default stdin)")
+	dryRun := flags.Bool("dry-run", false, "Print the requests instead of sending them")
+	var f core.EntryFilter
+	registerFilter(flags, &f)
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *inPath != "" {
+		file, err := os.Open(*inPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var srv *server
+	if !*dryRun {
+		var conn net.Conn
+		var err error
+		if *caFile != "" {
+			var config *tls.Config
+			if config, err = security.ClientTLS(*caFile, *certFile, *keyFile); err != nil {
+				return fmt.Errorf("failed to set up TLS: %v", err)
+			}
+			conn, err = tls.Dial("tcp", *addr, config)
+		} else {
+			conn, err = net.Dial("tcp", *addr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %v", *addr, err)
+		}
+		defer conn.Close()
+		srv = &server{conn: conn, dec: msgpack.NewDecoder(conn)}
+		if *password != "" {
+			auth := map[string]interface{}{"command": "AUTH", "username": *username, "password": *password}
+			if err := srv.send(auth); err != nil {
+				return fmt.Errorf("authentication failed: %v", err)
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	imported, failed, line := 0, 0, 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry core.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if !f.Accepts(entry) {
+			continue
+		}
+
+		requests, err := entry.Requests()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		complete := true
+		for _, req := range requests {
+			if *dryRun {
+				data, _ := json.Marshal(req)
+				fmt.Println(string(data))
+				continue
+			}
+			if err := srv.send(req); err != nil {
+				fmt.Fprintf(os.Stderr, "Key %q: %v\n", entry.Key, err)
+				failed++
+				complete = false
+			}
+		}
+		if complete {
+			imported++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported %d keys, %d requests failed\n", imported, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d requests failed", failed)
+	}
+	return nil
+}
+
+// server is a connection to a running server. Requests go out in one write
+// each, replies are decoded from the stream however the reads split them.
+type server struct {
+	conn net.Conn
+	dec  *msgpack.Decoder
+}
+
+// send writes one request and waits for the server to acknowledge it
+func (s *server) send(req map[string]interface{}) error {
+	data, err := msgpack.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(data); err != nil {
+		return err
+	}
+	var response map[string]interface{}
+	if err := s.dec.Decode(&response); err != nil {
+		return err
+	}
+	if response["status"] != "OK" {
+		return fmt.Errorf("%v", response["message"])
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+)
+
+// FormatVersion is bumped whenever the archive layout changes incompatibly
+const FormatVersion = 1
+
+// Files inside a backup
+const (
+	metadataFile = "metadata.json"
+	snapshotFile = "snapshot.dat"
+)
+
+// Metadata describes where and when a backup was taken
+type Metadata struct {
+	FormatVersion int       `json:"format_version"`
+	NodeID        int       `json:"node_id"`
+	Term          int64     `json:"term"` // raft term, -1 on a standalone node
+	LogPosition   uint64    `json:"log_position"`
+	Records       int       `json:"records"`
+	Encrypted     bool      `json:"encrypted"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Create writes a consistent snapshot of db and its metadata to target.
+// Targets ending in .tar, .tar.gz or .tgz become a tarball, anything else
+// a directory. An existing backup is never overwritten. The snapshot is
+// compressed and encrypted as codec says.
+func Create(db *core.Database, codec *persistence.Codec, nodeID int, term int64, target string) (*Metadata, error) {
+	meta := &Metadata{
+		FormatVersion: FormatVersion,
+		NodeID:        nodeID,
+		Term:          term,
+		Encrypted:     codec.Encrypted(),
+	}
+
+	// Only the copy happens under the database lock, writing is done after
+	var snapshot bytes.Buffer
+	err := db.SnapshotTo(func(records []map[string]interface{}, applied uint64) error {
+		meta.LogPosition = applied
+		meta.Records = len(records)
+		meta.CreatedAt = time.Now().UTC()
+		return persistence.WriteSnapshot(&snapshot, records, codec)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot database: %w", err)
+	}
+
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{metadataFile: metaJSON, snapshotFile: snapshot.Bytes()}
+	if isTarball(target) {
+		err = writeTarball(target, files)
+	} else {
+		err = writeDirectory(target, files)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Restore validates the backup at source and replaces everything stored in
+// engine with its snapshot. Encrypted backups are read with the engine's keys.
+func Restore(source string, engine persistence.Engine) (*Metadata, error) {
+	// The node would start empty with nothing to replay
+	if _, ok := engine.(*persistence.MemoryEngine); ok {
+		return nil, errors.New("cannot restore into the memory engine, it keeps nothing to replay")
+	}
+
+	var files map[string][]byte
+	var err error
+	if isTarball(source) {
+		files, err = readTarball(source)
+	} else {
+		files, err = readDirectory(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metaJSON, ok := files[metadataFile]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a backup: %s is missing", source, metadataFile)
+	}
+	meta := &Metadata{}
+	if err := json.Unmarshal(metaJSON, meta); err != nil {
+		return nil, fmt.Errorf("failed to read backup metadata: %w", err)
+	}
+	if meta.FormatVersion < 1 || meta.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("backup format version %d is not supported, this server reads versions 1 to %d", meta.FormatVersion, FormatVersion)
+	}
+
+	snapshot, ok := files[snapshotFile]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a backup: %s is missing", source, snapshotFile)
+	}
+	records, err := persistence.ReadSnapshot(bytes.NewReader(snapshot), persistence.CodecOf(engine))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup snapshot: %w", err)
+	}
+	if len(records) != meta.Records {
+		return nil, fmt.Errorf("backup snapshot is truncated: expected %d records, found %d", meta.Records, len(records))
+	}
+
+	if err := engine.Snapshot(records); err != nil {
+		return nil, fmt.Errorf("failed to load backup: %w", err)
+	}
+	return meta, nil
+}
+
+// isTarball reports whether path names a tar archive
+func isTarball(path string) bool {
+	return strings.HasSuffix(path, ".tar") || isGzip(path)
+}
+
+// isGzip reports whether path names a compressed tar archive
+func isGzip(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// writeDirectory writes files into dir, which must not already hold a backup
+func writeDirectory(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, metadataFile)); err == nil {
+		return fmt.Errorf("%s already contains a backup", dir)
+	}
+
+	// Metadata goes last so a half written backup is never mistaken for a complete one
+	for _, name := range []string{snapshotFile, metadataFile} {
+		if err := os.WriteFile(filepath.Join(dir, name), files[name], 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// readDirectory reads the backup files from dir
+func readDirectory(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, name := range []string{metadataFile, snapshotFile} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// writeTarball writes files into a new archive at path
+func writeTarball(path string, files map[string][]byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create backup archive: %w", err)
+	}
+
+	err = func() error {
+		var out io.Writer = file
+		var gz *gzip.Writer
+		if isGzip(path) {
+			gz = gzip.NewWriter(file)
+			out = gz
+		}
+		tw := tar.NewWriter(out)
+
+		for _, name := range []string{metadataFile, snapshotFile} {
+			header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: time.Now()}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := tw.Write(files[name]); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if gz != nil {
+			return gz.Close()
+		}
+		return nil
+	}()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to write backup archive: %w", err)
+	}
+	return nil
+}
+
+// readTarball reads the backup files from an archive
+func readTarball(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var in io.Reader = file
+	if isGzip(path) {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup archive: %w", err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup archive: %w", err)
+		}
+		if header.Name != metadataFile && header.Name != snapshotFile {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup archive: %w", err)
+		}
+		files[header.Name] = data
+	}
+}
@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// Operators change the members of a cluster through the AdminService of
+// any member, or through the CLUSTER command of its client port. The leader
+// makes the changes, the other members pass the calls on to it.
+
+// adminTimeout bounds a membership call passed on to the leader
+const adminTimeout = 30 * time.Second
+
+// transferTimeout bounds handing leadership to another node
+const transferTimeout = 10 * time.Second
+
+// errNoLeader is returned when a call needs the leader and none is known
+var errNoLeader = errors.New("No leader elected, try again later")
+
+// adminServer answers the membership calls of operators
+type adminServer struct {
+	pb.UnimplementedAdminServiceServer
+	cluster *ClusterServer
+}
+
+// Members lists the members with their roles and lag
+func (s *adminServer) Members(ctx context.Context, req *pb.MembersRequest) (*pb.MembersResponse, error) {
+	return s.cluster.Members()
+}
+
+// AddLearner adds a node that receives the log without voting
+func (s *adminServer) AddLearner(ctx context.Context, req *pb.AddLearnerRequest) (*pb.AdminResponse, error) {
+	return &pb.AdminResponse{}, s.cluster.AddLearner(req.NodeId, req.Address, req.ClientAddress)
+}
+
+// Promote makes a caught up learner a voter
+func (s *adminServer) Promote(ctx context.Context, req *pb.MemberRequest) (*pb.AdminResponse, error) {
+	return &pb.AdminResponse{}, s.cluster.Promote(req.NodeId)
+}
+
+// RemoveMember takes a node out of the cluster
+func (s *adminServer) RemoveMember(ctx context.Context, req *pb.MemberRequest) (*pb.AdminResponse, error) {
+	return &pb.AdminResponse{}, s.cluster.RemoveMember(req.NodeId)
+}
+
+// TransferLeadership hands leadership to a voter
+func (s *adminServer) TransferLeadership(ctx context.Context, req *pb.MemberRequest) (*pb.AdminResponse, error) {
+	return &pb.AdminResponse{}, s.cluster.TransferLeadership(req.NodeId)
+}
+
+// Members lists every member with its role and how far it lags behind the leader
+func (s *ClusterServer) Members() (*pb.MembersResponse, error) {
+	if !s.IsLeader() {
+		var resp *pb.MembersResponse
+		err := s.onLeader(func(ctx context.Context, client pb.AdminServiceClient) (err error) {
+			resp, err = client.Members(ctx, &pb.MembersRequest{})
+			return err
+		})
+		return resp, err
+	}
+
+	members, joint, err := s.Raft.Membership()
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.MembersResponse{LeaderId: s.NodeID, Term: s.Raft.Term(), Joint: joint}
+	for _, m := range members {
+		resp.Members = append(resp.Members, &pb.MemberStatus{
+			NodeId:        m.ID,
+			Address:       m.Address,
+			ClientAddress: m.ClientAddress,
+			Role:          m.Role,
+			MatchIndex:    m.MatchIndex,
+			AppliedIndex:  m.AppliedIndex,
+			Lag:           m.Lag,
+			LastContactMs: m.LastContact.Milliseconds(),
+		})
+	}
+	return resp, nil
+}
+
+// AddLearner adds the node id, reached by the others at addr and by clients
+// at clientAddr, as a learner
+func (s *ClusterServer) AddLearner(id int32, addr, clientAddr string) error {
+	if s.IsLeader() {
+		return s.Raft.AddLearner(id, addr, clientAddr)
+	}
+	return s.onLeader(func(ctx context.Context, client pb.AdminServiceClient) error {
+		_, err := client.AddLearner(ctx, &pb.AddLearnerRequest{NodeId: id, Address: addr, ClientAddress: clientAddr})
+		return err
+	})
+}
+
+// Promote makes the learner id a voter once it caught up with the log
+func (s *ClusterServer) Promote(id int32) error {
+	if s.IsLeader() {
+		return s.Raft.Promote(id)
+	}
+	return s.onLeader(func(ctx context.Context, client pb.AdminServiceClient) error {
+		_, err := client.Promote(ctx, &pb.MemberRequest{NodeId: id})
+		return err
+	})
+}
+
+// RemoveMember takes the node id out of the cluster
+func (s *ClusterServer) RemoveMember(id int32) error {
+	if s.IsLeader() {
+		return s.Raft.RemoveMember(id)
+	}
+	return s.onLeader(func(ctx context.Context, client pb.AdminServiceClient) error {
+		_, err := client.RemoveMember(ctx, &pb.MemberRequest{NodeId: id})
+		return err
+	})
+}
+
+// TransferLeadership hands leadership to the voter id
+func (s *ClusterServer) TransferLeadership(id int32) error {
+	if s.IsLeader() {
+		return s.Raft.TransferLeadership(id, transferTimeout)
+	}
+	return s.onLeader(func(ctx context.Context, client pb.AdminServiceClient) error {
+		_, err := client.TransferLeadership(ctx, &pb.MemberRequest{NodeId: id})
+		return err
+	})
+}
+
+// onLeader runs call against the AdminService of the leader
+func (s *ClusterServer) onLeader(call func(ctx context.Context, client pb.AdminServiceClient) error) error {
+	addr := s.GetLeaderAddress()
+	if addr == "" {
+		return errNoLeader
+	}
+	conn, err := s.Pool.Conn(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+	defer cancel()
+	return remoteError(call(ctx, pb.NewAdminServiceClient(conn)))
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/cluster/raft"
+)
+
+// A node finds its cluster through a list of peers, the gRPC addresses of
+// some of its members. It asks them in turn until one answers, and the
+// member asked passes the join on to the leader. When every peer is given
+// as <id>@<address>, the list is the static set of voters a new cluster
+// starts with: each node of it bootstraps the same first configuration,
+// they elect a leader among themselves and then tell it where clients reach
+// them, so no node has to be bootstrapped by hand.
+
+// Peer is a member to reach the cluster through, ID is 0 when not given
+type Peer struct {
+	ID      int32
+	Address string
+}
+
+// ParsePeers parses a list of "<address>" or "<id>@<address>" entries
+func ParsePeers(entries []string) ([]Peer, error) {
+	var peers []Peer
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		peer := Peer{Address: entry}
+		if id, addr, ok := strings.Cut(entry, "@"); ok {
+			parsed, err := strconv.ParseInt(id, 10, 32)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid peer %q: the node id must be a positive integer", entry)
+			}
+			peer = Peer{ID: int32(parsed), Address: addr}
+		}
+		if peer.Address == "" {
+			return nil, fmt.Errorf("invalid peer %q: missing address", entry)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// staticVoters returns the voters of a new cluster when every peer is
+// given with its id, nil otherwise
+func staticVoters(peers []Peer) map[int32]string {
+	if len(peers) == 0 {
+		return nil
+	}
+	voters := make(map[int32]string)
+	for _, peer := range peers {
+		if peer.ID == 0 {
+			return nil
+		}
+		voters[peer.ID] = peer.Address
+	}
+	return voters
+}
+
+// staticClusterID derives the cluster id every node of a static peer set
+// gives the cluster it bootstraps
+func staticClusterID(voters map[int32]string) string {
+	ids := make([]int32, 0, len(voters))
+	for id := range voters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	hash := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(hash, "%d@%s\n", id, voters[id])
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// JoinPeers joins the cluster through the first configured peer that takes
+// the request, going round the list until joinTimeout passes. A node of a
+// static peer set registers its client address with the leader this way.
+func (s *ClusterServer) JoinPeers(learner bool) error {
+	peers, err := ParsePeers(s.Config.Peers)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return errors.New("no peers to join through")
+	}
+	// A voter of the static set cannot join as a learner
+	if _, voter := staticVoters(peers)[s.NodeID]; voter {
+		learner = false
+	}
+
+	self := s.Config.GetAdvertiseAddress()
+	var others []string
+	for _, peer := range peers {
+		if peer.ID != s.NodeID && peer.Address != self {
+			others = append(others, peer.Address)
+		}
+	}
+	if len(others) == 0 {
+		if _, member := s.Raft.Members()[s.NodeID]; member {
+			return nil
+		}
+		return errors.New("no peer other than this node to join through")
+	}
+
+	// Asking one peer gives an election time to finish before the next is asked
+	perPeer := 3 * time.Duration(s.Config.ElectionTimeout) * time.Millisecond
+	deadline := time.Now().Add(joinTimeout)
+	for time.Now().Before(deadline) {
+		for _, addr := range others {
+			err = s.Raft.Join(addr, learner, perPeer)
+			if err == nil || errors.Is(err, raft.ErrOtherCluster) || errors.Is(err, raft.ErrStopped) {
+				return err
+			}
+			s.Logger.Warn(fmt.Sprintf("Joining through %s failed: %v", addr, err))
+		}
+	}
+	return fmt.Errorf("could not join the cluster through any of %d peers: %v", len(peers), err)
+}
@@ -0,0 +1,159 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/cluster/raft"
+)
+
+// A node keeps who it is and which cluster it belongs to in cluster.json
+// in its data directory, next to the raft log. A restarted node takes its
+// node id from there, goes back to its cluster without -join, and refuses
+// to join a cluster with another id.
+
+// identityFile is the name of the identity in the data directory
+const identityFile = "cluster.json"
+
+// identityInterval is how often a node saves its identity when it changed
+const identityInterval = time.Second
+
+// rejoinTimeout bounds asking one saved peer to add a node back
+const rejoinTimeout = 10 * time.Second
+
+// Identity is what a node remembers about itself and its cluster
+type Identity struct {
+	ClusterID string           `json:"cluster_id"`
+	NodeID    int32            `json:"node_id"`
+	Peers     map[int32]string `json:"peers"` // gRPC addresses of the members, this node among them while it is one
+	Learner   bool             `json:"learner,omitempty"`
+	Term      uint64           `json:"term"`
+}
+
+// LoadIdentity reads the identity saved in dir, nil when there is none
+func LoadIdentity(dir string) (*Identity, error) {
+	data, err := os.ReadFile(filepath.Join(dir, identityFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var identity Identity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %v", identityFile, err)
+	}
+	return &identity, nil
+}
+
+// saveIdentity atomically replaces the identity in dir
+func saveIdentity(dir string, identity *Identity) error {
+	data, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, identityFile)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(tmp, path)
+}
+
+// saveIdentity saves identity in the data directory of this node
+func (s *ClusterServer) saveIdentity(identity *Identity) error {
+	s.identityMu.Lock()
+	defer s.identityMu.Unlock()
+	return saveIdentity(s.Config.GetDataDir(), identity)
+}
+
+// currentIdentity describes this node as the raft node knows it now
+func (s *ClusterServer) currentIdentity() *Identity {
+	_, learner := s.Raft.Configuration().GetLearners()[s.NodeID]
+	return &Identity{
+		ClusterID: s.Raft.ClusterID(),
+		NodeID:    s.NodeID,
+		Peers:     s.Raft.Members(),
+		Learner:   learner,
+		Term:      s.Raft.Term(),
+	}
+}
+
+// keepIdentity saves the identity whenever it changed until the node
+// stops. Nothing is saved before the node belongs to a cluster.
+func (s *ClusterServer) keepIdentity() {
+	ticker := time.NewTicker(identityInterval)
+	defer ticker.Stop()
+	saved := s.identity
+	for {
+		current := s.currentIdentity()
+		if current.ClusterID != "" && !sameIdentity(saved, current) {
+			if err := s.saveIdentity(current); err != nil {
+				s.Logger.Error("Failed to save the cluster identity: " + err.Error())
+			} else {
+				saved = current
+			}
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sameIdentity reports whether two identities hold the same
+func sameIdentity(a, b *Identity) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ClusterID == b.ClusterID && a.NodeID == b.NodeID && a.Learner == b.Learner &&
+		a.Term == b.Term && maps.Equal(a.Peers, b.Peers)
+}
+
+// Rejoin brings a node restarted without -bootstrap or -join back into its
+// cluster. A member finds itself in its raft log, a node that was one when
+// it last saved its identity but lost its log asks the saved members to add
+// it, and then the configured peers.
+func (s *ClusterServer) Rejoin() error {
+	if s.identity == nil {
+		return errors.New("the data directory holds no cluster membership")
+	}
+	if _, member := s.Raft.Members()[s.NodeID]; member {
+		return nil
+	}
+	if _, was := s.identity.Peers[s.NodeID]; !was {
+		return fmt.Errorf("node %d was removed from cluster %s", s.NodeID, s.identity.ClusterID)
+	}
+
+	err := errors.New("no peer saved to rejoin through")
+	for id, addr := range s.identity.Peers {
+		if id == s.NodeID {
+			continue
+		}
+		if err = s.Raft.Join(addr, s.identity.Learner, rejoinTimeout); err == nil || errors.Is(err, raft.ErrOtherCluster) {
+			return err
+		}
+		s.Logger.Warn(fmt.Sprintf("Rejoining through node %d failed: %v", id, err))
+	}
+	if len(s.Config.Peers) > 0 {
+		return s.JoinPeers(s.identity.Learner)
+	}
+	return err
+}
@@ -0,0 +1,287 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+	"github.com/vskvj3/geomys/internal/core"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Slots move between groups while clients keep using them. The target
+// leader marks the slots IMPORTING and the source leader MIGRATING, from
+// then on keys the source no longer holds are answered with ASK. The source
+// moves its keys over in batches, each under the locks of its slots so no
+// request changes a key between being copied and deleted. Once every key
+// is over, the target claims the slots and the source drops them.
+
+// migrateBatch is how many keys move to the target group at a time
+const migrateBatch = 100
+
+// migrateTimeout bounds each step of a migration
+const migrateTimeout = 30 * time.Second
+
+// SetSlot changes the state of slots when this node leads their group
+func (s *shardServer) SetSlot(ctx context.Context, req *pb.SetSlotRequest) (*pb.SetSlotResponse, error) {
+	if err := s.cluster.SetSlots(req.Start, req.End, req.State, req.GroupId); err != nil {
+		return nil, err
+	}
+	return &pb.SetSlotResponse{}, nil
+}
+
+// Import stores keys migrating to this node's group
+func (s *shardServer) Import(ctx context.Context, req *pb.ImportRequest) (*pb.ImportResponse, error) {
+	if !s.cluster.IsLeader() {
+		return nil, errNotGroupLeader
+	}
+	dumps := make([]core.KeyDump, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		dumps = append(dumps, core.KeyDump{Key: key.Key, Value: string(key.Value), ExpireAt: key.ExpireAt})
+	}
+	if err := s.cluster.handler.RestoreKeys(dumps); err != nil {
+		return nil, err
+	}
+	return &pb.ImportResponse{}, nil
+}
+
+// Migrate moves slots of this node's group to another group
+func (s *shardServer) Migrate(ctx context.Context, req *pb.MigrateRequest) (*pb.MigrateResponse, error) {
+	moved, err := s.cluster.MigrateSlots(req.Slots, req.GroupId)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MigrateResponse{Keys: int64(moved)}, nil
+}
+
+// MigrateSlots moves the slots in ranges from this node's group, which it
+// must lead, to group target and returns how many keys moved
+func (s *ClusterServer) MigrateSlots(ranges string, target int32) (int, error) {
+	if !s.IsLeader() {
+		return 0, errNotGroupLeader
+	}
+	slots, err := shard.ParseRanges(ranges, 1)
+	if err != nil {
+		return 0, err
+	}
+	if target == int32(s.Config.ShardGroup) {
+		return 0, errors.New("slots cannot move to the group serving them")
+	}
+	client, addr, err := s.leaderOf(target)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, r := range slots {
+		n, err := s.migrateRange(client, addr, r.Start, r.End, target)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// migrateRange moves the slots from start to end to group target, whose
+// leader client reaches at addr
+func (s *ClusterServer) migrateRange(client pb.ShardServiceClient, addr string, start, end uint32, target int32) (int, error) {
+	mine := int32(s.Config.ShardGroup)
+	s.Logger.Info(fmt.Sprintf("Migrating slots %d-%d to group %d", start, end, target))
+	if err := s.setRemoteSlots(client, start, end, "IMPORTING", mine); err != nil {
+		return 0, err
+	}
+	if err := s.SetSlots(start, end, "MIGRATING", target); err != nil {
+		return 0, err
+	}
+
+	// No key of the slots appears here once they are MIGRATING, new ones are
+	// created at the target. After the requests that came before are done
+	// and applied, the keys present are all there is to move.
+	for slot := start; slot <= end; slot++ {
+		s.slotLocks[slot].Lock()
+		s.slotLocks[slot].Unlock()
+	}
+	if err := s.Raft.Barrier(migrateTimeout); err != nil {
+		return 0, err
+	}
+	inRange := func(key string) bool {
+		slot := shard.Slot(key)
+		return start <= slot && slot <= end
+	}
+	keys := s.handler.Database.Keys(inRange, -1)
+	moved := 0
+	for len(keys) > 0 {
+		batch := keys[:min(migrateBatch, len(keys))]
+		keys = keys[len(batch):]
+		n, err := s.moveKeys(client, batch)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	// Ownership flips only once every key is at the target
+	if err := s.setRemoteSlots(client, start, end, "NODE", target); err != nil {
+		return moved, err
+	}
+	// Learning of the claim first keeps clients from being told nobody serves the slots
+	if err := s.exchange(addr); err != nil {
+		s.Logger.Debug(fmt.Sprintf("Topology exchange with %s failed: %v", addr, err))
+	}
+	if err := s.SetSlots(start, end, "NODE", target); err != nil {
+		return moved, err
+	}
+	s.Logger.Info(fmt.Sprintf("Migrated slots %d-%d to group %d, %d keys moved", start, end, target, moved))
+	return moved, nil
+}
+
+// moveKeys copies keys to the target group and deletes them here, holding
+// the locks of their slots throughout
+func (s *ClusterServer) moveKeys(client pb.ShardServiceClient, keys []string) (int, error) {
+	locked := make(map[uint32]bool)
+	var slots []int
+	for _, key := range keys {
+		if slot := shard.Slot(key); !locked[slot] {
+			locked[slot] = true
+			slots = append(slots, int(slot))
+		}
+	}
+	// In slot order, so two batches never wait on each other
+	sort.Ints(slots)
+	for _, slot := range slots {
+		s.slotLocks[slot].Lock()
+		defer s.slotLocks[slot].Unlock()
+	}
+
+	// Writes that were answered before they were applied must not be lost
+	if err := s.Raft.Barrier(migrateTimeout); err != nil {
+		return 0, err
+	}
+	dumps := s.handler.DumpKeys(keys)
+	if len(dumps) == 0 {
+		return 0, nil
+	}
+	req := &pb.ImportRequest{Keys: make([]*pb.KeyDump, 0, len(dumps))}
+	moving := make([]string, 0, len(dumps))
+	for _, dump := range dumps {
+		req.Keys = append(req.Keys, &pb.KeyDump{Key: dump.Key, Value: []byte(dump.Value), ExpireAt: dump.ExpireAt})
+		moving = append(moving, dump.Key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+	if _, err := client.Import(ctx, req); err != nil {
+		return 0, remoteError(err)
+	}
+	if err := s.handler.DeleteKeys(moving); err != nil {
+		return 0, err
+	}
+	return len(moving), nil
+}
+
+// setRemoteSlots changes the state of slots in the group whose leader client reaches
+func (s *ClusterServer) setRemoteSlots(client pb.ShardServiceClient, start, end uint32, state string, group int32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+	if _, err := client.SetSlot(ctx, &pb.SetSlotRequest{Start: start, End: end, State: state, GroupId: group}); err != nil {
+		return remoteError(err)
+	}
+	return nil
+}
+
+// Migrate moves the slots in ranges, all served by one group, to group
+// target. The leader of the serving group does the work.
+func (s *ClusterServer) Migrate(ranges string, target int32) (int, error) {
+	slots, err := shard.ParseRanges(ranges, 1)
+	if err != nil {
+		return 0, err
+	}
+	source := int32(-1)
+	for _, r := range slots {
+		for slot := r.Start; slot <= r.End; slot++ {
+			owner, _, claimed := s.Shards.Owner(slot)
+			if !claimed {
+				return 0, fmt.Errorf("slot %d is not served by any group", slot)
+			}
+			if source != -1 && owner != source {
+				return 0, fmt.Errorf("slots %s are served by more than one group", ranges)
+			}
+			source = owner
+		}
+	}
+	return s.migrateFrom(source, shard.FormatRanges(slots), target)
+}
+
+// Rebalance evens out the slots between the known groups except those in
+// exclude, which give all of their slots away. It returns the moves made
+// and how many keys moved.
+func (s *ClusterServer) Rebalance(exclude []int32) ([]shard.Move, int, error) {
+	skip := make(map[int32]bool)
+	for _, group := range exclude {
+		skip[group] = true
+	}
+	var groups []int32
+	seen := make(map[int32]bool)
+	for _, info := range s.Shards.Nodes() {
+		if !seen[info.GroupId] && !skip[info.GroupId] {
+			groups = append(groups, info.GroupId)
+		}
+		seen[info.GroupId] = true
+	}
+	if len(groups) == 0 {
+		return nil, 0, errors.New("no group is left to serve the slots")
+	}
+
+	moves := shard.Plan(s.Shards.Map(), groups)
+	moved := 0
+	for i, move := range moves {
+		n, err := s.migrateFrom(move.From, fmt.Sprintf("%d-%d", move.Start, move.End), move.To)
+		moved += n
+		if err != nil {
+			return moves[:i], moved, err
+		}
+	}
+	return moves, moved, nil
+}
+
+// migrateFrom has the leader of group source move the slots in ranges to group target
+func (s *ClusterServer) migrateFrom(source int32, ranges string, target int32) (int, error) {
+	if source == int32(s.Config.ShardGroup) && s.IsLeader() {
+		return s.MigrateSlots(ranges, target)
+	}
+	client, _, err := s.leaderOf(source)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Migrate(context.Background(), &pb.MigrateRequest{Slots: ranges, GroupId: target})
+	if err != nil {
+		return 0, remoteError(err)
+	}
+	return int(resp.Keys), nil
+}
+
+// leaderOf returns a ShardService client for the leader of group and its address
+func (s *ClusterServer) leaderOf(group int32) (pb.ShardServiceClient, string, error) {
+	members := s.Shards.Members(group)
+	if len(members) == 0 || !members[0].Leader {
+		return nil, "", fmt.Errorf("the leader of group %d is not known", group)
+	}
+	conn, err := s.Pool.Conn(members[0].Address)
+	if err != nil {
+		return nil, "", err
+	}
+	return pb.NewShardServiceClient(conn), members[0].Address, nil
+}
+
+// remoteError unwraps the message of an error another node returned
+func remoteError(err error) error {
+	if st, ok := status.FromError(err); ok && st.Code() == codes.Unknown {
+		return errors.New(st.Message())
+	}
+	return err
+}
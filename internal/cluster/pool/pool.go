@@ -0,0 +1,64 @@
+// Package pool shares gRPC connections between the cluster services, so a
+// node keeps one connection per peer no matter how many services use it
+package pool
+
+import (
+	"errors"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ErrClosed is returned by a closed pool
+var ErrClosed = errors.New("connection pool is closed")
+
+// Pool keeps one gRPC connection per peer address
+type Pool struct {
+	mu     sync.Mutex
+	conns  map[string]*grpc.ClientConn
+	creds  credentials.TransportCredentials
+	opts   []grpc.DialOption
+	closed bool
+}
+
+// New returns an empty pool dialing with creds, in plain text when nil,
+// and opts
+func New(creds credentials.TransportCredentials, opts ...grpc.DialOption) *Pool {
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	return &Pool{conns: make(map[string]*grpc.ClientConn), creds: creds, opts: opts}
+}
+
+// Conn returns the connection to addr, dialing on first use. Connections
+// reconnect on their own, callers must not close them.
+func (p *Pool) Conn(addr string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, append([]grpc.DialOption{grpc.WithTransportCredentials(p.creds)}, p.opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+// Close closes every connection, later calls to Conn fail
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for addr, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, addr)
+	}
+}
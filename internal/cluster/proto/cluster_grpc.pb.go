@@ -19,22 +19,36 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	ElectionService_RequestVote_FullMethodName = "/cluster.ElectionService/RequestVote"
-	ElectionService_Heartbeat_FullMethodName   = "/cluster.ElectionService/Heartbeat"
+	ElectionService_RequestVote_FullMethodName     = "/cluster.ElectionService/RequestVote"
+	ElectionService_AppendEntries_FullMethodName   = "/cluster.ElectionService/AppendEntries"
+	ElectionService_Join_FullMethodName            = "/cluster.ElectionService/Join"
+	ElectionService_InstallSnapshot_FullMethodName = "/cluster.ElectionService/InstallSnapshot"
+	ElectionService_StreamSnapshot_FullMethodName  = "/cluster.ElectionService/StreamSnapshot"
+	ElectionService_Replicate_FullMethodName       = "/cluster.ElectionService/Replicate"
+	ElectionService_ReadIndex_FullMethodName       = "/cluster.ElectionService/ReadIndex"
+	ElectionService_TimeoutNow_FullMethodName      = "/cluster.ElectionService/TimeoutNow"
 )
 
 // ElectionServiceClient is the client API for ElectionService service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 //
-// ****************************************************************
-//
-//	ElectionService                         *
-//
-// ***************************************************************
+// Raft consensus: elections, log replication and membership
 type ElectionServiceClient interface {
 	RequestVote(ctx context.Context, in *VoteRequest, opts ...grpc.CallOption) (*VoteResponse, error)
-	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error)
+	AppendEntries(ctx context.Context, in *AppendEntriesRequest, opts ...grpc.CallOption) (*AppendEntriesResponse, error)
+	Join(ctx context.Context, in *JoinRequest, opts ...grpc.CallOption) (*JoinResponse, error)
+	InstallSnapshot(ctx context.Context, in *InstallSnapshotRequest, opts ...grpc.CallOption) (*InstallSnapshotResponse, error)
+	StreamSnapshot(ctx context.Context, in *SnapshotStreamRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error)
+	// Replicate carries AppendEntries calls from the leader to one follower,
+	// answered in order, for as long as the leader leads
+	Replicate(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AppendEntriesRequest, AppendEntriesResponse], error)
+	// ReadIndex returns a commit index the leader confirmed it still leads
+	// at, a follower that applied it can serve linearizable reads
+	ReadIndex(ctx context.Context, in *ReadIndexRequest, opts ...grpc.CallOption) (*ReadIndexResponse, error)
+	// TimeoutNow tells a caught up follower to start an election right
+	// away, the leader hands leadership over to it
+	TimeoutNow(ctx context.Context, in *TimeoutNowRequest, opts ...grpc.CallOption) (*TimeoutNowResponse, error)
 }
 
 type electionServiceClient struct {
@@ -55,10 +69,82 @@ func (c *electionServiceClient) RequestVote(ctx context.Context, in *VoteRequest
 	return out, nil
 }
 
-func (c *electionServiceClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
+func (c *electionServiceClient) AppendEntries(ctx context.Context, in *AppendEntriesRequest, opts ...grpc.CallOption) (*AppendEntriesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AppendEntriesResponse)
+	err := c.cc.Invoke(ctx, ElectionService_AppendEntries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *electionServiceClient) Join(ctx context.Context, in *JoinRequest, opts ...grpc.CallOption) (*JoinResponse, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
-	out := new(HeartbeatResponse)
-	err := c.cc.Invoke(ctx, ElectionService_Heartbeat_FullMethodName, in, out, cOpts...)
+	out := new(JoinResponse)
+	err := c.cc.Invoke(ctx, ElectionService_Join_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *electionServiceClient) InstallSnapshot(ctx context.Context, in *InstallSnapshotRequest, opts ...grpc.CallOption) (*InstallSnapshotResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(InstallSnapshotResponse)
+	err := c.cc.Invoke(ctx, ElectionService_InstallSnapshot_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *electionServiceClient) StreamSnapshot(ctx context.Context, in *SnapshotStreamRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[SnapshotChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ElectionService_ServiceDesc.Streams[0], ElectionService_StreamSnapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SnapshotStreamRequest, SnapshotChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ElectionService_StreamSnapshotClient = grpc.ServerStreamingClient[SnapshotChunk]
+
+func (c *electionServiceClient) Replicate(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[AppendEntriesRequest, AppendEntriesResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ElectionService_ServiceDesc.Streams[1], ElectionService_Replicate_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AppendEntriesRequest, AppendEntriesResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ElectionService_ReplicateClient = grpc.BidiStreamingClient[AppendEntriesRequest, AppendEntriesResponse]
+
+func (c *electionServiceClient) ReadIndex(ctx context.Context, in *ReadIndexRequest, opts ...grpc.CallOption) (*ReadIndexResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReadIndexResponse)
+	err := c.cc.Invoke(ctx, ElectionService_ReadIndex_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *electionServiceClient) TimeoutNow(ctx context.Context, in *TimeoutNowRequest, opts ...grpc.CallOption) (*TimeoutNowResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TimeoutNowResponse)
+	err := c.cc.Invoke(ctx, ElectionService_TimeoutNow_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -69,14 +155,22 @@ func (c *electionServiceClient) Heartbeat(ctx context.Context, in *HeartbeatRequ
 // All implementations must embed UnimplementedElectionServiceServer
 // for forward compatibility.
 //
-// ****************************************************************
-//
-//	ElectionService                         *
-//
-// ***************************************************************
+// Raft consensus: elections, log replication and membership
 type ElectionServiceServer interface {
 	RequestVote(context.Context, *VoteRequest) (*VoteResponse, error)
-	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
+	AppendEntries(context.Context, *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	Join(context.Context, *JoinRequest) (*JoinResponse, error)
+	InstallSnapshot(context.Context, *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+	StreamSnapshot(*SnapshotStreamRequest, grpc.ServerStreamingServer[SnapshotChunk]) error
+	// Replicate carries AppendEntries calls from the leader to one follower,
+	// answered in order, for as long as the leader leads
+	Replicate(grpc.BidiStreamingServer[AppendEntriesRequest, AppendEntriesResponse]) error
+	// ReadIndex returns a commit index the leader confirmed it still leads
+	// at, a follower that applied it can serve linearizable reads
+	ReadIndex(context.Context, *ReadIndexRequest) (*ReadIndexResponse, error)
+	// TimeoutNow tells a caught up follower to start an election right
+	// away, the leader hands leadership over to it
+	TimeoutNow(context.Context, *TimeoutNowRequest) (*TimeoutNowResponse, error)
 	mustEmbedUnimplementedElectionServiceServer()
 }
 
@@ -90,8 +184,26 @@ type UnimplementedElectionServiceServer struct{}
 func (UnimplementedElectionServiceServer) RequestVote(context.Context, *VoteRequest) (*VoteResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RequestVote not implemented")
 }
-func (UnimplementedElectionServiceServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+func (UnimplementedElectionServiceServer) AppendEntries(context.Context, *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AppendEntries not implemented")
+}
+func (UnimplementedElectionServiceServer) Join(context.Context, *JoinRequest) (*JoinResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Join not implemented")
+}
+func (UnimplementedElectionServiceServer) InstallSnapshot(context.Context, *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InstallSnapshot not implemented")
+}
+func (UnimplementedElectionServiceServer) StreamSnapshot(*SnapshotStreamRequest, grpc.ServerStreamingServer[SnapshotChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamSnapshot not implemented")
+}
+func (UnimplementedElectionServiceServer) Replicate(grpc.BidiStreamingServer[AppendEntriesRequest, AppendEntriesResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedElectionServiceServer) ReadIndex(context.Context, *ReadIndexRequest) (*ReadIndexResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReadIndex not implemented")
+}
+func (UnimplementedElectionServiceServer) TimeoutNow(context.Context, *TimeoutNowRequest) (*TimeoutNowResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TimeoutNow not implemented")
 }
 func (UnimplementedElectionServiceServer) mustEmbedUnimplementedElectionServiceServer() {}
 func (UnimplementedElectionServiceServer) testEmbeddedByValue()                         {}
@@ -132,20 +244,110 @@ func _ElectionService_RequestVote_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
-func _ElectionService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(HeartbeatRequest)
+func _ElectionService_AppendEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendEntriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ElectionServiceServer).AppendEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ElectionService_AppendEntries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ElectionServiceServer).AppendEntries(ctx, req.(*AppendEntriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ElectionService_Join_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JoinRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(ElectionServiceServer).Heartbeat(ctx, in)
+		return srv.(ElectionServiceServer).Join(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: ElectionService_Heartbeat_FullMethodName,
+		FullMethod: ElectionService_Join_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(ElectionServiceServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+		return srv.(ElectionServiceServer).Join(ctx, req.(*JoinRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ElectionService_InstallSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InstallSnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ElectionServiceServer).InstallSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ElectionService_InstallSnapshot_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ElectionServiceServer).InstallSnapshot(ctx, req.(*InstallSnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ElectionService_StreamSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SnapshotStreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ElectionServiceServer).StreamSnapshot(m, &grpc.GenericServerStream[SnapshotStreamRequest, SnapshotChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ElectionService_StreamSnapshotServer = grpc.ServerStreamingServer[SnapshotChunk]
+
+func _ElectionService_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ElectionServiceServer).Replicate(&grpc.GenericServerStream[AppendEntriesRequest, AppendEntriesResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ElectionService_ReplicateServer = grpc.BidiStreamingServer[AppendEntriesRequest, AppendEntriesResponse]
+
+func _ElectionService_ReadIndex_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadIndexRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ElectionServiceServer).ReadIndex(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ElectionService_ReadIndex_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ElectionServiceServer).ReadIndex(ctx, req.(*ReadIndexRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ElectionService_TimeoutNow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TimeoutNowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ElectionServiceServer).TimeoutNow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ElectionService_TimeoutNow_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ElectionServiceServer).TimeoutNow(ctx, req.(*TimeoutNowRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -162,18 +364,44 @@ var ElectionService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _ElectionService_RequestVote_Handler,
 		},
 		{
-			MethodName: "Heartbeat",
-			Handler:    _ElectionService_Heartbeat_Handler,
+			MethodName: "AppendEntries",
+			Handler:    _ElectionService_AppendEntries_Handler,
+		},
+		{
+			MethodName: "Join",
+			Handler:    _ElectionService_Join_Handler,
+		},
+		{
+			MethodName: "InstallSnapshot",
+			Handler:    _ElectionService_InstallSnapshot_Handler,
+		},
+		{
+			MethodName: "ReadIndex",
+			Handler:    _ElectionService_ReadIndex_Handler,
+		},
+		{
+			MethodName: "TimeoutNow",
+			Handler:    _ElectionService_TimeoutNow_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamSnapshot",
+			Handler:       _ElectionService_StreamSnapshot_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Replicate",
+			Handler:       _ElectionService_Replicate_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "internal/cluster/proto/cluster.proto",
 }
 
 const (
-	ReplicationService_ForwardRequest_FullMethodName   = "/cluster.ReplicationService/ForwardRequest"
-	ReplicationService_ReplicateRequest_FullMethodName = "/cluster.ReplicationService/ReplicateRequest"
-	ReplicationService_SyncRequest_FullMethodName      = "/cluster.ReplicationService/SyncRequest"
+	ReplicationService_ForwardRequest_FullMethodName = "/cluster.ReplicationService/ForwardRequest"
 )
 
 // ReplicationServiceClient is the client API for ReplicationService service.
@@ -187,8 +415,6 @@ const (
 // ***************************************************************
 type ReplicationServiceClient interface {
 	ForwardRequest(ctx context.Context, in *CommandRequest, opts ...grpc.CallOption) (*CommandResponse, error)
-	ReplicateRequest(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ReplicationAck, error)
-	SyncRequest(ctx context.Context, in *SyncRequestMessage, opts ...grpc.CallOption) (*SyncResponse, error)
 }
 
 type replicationServiceClient struct {
@@ -209,26 +435,6 @@ func (c *replicationServiceClient) ForwardRequest(ctx context.Context, in *Comma
 	return out, nil
 }
 
-func (c *replicationServiceClient) ReplicateRequest(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ReplicationAck, error) {
-	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
-	out := new(ReplicationAck)
-	err := c.cc.Invoke(ctx, ReplicationService_ReplicateRequest_FullMethodName, in, out, cOpts...)
-	if err != nil {
-		return nil, err
-	}
-	return out, nil
-}
-
-func (c *replicationServiceClient) SyncRequest(ctx context.Context, in *SyncRequestMessage, opts ...grpc.CallOption) (*SyncResponse, error) {
-	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
-	out := new(SyncResponse)
-	err := c.cc.Invoke(ctx, ReplicationService_SyncRequest_FullMethodName, in, out, cOpts...)
-	if err != nil {
-		return nil, err
-	}
-	return out, nil
-}
-
 // ReplicationServiceServer is the server API for ReplicationService service.
 // All implementations must embed UnimplementedReplicationServiceServer
 // for forward compatibility.
@@ -240,8 +446,6 @@ func (c *replicationServiceClient) SyncRequest(ctx context.Context, in *SyncRequ
 // ***************************************************************
 type ReplicationServiceServer interface {
 	ForwardRequest(context.Context, *CommandRequest) (*CommandResponse, error)
-	ReplicateRequest(context.Context, *Command) (*ReplicationAck, error)
-	SyncRequest(context.Context, *SyncRequestMessage) (*SyncResponse, error)
 	mustEmbedUnimplementedReplicationServiceServer()
 }
 
@@ -255,12 +459,6 @@ type UnimplementedReplicationServiceServer struct{}
 func (UnimplementedReplicationServiceServer) ForwardRequest(context.Context, *CommandRequest) (*CommandResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ForwardRequest not implemented")
 }
-func (UnimplementedReplicationServiceServer) ReplicateRequest(context.Context, *Command) (*ReplicationAck, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ReplicateRequest not implemented")
-}
-func (UnimplementedReplicationServiceServer) SyncRequest(context.Context, *SyncRequestMessage) (*SyncResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method SyncRequest not implemented")
-}
 func (UnimplementedReplicationServiceServer) mustEmbedUnimplementedReplicationServiceServer() {}
 func (UnimplementedReplicationServiceServer) testEmbeddedByValue()                            {}
 
@@ -300,60 +498,622 @@ func _ReplicationService_ForwardRequest_Handler(srv interface{}, ctx context.Con
 	return interceptor(ctx, in, info, handler)
 }
 
-func _ReplicationService_ReplicateRequest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(Command)
+// ReplicationService_ServiceDesc is the grpc.ServiceDesc for ReplicationService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ReplicationService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cluster.ReplicationService",
+	HandlerType: (*ReplicationServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ForwardRequest",
+			Handler:    _ReplicationService_ForwardRequest_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "internal/cluster/proto/cluster.proto",
+}
+
+const (
+	ShardService_Exchange_FullMethodName = "/cluster.ShardService/Exchange"
+	ShardService_SetSlot_FullMethodName  = "/cluster.ShardService/SetSlot"
+	ShardService_Import_FullMethodName   = "/cluster.ShardService/Import"
+	ShardService_Migrate_FullMethodName  = "/cluster.ShardService/Migrate"
+)
+
+// ShardServiceClient is the client API for ShardService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Nodes of every group exchange what they know about each other, so each
+// node can redirect clients to the group that serves a slot
+type ShardServiceClient interface {
+	Exchange(ctx context.Context, in *Topology, opts ...grpc.CallOption) (*Topology, error)
+	// SetSlot changes the state of slots of the group the called leader leads
+	SetSlot(ctx context.Context, in *SetSlotRequest, opts ...grpc.CallOption) (*SetSlotResponse, error)
+	// Import stores keys of a slot migrating to the called leader's group
+	Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportResponse, error)
+	// Migrate moves slots of the called leader's group to another group
+	Migrate(ctx context.Context, in *MigrateRequest, opts ...grpc.CallOption) (*MigrateResponse, error)
+}
+
+type shardServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewShardServiceClient(cc grpc.ClientConnInterface) ShardServiceClient {
+	return &shardServiceClient{cc}
+}
+
+func (c *shardServiceClient) Exchange(ctx context.Context, in *Topology, opts ...grpc.CallOption) (*Topology, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Topology)
+	err := c.cc.Invoke(ctx, ShardService_Exchange_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardServiceClient) SetSlot(ctx context.Context, in *SetSlotRequest, opts ...grpc.CallOption) (*SetSlotResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SetSlotResponse)
+	err := c.cc.Invoke(ctx, ShardService_SetSlot_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardServiceClient) Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ImportResponse)
+	err := c.cc.Invoke(ctx, ShardService_Import_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardServiceClient) Migrate(ctx context.Context, in *MigrateRequest, opts ...grpc.CallOption) (*MigrateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MigrateResponse)
+	err := c.cc.Invoke(ctx, ShardService_Migrate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ShardServiceServer is the server API for ShardService service.
+// All implementations must embed UnimplementedShardServiceServer
+// for forward compatibility.
+//
+// Nodes of every group exchange what they know about each other, so each
+// node can redirect clients to the group that serves a slot
+type ShardServiceServer interface {
+	Exchange(context.Context, *Topology) (*Topology, error)
+	// SetSlot changes the state of slots of the group the called leader leads
+	SetSlot(context.Context, *SetSlotRequest) (*SetSlotResponse, error)
+	// Import stores keys of a slot migrating to the called leader's group
+	Import(context.Context, *ImportRequest) (*ImportResponse, error)
+	// Migrate moves slots of the called leader's group to another group
+	Migrate(context.Context, *MigrateRequest) (*MigrateResponse, error)
+	mustEmbedUnimplementedShardServiceServer()
+}
+
+// UnimplementedShardServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedShardServiceServer struct{}
+
+func (UnimplementedShardServiceServer) Exchange(context.Context, *Topology) (*Topology, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Exchange not implemented")
+}
+func (UnimplementedShardServiceServer) SetSlot(context.Context, *SetSlotRequest) (*SetSlotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSlot not implemented")
+}
+func (UnimplementedShardServiceServer) Import(context.Context, *ImportRequest) (*ImportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Import not implemented")
+}
+func (UnimplementedShardServiceServer) Migrate(context.Context, *MigrateRequest) (*MigrateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Migrate not implemented")
+}
+func (UnimplementedShardServiceServer) mustEmbedUnimplementedShardServiceServer() {}
+func (UnimplementedShardServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeShardServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ShardServiceServer will
+// result in compilation errors.
+type UnsafeShardServiceServer interface {
+	mustEmbedUnimplementedShardServiceServer()
+}
+
+func RegisterShardServiceServer(s grpc.ServiceRegistrar, srv ShardServiceServer) {
+	// If the following call pancis, it indicates UnimplementedShardServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ShardService_ServiceDesc, srv)
+}
+
+func _ShardService_Exchange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Topology)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(ReplicationServiceServer).ReplicateRequest(ctx, in)
+		return srv.(ShardServiceServer).Exchange(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: ReplicationService_ReplicateRequest_FullMethodName,
+		FullMethod: ShardService_Exchange_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(ReplicationServiceServer).ReplicateRequest(ctx, req.(*Command))
+		return srv.(ShardServiceServer).Exchange(ctx, req.(*Topology))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _ReplicationService_SyncRequest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(SyncRequestMessage)
+func _ShardService_SetSlot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetSlotRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(ReplicationServiceServer).SyncRequest(ctx, in)
+		return srv.(ShardServiceServer).SetSlot(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: ReplicationService_SyncRequest_FullMethodName,
+		FullMethod: ShardService_SetSlot_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(ReplicationServiceServer).SyncRequest(ctx, req.(*SyncRequestMessage))
+		return srv.(ShardServiceServer).SetSlot(ctx, req.(*SetSlotRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-// ReplicationService_ServiceDesc is the grpc.ServiceDesc for ReplicationService service.
+func _ShardService_Import_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardServiceServer).Import(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardService_Import_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardServiceServer).Import(ctx, req.(*ImportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardService_Migrate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MigrateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardServiceServer).Migrate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardService_Migrate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardServiceServer).Migrate(ctx, req.(*MigrateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ShardService_ServiceDesc is the grpc.ServiceDesc for ShardService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
-var ReplicationService_ServiceDesc = grpc.ServiceDesc{
-	ServiceName: "cluster.ReplicationService",
-	HandlerType: (*ReplicationServiceServer)(nil),
+var ShardService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cluster.ShardService",
+	HandlerType: (*ShardServiceServer)(nil),
 	Methods: []grpc.MethodDesc{
 		{
-			MethodName: "ForwardRequest",
-			Handler:    _ReplicationService_ForwardRequest_Handler,
+			MethodName: "Exchange",
+			Handler:    _ShardService_Exchange_Handler,
+		},
+		{
+			MethodName: "SetSlot",
+			Handler:    _ShardService_SetSlot_Handler,
+		},
+		{
+			MethodName: "Import",
+			Handler:    _ShardService_Import_Handler,
 		},
 		{
-			MethodName: "ReplicateRequest",
-			Handler:    _ReplicationService_ReplicateRequest_Handler,
+			MethodName: "Migrate",
+			Handler:    _ShardService_Migrate_Handler,
 		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "internal/cluster/proto/cluster.proto",
+}
+
+const (
+	AdminService_Members_FullMethodName            = "/cluster.AdminService/Members"
+	AdminService_AddLearner_FullMethodName         = "/cluster.AdminService/AddLearner"
+	AdminService_Promote_FullMethodName            = "/cluster.AdminService/Promote"
+	AdminService_RemoveMember_FullMethodName       = "/cluster.AdminService/RemoveMember"
+	AdminService_TransferLeadership_FullMethodName = "/cluster.AdminService/TransferLeadership"
+)
+
+// AdminServiceClient is the client API for AdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Operators change the members of a cluster through any member, followers
+// pass the calls on to the leader
+type AdminServiceClient interface {
+	// Members lists every member with its role and how far it lags behind
+	Members(ctx context.Context, in *MembersRequest, opts ...grpc.CallOption) (*MembersResponse, error)
+	// AddLearner adds a node that receives the log without voting
+	AddLearner(ctx context.Context, in *AddLearnerRequest, opts ...grpc.CallOption) (*AdminResponse, error)
+	// Promote makes a caught up learner a voter
+	Promote(ctx context.Context, in *MemberRequest, opts ...grpc.CallOption) (*AdminResponse, error)
+	// RemoveMember takes a node out of the cluster
+	RemoveMember(ctx context.Context, in *MemberRequest, opts ...grpc.CallOption) (*AdminResponse, error)
+	// TransferLeadership hands leadership to a voter
+	TransferLeadership(ctx context.Context, in *MemberRequest, opts ...grpc.CallOption) (*AdminResponse, error)
+}
+
+type adminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminServiceClient(cc grpc.ClientConnInterface) AdminServiceClient {
+	return &adminServiceClient{cc}
+}
+
+func (c *adminServiceClient) Members(ctx context.Context, in *MembersRequest, opts ...grpc.CallOption) (*MembersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MembersResponse)
+	err := c.cc.Invoke(ctx, AdminService_Members_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) AddLearner(ctx context.Context, in *AddLearnerRequest, opts ...grpc.CallOption) (*AdminResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AdminResponse)
+	err := c.cc.Invoke(ctx, AdminService_AddLearner_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) Promote(ctx context.Context, in *MemberRequest, opts ...grpc.CallOption) (*AdminResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AdminResponse)
+	err := c.cc.Invoke(ctx, AdminService_Promote_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) RemoveMember(ctx context.Context, in *MemberRequest, opts ...grpc.CallOption) (*AdminResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AdminResponse)
+	err := c.cc.Invoke(ctx, AdminService_RemoveMember_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) TransferLeadership(ctx context.Context, in *MemberRequest, opts ...grpc.CallOption) (*AdminResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AdminResponse)
+	err := c.cc.Invoke(ctx, AdminService_TransferLeadership_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServiceServer is the server API for AdminService service.
+// All implementations must embed UnimplementedAdminServiceServer
+// for forward compatibility.
+//
+// Operators change the members of a cluster through any member, followers
+// pass the calls on to the leader
+type AdminServiceServer interface {
+	// Members lists every member with its role and how far it lags behind
+	Members(context.Context, *MembersRequest) (*MembersResponse, error)
+	// AddLearner adds a node that receives the log without voting
+	AddLearner(context.Context, *AddLearnerRequest) (*AdminResponse, error)
+	// Promote makes a caught up learner a voter
+	Promote(context.Context, *MemberRequest) (*AdminResponse, error)
+	// RemoveMember takes a node out of the cluster
+	RemoveMember(context.Context, *MemberRequest) (*AdminResponse, error)
+	// TransferLeadership hands leadership to a voter
+	TransferLeadership(context.Context, *MemberRequest) (*AdminResponse, error)
+	mustEmbedUnimplementedAdminServiceServer()
+}
+
+// UnimplementedAdminServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAdminServiceServer struct{}
+
+func (UnimplementedAdminServiceServer) Members(context.Context, *MembersRequest) (*MembersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Members not implemented")
+}
+func (UnimplementedAdminServiceServer) AddLearner(context.Context, *AddLearnerRequest) (*AdminResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddLearner not implemented")
+}
+func (UnimplementedAdminServiceServer) Promote(context.Context, *MemberRequest) (*AdminResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Promote not implemented")
+}
+func (UnimplementedAdminServiceServer) RemoveMember(context.Context, *MemberRequest) (*AdminResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveMember not implemented")
+}
+func (UnimplementedAdminServiceServer) TransferLeadership(context.Context, *MemberRequest) (*AdminResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransferLeadership not implemented")
+}
+func (UnimplementedAdminServiceServer) mustEmbedUnimplementedAdminServiceServer() {}
+func (UnimplementedAdminServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServiceServer will
+// result in compilation errors.
+type UnsafeAdminServiceServer interface {
+	mustEmbedUnimplementedAdminServiceServer()
+}
+
+func RegisterAdminServiceServer(s grpc.ServiceRegistrar, srv AdminServiceServer) {
+	// If the following call pancis, it indicates UnimplementedAdminServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AdminService_ServiceDesc, srv)
+}
+
+func _AdminService_Members_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MembersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).Members(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_Members_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).Members(ctx, req.(*MembersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_AddLearner_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddLearnerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).AddLearner(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_AddLearner_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).AddLearner(ctx, req.(*AddLearnerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_Promote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MemberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).Promote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_Promote_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).Promote(ctx, req.(*MemberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_RemoveMember_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MemberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).RemoveMember(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_RemoveMember_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).RemoveMember(ctx, req.(*MemberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_TransferLeadership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MemberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).TransferLeadership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_TransferLeadership_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).TransferLeadership(ctx, req.(*MemberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AdminService_ServiceDesc is the grpc.ServiceDesc for AdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cluster.AdminService",
+	HandlerType: (*AdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Members",
+			Handler:    _AdminService_Members_Handler,
+		},
+		{
+			MethodName: "AddLearner",
+			Handler:    _AdminService_AddLearner_Handler,
+		},
+		{
+			MethodName: "Promote",
+			Handler:    _AdminService_Promote_Handler,
+		},
+		{
+			MethodName: "RemoveMember",
+			Handler:    _AdminService_RemoveMember_Handler,
+		},
+		{
+			MethodName: "TransferLeadership",
+			Handler:    _AdminService_TransferLeadership_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "internal/cluster/proto/cluster.proto",
+}
+
+const (
+	PubSubService_Publish_FullMethodName = "/cluster.PubSubService/Publish"
+)
+
+// PubSubServiceClient is the client API for PubSubService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Messages published on one node reach the subscribers of every other node
+type PubSubServiceClient interface {
+	// Publish delivers a message to the subscribers of the receiving node
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+}
+
+type pubSubServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPubSubServiceClient(cc grpc.ClientConnInterface) PubSubServiceClient {
+	return &pubSubServiceClient{cc}
+}
+
+func (c *pubSubServiceClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, PubSubService_Publish_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PubSubServiceServer is the server API for PubSubService service.
+// All implementations must embed UnimplementedPubSubServiceServer
+// for forward compatibility.
+//
+// Messages published on one node reach the subscribers of every other node
+type PubSubServiceServer interface {
+	// Publish delivers a message to the subscribers of the receiving node
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	mustEmbedUnimplementedPubSubServiceServer()
+}
+
+// UnimplementedPubSubServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPubSubServiceServer struct{}
+
+func (UnimplementedPubSubServiceServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedPubSubServiceServer) mustEmbedUnimplementedPubSubServiceServer() {}
+func (UnimplementedPubSubServiceServer) testEmbeddedByValue()                       {}
+
+// UnsafePubSubServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PubSubServiceServer will
+// result in compilation errors.
+type UnsafePubSubServiceServer interface {
+	mustEmbedUnimplementedPubSubServiceServer()
+}
+
+func RegisterPubSubServiceServer(s grpc.ServiceRegistrar, srv PubSubServiceServer) {
+	// If the following call pancis, it indicates UnimplementedPubSubServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&PubSubService_ServiceDesc, srv)
+}
+
+func _PubSubService_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PubSubServiceServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PubSubService_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PubSubServiceServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PubSubService_ServiceDesc is the grpc.ServiceDesc for PubSubService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PubSubService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cluster.PubSubService",
+	HandlerType: (*PubSubServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
 		{
-			MethodName: "SyncRequest",
-			Handler:    _ReplicationService_SyncRequest_Handler,
+			MethodName: "Publish",
+			Handler:    _PubSubService_Publish_Handler,
 		},
 	},
 	Streams:  []grpc.StreamDesc{},
@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// publishTimeout bounds passing a published message to another node
+const publishTimeout = time.Second
+
+// pubsubServer delivers messages published on other nodes to the subscribers of this one
+type pubsubServer struct {
+	pb.UnimplementedPubSubServiceServer
+	cluster *ClusterServer
+}
+
+// Publish delivers a message published on another node here
+func (s *pubsubServer) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
+	return &pb.PublishResponse{Receivers: int64(s.cluster.PubSub.Publish(req.Channel, req.Message))}, nil
+}
+
+// Publish delivers message to the subscribers of channel on this node and on
+// every other member, and of every group with sharding, and returns how many
+// received it. Nodes that cannot be reached are skipped, messages are not
+// kept for later.
+func (s *ClusterServer) Publish(channel, message string) int {
+	receivers := s.PubSub.Publish(channel, message)
+
+	self := s.Config.GetAdvertiseAddress()
+	peers := make(map[string]bool)
+	for id, addr := range s.GetNodes() {
+		if id != s.NodeID {
+			peers[addr] = true
+		}
+	}
+	if s.Config.Sharding {
+		for _, info := range s.Shards.Nodes() {
+			peers[info.Address] = true
+		}
+	}
+	delete(peers, self)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for addr := range peers {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			n, err := s.publishTo(addr, channel, message)
+			if err != nil {
+				s.Logger.Debug(fmt.Sprintf("Publishing to %s failed: %v", addr, err))
+				return
+			}
+			mu.Lock()
+			receivers += n
+			mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+	return receivers
+}
+
+func (s *ClusterServer) publishTo(addr, channel, message string) (int, error) {
+	conn, err := s.Pool.Conn(addr)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	resp, err := pb.NewPubSubServiceClient(conn).Publish(ctx, &pb.PublishRequest{NodeId: s.NodeID, Channel: channel, Message: message})
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.Receivers), nil
+}
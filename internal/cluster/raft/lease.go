@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A leader holds a lease for as long as a majority of the voters answered
+// its messages within LeaseTimeout. A voter that heard from a leader within
+// the election timeout refuses to vote for anyone else, so while the lease
+// holds no other leader can be elected. A leader whose lease ran out, one
+// cut off from the others for example, steps down instead of taking writes
+// it can never commit. The lease is a little shorter than the election
+// timeout to allow for clocks running at different speeds.
+//
+// Every message of a leader carries its term, and members reject those of
+// an older term than their own: a stale leader learns it was replaced from
+// the first answer it gets.
+
+// ErrStaleTerm is returned to a leader of an older term than the sender's
+var ErrStaleTerm = errors.New("this node led an older term and no longer leads")
+
+// leaseHeld reports whether this node leads and a majority of the voters
+// answered it within the lease, callers must hold the lock
+func (n *Node) leaseHeld(now time.Time) bool {
+	if n.role != Leader {
+		return false
+	}
+	if now.Sub(n.leaderSince) < n.config.LeaseTimeout {
+		// The voters that elected it just answered
+		return true
+	}
+	return n.hasQuorum(func(id int32) bool {
+		return id == n.config.ID || now.Sub(n.lastAck[id]) < n.config.LeaseTimeout
+	})
+}
+
+// checkLease steps down a leader whose lease ran out, callers must hold the lock
+func (n *Node) checkLease() {
+	if n.role != Leader || n.leaseHeld(time.Now()) {
+		return
+	}
+	n.logger.Warn(fmt.Sprintf("Node %d lost contact with a majority and steps down in term %d", n.config.ID, n.term))
+	n.stepDown(n.term)
+	n.leaderID = none
+}
+
+// heardFromLeader records a message of the leader id in the current term,
+// callers must hold the lock
+func (n *Node) heardFromLeader(id int32) {
+	n.leaderID = id
+	n.leaderContact = time.Now()
+	n.resetElectionTimer()
+}
+
+// inLease reports whether this node still follows a live leader, or is
+// one, and so must not vote for another candidate. Callers must hold the lock.
+func (n *Node) inLease() bool {
+	if n.role == Leader {
+		return n.leaseHeld(time.Now())
+	}
+	return n.leaderID != none && time.Since(n.leaderContact) < n.config.ElectionTimeout
+}
+
+// Fence makes this node step down if term, the term of a member that sent
+// it a request, is newer than its own
+func (n *Node) Fence(term uint64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term <= n.term {
+		return nil
+	}
+	n.stepDown(term)
+	return ErrStaleTerm
+}
@@ -0,0 +1,332 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+// logMagic starts every raft log file
+var logMagic = []byte{'G', 'R', 'L', 0x01}
+
+// Log is the persistent list of raft entries, one frame per entry so the
+// log is compressed and encrypted like the rest of the data directory.
+// A compacted log starts with an ENTRY_SNAPSHOT entry, the base, standing in
+// for every entry up to its index.
+type Log struct {
+	path    string
+	file    *os.File
+	codec   *persistence.Codec
+	base    *pb.Entry
+	entries []*pb.Entry
+	offsets []int64 // file offset of every entry
+}
+
+// OpenLog opens (or creates) the raft log at path, dropping a torn write at the tail
+func OpenLog(path string, codec *persistence.Codec) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create raft directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %v", err)
+	}
+
+	l := &Log{path: path, file: file, codec: codec, base: &pb.Entry{Type: pb.EntryType_ENTRY_SNAPSHOT}}
+	if err := l.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads every entry and positions the file for appending
+func (l *Log) load() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := l.file.Write(logMagic); err != nil {
+			return err
+		}
+		return l.file.Sync()
+	}
+
+	reader := bufio.NewReader(l.file)
+	magic := make([]byte, len(logMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, logMagic) {
+		return errors.New("raft log has an unknown format")
+	}
+
+	offset := int64(len(logMagic))
+	counter := &countingReader{r: reader}
+	for {
+		data, err := persistence.ReadFrame(counter, l.codec)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read raft log: %w", err)
+		}
+		entry := &pb.Entry{}
+		if err := proto.Unmarshal(data, entry); err != nil {
+			return fmt.Errorf("corrupt raft log entry: %v", err)
+		}
+		if entry.Type == pb.EntryType_ENTRY_SNAPSHOT && len(l.entries) == 0 {
+			l.base = entry
+			offset += counter.n
+			counter.n = 0
+			continue
+		}
+		if entry.Index != l.LastIndex()+1 {
+			return fmt.Errorf("raft log skips from index %d to %d", l.LastIndex(), entry.Index)
+		}
+		l.entries = append(l.entries, entry)
+		l.offsets = append(l.offsets, offset)
+		offset += counter.n
+		counter.n = 0
+	}
+
+	// Anything after the last complete entry is a torn write
+	if err := l.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err = l.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// BaseIndex returns the index the log was compacted up to, 0 if it never was
+func (l *Log) BaseIndex() uint64 {
+	return l.base.Index
+}
+
+// LastIndex returns the index of the last entry, the base for an empty log
+func (l *Log) LastIndex() uint64 {
+	if len(l.entries) == 0 {
+		return l.base.Index
+	}
+	return l.entries[len(l.entries)-1].Index
+}
+
+// LastTerm returns the term of the last entry, 0 for an empty log
+func (l *Log) LastTerm() uint64 {
+	return l.Term(l.LastIndex())
+}
+
+// Term returns the term of the entry at index, 0 if there is none
+func (l *Log) Term(index uint64) uint64 {
+	if index == l.base.Index {
+		return l.base.Term
+	}
+	if entry := l.Entry(index); entry != nil {
+		return entry.Term
+	}
+	return 0
+}
+
+// Entry returns the entry at index, nil if there is none or it was compacted
+func (l *Log) Entry(index uint64) *pb.Entry {
+	if index <= l.base.Index || index > l.LastIndex() {
+		return nil
+	}
+	return l.entries[index-l.base.Index-1]
+}
+
+// Entries returns up to max entries starting at index, nil if index was compacted
+func (l *Log) Entries(index uint64, max int) []*pb.Entry {
+	if index <= l.base.Index || index > l.LastIndex() {
+		return nil
+	}
+	entries := l.entries[index-l.base.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return entries
+}
+
+// Append durably writes entries at the end of the log
+func (l *Log) Append(entries ...*pb.Entry) error {
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		data, err := proto.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		frame, err := persistence.EncodeFrame(data, l.codec)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, offset+int64(buf.Len()))
+		buf.Write(frame)
+	}
+
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write raft log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync raft log: %w", err)
+	}
+	l.entries = append(l.entries, entries...)
+	l.offsets = append(l.offsets, offsets...)
+	return nil
+}
+
+// TruncateFrom removes the entry at index and everything after it
+func (l *Log) TruncateFrom(index uint64) error {
+	if index <= l.base.Index || index > l.LastIndex() {
+		return nil
+	}
+	pos := index - l.base.Index - 1
+	offset := l.offsets[pos]
+	if err := l.file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate raft log: %w", err)
+	}
+	if _, err := l.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	l.entries = l.entries[:pos]
+	l.offsets = l.offsets[:pos]
+	return nil
+}
+
+// ConfigurationAt returns the membership in effect at index, nil if the log
+// holds none up to there
+func (l *Log) ConfigurationAt(index uint64) (*pb.Configuration, error) {
+	for i := min(index, l.LastIndex()); i > l.base.Index; i-- {
+		if entry := l.Entry(i); entry.Type == pb.EntryType_ENTRY_CONFIG {
+			return decodeConfiguration(entry.Data)
+		}
+	}
+	if len(l.base.Data) == 0 {
+		return nil, nil
+	}
+	return decodeConfiguration(l.base.Data)
+}
+
+// Compact drops every entry up to base.Index, base takes their place. Entries
+// after it are kept when the log holds base itself, otherwise the log is left
+// with base alone. The file is rewritten and swapped in atomically.
+func (l *Log) Compact(base *pb.Entry) error {
+	if base.Index <= l.base.Index {
+		return nil
+	}
+	var kept []*pb.Entry
+	if base.Index <= l.LastIndex() && l.Term(base.Index) == base.Term {
+		kept = l.entries[base.Index-l.base.Index:]
+	}
+
+	tmp := l.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to compact raft log: %w", err)
+	}
+	next := &Log{path: l.path, file: file, codec: l.codec, base: base}
+	if _, err := file.Write(logMagic); err != nil {
+		file.Close()
+		return err
+	}
+	// The base is written like an entry but never counted as one
+	if err := next.Append(base); err != nil {
+		file.Close()
+		return err
+	}
+	next.entries, next.offsets = nil, nil
+	if err := next.Append(kept...); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file.Close()
+	*l = *next
+	return nil
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// decodeConfiguration parses the data of a configuration entry
+func decodeConfiguration(data []byte) (*pb.Configuration, error) {
+	config := &pb.Configuration{}
+	if err := proto.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("corrupt configuration: %v", err)
+	}
+	return config, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// hardState is what a node must remember across restarts to vote safely
+type hardState struct {
+	Term     uint64
+	VotedFor int32
+}
+
+// loadHardState reads the state file, a missing file is a fresh node
+func loadHardState(path string) (hardState, error) {
+	state := hardState{VotedFor: noVote}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &state); err != nil {
+		return state, fmt.Errorf("corrupt raft state: %v", err)
+	}
+	return state, nil
+}
+
+// saveHardState atomically replaces the state file
+func saveHardState(path string, state hardState) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, state)
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+	return os.Rename(tmp, path)
+}
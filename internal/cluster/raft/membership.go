@@ -0,0 +1,329 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// Operators change the members of a cluster deliberately. A new node joins
+// as a learner, which receives the log without voting, and is promoted to
+// a voter once it caught up. Voters are added and removed through a joint
+// configuration: while it is the latest one, elections and commits need a
+// majority of the old voters and one of the new, so no two leaders can be
+// elected while the members learn about the change. Once the joint
+// configuration committed the leader moves on to the new voters alone.
+
+// promoteLag is how many entries a learner may lag behind the leader's log
+// and still be promoted
+const promoteLag = maxBatch
+
+// Member is one member of the cluster as the leader sees it
+type Member struct {
+	ID            int32
+	Address       string
+	ClientAddress string
+	Role          string        // leader, follower, learner or leaving (a voter being removed)
+	MatchIndex    uint64        // last entry known to be stored on the member
+	AppliedIndex  uint64        // last entry the member reported as applied
+	Lag           uint64        // entries of the leader's log the member does not store yet
+	LastContact   time.Duration // since the member last answered, -1 if it never did
+}
+
+// peers returns every member of config by id: voters, old voters and learners
+func peers(config *pb.Configuration) map[int32]string {
+	members := make(map[int32]string)
+	for _, group := range []map[int32]string{config.GetLearners(), config.GetOldVoters(), config.GetVoters()} {
+		maps.Copy(members, group)
+	}
+	return members
+}
+
+// isVoter reports whether id votes in the latest configuration, callers must hold the lock
+func (n *Node) isVoter(id int32) bool {
+	if _, ok := n.configuration.GetVoters()[id]; ok {
+		return true
+	}
+	_, ok := n.configuration.GetOldVoters()[id]
+	return ok
+}
+
+// hasQuorum reports whether the members for which has is true are a
+// majority of the voters, and of the old voters during a change. Callers
+// must hold the lock.
+func (n *Node) hasQuorum(has func(id int32) bool) bool {
+	majority := func(voters map[int32]string) bool {
+		count := 0
+		for id := range voters {
+			if has(id) {
+				count++
+			}
+		}
+		return count >= len(voters)/2+1
+	}
+	if !majority(n.configuration.GetVoters()) {
+		return false
+	}
+	old := n.configuration.GetOldVoters()
+	return len(old) == 0 || majority(old)
+}
+
+// configCommitted finishes a membership change once the latest
+// configuration committed: a joint configuration makes way for the new
+// voters alone, and a leader that no longer votes steps down. Callers must
+// hold the lock.
+func (n *Node) configCommitted() {
+	if len(n.configuration.GetOldVoters()) > 0 {
+		config := n.cloneConfiguration()
+		config.OldVoters = nil
+		if err := n.appendConfig(config); err != nil {
+			n.logger.Error("Failed to append to raft log: " + err.Error())
+			return
+		}
+		n.notifyReplicators()
+		n.advanceCommit()
+		return
+	}
+	if !n.isVoter(n.config.ID) {
+		n.logger.Info(fmt.Sprintf("Node %d was removed from the voters and steps down", n.config.ID))
+		n.stepDown(n.term)
+	}
+}
+
+// AddLearner adds a node that clients reach at clientAddr to the cluster
+// as a learner, which receives the log but does not vote
+func (n *Node) AddLearner(id int32, addr, clientAddr string) error {
+	n.mu.Lock()
+	_, voter := n.configuration.GetVoters()[id]
+	existing, learner := n.configuration.GetLearners()[id]
+	known := n.configuration.GetClientAddresses()[id]
+	n.mu.Unlock()
+	if voter {
+		return fmt.Errorf("node %d is already a voter", id)
+	}
+	if learner && existing == addr && known == clientAddr {
+		return nil
+	}
+
+	n.logger.Info(fmt.Sprintf("Adding node %d at %s to the cluster as a learner", id, addr))
+	return n.changeConfig(func(config *pb.Configuration) error {
+		if config.Learners == nil {
+			config.Learners = make(map[int32]string)
+		}
+		config.Learners[id] = addr
+		if config.ClientAddresses == nil {
+			config.ClientAddresses = make(map[int32]string)
+		}
+		config.ClientAddresses[id] = clientAddr
+		return nil
+	})
+}
+
+// Promote makes a learner that caught up with the log a voter
+func (n *Node) Promote(id int32) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	addr, learner := n.configuration.GetLearners()[id]
+	caughtUp := n.matchIndex[id] > 0 && n.matchIndex[id]+promoteLag >= n.log.LastIndex()
+	n.mu.Unlock()
+	if !learner {
+		return fmt.Errorf("node %d is not a learner", id)
+	}
+	if !caughtUp {
+		return fmt.Errorf("node %d has not caught up with the log yet", id)
+	}
+
+	n.logger.Info(fmt.Sprintf("Promoting node %d to a voter", id))
+	return n.changeVoters(func(config *pb.Configuration) {
+		delete(config.Learners, id)
+		config.Voters[id] = addr
+	})
+}
+
+// RemoveMember takes a node out of the cluster. A leader removing itself
+// steps down once the change committed.
+func (n *Node) RemoveMember(id int32) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	_, voter := n.configuration.GetVoters()[id]
+	_, learner := n.configuration.GetLearners()[id]
+	n.mu.Unlock()
+
+	switch {
+	case learner:
+		n.logger.Info(fmt.Sprintf("Removing learner %d from the cluster", id))
+		return n.changeConfig(func(config *pb.Configuration) error {
+			delete(config.Learners, id)
+			delete(config.ClientAddresses, id)
+			return nil
+		})
+	case voter:
+		n.logger.Info(fmt.Sprintf("Removing node %d from the cluster", id))
+		return n.changeVoters(func(config *pb.Configuration) {
+			delete(config.Voters, id)
+			delete(config.ClientAddresses, id)
+		})
+	}
+	return fmt.Errorf("node %d is not a member", id)
+}
+
+// changeVoters moves the cluster to the voters change leaves through a
+// joint configuration, and waits until the new voters alone are committed
+func (n *Node) changeVoters(change func(config *pb.Configuration)) error {
+	n.mu.Lock()
+	_, err := n.proposeConfig(func(config *pb.Configuration) error {
+		old := maps.Clone(config.Voters)
+		change(config)
+		if len(config.Voters) == 0 {
+			return errors.New("the cluster needs at least one voter")
+		}
+		config.OldVoters = old
+		return nil
+	})
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The leader moves on from the joint configuration in configCommitted
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.CommitTimeout)
+	defer cancel()
+	return n.waitUntil(ctx, func() (bool, error) {
+		if len(n.configuration.GetOldVoters()) == 0 && n.commitIndex >= n.configIndex {
+			return true, nil
+		}
+		if n.role != Leader {
+			return false, ErrLeadershipLost
+		}
+		return false, nil
+	})
+}
+
+// Membership lists the members by id and reports whether a change of
+// voters is in progress. Only the leader knows how far the others got.
+func (n *Node) Membership() ([]Member, bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != Leader {
+		return nil, false, ErrNotLeader
+	}
+
+	last := n.log.LastIndex()
+	members := make([]Member, 0, len(n.members))
+	for id, addr := range n.members {
+		m := Member{ID: id, Address: addr, ClientAddress: n.configuration.GetClientAddresses()[id]}
+		_, voter := n.configuration.GetVoters()[id]
+		switch {
+		case id == n.config.ID:
+			m.Role = Leader.String()
+		case voter:
+			m.Role = Follower.String()
+		case n.isVoter(id):
+			m.Role = "leaving"
+		default:
+			m.Role = "learner"
+		}
+		if id == n.config.ID {
+			m.MatchIndex, m.AppliedIndex = last, n.lastApplied
+		} else {
+			m.MatchIndex, m.AppliedIndex = n.matchIndex[id], n.appliedIndex[id]
+			m.LastContact = -1
+			if ack := n.lastAck[id]; !ack.IsZero() {
+				m.LastContact = time.Since(ack)
+			}
+		}
+		m.Lag = last - min(last, m.MatchIndex)
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, len(n.configuration.GetOldVoters()) > 0, nil
+}
+
+// TransferLeadership hands leadership to the voter id: new writes are
+// refused until it caught up with the log, then it is told to start an
+// election right away. It returns once this node stepped down.
+func (n *Node) TransferLeadership(id int32, timeout time.Duration) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if id == n.config.ID {
+		n.mu.Unlock()
+		return nil
+	}
+	if !n.isVoter(id) {
+		n.mu.Unlock()
+		return fmt.Errorf("node %d is not a voter", id)
+	}
+	if n.transferee != none {
+		n.mu.Unlock()
+		return ErrTransferring
+	}
+	n.transferee = id
+	term, addr := n.term, n.members[id]
+	n.notifyReplicators()
+	n.mu.Unlock()
+	n.logger.Info(fmt.Sprintf("Node %d hands leadership to node %d", n.config.ID, id))
+
+	defer func() {
+		n.mu.Lock()
+		if n.transferee == id {
+			n.transferee = none
+		}
+		n.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := n.waitUntil(ctx, func() (bool, error) {
+		if n.role != Leader || n.term != term {
+			return false, ErrNotLeader
+		}
+		return n.matchIndex[id] >= n.log.LastIndex(), nil
+	})
+	if err == nil {
+		err = n.timeoutNow(ctx, addr, &pb.TimeoutNowRequest{Term: term, LeaderId: n.config.ID})
+	}
+	if err == nil {
+		err = n.waitUntil(ctx, func() (bool, error) {
+			return n.role != Leader, nil
+		})
+	}
+	if errors.Is(err, ErrTimeout) {
+		return fmt.Errorf("node %d did not take over leadership in time", id)
+	}
+	return err
+}
+
+// timeoutNow calls TimeoutNow on one peer
+func (n *Node) timeoutNow(ctx context.Context, addr string, req *pb.TimeoutNowRequest) error {
+	client, err := n.transport.client(addr)
+	if err != nil {
+		return err
+	}
+	_, err = client.TimeoutNow(ctx, req)
+	return err
+}
+
+// handleTimeoutNow starts an election right away when the leader hands leadership over
+func (n *Node) handleTimeoutNow(req *pb.TimeoutNowRequest) *pb.TimeoutNowResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.stopped && req.Term == n.term && n.role == Follower && n.isVoter(n.config.ID) {
+		n.logger.Info(fmt.Sprintf("Node %d takes over leadership from node %d", n.config.ID, req.LeaderId))
+		n.startElection(true)
+	}
+	return &pb.TimeoutNowResponse{Term: n.term}
+}
@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// Followers tell the leader how far they applied the log, in every answer
+// and in progress messages sent over the Replicate stream as soon as they
+// applied more. Writers use it to wait until enough followers applied a write.
+
+// broadcastProgress wakes everyone waiting for entries to be applied,
+// callers must hold the lock
+func (n *Node) broadcastProgress() {
+	close(n.progressCh)
+	n.progressCh = make(chan struct{})
+}
+
+// Followers returns the number of voters besides this one
+func (n *Node) Followers() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	count := 0
+	for id := range n.members {
+		if id != n.config.ID && n.isVoter(id) {
+			count++
+		}
+	}
+	return count
+}
+
+// WaitApplied waits until at least replicas voting followers applied the entry at
+// index or timeout passed, 0 waits for as long as this node leads. It
+// returns how many followers applied the entry.
+func (n *Node) WaitApplied(index uint64, replicas int, timeout time.Duration) (int, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		n.mu.Lock()
+		if n.role != Leader {
+			n.mu.Unlock()
+			return 0, ErrNotLeader
+		}
+		count := 0
+		for id := range n.members {
+			if id != n.config.ID && n.isVoter(id) && n.appliedIndex[id] >= index {
+				count++
+			}
+		}
+		changed := n.progressCh
+		n.mu.Unlock()
+
+		if count >= replicas {
+			return count, nil
+		}
+		select {
+		case <-changed:
+		case <-expired:
+			return count, nil
+		case <-n.stopCh:
+			return count, ErrStopped
+		}
+	}
+}
+
+// recordApplied notes how far a follower applied the log, callers must hold the lock
+func (n *Node) recordApplied(id int32, index uint64) {
+	if index > n.appliedIndex[id] {
+		n.appliedIndex[id] = index
+		n.broadcastProgress()
+	}
+}
+
+// reportProgress sends a progress message whenever this node applied more
+// entries, until ctx is done
+func (n *Node) reportProgress(ctx context.Context, send func(*pb.AppendEntriesResponse) error) {
+	n.mu.Lock()
+	reported := n.lastApplied
+	n.mu.Unlock()
+
+	for {
+		n.mu.Lock()
+		applied, term, changed := n.lastApplied, n.term, n.progressCh
+		n.mu.Unlock()
+
+		if applied > reported {
+			if err := send(&pb.AppendEntriesResponse{Term: term, AppliedIndex: applied, Progress: true}); err != nil {
+				return
+			}
+			reported = applied
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
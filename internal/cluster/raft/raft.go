@@ -0,0 +1,1234 @@
+package raft
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	mathrand "math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/cluster/pool"
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"github.com/vskvj3/geomys/internal/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+// Role of a node in the cluster
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Leader:
+		return "leader"
+	case Candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// none marks a missing vote or an unknown leader
+const none int32 = -1
+
+// noVote is the persisted value of votedFor before a node votes in a term
+const noVote = none
+
+// maxBatch caps the number of entries sent in one AppendEntries call
+const maxBatch = 256
+
+// Errors returned to writers
+var (
+	ErrNotLeader      = errors.New("this node is not the leader")
+	ErrLeadershipLost = errors.New("leadership changed before the write was committed, it may or may not be applied")
+	ErrTimeout        = errors.New("timed out waiting for the write to be committed")
+	ErrStopped        = errors.New("raft node is stopped")
+	ErrConfigPending  = errors.New("another membership change is in progress")
+	ErrTransferring   = errors.New("leadership transfer in progress, try again later")
+	ErrOtherCluster   = errors.New("the node belongs to another cluster")
+)
+
+// StateMachine applies committed commands in log order
+type StateMachine interface {
+	// Apply applies the command at index and returns its result
+	Apply(index uint64, data []byte) (interface{}, error)
+	// AppliedIndex is the index of the last command reflected in the state,
+	// entries up to it are not applied again after a restart
+	AppliedIndex() uint64
+	// Snapshot writes the whole state to w, no Apply runs meanwhile
+	Snapshot(w io.Writer) error
+	// Restore replaces the state with a snapshot taken at index
+	Restore(r io.Reader, index uint64) error
+}
+
+// Config holds the settings of a raft node
+type Config struct {
+	ID                int32
+	ClusterID         string // cluster this node belonged to before, "" for a new node
+	Address           string // gRPC address other nodes reach this one at
+	ClientAddress     string // address clients reach this node at
+	Dir               string // directory for the log and the vote
+	Codec             *persistence.Codec
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration    // randomized between this and twice this
+	LeaseTimeout      time.Duration    // a leader not heard by a majority for this long steps down, below ElectionTimeout
+	CommitTimeout     time.Duration    // how long a write waits for a majority
+	SnapshotThreshold uint64           // applied entries that trigger a snapshot and log compaction
+	TrailingLogs      uint64           // entries kept after compaction for followers that lag a little
+	MaxInflight       int              // batches sent to a follower before waiting for acknowledgements
+	Pool              *pool.Pool       // connections to peers, the node opens its own when nil
+	Slots             []*pb.SlotRange  // hash slots a cluster serves from the start when bootstrapped
+	InitialVoters     map[int32]string // voters a cluster bootstrapped from a static peer set starts with
+	Logger            *utils.Logger
+}
+
+// result of applying a proposed entry
+type result struct {
+	value interface{}
+	err   error
+}
+
+// waiter is a writer blocked until its entry is applied
+type waiter struct {
+	term uint64
+	done chan result
+}
+
+// Node is one member of a raft cluster
+type Node struct {
+	config    Config
+	logger    *utils.Logger
+	sm        StateMachine
+	log       *Log
+	transport *transport
+
+	// applyMu serializes applying entries, taking snapshots and installing
+	// them. It is taken before mu.
+	applyMu sync.Mutex
+
+	mu               sync.Mutex
+	role             Role
+	term             uint64
+	votedFor         int32
+	leaderID         int32
+	leaderSince      time.Time         // when this node last became leader
+	leaderContact    time.Time         // when the leader was last heard from
+	configuration    *pb.Configuration // latest configuration in the log
+	members          map[int32]string  // voters, old voters and learners of configuration
+	configIndex      uint64            // index of the entry configuration came from
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[int32]uint64
+	matchIndex       map[int32]uint64
+	appliedIndex     map[int32]uint64    // last entry each follower reported as applied
+	lastAck          map[int32]time.Time // send time of the newest message each follower answered
+	confirmAfter     time.Time           // reads wait for answers to messages sent after this
+	leaderCommit     uint64              // newest commit index heard from the leader
+	freshAt          time.Time           // data is known to be current as of this time
+	commitSamples    []commitSample
+	replicators      map[int32]chan struct{}
+	departing        map[int32]string // removed members, sent the log until they have the entry removing them
+	transferee       int32            // voter leadership is handed to, none otherwise
+	electionDeadline time.Time
+	waiters          map[uint64]waiter
+	installing       bool   // a snapshot is being fetched from the leader
+	readyIndex       uint64 // commit index to apply before serving reads
+	ready            bool
+	stopped          bool
+	progressCh       chan struct{} // closed when this node or a follower applied entries
+
+	// xferMu guards the snapshot prepared for sending to followers
+	xferMu sync.Mutex
+	xfer   *transfer
+
+	applyCh chan struct{}
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewNode loads the log and vote of a node from config.Dir
+func NewNode(config Config, sm StateMachine) (*Node, error) {
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = 200 * time.Millisecond
+	}
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = 2 * time.Second
+	}
+	if config.LeaseTimeout == 0 || config.LeaseTimeout > config.ElectionTimeout {
+		config.LeaseTimeout = config.ElectionTimeout * 9 / 10
+	}
+	if config.CommitTimeout == 0 {
+		config.CommitTimeout = 5 * time.Second
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = 8192
+	}
+	if config.MaxInflight == 0 {
+		config.MaxInflight = 8
+	}
+	if config.TrailingLogs == 0 {
+		config.TrailingLogs = 1024
+	}
+	if config.TrailingLogs >= config.SnapshotThreshold {
+		config.TrailingLogs = config.SnapshotThreshold / 2
+	}
+	if config.Logger == nil {
+		config.Logger = utils.NewNopLogger()
+	}
+
+	log, err := OpenLog(filepath.Join(config.Dir, "raft.log"), config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadHardState(filepath.Join(config.Dir, "raft.state"))
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	n := &Node{
+		config:      config,
+		logger:      config.Logger,
+		sm:          sm,
+		log:         log,
+		transport:   newTransport(config.Pool),
+		term:        state.Term,
+		votedFor:    state.VotedFor,
+		leaderID:    none,
+		transferee:  none,
+		nextIndex:   make(map[int32]uint64),
+		matchIndex:  make(map[int32]uint64),
+		replicators: make(map[int32]chan struct{}),
+		waiters:     make(map[uint64]waiter),
+		progressCh:  make(chan struct{}),
+		applyCh:     make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+	n.reloadMembers()
+
+	// A state machine that lost writes the log no longer holds, for example
+	// one without persistence, starts over from the snapshot
+	if sm.AppliedIndex() < log.BaseIndex() {
+		if err := n.restoreLocalSnapshot(); err != nil {
+			n.Stop()
+			return nil, err
+		}
+	}
+
+	// Whatever the state machine already holds was committed before
+	n.lastApplied = min(max(sm.AppliedIndex(), log.BaseIndex()), log.LastIndex())
+	n.commitIndex = n.lastApplied
+	return n, nil
+}
+
+// restoreLocalSnapshot loads the snapshot file into the state machine
+func (n *Node) restoreLocalSnapshot() error {
+	meta, data, file, err := openSnapshotFile(n.snapshotPath(), n.config.Codec)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return fmt.Errorf("raft log is compacted up to %d but there is no snapshot", n.log.BaseIndex())
+	}
+	defer file.Close()
+	n.logger.Info(fmt.Sprintf("Restoring snapshot at index %d", meta.Index))
+	return n.sm.Restore(data, meta.Index)
+}
+
+// snapshotPath is the file holding the latest snapshot
+func (n *Node) snapshotPath() string {
+	return filepath.Join(n.config.Dir, "raft.snapshot")
+}
+
+// Start runs the node. With bootstrap set, a node with an empty log starts
+// a new cluster with itself as the only member.
+func (n *Node) Start(bootstrap bool) error {
+	n.mu.Lock()
+	if bootstrap && n.log.LastIndex() == 0 {
+		n.term = 1
+		if err := n.persist(); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		config := &pb.Configuration{
+			Voters:          map[int32]string{n.config.ID: n.config.Address},
+			ClientAddresses: map[int32]string{n.config.ID: n.config.ClientAddress},
+			Slots:           n.config.Slots,
+			ClusterId:       n.config.ClusterID,
+		}
+		static := len(n.config.InitialVoters) > 1
+		if static {
+			// Every voter of the set writes the same first entry, they tell
+			// the leader their client addresses once one is elected
+			config.Voters, config.ClientAddresses = maps.Clone(n.config.InitialVoters), nil
+		}
+		if config.ClusterId == "" {
+			config.ClusterId = newClusterID()
+		}
+		var err error
+		if applied := n.sm.AppliedIndex(); applied > 0 && static {
+			err = errors.New("a cluster bootstrapped from a static peer set starts without data")
+		} else if applied > 0 {
+			// Existing data becomes a snapshot that joining nodes receive
+			err = n.bootstrapSnapshot(applied, config)
+		} else {
+			err = n.appendConfig(config)
+		}
+		if err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		if static {
+			n.logger.Info(fmt.Sprintf("Bootstrapped a new cluster with %d voters", len(config.Voters)))
+			n.resetElectionTimer()
+		} else {
+			n.logger.Info(fmt.Sprintf("Bootstrapped a new cluster with node %d", n.config.ID))
+			// A single member wins right away
+			n.electionDeadline = time.Now()
+		}
+	} else {
+		n.resetElectionTimer()
+	}
+	n.mu.Unlock()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	n.signalApply()
+	return nil
+}
+
+// Stop halts the node and closes its log
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stopCh)
+	n.mu.Unlock()
+
+	n.wg.Wait()
+	n.transport.close()
+	n.log.Close()
+}
+
+/***************************************************************
+*                          Status                              *
+***************************************************************/
+
+// ID returns the id of this node
+func (n *Node) ID() int32 {
+	return n.config.ID
+}
+
+// Address returns the gRPC address of this node
+func (n *Node) Address() string {
+	return n.config.Address
+}
+
+// Role returns the current role of this node
+func (n *Node) Role() Role {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.checkLease()
+	return n.role
+}
+
+// IsLeader reports whether this node is the leader
+func (n *Node) IsLeader() bool {
+	return n.Role() == Leader
+}
+
+// Term returns the current term
+func (n *Node) Term() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.term
+}
+
+// ClusterID returns the id of the cluster this node belongs to, "" while it
+// does not know
+func (n *Node) ClusterID() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.clusterID()
+}
+
+// clusterID returns the id of the cluster this node belongs to, callers must hold the lock
+func (n *Node) clusterID() string {
+	if id := n.configuration.GetClusterId(); id != "" {
+		return id
+	}
+	return n.config.ClusterID
+}
+
+// newClusterID returns a random id for a new cluster
+func newClusterID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// LeaderID returns the id of the known leader, -1 if there is none
+func (n *Node) LeaderID() int32 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.checkLease()
+	return n.leaderID
+}
+
+// LeaderAddress returns the gRPC address of the known leader, "" if there is none
+func (n *Node) LeaderAddress() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.checkLease()
+	return n.members[n.leaderID]
+}
+
+// LeaderClientAddress returns the address clients reach the known leader
+// at, "" if there is none
+func (n *Node) LeaderClientAddress() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.checkLease()
+	return n.configuration.GetClientAddresses()[n.leaderID]
+}
+
+// Members returns a copy of the current members
+func (n *Node) Members() map[int32]string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members := make(map[int32]string, len(n.members))
+	for id, addr := range n.members {
+		members[id] = addr
+	}
+	return members
+}
+
+// Configuration returns a copy of the latest configuration
+func (n *Node) Configuration() *pb.Configuration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.cloneConfiguration()
+}
+
+// ChangeSlots changes the hash slots of the latest configuration and waits
+// until the new configuration is committed, the members stay as they are
+func (n *Node) ChangeSlots(change func(config *pb.Configuration) error) error {
+	return n.changeConfig(func(config *pb.Configuration) error {
+		voters := config.Voters
+		err := change(config)
+		config.Voters = voters
+		return err
+	})
+}
+
+// CommitIndex returns the index of the last committed entry
+func (n *Node) CommitIndex() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.commitIndex
+}
+
+// LastApplied returns the index of the last entry applied to the state machine
+func (n *Node) LastApplied() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lastApplied
+}
+
+// Ready reports whether the node has caught up with the cluster far enough
+// to serve reads: it leads, or it applied everything the leader had
+// committed when it first heard from it
+func (n *Node) Ready() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.ready && n.readyIndex > 0 && n.lastApplied >= n.readyIndex {
+		n.ready = true
+	}
+	return n.ready
+}
+
+/***************************************************************
+*                          Writes                              *
+***************************************************************/
+
+// Propose appends a command to the log and waits until a majority stored it
+// and it was applied, returning the result of applying it and its index
+func (n *Node) Propose(data []byte) (interface{}, uint64, error) {
+	n.mu.Lock()
+	index, err := n.appendCommand(data)
+	if err != nil {
+		n.mu.Unlock()
+		return nil, 0, err
+	}
+	w := n.addWaiter(index)
+	n.mu.Unlock()
+
+	value, err := n.wait(index, w)
+	return value, index, err
+}
+
+// Submit appends a command to the log without waiting for it to commit and
+// returns its index. The write may still be lost if this node stops leading.
+func (n *Node) Submit(data []byte) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.appendCommand(data)
+}
+
+// appendCommand appends a command entry and starts replicating it, callers
+// must hold the lock
+func (n *Node) appendCommand(data []byte) (uint64, error) {
+	n.checkLease()
+	if n.role != Leader {
+		return 0, ErrNotLeader
+	}
+	if n.transferee != none {
+		return 0, ErrTransferring
+	}
+	entry := &pb.Entry{Index: n.log.LastIndex() + 1, Term: n.term, Type: pb.EntryType_ENTRY_COMMAND, Data: data}
+	if err := n.log.Append(entry); err != nil {
+		return 0, err
+	}
+	n.notifyReplicators()
+	n.advanceCommit()
+	return entry.Index, nil
+}
+
+// AddMember adds a node that clients reach at clientAddr to the cluster
+// through a configuration entry
+func (n *Node) AddMember(id int32, addr, clientAddr string) error {
+	n.mu.Lock()
+	existing, ok := n.configuration.GetVoters()[id]
+	known := n.configuration.GetClientAddresses()[id]
+	n.mu.Unlock()
+	if ok && existing == addr && known == clientAddr {
+		return nil
+	}
+
+	n.logger.Info(fmt.Sprintf("Adding node %d at %s to the cluster", id, addr))
+	return n.changeConfig(func(config *pb.Configuration) error {
+		if config.Voters == nil {
+			config.Voters = make(map[int32]string)
+		}
+		config.Voters[id] = addr
+		delete(config.Learners, id)
+		if config.ClientAddresses == nil {
+			config.ClientAddresses = make(map[int32]string)
+		}
+		config.ClientAddresses[id] = clientAddr
+		return nil
+	})
+}
+
+// changeConfig applies change to a copy of the latest configuration and
+// waits until the new configuration is committed
+func (n *Node) changeConfig(change func(config *pb.Configuration) error) error {
+	n.mu.Lock()
+	index, err := n.proposeConfig(change)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	w := n.addWaiter(index)
+	n.mu.Unlock()
+
+	_, err = n.wait(index, w)
+	return err
+}
+
+// proposeConfig appends change applied to a copy of the latest
+// configuration and returns its index, callers must hold the lock
+func (n *Node) proposeConfig(change func(config *pb.Configuration) error) (uint64, error) {
+	n.checkLease()
+	if n.role != Leader {
+		return 0, ErrNotLeader
+	}
+	if n.transferee != none {
+		return 0, ErrTransferring
+	}
+	// One change at a time keeps every pair of majorities overlapping
+	if n.configIndex > n.commitIndex || len(n.configuration.GetOldVoters()) > 0 {
+		return 0, ErrConfigPending
+	}
+
+	config := n.cloneConfiguration()
+	if err := change(config); err != nil {
+		return 0, err
+	}
+	if err := n.appendConfig(config); err != nil {
+		return 0, err
+	}
+	index := n.log.LastIndex()
+	n.startReplicators()
+	n.advanceCommit()
+	return index, nil
+}
+
+// appendConfig writes a configuration entry, it takes effect right away.
+// Callers must hold the lock.
+func (n *Node) appendConfig(config *pb.Configuration) error {
+	data, err := proto.Marshal(config)
+	if err != nil {
+		return err
+	}
+	entry := &pb.Entry{Index: n.log.LastIndex() + 1, Term: n.term, Type: pb.EntryType_ENTRY_CONFIG, Data: data}
+	if err := n.log.Append(entry); err != nil {
+		return err
+	}
+	members := peers(config)
+	if n.role == Leader {
+		for id, addr := range n.members {
+			if _, ok := members[id]; !ok && id != n.config.ID {
+				n.departing[id] = addr
+			}
+		}
+	}
+	n.configuration = config
+	n.members = members
+	n.configIndex = entry.Index
+	return nil
+}
+
+// cloneConfiguration returns a copy of the latest configuration, callers must hold the lock
+func (n *Node) cloneConfiguration() *pb.Configuration {
+	if n.configuration == nil {
+		return &pb.Configuration{}
+	}
+	return proto.Clone(n.configuration).(*pb.Configuration)
+}
+
+// addWaiter registers a writer for the entry at index, callers must hold the lock
+func (n *Node) addWaiter(index uint64) waiter {
+	w := waiter{term: n.term, done: make(chan result, 1)}
+	n.waiters[index] = w
+	return w
+}
+
+// wait blocks until the entry at index is applied, leadership is lost or time runs out
+func (n *Node) wait(index uint64, w waiter) (interface{}, error) {
+	timer := time.NewTimer(n.config.CommitTimeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-w.done:
+		return res.value, res.err
+	case <-timer.C:
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return nil, ErrTimeout
+	case <-n.stopCh:
+		return nil, ErrStopped
+	}
+}
+
+/***************************************************************
+*                         Elections                            *
+***************************************************************/
+
+// run starts elections when the leader goes quiet, and steps down a
+// leader that lost its lease
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(max(n.config.HeartbeatInterval/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		n.checkLease()
+		if n.role != Leader && n.isVoter(n.config.ID) && time.Now().After(n.electionDeadline) {
+			n.startElection(false)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection becomes a candidate in a new term, transfer is set when the
+// leader handed leadership over. Callers must hold the lock.
+func (n *Node) startElection(transfer bool) {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.config.ID
+	n.leaderID = none
+	n.resetElectionTimer()
+	if err := n.persist(); err != nil {
+		n.logger.Error("Failed to persist raft state: " + err.Error())
+		n.role = Follower
+		return
+	}
+	n.logger.Info(fmt.Sprintf("Node %d starts an election for term %d", n.config.ID, n.term))
+
+	granted := map[int32]bool{n.config.ID: true}
+	if n.hasQuorum(func(id int32) bool { return granted[id] }) {
+		n.becomeLeader()
+		return
+	}
+
+	term := n.term
+	req := &pb.VoteRequest{
+		NodeId:             n.config.ID,
+		Term:               term,
+		LastLogIndex:       n.log.LastIndex(),
+		LastLogTerm:        n.log.LastTerm(),
+		LeadershipTransfer: transfer,
+	}
+	for id, addr := range n.members {
+		if id == n.config.ID || !n.isVoter(id) {
+			continue
+		}
+		n.wg.Add(1)
+		go func(id int32, addr string) {
+			defer n.wg.Done()
+			resp, err := n.requestVote(addr, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.stopped {
+				return
+			}
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.role != Candidate || n.term != term || !resp.VoteGranted {
+				return
+			}
+			granted[id] = true
+			if n.hasQuorum(func(id int32) bool { return granted[id] }) {
+				n.becomeLeader()
+			}
+		}(id, addr)
+	}
+}
+
+// requestVote asks one peer for its vote
+func (n *Node) requestVote(addr string, req *pb.VoteRequest) (*pb.VoteResponse, error) {
+	client, err := n.transport.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+	defer cancel()
+	return client.RequestVote(ctx, req)
+}
+
+// becomeLeader takes over the cluster, callers must hold the lock
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leaderID = n.config.ID
+	n.leaderSince = time.Now()
+	n.ready = true
+	n.nextIndex = make(map[int32]uint64)
+	n.matchIndex = make(map[int32]uint64)
+	n.appliedIndex = make(map[int32]uint64)
+	n.lastAck = make(map[int32]time.Time)
+	n.replicators = make(map[int32]chan struct{})
+	n.departing = make(map[int32]string)
+	n.transferee = none
+	n.logger.Info(fmt.Sprintf("Node %d is the leader for term %d", n.config.ID, n.term))
+
+	// Entries from earlier terms only commit along with one from this term
+	noop := &pb.Entry{Index: n.log.LastIndex() + 1, Term: n.term, Type: pb.EntryType_ENTRY_NOOP}
+	if err := n.log.Append(noop); err != nil {
+		n.logger.Error("Failed to append to raft log: " + err.Error())
+		n.stepDown(n.term)
+		return
+	}
+	// Clusters bootstrapped before they had ids get one
+	if n.configuration != nil && n.configuration.ClusterId == "" {
+		config := n.cloneConfiguration()
+		config.ClusterId = newClusterID()
+		if err := n.appendConfig(config); err != nil {
+			n.logger.Error("Failed to append to raft log: " + err.Error())
+		}
+	}
+	n.startReplicators()
+	n.advanceCommit()
+}
+
+// stepDown turns the node into a follower, adopting term if it is newer.
+// Callers must hold the lock.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = noVote
+		n.leaderID = none
+		if err := n.persist(); err != nil {
+			n.logger.Error("Failed to persist raft state: " + err.Error())
+		}
+	}
+	if n.role == Leader {
+		n.logger.Info(fmt.Sprintf("Node %d steps down in term %d", n.config.ID, n.term))
+		for index, w := range n.waiters {
+			w.done <- result{err: ErrLeadershipLost}
+			delete(n.waiters, index)
+		}
+		n.replicators = make(map[int32]chan struct{})
+		n.transferee = none
+		// Wakes those waiting on this node to lead
+		n.broadcastProgress()
+	}
+	n.role = Follower
+	n.resetElectionTimer()
+}
+
+// resetElectionTimer picks a new random election deadline, callers must hold the lock
+func (n *Node) resetElectionTimer() {
+	timeout := n.config.ElectionTimeout + time.Duration(mathrand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// persist saves the term and vote, callers must hold the lock
+func (n *Node) persist() error {
+	return saveHardState(filepath.Join(n.config.Dir, "raft.state"), hardState{Term: n.term, VotedFor: n.votedFor})
+}
+
+/***************************************************************
+*                        Replication                           *
+***************************************************************/
+
+// startReplicators starts one replication loop per member that lacks one,
+// callers must hold the lock
+func (n *Node) startReplicators() {
+	for id := range n.members {
+		if id == n.config.ID {
+			continue
+		}
+		if _, ok := n.replicators[id]; ok {
+			continue
+		}
+		ch := make(chan struct{}, 1)
+		n.replicators[id] = ch
+		n.nextIndex[id] = n.log.LastIndex() + 1
+		n.matchIndex[id] = 0
+		n.wg.Add(1)
+		go n.replicate(id, n.term, ch)
+	}
+}
+
+// notifyReplicators wakes every replication loop, callers must hold the lock
+func (n *Node) notifyReplicators() {
+	for _, ch := range n.replicators {
+		notify(ch)
+	}
+}
+
+// advanceCommit commits the newest entry of this term stored on a majority,
+// callers must hold the lock
+func (n *Node) advanceCommit() {
+	if n.role != Leader {
+		return
+	}
+	last := n.log.LastIndex()
+	for index := last; index > n.commitIndex; index-- {
+		// Entries of older terms are committed indirectly, see becomeLeader
+		if n.log.Term(index) != n.term {
+			return
+		}
+		stored := func(id int32) bool {
+			return id == n.config.ID || n.matchIndex[id] >= index
+		}
+		if n.hasQuorum(stored) {
+			n.commitIndex = index
+			n.signalApply()
+			n.notifyReplicators()
+			if n.commitIndex >= n.configIndex {
+				n.configCommitted()
+			}
+			return
+		}
+	}
+}
+
+/***************************************************************
+*                          Applying                            *
+***************************************************************/
+
+// signalApply wakes the apply loop
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applyLoop applies committed entries in order and hands results to waiting writers
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-n.applyCh:
+		}
+
+		n.applyMu.Lock()
+		for n.applyNext() {
+		}
+		n.mu.Lock()
+		n.advanceFreshness()
+		n.broadcastProgress()
+		n.mu.Unlock()
+		if err := n.maybeSnapshot(); err != nil {
+			n.logger.Error("Failed to take a snapshot: " + err.Error())
+		}
+		n.applyMu.Unlock()
+	}
+}
+
+// applyNext applies the next committed entry, reporting false when there is
+// none. Callers must hold applyMu.
+func (n *Node) applyNext() bool {
+	n.mu.Lock()
+	if n.stopped || n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	entry := n.log.Entry(n.lastApplied + 1)
+	n.mu.Unlock()
+
+	// Committed entries never change, so they are applied without the lock
+	var res result
+	if entry.Type == pb.EntryType_ENTRY_COMMAND {
+		res.value, res.err = n.sm.Apply(entry.Index, entry.Data)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.lastApplied = entry.Index
+	if w, ok := n.waiters[entry.Index]; ok {
+		delete(n.waiters, entry.Index)
+		if w.term != entry.Term {
+			res = result{err: ErrLeadershipLost}
+		}
+		w.done <- res
+	}
+	return true
+}
+
+// reloadMembers takes the membership from the newest configuration in the
+// log, callers must hold the lock
+func (n *Node) reloadMembers() {
+	n.configuration = nil
+	n.members = make(map[int32]string)
+	n.configIndex = 0
+	for index := n.log.LastIndex(); index > n.log.BaseIndex(); index-- {
+		if n.log.Entry(index).Type == pb.EntryType_ENTRY_CONFIG {
+			n.configIndex = index
+			break
+		}
+	}
+	config, err := n.log.ConfigurationAt(n.log.LastIndex())
+	if err != nil {
+		n.logger.Error(err.Error())
+		return
+	}
+	if config != nil && config.Voters != nil {
+		n.configuration = config
+		n.members = peers(config)
+	}
+}
+
+/***************************************************************
+*                       RPC handlers                           *
+***************************************************************/
+
+// handleRequestVote grants a vote to an up to date candidate, at most one per term
+func (n *Node) handleRequestVote(req *pb.VoteRequest) *pb.VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// A voter that still hears from a leader keeps it, unless it hands over
+	if req.Term > n.term && !req.LeadershipTransfer && n.inLease() {
+		return &pb.VoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	resp := &pb.VoteResponse{Term: n.term}
+	if n.stopped || req.Term < n.term {
+		return resp
+	}
+
+	lastTerm, lastIndex := n.log.LastTerm(), n.log.LastIndex()
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= lastIndex)
+	if (n.votedFor == noVote || n.votedFor == req.NodeId) && upToDate {
+		n.votedFor = req.NodeId
+		if err := n.persist(); err != nil {
+			n.logger.Error("Failed to persist raft state: " + err.Error())
+			return resp
+		}
+		n.resetElectionTimer()
+		resp.VoteGranted = true
+	}
+	return resp
+}
+
+// handleAppendEntries stores entries from the leader once the logs match up to them
+func (n *Node) handleAppendEntries(req *pb.AppendEntriesRequest) *pb.AppendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &pb.AppendEntriesResponse{Term: n.term, LastIndex: n.log.LastIndex(), AppliedIndex: n.lastApplied}
+	if n.stopped || req.Term < n.term {
+		return resp
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.stepDown(req.Term)
+	}
+	n.heardFromLeader(req.LeaderId)
+	resp.Term = n.term
+
+	if req.PrevLogIndex > n.log.LastIndex() {
+		return resp
+	}
+	if base := n.log.BaseIndex(); req.PrevLogIndex < base {
+		// Everything up to the base is committed and matches the leader
+		for len(req.Entries) > 0 && req.Entries[0].Index <= base {
+			req.Entries = req.Entries[1:]
+		}
+		req.PrevLogIndex, req.PrevLogTerm = base, n.log.Term(base)
+	}
+	if conflict := n.log.Term(req.PrevLogIndex); conflict != req.PrevLogTerm {
+		// Skip the whole conflicting term instead of one entry per call
+		index := req.PrevLogIndex
+		for index > n.log.BaseIndex() && n.log.Term(index) == conflict {
+			index--
+		}
+		resp.LastIndex = index
+		return resp
+	}
+
+	var fresh []*pb.Entry
+	reload := false
+	for i, entry := range req.Entries {
+		if entry.Index > n.log.LastIndex() {
+			fresh = req.Entries[i:]
+			break
+		}
+		if n.log.Term(entry.Index) != entry.Term {
+			if err := n.log.TruncateFrom(entry.Index); err != nil {
+				n.logger.Error(err.Error())
+				return resp
+			}
+			reload = true
+			fresh = req.Entries[i:]
+			break
+		}
+	}
+	if len(fresh) > 0 {
+		if err := n.log.Append(fresh...); err != nil {
+			n.logger.Error(err.Error())
+			resp.LastIndex = n.log.LastIndex()
+			return resp
+		}
+		for _, entry := range fresh {
+			if entry.Type == pb.EntryType_ENTRY_CONFIG {
+				reload = true
+			}
+		}
+	}
+	if reload {
+		n.reloadMembers()
+	}
+
+	resp.Success = true
+	resp.LastIndex = req.PrevLogIndex + uint64(len(req.Entries))
+	if n.readyIndex == 0 {
+		n.readyIndex = max(req.LeaderCommit, 1)
+	}
+	n.noteLeaderCommit(req.LeaderCommit)
+	// A late heartbeat may only vouch for a shorter log, the commit index never goes back
+	if commit := min(req.LeaderCommit, resp.LastIndex); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signalApply()
+	}
+	return resp
+}
+
+// handleJoin adds the requesting node, or points it to the leader
+func (n *Node) handleJoin(req *pb.JoinRequest) *pb.JoinResponse {
+	clusterID := n.ClusterID()
+	if req.ClusterId != "" && clusterID != "" && req.ClusterId != clusterID {
+		n.logger.Warn(fmt.Sprintf("Refused node %d of cluster %s", req.NodeId, req.ClusterId))
+		return &pb.JoinResponse{LeaderId: n.LeaderID(), ClusterId: clusterID, Message: ErrOtherCluster.Error()}
+	}
+
+	var err error
+	if req.Learner {
+		err = n.AddLearner(req.NodeId, req.Address, req.ClientAddress)
+	} else {
+		err = n.AddMember(req.NodeId, req.Address, req.ClientAddress)
+	}
+	if err == nil {
+		return &pb.JoinResponse{Success: true, LeaderId: n.config.ID, ClusterId: clusterID}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &pb.JoinResponse{LeaderId: n.leaderID, ClusterId: clusterID, Message: err.Error()}
+	if n.leaderID != n.config.ID {
+		resp.LeaderAddress = n.members[n.leaderID]
+	}
+	return resp
+}
+
+// Join asks the cluster behind addr to add this node, as a learner when
+// learner is set, following redirects to the leader and retrying until
+// timeout passes
+func (n *Node) Join(addr string, learner bool, timeout time.Duration) error {
+	// A restarted member finds itself in its own log, a member of a static
+	// peer set still tells the leader where clients reach it
+	n.mu.Lock()
+	_, member := n.members[n.config.ID]
+	registered := member && n.configuration.GetClientAddresses()[n.config.ID] == n.config.ClientAddress
+	clusterID := n.clusterID()
+	n.mu.Unlock()
+	if registered {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	req := &pb.JoinRequest{NodeId: n.config.ID, Address: n.config.Address, ClientAddress: n.config.ClientAddress, Learner: learner, ClusterId: clusterID}
+	target := addr
+
+	for {
+		resp, err := n.join(target, req)
+		if err == nil && clusterID != "" && resp.ClusterId != "" && resp.ClusterId != clusterID {
+			return fmt.Errorf("%w: this node is part of cluster %s, the node at %s of cluster %s", ErrOtherCluster, clusterID, target, resp.ClusterId)
+		}
+		if err == nil && resp.Success {
+			n.logger.Info(fmt.Sprintf("Joined the cluster led by node %d", resp.LeaderId))
+			return nil
+		}
+
+		if err != nil {
+			n.logger.Warn(fmt.Sprintf("Join request to %s failed: %v", target, err))
+			target = addr
+		} else if resp.LeaderAddress != "" {
+			target = resp.LeaderAddress
+			continue
+		} else {
+			n.logger.Warn(fmt.Sprintf("Join request to %s refused: %s", target, resp.Message))
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("could not join the cluster at %s", addr)
+		}
+		select {
+		case <-n.stopCh:
+			return ErrStopped
+		case <-time.After(n.config.ElectionTimeout / 2):
+		}
+	}
+}
+
+// join sends one Join request
+func (n *Node) join(addr string, req *pb.JoinRequest) (*pb.JoinResponse, error) {
+	client, err := n.transport.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.CommitTimeout+time.Second)
+	defer cancel()
+	return client.Join(ctx, req)
+}
+
+/***************************************************************
+*                         Snapshots                            *
+***************************************************************/
+
+// bootstrapSnapshot turns the data a node already holds into the start of
+// a new cluster's log, callers must hold the lock
+func (n *Node) bootstrapSnapshot(index uint64, config *pb.Configuration) error {
+	meta := &pb.SnapshotMeta{Index: index, Term: n.term, Configuration: config}
+	if err := writeSnapshotFile(n.snapshotPath(), n.config.Codec, meta, n.sm.Snapshot); err != nil {
+		return err
+	}
+	if err := n.compactLog(meta.Index, meta.Term, meta.Configuration); err != nil {
+		return err
+	}
+	n.lastApplied, n.commitIndex = index, index
+	return nil
+}
+
+// maybeSnapshot snapshots the state machine and compacts the log once
+// enough entries were applied since the last time. Callers must hold applyMu.
+func (n *Node) maybeSnapshot() error {
+	n.mu.Lock()
+	applied := n.lastApplied
+	if n.stopped || applied-n.log.BaseIndex() < n.config.SnapshotThreshold {
+		n.mu.Unlock()
+		return nil
+	}
+	meta := &pb.SnapshotMeta{Index: applied, Term: n.log.Term(applied)}
+	config, err := n.log.ConfigurationAt(applied)
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	meta.Configuration = config
+
+	// Applied entries never change, so the log lock is not needed meanwhile
+	if err := writeSnapshotFile(n.snapshotPath(), n.config.Codec, meta, n.sm.Snapshot); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// Keep a tail so followers that lag a little still catch up from the log
+	keep := applied - min(applied, n.config.TrailingLogs)
+	if keep <= n.log.BaseIndex() {
+		return nil
+	}
+	config, err = n.log.ConfigurationAt(keep)
+	if err != nil {
+		return err
+	}
+	if err := n.compactLog(keep, n.log.Term(keep), config); err != nil {
+		return err
+	}
+	n.logger.Info(fmt.Sprintf("Took a snapshot at index %d and compacted the raft log up to %d", applied, keep))
+	return nil
+}
+
+// compactLog replaces the log up to index with a base entry, callers must hold the lock
+func (n *Node) compactLog(index, term uint64, config *pb.Configuration) error {
+	var data []byte
+	if config != nil {
+		var err error
+		if data, err = proto.Marshal(config); err != nil {
+			return err
+		}
+	}
+	if err := n.log.Compact(&pb.Entry{Index: index, Term: term, Type: pb.EntryType_ENTRY_SNAPSHOT, Data: data}); err != nil {
+		return err
+	}
+	n.reloadMembers()
+	return nil
+}
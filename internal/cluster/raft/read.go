@@ -0,0 +1,178 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// Linearizable reads use a read index: the leader takes its commit index,
+// confirms with a majority that it still leads, and the read is served once
+// that index is applied. Followers ask the leader for the index and serve
+// the read themselves.
+//
+// Followers also track how stale their data may be: freshAt is when the
+// newest message arrived whose commit index they applied.
+
+// ErrNoLeader is returned when a read needs the leader and none is known
+var ErrNoLeader = errors.New("no leader")
+
+// maxCommitSamples bounds the commit indexes a follower remembers while applying
+const maxCommitSamples = 1024
+
+// commitSample is the leader's commit index at the time a message arrived
+type commitSample struct {
+	index uint64
+	at    time.Time
+}
+
+// ReadIndex returns an index that reads must wait for to be linearizable
+func (n *Node) ReadIndex(timeout time.Duration) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	n.mu.Lock()
+	leader, addr := n.role == Leader, n.members[n.leaderID]
+	n.mu.Unlock()
+	if leader {
+		return n.readIndex(ctx)
+	}
+	if addr == "" {
+		return 0, ErrNoLeader
+	}
+
+	client, err := n.transport.client(addr)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.ReadIndex(ctx, &pb.ReadIndexRequest{NodeId: n.config.ID})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
+
+// readIndex confirms this node still leads and returns its commit index
+func (n *Node) readIndex(ctx context.Context) (uint64, error) {
+	leading := func() error {
+		if n.role != Leader {
+			return ErrNotLeader
+		}
+		return nil
+	}
+
+	// The commit index is only known to be current once an entry of this term committed
+	err := n.waitUntil(ctx, func() (bool, error) {
+		return n.log.Term(n.commitIndex) == n.term, leading()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n.mu.Lock()
+	index, start := n.commitIndex, time.Now()
+	n.confirmAfter = start
+	n.notifyReplicators()
+	n.mu.Unlock()
+
+	// Answers to messages sent after start prove no other leader was elected before
+	err = n.waitUntil(ctx, func() (bool, error) {
+		acked := func(id int32) bool {
+			return id == n.config.ID || !n.lastAck[id].Before(start)
+		}
+		return n.hasQuorum(acked), leading()
+	})
+	return index, err
+}
+
+// WaitIndex waits until this node applied index
+func (n *Node) WaitIndex(index uint64, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return n.waitUntil(ctx, func() (bool, error) {
+		return n.lastApplied >= index, nil
+	})
+}
+
+// Barrier waits until this node applied every entry its log holds now
+func (n *Node) Barrier(timeout time.Duration) error {
+	n.mu.Lock()
+	last := n.log.LastIndex()
+	n.mu.Unlock()
+	return n.WaitIndex(last, timeout)
+}
+
+// Staleness returns how long ago this node's data was known to be current,
+// the longest duration if it never heard from a leader, and how many
+// entries the leader committed that it has not applied yet
+func (n *Node) Staleness() (time.Duration, uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == Leader {
+		return 0, 0
+	}
+	var behind uint64
+	if n.leaderCommit > n.lastApplied {
+		behind = n.leaderCommit - n.lastApplied
+	}
+	if n.freshAt.IsZero() {
+		return time.Duration(math.MaxInt64), behind
+	}
+	return time.Since(n.freshAt), behind
+}
+
+// noteLeaderCommit records the commit index of a message from the leader,
+// callers must hold the lock
+func (n *Node) noteLeaderCommit(commit uint64) {
+	now := time.Now()
+	n.leaderCommit = max(n.leaderCommit, commit)
+	if commit <= n.lastApplied {
+		n.freshAt = now
+		return
+	}
+	if last := len(n.commitSamples) - 1; last >= 0 && n.commitSamples[last].index >= commit {
+		if n.commitSamples[last].index == commit {
+			n.commitSamples[last].at = now
+		}
+		return
+	}
+	if len(n.commitSamples) == maxCommitSamples {
+		n.commitSamples = n.commitSamples[1:]
+	}
+	n.commitSamples = append(n.commitSamples, commitSample{index: commit, at: now})
+}
+
+// advanceFreshness moves freshAt past the samples this node applied, callers must hold the lock
+func (n *Node) advanceFreshness() {
+	for len(n.commitSamples) > 0 && n.commitSamples[0].index <= n.lastApplied {
+		n.freshAt = n.commitSamples[0].at
+		n.commitSamples = n.commitSamples[1:]
+	}
+}
+
+// waitUntil blocks until cond holds or fails, cond runs under the lock
+// whenever entries were applied or a follower answered
+func (n *Node) waitUntil(ctx context.Context, cond func() (bool, error)) error {
+	for {
+		n.mu.Lock()
+		done, err := cond()
+		changed := n.progressCh
+		n.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ErrTimeout
+		case <-n.stopCh:
+			return ErrStopped
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package raft
+
+import (
+	"context"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// Server exposes a node over the ElectionService gRPC API
+type Server struct {
+	pb.UnimplementedElectionServiceServer
+	Node *Node
+}
+
+// RequestVote handles a vote request from a candidate
+func (s *Server) RequestVote(ctx context.Context, req *pb.VoteRequest) (*pb.VoteResponse, error) {
+	return s.Node.handleRequestVote(req), nil
+}
+
+// AppendEntries handles entries and heartbeats from the leader
+func (s *Server) AppendEntries(ctx context.Context, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	return s.Node.handleAppendEntries(req), nil
+}
+
+// Replicate handles the stream of entries and heartbeats from the leader
+func (s *Server) Replicate(stream pb.ElectionService_ReplicateServer) error {
+	return s.Node.handleReplicate(stream)
+}
+
+// Join handles a request from a node to become a member
+func (s *Server) Join(ctx context.Context, req *pb.JoinRequest) (*pb.JoinResponse, error) {
+	return s.Node.handleJoin(req), nil
+}
+
+// InstallSnapshot handles a snapshot from the leader
+func (s *Server) InstallSnapshot(ctx context.Context, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	return s.Node.handleInstallSnapshot(req), nil
+}
+
+// StreamSnapshot streams the latest snapshot and the log after it to a follower
+func (s *Server) StreamSnapshot(req *pb.SnapshotStreamRequest, stream pb.ElectionService_StreamSnapshotServer) error {
+	return s.Node.handleStreamSnapshot(req, stream)
+}
+
+// ReadIndex confirms leadership for a follower's linearizable read
+func (s *Server) ReadIndex(ctx context.Context, req *pb.ReadIndexRequest) (*pb.ReadIndexResponse, error) {
+	index, err := s.Node.readIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ReadIndexResponse{Index: index}, nil
+}
+
+// TimeoutNow starts an election when the leader hands leadership to this node
+func (s *Server) TimeoutNow(ctx context.Context, req *pb.TimeoutNowRequest) (*pb.TimeoutNowResponse, error) {
+	return s.Node.handleTimeoutNow(req), nil
+}
@@ -0,0 +1,164 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"google.golang.org/protobuf/proto"
+)
+
+// snapshotMagic starts every raft snapshot file
+var snapshotMagic = []byte{'G', 'R', 'S', 0x01}
+
+// chunkSize is how much state machine data goes into one frame
+const chunkSize = 64 << 10
+
+// A snapshot file holds the magic, a frame with the SnapshotMeta and then
+// the state machine data cut into frames, all written with the node's codec.
+
+// writeSnapshotFile atomically replaces the snapshot at path, fill writes the state machine data
+func writeSnapshotFile(path string, codec *persistence.Codec, meta *pb.SnapshotMeta, fill func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	buffered := bufio.NewWriter(file)
+	err = writeSnapshot(buffered, codec, meta, fill)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeSnapshot writes the magic, meta and framed data to w
+func writeSnapshot(w io.Writer, codec *persistence.Codec, meta *pb.SnapshotMeta, fill func(w io.Writer) error) error {
+	if _, err := w.Write(snapshotMagic); err != nil {
+		return err
+	}
+	data, err := proto.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	frame, err := persistence.EncodeFrame(data, codec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+
+	chunks := &frameWriter{w: w, codec: codec}
+	if err := fill(chunks); err != nil {
+		return err
+	}
+	return chunks.flush()
+}
+
+// openSnapshot reads the meta of a snapshot and returns a reader over its
+// data, a nil meta means there is no snapshot
+func openSnapshot(r io.Reader, codec *persistence.Codec) (*pb.SnapshotMeta, io.Reader, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		return nil, nil, errors.New("snapshot has an unknown format")
+	}
+	data, err := persistence.ReadFrame(r, codec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	meta := &pb.SnapshotMeta{}
+	if err := proto.Unmarshal(data, meta); err != nil {
+		return nil, nil, fmt.Errorf("corrupt snapshot meta: %v", err)
+	}
+	return meta, &frameReader{r: r, codec: codec}, nil
+}
+
+// openSnapshotFile opens the snapshot at path, a missing file yields a nil meta.
+// The caller closes the returned file.
+func openSnapshotFile(path string, codec *persistence.Codec) (*pb.SnapshotMeta, io.Reader, *os.File, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	meta, data, err := openSnapshot(bufio.NewReader(file), codec)
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+	return meta, data, file, nil
+}
+
+// frameWriter cuts a byte stream into frames
+type frameWriter struct {
+	w     io.Writer
+	codec *persistence.Codec
+	buf   []byte
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.buf = append(f.buf, p...)
+	for len(f.buf) >= chunkSize {
+		if err := f.emit(f.buf[:chunkSize]); err != nil {
+			return 0, err
+		}
+		f.buf = f.buf[chunkSize:]
+	}
+	return len(p), nil
+}
+
+// flush writes whatever is buffered as a last, shorter frame
+func (f *frameWriter) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	err := f.emit(f.buf)
+	f.buf = nil
+	return err
+}
+
+func (f *frameWriter) emit(chunk []byte) error {
+	frame, err := persistence.EncodeFrame(chunk, f.codec)
+	if err != nil {
+		return err
+	}
+	_, err = f.w.Write(frame)
+	return err
+}
+
+// frameReader turns frames back into the byte stream written through a frameWriter
+type frameReader struct {
+	r     io.Reader
+	codec *persistence.Codec
+	buf   []byte
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		data, err := persistence.ReadFrame(f.r, f.codec)
+		if err != nil {
+			return 0, err
+		}
+		f.buf = data
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,312 @@
+package raft
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// The leader keeps one Replicate stream open per follower. Batches are
+// pipelined: up to MaxInflight of them are sent before the first is
+// acknowledged, and the follower answers them in order with the index its
+// log now matches up to. A follower that falls behind fills the window and
+// the leader stops sending to it until acknowledgements free it, the other
+// followers are not held up.
+
+// inflight is a batch sent over a stream but not acknowledged yet
+type inflight struct {
+	prev  uint64 // index the batch follows
+	epoch uint64
+	sent  time.Time
+}
+
+// pipeline is the state of one replication stream, guarded by the node's lock
+type pipeline struct {
+	queue []inflight
+	// epoch changes when the follower rejects a batch, answers to batches
+	// sent before that are stale
+	epoch      uint64
+	probing    bool // only one batch in flight until the follower's log matches
+	broken     bool
+	lastSend   time.Time
+	sentCommit uint64
+	acked      chan struct{}
+}
+
+// replicate keeps one follower up to date for as long as this node leads in
+// term, reopening the stream when it breaks
+func (n *Node) replicate(id int32, term uint64, wake chan struct{}) {
+	defer n.wg.Done()
+	for n.stream(id, term, wake) {
+		select {
+		case <-n.stopCh:
+			return
+		case <-time.After(n.config.HeartbeatInterval):
+		}
+	}
+}
+
+// stream replicates over one Replicate stream until it breaks or this node
+// stops leading. It reports whether replication should go on.
+func (n *Node) stream(id int32, term uint64, wake chan struct{}) bool {
+	n.mu.Lock()
+	addr, alive := n.replicating(id, term)
+	n.mu.Unlock()
+	if !alive {
+		return false
+	}
+
+	client, err := n.transport.client(addr)
+	if err != nil {
+		return true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	stream, err := client.Replicate(ctx)
+	if err != nil {
+		// Unreachable followers are retried after a heartbeat interval
+		return true
+	}
+
+	p := &pipeline{probing: true, acked: make(chan struct{}, 1)}
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		n.receiveAcks(id, term, p, stream)
+	}()
+	defer func() {
+		cancel()
+		<-received
+		n.mu.Lock()
+		// Batches that were never acknowledged are sent again on the next stream
+		for _, batch := range p.queue {
+			if batch.epoch == p.epoch {
+				n.nextIndex[id] = min(n.nextIndex[id], batch.prev+1)
+				break
+			}
+		}
+		n.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		n.mu.Lock()
+		if _, alive := n.replicating(id, term); !alive {
+			n.mu.Unlock()
+			return false
+		}
+		if p.broken {
+			n.mu.Unlock()
+			return true
+		}
+
+		if n.nextIndex[id] <= n.log.BaseIndex() {
+			if len(p.queue) > 0 {
+				// Let the batches in flight settle first
+				n.mu.Unlock()
+				if !n.waitForAck(p, wake, ticker) {
+					return false
+				}
+				continue
+			}
+			// The entries the follower needs were compacted away
+			n.mu.Unlock()
+			alive, pending := n.sendSnapshot(id, addr, term)
+			if !alive {
+				return false
+			}
+			if !pending && !n.waitForAck(p, wake, ticker) {
+				return false
+			}
+			continue
+		}
+
+		req := n.nextBatch(id, term, p)
+		n.mu.Unlock()
+		if req != nil {
+			if err := stream.Send(req); err != nil {
+				return true
+			}
+			continue
+		}
+		if !n.waitForAck(p, wake, ticker) {
+			return false
+		}
+	}
+}
+
+// replicating returns the address of a follower this node still replicates
+// to in term, closing its replicator once it left the cluster. Callers must
+// hold the lock.
+func (n *Node) replicating(id int32, term uint64) (string, bool) {
+	addr, member := n.members[id]
+	if !member && n.role == Leader {
+		// A removed member gets the entry removing it, or it would keep
+		// starting elections with the old voters
+		if addr, member = n.departing[id]; member && n.matchIndex[id] >= n.configIndex {
+			delete(n.departing, id)
+			member = false
+		}
+	}
+	if n.stopped || n.role != Leader || n.term != term || !member {
+		if ch, ok := n.replicators[id]; ok && !member {
+			delete(n.replicators, id)
+			close(ch)
+		}
+		return "", false
+	}
+	return addr, true
+}
+
+// nextBatch returns the next request for a follower, or nil when there is
+// nothing to send or the window is full. Callers must hold the lock.
+func (n *Node) nextBatch(id int32, term uint64, p *pipeline) *pb.AppendEntriesRequest {
+	window := n.config.MaxInflight
+	if p.probing {
+		window = 1
+	}
+	if len(p.queue) >= window {
+		return nil
+	}
+	pending := n.nextIndex[id] <= n.log.LastIndex()
+	// A linearizable read waiting for confirmation makes the heartbeat due now
+	heartbeat := time.Since(p.lastSend) >= n.config.HeartbeatInterval || p.lastSend.Before(n.confirmAfter)
+	if !pending && !heartbeat && p.sentCommit == n.commitIndex {
+		return nil
+	}
+
+	prev := n.nextIndex[id] - 1
+	req := &pb.AppendEntriesRequest{
+		Term:         term,
+		LeaderId:     n.config.ID,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.log.Term(prev),
+		Entries:      n.log.Entries(prev+1, maxBatch),
+		LeaderCommit: n.commitIndex,
+	}
+	// Later batches follow this one without waiting for its answer
+	n.nextIndex[id] = prev + uint64(len(req.Entries)) + 1
+	p.lastSend = time.Now()
+	p.queue = append(p.queue, inflight{prev: prev, epoch: p.epoch, sent: p.lastSend})
+	p.sentCommit = n.commitIndex
+	return req
+}
+
+// waitForAck blocks until there may be something to send, it reports false
+// once the node stops
+func (n *Node) waitForAck(p *pipeline, wake chan struct{}, ticker *time.Ticker) bool {
+	select {
+	case <-n.stopCh:
+		return false
+	case <-wake:
+	case <-p.acked:
+	case <-ticker.C:
+	}
+	return true
+}
+
+// receiveAcks handles the follower's answers, one per batch and in order
+func (n *Node) receiveAcks(id int32, term uint64, p *pipeline, stream pb.ElectionService_ReplicateClient) {
+	defer func() {
+		n.mu.Lock()
+		p.broken = true
+		n.mu.Unlock()
+		notify(p.acked)
+	}()
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return
+		}
+
+		n.mu.Lock()
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+		}
+		if n.role != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		n.recordApplied(id, resp.AppliedIndex)
+		if resp.Progress {
+			n.mu.Unlock()
+			continue
+		}
+		if len(p.queue) == 0 {
+			n.mu.Unlock()
+			return
+		}
+		batch := p.queue[0]
+		p.queue = p.queue[1:]
+		// Any answer in this term shows the follower still follows this node
+		if batch.sent.After(n.lastAck[id]) {
+			n.lastAck[id] = batch.sent
+			n.broadcastProgress()
+		}
+		if batch.epoch == p.epoch {
+			if resp.Success {
+				p.probing = false
+				n.matchIndex[id] = max(n.matchIndex[id], resp.LastIndex)
+				n.advanceCommit()
+			} else {
+				// Back off to where the follower's log may still match
+				p.epoch++
+				p.probing = true
+				n.nextIndex[id] = max(min(batch.prev, resp.LastIndex+1), 1)
+			}
+		}
+		n.mu.Unlock()
+		notify(p.acked)
+	}
+}
+
+// handleReplicate answers the batches of a Replicate stream in order and
+// reports progress in between
+func (n *Node) handleReplicate(stream pb.ElectionService_ReplicateServer) error {
+	var sendMu sync.Mutex
+	send := func(resp *pb.AppendEntriesResponse) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(resp)
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		n.reportProgress(ctx, send)
+	}()
+	defer func() {
+		cancel()
+		<-reported
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := send(n.handleAppendEntries(req)); err != nil {
+			return err
+		}
+	}
+}
+
+// notify wakes whoever waits on ch without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
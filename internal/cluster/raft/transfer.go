@@ -0,0 +1,408 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// Snapshots reach followers in two steps. The leader calls InstallSnapshot
+// with the snapshot's meta, the follower then pulls the data with
+// StreamSnapshot in checksummed chunks, followed by the log entries after
+// the snapshot. Received bytes are kept in a partial file, so a broken
+// transfer resumes where it stopped on the leader's next attempt.
+
+// crcTable checksums every chunk
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// transfer is the latest snapshot prepared for sending: the state machine
+// data framed without encryption, in a file so that every transfer, and
+// every resumed one, streams the same bytes
+type transfer struct {
+	meta     *pb.SnapshotMeta
+	path     string
+	size     uint64
+	checksum []byte
+}
+
+// prepareTransfer returns the transfer form of the latest snapshot, building it on first use
+func (n *Node) prepareTransfer() (*transfer, error) {
+	n.xferMu.Lock()
+	defer n.xferMu.Unlock()
+
+	meta, data, file, err := openSnapshotFile(n.snapshotPath(), n.config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, errors.New("no snapshot to send")
+	}
+	defer file.Close()
+	if n.xfer != nil && n.xfer.meta.Index == meta.Index && n.xfer.meta.Term == meta.Term {
+		return n.xfer, nil
+	}
+
+	// Streams of an older snapshot keep reading the file they opened
+	path := filepath.Join(n.config.Dir, fmt.Sprintf("raft.snapshot.%d-%d.send", meta.Index, meta.Term))
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(out, hash))
+	// Followers may use other keys, so transfers are compressed but never encrypted
+	chunks := &frameWriter{w: buffered, codec: n.config.Codec.WithoutKeys()}
+	_, err = io.Copy(chunks, data)
+	if err == nil {
+		err = chunks.flush()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	out.Close()
+	info, statErr := os.Stat(path)
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to prepare snapshot for sending: %w", err)
+	}
+
+	removeFiles(n.config.Dir, "raft.snapshot.*.send", path)
+	n.xfer = &transfer{meta: meta, path: path, size: uint64(info.Size()), checksum: hash.Sum(nil)}
+	return n.xfer, nil
+}
+
+// sendSnapshot asks a follower the log cannot catch up anymore to fetch the
+// latest snapshot. It reports whether replication should go on and whether
+// entries are still waiting to be sent.
+func (n *Node) sendSnapshot(id int32, addr string, term uint64) (bool, bool) {
+	xfer, err := n.prepareTransfer()
+	if err != nil {
+		n.logger.Error(fmt.Sprintf("Cannot send a snapshot to node %d: %v", id, err))
+		return true, false
+	}
+
+	req := &pb.InstallSnapshotRequest{Term: term, LeaderId: n.config.ID, Meta: xfer.meta, LeaderAddress: n.config.Address}
+	sent := time.Now()
+	resp, err := n.installSnapshot(addr, req)
+	if err != nil {
+		return true, false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false, false
+	}
+	if n.role != Leader || n.term != term {
+		return false, false
+	}
+	// A follower busy installing still follows this node
+	if sent.After(n.lastAck[id]) {
+		n.lastAck[id] = sent
+	}
+	if resp.Installing {
+		return true, false
+	}
+	// Everything up to the snapshot is committed, the rest is checked by AppendEntries
+	n.matchIndex[id] = max(n.matchIndex[id], xfer.meta.Index)
+	n.nextIndex[id] = max(resp.LastIndex, xfer.meta.Index) + 1
+	n.advanceCommit()
+	return true, n.nextIndex[id] <= n.log.LastIndex()
+}
+
+// installSnapshot calls InstallSnapshot on one peer
+func (n *Node) installSnapshot(addr string, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	client, err := n.transport.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+	defer cancel()
+	return client.InstallSnapshot(ctx, req)
+}
+
+// handleStreamSnapshot streams the latest snapshot from offset, then the log after it
+func (n *Node) handleStreamSnapshot(req *pb.SnapshotStreamRequest, stream pb.ElectionService_StreamSnapshotServer) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	term := n.term
+	n.mu.Unlock()
+
+	xfer, err := n.prepareTransfer()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(xfer.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Bytes of another snapshot are useless, start over
+	offset := req.Offset
+	if req.Index != xfer.meta.Index || req.Term != xfer.meta.Term || offset > xfer.size {
+		offset = 0
+	}
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	if offset > 0 {
+		n.logger.Info(fmt.Sprintf("Resuming snapshot transfer to node %d at byte %d of %d", req.NodeId, offset, xfer.size))
+	}
+
+	chunk := func(c *pb.SnapshotChunk) *pb.SnapshotChunk {
+		c.Term, c.Meta, c.Size, c.Checksum = term, xfer.meta, xfer.size, xfer.checksum
+		return c
+	}
+	reader := bufio.NewReader(file)
+	for offset < xfer.size {
+		data := make([]byte, min(chunkSize, xfer.size-offset))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		if err := stream.Send(chunk(&pb.SnapshotChunk{Offset: offset, Data: data, Crc: crc32.Checksum(data, crcTable)})); err != nil {
+			return err
+		}
+		offset += uint64(len(data))
+	}
+
+	// The log tail saves the follower a round of AppendEntries calls. It
+	// stops at the entries the log held when the data was sent, under
+	// steady writes AppendEntries brings the rest.
+	n.mu.Lock()
+	next, end := xfer.meta.Index+1, n.log.LastIndex()
+	n.mu.Unlock()
+	for {
+		n.mu.Lock()
+		if n.role != Leader || n.term != term {
+			n.mu.Unlock()
+			return ErrLeadershipLost
+		}
+		var entries []*pb.Entry
+		if next <= end {
+			entries = n.log.Entries(next, int(min(maxBatch, end-next+1)))
+		}
+		commit := n.commitIndex
+		n.mu.Unlock()
+
+		if err := stream.Send(chunk(&pb.SnapshotChunk{Offset: offset, Entries: entries, LeaderCommit: commit})); err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		next = entries[len(entries)-1].Index + 1
+	}
+}
+
+// handleInstallSnapshot starts, or reports on, fetching a snapshot from the leader
+func (n *Node) handleInstallSnapshot(req *pb.InstallSnapshotRequest) *pb.InstallSnapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &pb.InstallSnapshotResponse{Term: n.term}
+	if n.stopped || req.Term < n.term || req.Meta == nil {
+		return resp
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.stepDown(req.Term)
+	}
+	n.heardFromLeader(req.LeaderId)
+	resp.Term = n.term
+
+	if req.Meta.Index <= n.lastApplied {
+		resp.LastIndex = n.log.LastIndex()
+		return resp
+	}
+	resp.Installing = true
+	if !n.installing {
+		n.installing = true
+		n.wg.Add(1)
+		go n.fetchSnapshot(req.LeaderAddress, req.LeaderId, req.Meta)
+	}
+	return resp
+}
+
+// fetchSnapshot runs one transfer attempt
+func (n *Node) fetchSnapshot(addr string, leaderID int32, meta *pb.SnapshotMeta) {
+	defer n.wg.Done()
+	n.logger.Info(fmt.Sprintf("Fetching snapshot at index %d from node %d", meta.Index, leaderID))
+	err := n.downloadSnapshot(addr, leaderID, meta)
+
+	n.mu.Lock()
+	n.installing = false
+	n.mu.Unlock()
+	if err != nil {
+		n.logger.Warn("Snapshot transfer stopped, the next attempt resumes it: " + err.Error())
+	}
+}
+
+// downloadSnapshot receives the snapshot into a partial file, verifies it and installs it
+func (n *Node) downloadSnapshot(addr string, leaderID int32, meta *pb.SnapshotMeta) error {
+	partial := filepath.Join(n.config.Dir, fmt.Sprintf("raft.snapshot.%d-%d.partial", meta.Index, meta.Term))
+	removeFiles(n.config.Dir, "raft.snapshot.*.partial", partial)
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := uint64(info.Size())
+
+	client, err := n.transport.client(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	stream, err := client.StreamSnapshot(ctx, &pb.SnapshotStreamRequest{NodeId: n.config.ID, Index: meta.Index, Term: meta.Term, Offset: offset})
+	if err != nil {
+		return err
+	}
+
+	var last *pb.SnapshotChunk
+	var tail []*pb.Entry
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// What was written so far stays for the next attempt
+			file.Sync()
+			return err
+		}
+		if chunk.Meta.GetIndex() != meta.Index || chunk.Meta.GetTerm() != meta.Term {
+			os.Remove(partial)
+			return fmt.Errorf("leader moved on to the snapshot at index %d", chunk.Meta.GetIndex())
+		}
+		if len(chunk.Data) > 0 {
+			if chunk.Offset != offset {
+				if chunk.Offset != 0 {
+					return fmt.Errorf("expected snapshot data at byte %d, got %d", offset, chunk.Offset)
+				}
+				// The leader started over
+				if err := file.Truncate(0); err != nil {
+					return err
+				}
+				offset = 0
+			}
+			if crc32.Checksum(chunk.Data, crcTable) != chunk.Crc {
+				return fmt.Errorf("snapshot chunk at byte %d is corrupt", chunk.Offset)
+			}
+			if _, err := file.WriteAt(chunk.Data, int64(offset)); err != nil {
+				return err
+			}
+			offset += uint64(len(chunk.Data))
+		}
+		tail = append(tail, chunk.Entries...)
+		last = chunk
+	}
+	if last == nil || offset != last.Size {
+		return fmt.Errorf("snapshot transfer ended after %d bytes", offset)
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, int64(offset))); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), last.Checksum) {
+		os.Remove(partial)
+		return errors.New("snapshot checksum mismatch, starting over")
+	}
+
+	if err := n.installFetched(file, meta); err != nil {
+		return err
+	}
+	os.Remove(partial)
+
+	// Entries after the snapshot go through the usual consistency checks
+	n.handleAppendEntries(&pb.AppendEntriesRequest{
+		Term:         last.Term,
+		LeaderId:     leaderID,
+		PrevLogIndex: meta.Index,
+		PrevLogTerm:  meta.Term,
+		Entries:      tail,
+		LeaderCommit: last.LeaderCommit,
+	})
+	return nil
+}
+
+// installFetched swaps in a verified snapshot: it becomes this node's
+// snapshot, replaces the state machine and the log up to it
+func (n *Node) installFetched(data io.ReaderAt, meta *pb.SnapshotMeta) error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	stale := n.stopped || meta.Index <= n.lastApplied
+	n.mu.Unlock()
+	if stale {
+		return nil
+	}
+
+	// Stored with this node's own keys, replacing the old snapshot in one rename
+	err := writeSnapshotFile(n.snapshotPath(), n.config.Codec, meta, func(w io.Writer) error {
+		_, err := io.Copy(w, &frameReader{r: bufio.NewReader(io.NewSectionReader(data, 0, 1<<62))})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := n.restoreLocalSnapshot(); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.compactLog(meta.Index, meta.Term, meta.Configuration); err != nil {
+		return err
+	}
+	n.lastApplied = meta.Index
+	n.commitIndex = max(n.commitIndex, meta.Index)
+	n.advanceFreshness()
+	n.broadcastProgress()
+	n.resetElectionTimer()
+	n.logger.Info(fmt.Sprintf("Installed snapshot at index %d", meta.Index))
+	return nil
+}
+
+// removeFiles deletes the files in dir matching pattern, except keep
+func removeFiles(dir, pattern, keep string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+	for _, match := range matches {
+		if match != keep {
+			os.Remove(match)
+		}
+	}
+}
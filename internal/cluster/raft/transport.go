@@ -0,0 +1,36 @@
+package raft
+
+import (
+	"github.com/vskvj3/geomys/internal/cluster/pool"
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// transport reaches peers through a connection pool, shared with the other
+// cluster services or owned by the node when none was given
+type transport struct {
+	pool  *pool.Pool
+	owned bool
+}
+
+func newTransport(shared *pool.Pool) *transport {
+	if shared != nil {
+		return &transport{pool: shared}
+	}
+	return &transport{pool: pool.New(nil), owned: true}
+}
+
+// client returns an ElectionService client for addr
+func (t *transport) client(addr string) (pb.ElectionServiceClient, error) {
+	conn, err := t.pool.Conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	return pb.NewElectionServiceClient(conn), nil
+}
+
+// close closes the pool if the node owns it
+func (t *transport) close() {
+	if t.owned {
+		t.pool.Close()
+	}
+}
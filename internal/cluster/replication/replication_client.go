@@ -2,16 +2,11 @@ package replication
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"strings"
 	"time"
 
+	"github.com/vskvj3/geomys/internal/cluster/pool"
 	"github.com/vskvj3/geomys/internal/cluster/proto"
-	"github.com/vskvj3/geomys/internal/core"
-	"github.com/vskvj3/geomys/internal/utils"
-
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 // ReplicationClient enables followers to communicate with the leader
@@ -19,9 +14,9 @@ type ReplicationClient struct {
 	client proto.ReplicationServiceClient
 }
 
-// NewReplicationClient initializes a gRPC client connection
-func NewReplicationClient(leaderAddress string) (*ReplicationClient, error) {
-	conn, err := grpc.NewClient(leaderAddress, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+// NewReplicationClient returns a client for the leader using a pooled connection
+func NewReplicationClient(conns *pool.Pool, leaderAddress string) (*ReplicationClient, error) {
+	conn, err := conns.Conn(leaderAddress)
 	if err != nil {
 		return nil, err
 	}
@@ -31,92 +26,27 @@ func NewReplicationClient(leaderAddress string) (*ReplicationClient, error) {
 	}, nil
 }
 
-// Forward a write request from follower to leader
-func (c *ReplicationClient) ForwardRequest(node_id int32, command *proto.Command) (*proto.CommandResponse, error) {
+// Forward a write request from follower to leader, term is the follower's
+func (c *ReplicationClient) ForwardRequest(node_id int32, term uint64, command *proto.Command) (*proto.CommandResponse, error) {
 	req := &proto.CommandRequest{
 		NodeId:  node_id,
 		Command: command,
+		Term:    term,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	resp, err := c.client.ForwardRequest(ctx, req)
-	if err != nil {
-		return nil, err
-	}
-
-	return resp, nil
-}
-
-func (c *ReplicationClient) ReplicateRequest(command *proto.Command) (*proto.ReplicationAck, error) {
-	if command == nil || command.Command == "" {
-		return nil, fmt.Errorf("invalid or missing 'command' field in ReplicateRequest")
+	// Waiting for a write concern or WAIT adds to the time the leader needs,
+	// a WAIT without timeout blocks until it is satisfied
+	ctx := context.Background()
+	if strings.ToUpper(command.Command) != "WAIT" || command.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 5*time.Second+time.Duration(command.Timeout)*time.Millisecond)
+		defer cancel()
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	fmt.Printf("Sending ReplicateRequest: %+v\n", command) // Print command details
-
-	resp, err := c.client.ReplicateRequest(ctx, command)
+	resp, err := c.client.ForwardRequest(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
 	return resp, nil
 }
-
-// Helper function to replicate writes to all followers
-func ReplicateToFollowers(command *proto.Command, server *ReplicationServer) error {
-	logger := utils.GetLogger()
-	for _, followerAddr := range server.Cluster.GetNodes() {
-		client, err := NewReplicationClient(followerAddr)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Error connecting to follower %s: %v", followerAddr, err))
-			continue
-		}
-
-		_, err = client.ReplicateRequest(command)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Error replicating to follower %s: %v", followerAddr, err))
-		} else {
-			logger.Info("Replication success")
-		}
-	}
-	return nil
-}
-
-// SyncRequest is called when a follower restarts to get the latest data
-func (c *ReplicationClient) SyncRequest(commandHandler *core.CommandHandler) error {
-	req := &proto.SyncRequestMessage{}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	resp, err := c.client.SyncRequest(ctx, req)
-	if err != nil {
-		return err
-	}
-
-	// Process each received command
-	for _, command := range resp.Commands {
-		// Convert received gRPC Command into a map
-		cmdMap := map[string]interface{}{
-			"command": command.Command,
-			"key":     command.Key,
-			"value":   command.Value,
-			"offset":  command.Offset, // Convert int32 to int
-		}
-
-		// Execute command in database
-		_, err := commandHandler.HandleCommand(cmdMap)
-		if err != nil {
-			log.Printf("Error applying command during sync: %v", err)
-		} else {
-			log.Printf("Successfully applied command during sync: %+v", cmdMap)
-		}
-	}
-
-	return nil
-}
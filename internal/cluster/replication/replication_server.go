@@ -2,28 +2,31 @@ package replication
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/vskvj3/geomys/internal/cluster/proto"
 	"github.com/vskvj3/geomys/internal/core"
-	"github.com/vskvj3/geomys/internal/persistence"
 	"github.com/vskvj3/geomys/internal/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // interface to implement clusterServer functions
 type ClusterInterface interface {
 	GetNodeID() int32
 	GetLeaderID() int32
-	SetLeaderID(id int32)
 	GetLeaderAddress() string
-	SetLeaderAddress(addr string)
 	GetNodes() map[int32]string
-	GetPort() int32
-	AddNode(nodeID int32, addr string)
-	SetNodes(map[int32]string)
+	GetConfig() *utils.Config
+	GetLogger() *utils.Logger
+	Fence(term uint64) error
+	Route(key string, write, asking bool, exists func() bool) (string, func())
 }
 
-// ReplicationServer handles leader-follower replication
+// ReplicationServer takes writes forwarded by followers, replication
+// itself happens in the raft log
 type ReplicationServer struct {
 	proto.UnimplementedReplicationServiceServer
 	Cluster        ClusterInterface
@@ -37,10 +40,32 @@ func NewReplicationServer(server ClusterInterface, handler *core.CommandHandler)
 	}
 }
 func (s *ReplicationServer) ForwardRequest(ctx context.Context, command *proto.CommandRequest) (*proto.CommandResponse, error) {
-	logger := utils.GetLogger()
-	logger.Debug("Recieved forward request")
-	fmt.Println(command)
+	logger := s.Cluster.GetLogger()
+	logger.Debug("Received forwarded " + command.Command.GetCommand() + " request")
+	// A follower in a newer term no longer follows this node
+	if err := s.Cluster.Fence(command.Term); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	// Followers send the request as the client sent it, older ones only the command fields
 	requestMap := utils.ConvertCommandToRequest(command.Command)
+	if len(command.Command.Request) > 0 {
+		decoded, err := utils.DecodeRequest(command.Command.Request)
+		if err != nil {
+			return nil, err
+		}
+		requestMap = decoded
+	}
+
+	// The follower routed the write on data that may lag behind, a slot
+	// migration only waits for the requests running here
+	if key := command.Command.Key; key != "" {
+		exists := func() bool { return s.CommandHandler.Database.Exists(key) }
+		redirect, release := s.Cluster.Route(key, true, command.Command.Asking, exists)
+		if redirect != "" {
+			return nil, errors.New(redirect)
+		}
+		defer release()
+	}
 
 	// copy the request into database
 	response, err := s.CommandHandler.HandleCommand(requestMap)
@@ -57,52 +82,17 @@ func (s *ReplicationServer) ForwardRequest(ctx context.Context, command *proto.C
 	if val, ok := response["value"].(string); ok {
 		protoResponse.Value = val
 	}
-
-	// replicate the request to followers
-	ReplicateToFollowers(command.Command, s)
-
-	// Return the final response
-	return &protoResponse, nil
-}
-
-// ReplicateRequest is called by the leader to sync a command to followers
-func (s *ReplicationServer) ReplicateRequest(ctx context.Context, command *proto.Command) (*proto.ReplicationAck, error) {
-
-	// Convert gRPC request into a map
-	requestMap := utils.ConvertCommandToRequest(command)
-
-	// Execute the command using commandHandler
-	_, err := s.CommandHandler.HandleCommand(requestMap)
-	if err != nil {
-		return nil, err
+	if count, ok := response["value"].(int); ok && strings.ToUpper(command.Command.Command) == "WAIT" {
+		protoResponse.Value = strconv.Itoa(count)
 	}
-
-	return &proto.ReplicationAck{Success: true}, nil
-}
-
-// SyncRequest is called when a follower restarts and wants the latest data
-func (s *ReplicationServer) SyncRequest(ctx context.Context, req *proto.SyncRequestMessage) (*proto.SyncResponse, error) {
-	// Load requests from persistence
-	p, err := persistence.CreateOrReplacePersistence()
-	if err != nil {
-		return nil, err
+	if index, ok := response["index"].(uint64); ok {
+		protoResponse.Index = index
 	}
-	requests, err := p.LoadRequests()
-	if err != nil {
+	// The full response keeps integer values, such as INCR's, as integers
+	if protoResponse.Response, err = utils.EncodeResponse(response); err != nil {
 		return nil, err
 	}
 
-	// Convert loaded requests to []*proto.Command
-	var commands []*proto.Command
-	for _, req := range requests {
-		command, err := utils.ConvertRequestToCommand(req)
-		if err != nil {
-			utils.GetLogger().Error("Reuest conversion failed: " + err.Error())
-		}
-
-		commands = append(commands, command)
-	}
-
-	// Return response
-	return &proto.SyncResponse{Commands: commands}, nil
+	// Return the final response
+	return &protoResponse, nil
 }
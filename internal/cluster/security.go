@@ -0,0 +1,190 @@
+package cluster
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/security"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// With cluster_tls set, nodes talk over mutual TLS: each side presents a
+// certificate the cluster's CA signed. Node certificates carry the node id
+// as their subject (CN=node-<id>), and a request naming a node, a vote or a
+// join for example, is refused unless it came with that node's
+// certificate. Only node certificates reach the services nodes call each
+// other on, the AdminService also takes operator certificates
+// (CN=operator or CN=operator-<name>).
+//
+// With a cluster token set, every call to any of the services must carry
+// it, on top of TLS or without it. Calls are checked for the token first.
+
+// serverOptions returns the options of the gRPC server, TLS, the token and
+// the sender checks when enabled
+func (s *ClusterServer) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if s.tokens.Enabled() {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := s.tokens.Check(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := s.tokens.Check(stream.Context()); err != nil {
+					return err
+				}
+				return handler(srv, stream)
+			}))
+	}
+	if s.tls.Enabled() {
+		opts = append(opts,
+			grpc.Creds(credentials.NewTLS(s.tls.ServerConfig(nil))),
+			grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := checkService(ctx, info.FullMethod); err != nil {
+					return nil, err
+				}
+				if err := checkSender(ctx, req); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := checkService(stream.Context(), info.FullMethod); err != nil {
+					return err
+				}
+				return handler(srv, checkedStream{stream})
+			}))
+	}
+	return opts
+}
+
+// loadTokens reads the cluster token before the gRPC port opens
+func (s *ClusterServer) loadTokens() error {
+	if !s.tokens.Enabled() {
+		if len(s.Config.ClusterPreviousTokenFiles) > 0 {
+			return errors.New("previous cluster tokens are configured without a current token")
+		}
+		return nil
+	}
+	return s.tokens.Reload()
+}
+
+// ReloadTokens rereads the cluster tokens, calls from then on are checked against them
+func (s *ClusterServer) ReloadTokens() error {
+	if !s.tokens.Enabled() {
+		return nil
+	}
+	return s.tokens.Reload()
+}
+
+// loadTLS reads the certificates before the gRPC port opens
+func (s *ClusterServer) loadTLS() error {
+	if !s.tls.Enabled() {
+		return nil
+	}
+	if s.Config.ClusterTLS.CAFile == "" {
+		return errors.New("cluster_tls needs a ca_file to verify the other nodes")
+	}
+	return s.tls.Reload()
+}
+
+// ReloadTLS rereads the certificates of the cluster port, new connections use them
+func (s *ClusterServer) ReloadTLS() error {
+	if !s.tls.Enabled() {
+		return nil
+	}
+	return s.tls.Reload()
+}
+
+// checkedStream checks the sender of every message received on a stream
+type checkedStream struct {
+	grpc.ServerStream
+}
+
+func (s checkedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return checkSender(s.Context(), m)
+}
+
+// senderID returns the node a request says it comes from
+func senderID(req interface{}) (int32, bool) {
+	switch req := req.(type) {
+	case *pb.VoteRequest:
+		return req.NodeId, true
+	case *pb.AppendEntriesRequest:
+		return req.LeaderId, true
+	case *pb.InstallSnapshotRequest:
+		return req.LeaderId, true
+	case *pb.SnapshotStreamRequest:
+		return req.NodeId, true
+	case *pb.ReadIndexRequest:
+		return req.NodeId, true
+	case *pb.TimeoutNowRequest:
+		return req.LeaderId, true
+	case *pb.JoinRequest:
+		return req.NodeId, true
+	case *pb.CommandRequest:
+		return req.NodeId, true
+	case *pb.PublishRequest:
+		return req.NodeId, true
+	}
+	return 0, false
+}
+
+// checkService refuses certificates the called service does not take:
+// node certificates only, or for the AdminService operator certificates too
+func checkService(ctx context.Context, method string) error {
+	cert, err := peerCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	check := security.RequireNode
+	if strings.HasPrefix(method, "/"+pb.AdminService_ServiceDesc.ServiceName+"/") {
+		check = security.RequireNodeOrOperator
+	}
+	if err := check(cert); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// checkSender refuses a request naming another node than the one the
+// client certificate was issued to
+func checkSender(ctx context.Context, req interface{}) error {
+	id, ok := senderID(req)
+	if !ok {
+		return nil
+	}
+	cert, err := peerCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	if certID, ok := security.NodeID(cert); !ok || certID != id {
+		return status.Errorf(codes.PermissionDenied, "the certificate of %q does not belong to node %d", cert.Subject.CommonName, id)
+	}
+	return nil
+}
+
+// peerCertificate returns the client certificate a call came with
+func peerCertificate(ctx context.Context) (*x509.Certificate, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "unknown peer")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil, status.Error(codes.PermissionDenied, "no client certificate")
+	}
+	return info.State.PeerCertificates[0], nil
+}
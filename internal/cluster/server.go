@@ -4,133 +4,315 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/vskvj3/geomys/internal/cluster/pool"
 	pb "github.com/vskvj3/geomys/internal/cluster/proto"
-
-	"github.com/vskvj3/geomys/internal/cluster/election"
+	"github.com/vskvj3/geomys/internal/cluster/raft"
 	"github.com/vskvj3/geomys/internal/cluster/replication"
+	"github.com/vskvj3/geomys/internal/cluster/shard"
 	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"github.com/vskvj3/geomys/internal/pubsub"
+	"github.com/vskvj3/geomys/internal/security"
 	"github.com/vskvj3/geomys/internal/utils"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-// ClusterServer manages election and replication services
+// joinTimeout bounds how long a node keeps trying to join a cluster
+const joinTimeout = time.Minute
+
+// ClusterServer runs the raft node and the gRPC services of a cluster member
 type ClusterServer struct {
-	NodeID        int32
-	LeaderID      int32
-	LeaderAddress string
-	Port          int32
-	Nodes         map[int32]string
-	mu            sync.Mutex
-
-	ElectionService    *election.ElectionServer
+	NodeID int32
+	Port   int32
+	Config *utils.Config
+	Logger *utils.Logger
+
+	Raft               *raft.Node
 	ReplicationService *replication.ReplicationServer
+	Pool               *pool.Pool      // connections to the other members, shared by all services
+	Shards             *shard.Topology // nodes of every group and the slots they serve
+	PubSub             *pubsub.Hub     // subscribers connected to this node
+
+	handler    *core.CommandHandler
+	identity   *Identity          // as saved by the previous run, nil for a new node
+	identityMu sync.Mutex         // serializes saving the identity
+	tls        *security.Reloader // certificates of the gRPC port and of calls to other nodes
+	tokens     *security.Tokens   // shared secret of calls between nodes
+	listener   net.Listener
+	grpcServer *grpc.Server
+	gossipNow  chan struct{}
+	stopCh     chan struct{}
+	// slotLocks are held for reading by requests on a slot and for writing
+	// while keys of the slot move to another group
+	slotLocks [shard.SlotCount]sync.RWMutex
 }
 
-// NewClusterServer initializes the cluster server with election and replication services
-func NewClusterServer(nodeID int32, port int32) *ClusterServer {
-	cluster := &ClusterServer{
+// NewClusterServer initializes the cluster server for a node
+func NewClusterServer(config *utils.Config, logger *utils.Logger, nodeID int32, port int32) *ClusterServer {
+	// Nodes always check each other's certificates
+	tlsConfig := config.ClusterTLS
+	tlsConfig.ClientAuth = "require"
+	reloader := security.NewReloader(tlsConfig)
+	var creds credentials.TransportCredentials
+	if reloader.Enabled() {
+		creds = credentials.NewTLS(reloader.ClientConfig(security.RequireNode))
+	}
+	tokens := security.NewTokens(config.ClusterTokenFile, config.ClusterTokenEnv, config.ClusterPreviousTokenFiles)
+	var opts []grpc.DialOption
+	if tokens.Enabled() {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokens))
+	}
+
+	return &ClusterServer{
 		NodeID: nodeID,
 		Port:   port,
-		Nodes:  make(map[int32]string),
-	}
+		Config: config,
+		Logger: logger,
+		Pool:   pool.New(creds, opts...),
+		Shards: shard.NewTopology(),
+		PubSub: pubsub.NewHub(),
+		tls:    reloader,
+		tokens: tokens,
 
-	return cluster
+		gossipNow: make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+	}
 }
 
-// StartServer initializes and starts the gRPC server
-func (s *ClusterServer) StartServer(handler *core.CommandHandler) {
-	logger := utils.GetLogger()
+// Listen binds the gRPC port, port 0 picks a free one
+func (s *ClusterServer) Listen() error {
+	if err := s.loadTLS(); err != nil {
+		return err
+	}
+	if err := s.loadTokens(); err != nil {
+		return err
+	}
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
 	if err != nil {
-		logger.Error("Failed to start server: " + err.Error())
-		return
+		return err
+	}
+	s.listener = lis
+	s.Port = int32(lis.Addr().(*net.TCPAddr).Port)
+	return nil
+}
+
+// Addr returns the address the gRPC server is listening on
+func (s *ClusterServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// StartServer starts the raft node on top of handler and serves the gRPC
+// services. With bootstrap set, a node without a log starts a new cluster.
+// The database must already be rebuilt from persistence.
+func (s *ClusterServer) StartServer(handler *core.CommandHandler, bootstrap bool) error {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+	}
+
+	// A data directory belongs to one node of one cluster
+	dir := s.Config.GetDataDir()
+	identity, err := LoadIdentity(dir)
+	if err != nil {
+		return err
+	}
+	var clusterID string
+	if identity != nil {
+		if identity.NodeID != s.NodeID {
+			return fmt.Errorf("data directory %s belongs to node %d, not node %d", dir, identity.NodeID, s.NodeID)
+		}
+		clusterID = identity.ClusterID
+	}
+
+	// A new node of a static peer set bootstraps the cluster with the others
+	peers, err := ParsePeers(s.Config.Peers)
+	if err != nil {
+		return err
+	}
+	var initialVoters map[int32]string
+	if voters := staticVoters(peers); voters[s.NodeID] != "" && identity == nil {
+		initialVoters, bootstrap = voters, true
+		clusterID = staticClusterID(voters)
 	}
 
-	grpcServer := grpc.NewServer()
+	// A group bootstrapped with sharding serves the configured slots from the start
+	var slots []*pb.SlotRange
+	if s.Config.Sharding && bootstrap {
+		if slots, err = shard.ParseRanges(s.Config.ShardSlots, 1); err != nil {
+			return err
+		}
+	}
 
-	// Assign election and replication services
-	s.ElectionService = election.NewElectionServer(s)
+	node, err := raft.NewNode(raft.Config{
+		ID:                s.NodeID,
+		ClusterID:         clusterID,
+		Address:           s.Config.GetAdvertiseAddress(),
+		ClientAddress:     s.Config.GetClientAddress(),
+		Dir:               dir,
+		Codec:             persistence.CodecOf(handler.Persistence),
+		HeartbeatInterval: time.Duration(s.Config.HeartbeatInterval) * time.Millisecond,
+		ElectionTimeout:   time.Duration(s.Config.ElectionTimeout) * time.Millisecond,
+		SnapshotThreshold: uint64(s.Config.SnapshotThreshold),
+		MaxInflight:       s.Config.ReplicationWindow,
+		Pool:              s.Pool,
+		Slots:             slots,
+		InitialVoters:     initialVoters,
+		Logger:            s.Logger,
+	}, handler)
+	if err != nil {
+		return err
+	}
+	if clusterID != "" && node.ClusterID() != clusterID {
+		node.Stop()
+		return fmt.Errorf("data directory %s holds a raft log of cluster %s, but node %d belongs to cluster %s", dir, node.ClusterID(), s.NodeID, clusterID)
+	}
+	s.Raft = node
+	s.identity = identity
+	s.handler = handler
+	handler.Replicator = node
 	s.ReplicationService = replication.NewReplicationServer(s, handler)
 
-	// Register services with gRPC
-	pb.RegisterElectionServiceServer(grpcServer, s.ElectionService)
-	pb.RegisterReplicationServiceServer(grpcServer, s.ReplicationService)
+	s.grpcServer = grpc.NewServer(s.serverOptions()...)
+	pb.RegisterElectionServiceServer(s.grpcServer, &raft.Server{Node: node})
+	pb.RegisterReplicationServiceServer(s.grpcServer, s.ReplicationService)
+	pb.RegisterShardServiceServer(s.grpcServer, &shardServer{cluster: s})
+	pb.RegisterAdminServiceServer(s.grpcServer, &adminServer{cluster: s})
+	pb.RegisterPubSubServiceServer(s.grpcServer, &pubsubServer{cluster: s})
 
-	logger.Info(fmt.Sprintf("Node %d started gRPC server on port %d", s.NodeID, s.Port))
+	s.Logger.Info(fmt.Sprintf("Node %d started gRPC server on port %d", s.NodeID, s.Port))
+	go func() {
+		if err := s.grpcServer.Serve(s.listener); err != nil {
+			s.Logger.Error("gRPC server stopped: " + err.Error())
+		}
+	}()
 
-	// Start the server
-	if err := grpcServer.Serve(lis); err != nil {
-		logger.Error("gRPC server stopped: " + err.Error())
+	if err := node.Start(bootstrap); err != nil {
+		return err
 	}
+	go s.keepIdentity()
+	if s.Config.Sharding {
+		s.Logger.Info(fmt.Sprintf("Node %d serves hash slots in group %d", s.NodeID, s.Config.ShardGroup))
+		go s.gossip()
+	}
+	return nil
+}
+
+// Join asks the cluster at addr, any member of it, to add this node
+func (s *ClusterServer) Join(addr string) error {
+	return s.Raft.Join(addr, false, joinTimeout)
+}
+
+// JoinAsLearner asks the cluster at addr to add this node as a learner,
+// which receives the log without voting until it is promoted
+func (s *ClusterServer) JoinAsLearner(addr string) error {
+	return s.Raft.Join(addr, true, joinTimeout)
+}
+
+// Stop stops serving and halts the raft node
+func (s *ClusterServer) Stop() {
+	select {
+	case <-s.stopCh:
+	default:
+		close(s.stopCh)
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.Raft != nil {
+		s.Raft.Stop()
+		if current := s.currentIdentity(); current.ClusterID != "" {
+			if err := s.saveIdentity(current); err != nil {
+				s.Logger.Error("Failed to save the cluster identity: " + err.Error())
+			}
+		}
+	}
+	s.Pool.Close()
 }
 
 /***************************************************************
 *                  ClusterInterface Methods                    *
 ***************************************************************/
+// Get the configuration of this node
+func (c *ClusterServer) GetConfig() *utils.Config {
+	return c.Config
+}
+
+// Get the logger of this node
+func (c *ClusterServer) GetLogger() *utils.Logger {
+	return c.Logger
+}
+
 // Get node id of current node
 func (c *ClusterServer) GetNodeID() int32 {
 	return c.NodeID
 }
 
-// Change nodes list
-func (c *ClusterServer) GetPort() int32 {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.Port
+// Check whether this node is the leader
+func (c *ClusterServer) IsLeader() bool {
+	return c.Raft != nil && c.Raft.IsLeader()
 }
 
-// Get node id of leader node
-func (c *ClusterServer) GetLeaderID() int32 {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.LeaderID
+// Check whether this node has caught up enough to serve reads
+func (c *ClusterServer) Ready() bool {
+	return c.Raft != nil && c.Raft.Ready()
 }
 
-// Change leader id
-func (c *ClusterServer) SetLeaderID(id int32) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.LeaderID = id
+// Get the current term
+func (c *ClusterServer) Term() uint64 {
+	if c.Raft == nil {
+		return 0
+	}
+	return c.Raft.Term()
 }
 
-// Get leader address
-func (c *ClusterServer) GetLeaderAddress() string {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.LeaderAddress
+// Step down if term, the term of the member sending a request, is newer
+func (c *ClusterServer) Fence(term uint64) error {
+	if c.Raft == nil {
+		return nil
+	}
+	return c.Raft.Fence(term)
 }
 
-// Change leader Address
-func (c *ClusterServer) SetLeaderAddress(addr string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.LeaderAddress = addr
+// Get node id of leader node, -1 if there is none
+func (c *ClusterServer) GetLeaderID() int32 {
+	if c.Raft == nil {
+		return -1
+	}
+	return c.Raft.LeaderID()
 }
 
-// Get Nodes
-func (c *ClusterServer) GetNodes() map[int32]string {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.Nodes
+// Get the gRPC address of the leader, "" if there is none
+func (c *ClusterServer) GetLeaderAddress() string {
+	if c.Raft == nil {
+		return ""
+	}
+	return c.Raft.LeaderAddress()
 }
 
-// Add a new node into node list
-func (c *ClusterServer) AddNode(nodeID int32, addr string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Nodes[nodeID] = addr
+// Get the members of the cluster
+func (c *ClusterServer) GetNodes() map[int32]string {
+	if c.Raft == nil {
+		return map[int32]string{}
+	}
+	return c.Raft.Members()
 }
 
-func (c *ClusterServer) RemodeNode(nodeID int32) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.Nodes, nodeID)
+// Get the address clients reach the leader at, "" if there is none
+func (c *ClusterServer) GetLeaderClientAddress() string {
+	if c.Raft == nil {
+		return ""
+	}
+	return c.Raft.LeaderClientAddress()
 }
 
-// Change nodes list
-func (c *ClusterServer) SetNodes(newNodes map[int32]string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Nodes = newNodes
+// Get the addresses clients reach the members of the cluster at
+func (c *ClusterServer) GetClientAddresses() map[int32]string {
+	if c.Raft == nil {
+		return map[int32]string{}
+	}
+	return c.Raft.Configuration().GetClientAddresses()
 }
@@ -0,0 +1,70 @@
+package shard
+
+import "sort"
+
+// Move is a range of slots to migrate from one group to another
+type Move struct {
+	From, To   int32
+	Start, End uint32
+}
+
+// Plan returns the moves that leave every group in groups with an even
+// share of the slots in slotMap, lower group ids taking the remainder.
+// Groups that serve slots but are not in groups give all of them away.
+// Each group gives away its highest slots, so ranges stay contiguous.
+func Plan(slotMap []SlotRange, groups []int32) []Move {
+	if len(groups) == 0 {
+		return nil
+	}
+	owned := make(map[int32][]uint32)
+	total := 0
+	for _, r := range slotMap {
+		for slot := r.Start; slot <= r.End; slot++ {
+			owned[r.Group] = append(owned[r.Group], slot)
+		}
+		total += int(r.End-r.Start) + 1
+	}
+
+	sorted := append([]int32(nil), groups...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	want := make(map[int32]int)
+	for i, group := range sorted {
+		want[group] = total / len(sorted)
+		if i < total%len(sorted) {
+			want[group]++
+		}
+	}
+
+	// Slots given away, in slot order, and the groups that need them
+	var given []uint32
+	from := make(map[uint32]int32)
+	donors := make([]int32, 0, len(owned))
+	for group := range owned {
+		donors = append(donors, group)
+	}
+	sort.Slice(donors, func(i, j int) bool { return donors[i] < donors[j] })
+	for _, group := range donors {
+		slots := owned[group]
+		if surplus := len(slots) - want[group]; surplus > 0 {
+			for _, slot := range slots[len(slots)-surplus:] {
+				given = append(given, slot)
+				from[slot] = group
+			}
+		}
+	}
+	sort.Slice(given, func(i, j int) bool { return given[i] < given[j] })
+
+	var moves []Move
+	for _, group := range sorted {
+		for need := want[group] - len(owned[group]); need > 0 && len(given) > 0; need-- {
+			slot := given[0]
+			given = given[1:]
+			if last := len(moves) - 1; last >= 0 && moves[last].To == group && moves[last].From == from[slot] && moves[last].End == slot-1 {
+				moves[last].End = slot
+				continue
+			}
+			moves = append(moves, Move{From: from[slot], To: group, Start: slot, End: slot})
+		}
+	}
+	return moves
+}
@@ -0,0 +1,115 @@
+package shard
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+)
+
+// ParseRanges reads slot ranges written as "0-5460,5461,6000-6100". Every
+// range gets epoch.
+func ParseRanges(s string, epoch uint64) ([]*pb.SlotRange, error) {
+	var ranges []*pb.SlotRange
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		start, end, err := ParseRange(part)
+		if err != nil {
+			return nil, err
+		}
+		ranges = Assign(ranges, start, end, epoch)
+	}
+	return ranges, nil
+}
+
+// ParseRange reads one slot or a range of slots written as "start-end"
+func ParseRange(s string) (uint32, uint32, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := parseSlot(first)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := start
+	if isRange {
+		if end, err = parseSlot(last); err != nil {
+			return 0, 0, err
+		}
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("invalid slot range %q", s)
+	}
+	return start, end, nil
+}
+
+// parseSlot reads a slot number
+func parseSlot(s string) (uint32, error) {
+	slot, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+	if err != nil || slot >= SlotCount {
+		return 0, fmt.Errorf("invalid slot %q, slots go from 0 to %d", s, SlotCount-1)
+	}
+	return uint32(slot), nil
+}
+
+// FormatRanges writes ranges the way ParseRanges reads them
+func FormatRanges(ranges []*pb.SlotRange) string {
+	parts := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Start == r.End {
+			parts = append(parts, strconv.Itoa(int(r.Start)))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r.Start, r.End))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Find returns the range holding slot, nil if there is none
+func Find(ranges []*pb.SlotRange, slot uint32) *pb.SlotRange {
+	for _, r := range ranges {
+		if r.Start <= slot && slot <= r.End {
+			return r
+		}
+	}
+	return nil
+}
+
+// Assign returns ranges with the slots from start to end added at epoch
+func Assign(ranges []*pb.SlotRange, start, end uint32, epoch uint64) []*pb.SlotRange {
+	epochs := expand(ranges)
+	for slot := start; slot <= end; slot++ {
+		epochs[slot] = epoch
+	}
+	return compress(epochs)
+}
+
+// Remove returns ranges without the slots from start to end
+func Remove(ranges []*pb.SlotRange, start, end uint32) []*pb.SlotRange {
+	return Assign(ranges, start, end, 0)
+}
+
+// expand returns the epoch of every slot in ranges, 0 for the others
+func expand(ranges []*pb.SlotRange) []uint64 {
+	epochs := make([]uint64, SlotCount)
+	for _, r := range ranges {
+		for slot := r.Start; slot <= r.End && slot < SlotCount; slot++ {
+			epochs[slot] = r.Epoch
+		}
+	}
+	return epochs
+}
+
+// compress turns the epoch of every slot back into ranges
+func compress(epochs []uint64) []*pb.SlotRange {
+	var ranges []*pb.SlotRange
+	for slot := uint32(0); slot < SlotCount; slot++ {
+		if epochs[slot] == 0 {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].End == slot-1 && ranges[last].Epoch == epochs[slot] {
+			ranges[last].End = slot
+			continue
+		}
+		ranges = append(ranges, &pb.SlotRange{Start: slot, End: slot, Epoch: epochs[slot]})
+	}
+	return ranges
+}
@@ -0,0 +1,47 @@
+// Package shard partitions the keyspace into hash slots. Every slot is
+// served by one replication group, a raft cluster with its own leader and
+// followers, and nodes redirect clients to the group that serves a key.
+package shard
+
+import "strings"
+
+// SlotCount is the number of hash slots the keyspace is split into
+const SlotCount = 16384
+
+// Slot returns the hash slot of key. When the key holds a non-empty hash
+// tag, the part between the first { and the next }, only the tag is hashed,
+// so {user}:1 and {user}:2 land in the same slot.
+func Slot(key string) uint32 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return uint32(crc16(key)) % SlotCount
+}
+
+// crc16Table holds CRC-16/XMODEM of every byte value
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 returns the CRC-16/XMODEM checksum of s
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
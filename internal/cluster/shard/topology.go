@@ -0,0 +1,153 @@
+package shard
+
+import (
+	"sort"
+	"sync"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Topology is what a node knows about every node of every group, built
+// from what the nodes tell about themselves. Node ids must be unique
+// across groups.
+type Topology struct {
+	mu     sync.Mutex
+	nodes  map[int32]*pb.NodeInfo
+	owners []owner // by slot, rebuilt whenever a node changes
+}
+
+// owner is the group that claimed a slot with the highest epoch
+type owner struct {
+	group int32
+	epoch uint64
+}
+
+// NewTopology returns a topology that knows no nodes
+func NewTopology() *Topology {
+	return &Topology{nodes: make(map[int32]*pb.NodeInfo), owners: make([]owner, SlotCount)}
+}
+
+// Update records what a node told about itself unless a newer version is
+// known already. It reports whether anything changed.
+func (t *Topology) Update(infos ...*pb.NodeInfo) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := false
+	for _, info := range infos {
+		if known, ok := t.nodes[info.NodeId]; ok && known.Version >= info.Version {
+			continue
+		}
+		t.nodes[info.NodeId] = proto.Clone(info).(*pb.NodeInfo)
+		changed = true
+	}
+	if changed {
+		t.rebuild()
+	}
+	return changed
+}
+
+// rebuild works out the owner of every slot, callers must hold the lock.
+// Ties between groups go to the lower group id so every node agrees.
+func (t *Topology) rebuild() {
+	owners := make([]owner, SlotCount)
+	for _, info := range t.nodes {
+		if info.Configuration == nil {
+			continue
+		}
+		for _, r := range info.Configuration.Slots {
+			for slot := r.Start; slot <= r.End && slot < SlotCount; slot++ {
+				current := owners[slot]
+				if r.Epoch > current.epoch || (r.Epoch == current.epoch && info.GroupId < current.group) {
+					owners[slot] = owner{group: info.GroupId, epoch: r.Epoch}
+				}
+			}
+		}
+	}
+	t.owners = owners
+}
+
+// Nodes returns every known node ordered by id
+func (t *Topology) Nodes() []*pb.NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	nodes := make([]*pb.NodeInfo, 0, len(t.nodes))
+	for _, info := range t.nodes {
+		nodes = append(nodes, info)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].NodeId < nodes[j].NodeId })
+	return nodes
+}
+
+// Owner returns the group that serves slot and the epoch of its claim,
+// false when no group claimed it
+func (t *Topology) Owner(slot uint32) (int32, uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o := t.owners[slot%SlotCount]
+	return o.group, o.epoch, o.epoch > 0
+}
+
+// MaxEpoch returns the highest epoch any group claimed a slot with
+func (t *Topology) MaxEpoch() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var epoch uint64
+	for _, o := range t.owners {
+		epoch = max(epoch, o.epoch)
+	}
+	return epoch
+}
+
+// Members returns the nodes of group, the leader first
+func (t *Topology) Members(group int32) []*pb.NodeInfo {
+	var members []*pb.NodeInfo
+	for _, info := range t.Nodes() {
+		if info.GroupId == group {
+			members = append(members, info)
+		}
+	}
+	// A node that leads in a newer term replaces one that led before
+	sort.SliceStable(members, func(i, j int) bool {
+		if members[i].Leader != members[j].Leader {
+			return members[i].Leader
+		}
+		return members[i].Leader && members[i].Term > members[j].Term
+	})
+	return members
+}
+
+// Address returns the client address of the node to send requests for
+// group to, the leader when one is known, "" when no node of group is known
+func (t *Topology) Address(group int32) string {
+	if members := t.Members(group); len(members) > 0 {
+		return members[0].ClientAddress
+	}
+	return ""
+}
+
+// SlotRange is a range of slots served by one group
+type SlotRange struct {
+	Start, End uint32
+	Group      int32
+}
+
+// Map returns the ranges of slots every group serves, in slot order.
+// Slots no group claimed are left out.
+func (t *Topology) Map() []SlotRange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ranges []SlotRange
+	for slot := uint32(0); slot < SlotCount; slot++ {
+		o := t.owners[slot]
+		if o.epoch == 0 {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].End == slot-1 && ranges[last].Group == o.group {
+			ranges[last].End = slot
+			continue
+		}
+		ranges = append(ranges, SlotRange{Start: slot, End: slot, Group: o.group})
+	}
+	return ranges
+}
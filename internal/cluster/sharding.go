@@ -0,0 +1,282 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+)
+
+// With sharding, every raft cluster is one group serving the hash slots in
+// its configuration. Nodes of all groups tell each other about themselves
+// every gossipInterval, so any node can redirect a client to the group
+// that serves a key.
+
+// gossipInterval is how often a node exchanges what it knows with the others
+const gossipInterval = time.Second
+
+// exchangeTimeout bounds one exchange with another node
+const exchangeTimeout = time.Second
+
+// shardServer answers the exchanges of other nodes
+type shardServer struct {
+	pb.UnimplementedShardServiceServer
+	cluster *ClusterServer
+}
+
+// Exchange merges what the caller knows and answers with what this node knows
+func (s *shardServer) Exchange(ctx context.Context, req *pb.Topology) (*pb.Topology, error) {
+	s.cluster.Shards.Update(req.Nodes...)
+	return &pb.Topology{Nodes: s.cluster.Shards.Nodes()}, nil
+}
+
+// describe returns what this node tells the others about itself
+func (s *ClusterServer) describe() *pb.NodeInfo {
+	// Versioned before reading the configuration, so a description racing
+	// with a slot change never replaces the one announcing it
+	version := time.Now().UnixNano()
+	return &pb.NodeInfo{
+		NodeId:        s.NodeID,
+		GroupId:       int32(s.Config.ShardGroup),
+		Address:       s.Config.GetAdvertiseAddress(),
+		ClientAddress: s.Config.GetClientAddress(),
+		Leader:        s.Raft.IsLeader(),
+		Term:          s.Raft.Term(),
+		Configuration: s.Raft.Configuration(),
+		Version:       version,
+	}
+}
+
+// gossip exchanges topologies with the seeds and every known node until the node stops
+func (s *ClusterServer) gossip() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+	for {
+		s.Shards.Update(s.describe())
+
+		self := s.Config.GetAdvertiseAddress()
+		peers := make(map[string]bool)
+		for _, addr := range s.Config.ShardSeeds {
+			peers[addr] = true
+		}
+		for _, info := range s.Shards.Nodes() {
+			peers[info.Address] = true
+		}
+		delete(peers, self)
+		for addr := range peers {
+			if err := s.exchange(addr); err != nil {
+				s.Logger.Debug(fmt.Sprintf("Topology exchange with %s failed: %v", addr, err))
+			}
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.gossipNow:
+		case <-ticker.C:
+		}
+	}
+}
+
+// exchange sends what this node knows to the node at addr and merges its answer
+func (s *ClusterServer) exchange(addr string) error {
+	conn, err := s.Pool.Conn(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exchangeTimeout)
+	defer cancel()
+	resp, err := pb.NewShardServiceClient(conn).Exchange(ctx, &pb.Topology{Nodes: s.Shards.Nodes()})
+	if err != nil {
+		return err
+	}
+	s.Shards.Update(resp.Nodes...)
+	return nil
+}
+
+// announce tells the other nodes about a change of this group's slots right away
+func (s *ClusterServer) announce() {
+	s.Shards.Update(s.describe())
+	select {
+	case s.gossipNow <- struct{}{}:
+	default:
+	}
+}
+
+// Route returns the redirect for a request on key when this node's group
+// does not serve it, "" when it does. asking is set when the client sent
+// ASKING before the request, exists reports whether the key is stored here.
+//
+// When the group serves the key, the request must run before release is
+// called: a slot migration does not move keys while requests on the slot run.
+func (s *ClusterServer) Route(key string, write, asking bool, exists func() bool) (redirect string, release func()) {
+	if !s.Config.Sharding || s.Raft == nil {
+		return "", func() {}
+	}
+	slot := shard.Slot(key)
+	lock := &s.slotLocks[slot]
+	lock.RLock()
+	if redirect := s.route(slot, write, asking, exists); redirect != "" {
+		lock.RUnlock()
+		return redirect, func() {}
+	}
+	return "", lock.RUnlock
+}
+
+// route works out the redirect for a request on slot, callers hold the slot's lock
+func (s *ClusterServer) route(slot uint32, write, asking bool, exists func() bool) string {
+	config := s.Raft.Configuration()
+	group := int32(s.Config.ShardGroup)
+	owner, epoch, claimed := s.Shards.Owner(slot)
+
+	// A claim with a higher epoch means the slot moved to another group
+	if r := shard.Find(config.Slots, slot); r != nil && (!claimed || owner == group || epoch <= r.Epoch) {
+		// Keys of a slot on its way out that are gone already live at the
+		// target. Only the leader is sure a key is gone, followers forward
+		// writes to it.
+		if target, ok := config.Migrating[slot]; ok && (!write || s.Raft.IsLeader()) && !exists() {
+			return s.redirect("ASK", slot, target)
+		}
+		return ""
+	}
+	if _, ok := config.Importing[slot]; ok && asking {
+		return ""
+	}
+	if !claimed {
+		return fmt.Sprintf("CLUSTERDOWN hash slot %d is not served by any group", slot)
+	}
+	return s.redirect("MOVED", slot, owner)
+}
+
+// redirect formats a MOVED or ASK redirect to the node serving group
+func (s *ClusterServer) redirect(kind string, slot uint32, group int32) string {
+	addr := s.Shards.Address(group)
+	if addr == "" {
+		return fmt.Sprintf("CLUSTERDOWN hash slot %d is served by group %d, no node of it is known", slot, group)
+	}
+	return fmt.Sprintf("%s %d %s", kind, slot, addr)
+}
+
+// errNotGroupLeader is returned by slot changes sent to a follower
+var errNotGroupLeader = errors.New("slots are changed on the leader of the group")
+
+// AddSlots makes this node's group serve the slots in ranges, none of them
+// may be served by another group
+func (s *ClusterServer) AddSlots(ranges string) error {
+	claims, err := shard.ParseRanges(ranges, 1)
+	if err != nil {
+		return err
+	}
+	group := int32(s.Config.ShardGroup)
+	for _, r := range claims {
+		for slot := r.Start; slot <= r.End; slot++ {
+			if owner, _, claimed := s.Shards.Owner(slot); claimed && owner != group {
+				return fmt.Errorf("slot %d is served by group %d", slot, owner)
+			}
+		}
+	}
+	epoch := s.Shards.MaxEpoch() + 1
+	return s.changeSlots(func(config *pb.Configuration) error {
+		for _, r := range claims {
+			config.Slots = shard.Assign(config.Slots, r.Start, r.End, epoch)
+		}
+		return nil
+	})
+}
+
+// DelSlots stops this node's group from serving the slots in ranges
+func (s *ClusterServer) DelSlots(ranges string) error {
+	drops, err := shard.ParseRanges(ranges, 1)
+	if err != nil {
+		return err
+	}
+	return s.changeSlots(func(config *pb.Configuration) error {
+		for _, r := range drops {
+			config.Slots = shard.Remove(config.Slots, r.Start, r.End)
+		}
+		return nil
+	})
+}
+
+// SetSlot changes the state of one slot of this node's group:
+//   - MIGRATING: the slot moves to group, keys not found here are sent there with ASK
+//   - IMPORTING: the slot moves here from group, requests after ASKING are served
+//   - STABLE: the slot is neither migrating nor importing
+//   - NODE: group serves the slot from now on
+func (s *ClusterServer) SetSlot(slot uint32, state string, group int32) error {
+	return s.SetSlots(slot, slot, state, group)
+}
+
+// SetSlots changes the state of the slots from start to end like SetSlot
+func (s *ClusterServer) SetSlots(start, end uint32, state string, group int32) error {
+	mine := int32(s.Config.ShardGroup)
+	if state == "NODE" && group == mine {
+		// Claiming with a higher epoch than anyone takes the slots over
+		epoch := s.Shards.MaxEpoch() + 1
+		return s.changeSlots(func(config *pb.Configuration) error {
+			config.Slots = shard.Assign(config.Slots, start, end, epoch)
+			for slot := start; slot <= end; slot++ {
+				delete(config.Importing, slot)
+				delete(config.Migrating, slot)
+			}
+			return nil
+		})
+	}
+
+	return s.changeSlots(func(config *pb.Configuration) error {
+		for slot := start; slot <= end; slot++ {
+			owned := shard.Find(config.Slots, slot) != nil
+			switch state {
+			case "MIGRATING":
+				if !owned {
+					return fmt.Errorf("slot %d is not served by this group", slot)
+				}
+				if config.Migrating == nil {
+					config.Migrating = make(map[uint32]int32)
+				}
+				config.Migrating[slot] = group
+			case "IMPORTING":
+				if owned {
+					return fmt.Errorf("slot %d is served by this group already", slot)
+				}
+				if config.Importing == nil {
+					config.Importing = make(map[uint32]int32)
+				}
+				config.Importing[slot] = group
+			case "STABLE":
+				delete(config.Migrating, slot)
+				delete(config.Importing, slot)
+			case "NODE":
+				delete(config.Migrating, slot)
+				delete(config.Importing, slot)
+			default:
+				return fmt.Errorf("unknown slot state %q, use MIGRATING, IMPORTING, STABLE or NODE", state)
+			}
+		}
+		if state == "NODE" {
+			config.Slots = shard.Remove(config.Slots, start, end)
+		}
+		return nil
+	})
+}
+
+// changeSlots changes this group's slots through its raft log and announces the result
+func (s *ClusterServer) changeSlots(change func(config *pb.Configuration) error) error {
+	if !s.Config.Sharding || s.Raft == nil {
+		return errors.New("sharding is not enabled")
+	}
+	if !s.Raft.IsLeader() {
+		if addr := s.Shards.Address(int32(s.Config.ShardGroup)); addr != "" {
+			return fmt.Errorf("%v, send it to %s", errNotGroupLeader, addr)
+		}
+		return errNotGroupLeader
+	}
+	if err := s.Raft.ChangeSlots(change); err != nil {
+		return err
+	}
+	s.announce()
+	return nil
+}
@@ -0,0 +1,484 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vskvj3/geomys/internal/utils"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Users are stored in the database and changed through the log like keys,
+// so every member of a cluster knows the same users and a restart keeps
+// them. Passwords are hashed by the node that takes ACL SETUSER, a
+// follower before forwarding it, so only the hashes reach the leader and
+// the log. While no "default" user exists,
+// connections that did not authenticate may run every command.
+
+// defaultUser is the user of connections that did not authenticate
+const defaultUser = "default"
+
+// commandCategories lists the categories of every command that needs a permission
+var commandCategories = map[string][]string{
+	"GET":     {"read"},
+	"WAIT":    {"read"},
+	"SET":     {"write"},
+	"INCR":    {"write"},
+	"PUSH":    {"write"},
+	"LPOP":    {"write"},
+	"RPOP":    {"write"},
+	"FLUSHDB": {"write", "dangerous"},
+	"BACKUP":  {"admin", "dangerous"},
+	"CLUSTER": {"admin", "dangerous"},
+	"ACL":     {"admin", "dangerous"},
+
+	"PUBLISH":      {"pubsub"},
+	"SUBSCRIBE":    {"pubsub"},
+	"PSUBSCRIBE":   {"pubsub"},
+	"UNSUBSCRIBE":  {"pubsub"},
+	"PUNSUBSCRIBE": {"pubsub"},
+}
+
+// connectionCommands only concern the connection, any authenticated user may run them
+var connectionCommands = map[string]bool{"AUTH": true, "PING": true, "ECHO": true, "ROLE": true, "ASKING": true, "WRITECONCERN": true}
+
+var categories = map[string]bool{"all": true, "read": true, "write": true, "admin": true, "dangerous": true, "pubsub": true}
+
+// Password hashes are "scrypt$N$r$p$salt$key", salt and key in hex, so the
+// cost of the hashes already stored can change with the defaults below
+const (
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+	scryptSaltSize = 16
+	scryptKeySize  = 32
+)
+
+// user is an account clients authenticate as, with what it may run
+type user struct {
+	Name      string   `msgpack:"name"`
+	Enabled   bool     `msgpack:"enabled"`
+	NoPass    bool     `msgpack:"nopass"`
+	Passwords []string `msgpack:"passwords"` // scrypt hashes
+	Commands  []string `msgpack:"commands"`  // +@category, -@category, +command or -command, the last match wins
+	Keys      []string `msgpack:"keys"`      // patterns of the keys it may access
+}
+
+// clone returns a copy that can be changed without touching u
+func (u *user) clone() *user {
+	c := *u
+	c.Passwords = append([]string(nil), u.Passwords...)
+	c.Commands = append([]string(nil), u.Commands...)
+	c.Keys = append([]string(nil), u.Keys...)
+	return &c
+}
+
+// apply changes the user as rules say, in order:
+//
+//	on, off                  allow or refuse authenticating as the user
+//	#<hash>, !<hash>         add or remove a hashed password
+//	nopass, resetpass        accept any password, or none until one is added
+//	+@category, -@category   allow or refuse a category: read, write, admin, dangerous, pubsub or all
+//	+command, -command       allow or refuse one command
+//	allcommands, nocommands  same as +@all and -@all
+//	~pattern, allkeys        allow keys matching pattern, * matching any run of characters and ? one
+//	resetkeys                refuse every key
+//	reset                    back to a new user: off, no passwords, commands or keys
+func (u *user) apply(rules []string) error {
+	for _, rule := range rules {
+		switch lower := strings.ToLower(rule); {
+		case lower == "on":
+			u.Enabled = true
+		case lower == "off":
+			u.Enabled = false
+		case lower == "nopass":
+			u.NoPass, u.Passwords = true, nil
+		case lower == "resetpass":
+			u.NoPass, u.Passwords = false, nil
+		case lower == "allcommands":
+			u.Commands = []string{"+@all"}
+		case lower == "nocommands":
+			u.Commands = nil
+		case lower == "allkeys":
+			u.Keys = []string{"*"}
+		case lower == "resetkeys":
+			u.Keys = nil
+		case lower == "reset":
+			*u = user{Name: u.Name}
+		case strings.HasPrefix(rule, ">"), strings.HasPrefix(rule, "<"):
+			return errors.New("passwords must be hashed before they are stored")
+		case strings.HasPrefix(rule, "#"):
+			hash := strings.ToLower(rule[1:])
+			if _, _, err := parseHash(hash); err != nil {
+				return fmt.Errorf("invalid password hash %q: %v", rule, err)
+			}
+			u.NoPass = false
+			if !containsString(u.Passwords, hash) {
+				u.Passwords = append(u.Passwords, hash)
+			}
+		case strings.HasPrefix(rule, "!"):
+			hash := strings.ToLower(rule[1:])
+			if !containsString(u.Passwords, hash) {
+				return errors.New("no such password hash: " + rule)
+			}
+			u.Passwords = removeString(u.Passwords, hash)
+		case strings.HasPrefix(rule, "~"):
+			if rule == "~" {
+				return errors.New("empty key pattern")
+			}
+			if !containsString(u.Keys, rule[1:]) {
+				u.Keys = append(u.Keys, rule[1:])
+			}
+		case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+			name := strings.ToUpper(rule[1:])
+			if category, ok := strings.CutPrefix(strings.ToLower(rule[1:]), "@"); ok {
+				if !categories[category] {
+					return fmt.Errorf("unknown command category %q", category)
+				}
+				name = "@" + category
+			} else if commandCategories[name] == nil {
+				return fmt.Errorf("unknown command %q", rule[1:])
+			}
+			if name == "@all" {
+				u.Commands = nil
+				if rule[0] == '-' {
+					continue
+				}
+			}
+			u.Commands = append(u.Commands, rule[:1]+name)
+		default:
+			return fmt.Errorf("unknown ACL rule %q", rule)
+		}
+	}
+	return nil
+}
+
+// rules describes the user as the rules that create it
+func (u *user) rules() []string {
+	rules := []string{"off"}
+	if u.Enabled {
+		rules[0] = "on"
+	}
+	if u.NoPass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range u.Passwords {
+		rules = append(rules, "#"+hash)
+	}
+	for _, pattern := range u.Keys {
+		rules = append(rules, "~"+pattern)
+	}
+	if len(u.Commands) == 0 || u.Commands[0] != "+@all" {
+		rules = append(rules, "-@all")
+	}
+	return append(rules, u.Commands...)
+}
+
+// allowed reports whether the user may run command
+func (u *user) allowed(command string) bool {
+	allowed := false
+	for _, rule := range u.Commands {
+		name := rule[1:]
+		category, isCategory := strings.CutPrefix(name, "@")
+		if name == command || category == "all" || (isCategory && containsString(commandCategories[command], category)) {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// checkPassword reports whether password matches one of the user's
+func (u *user) checkPassword(password string) bool {
+	if u.NoPass {
+		return true
+	}
+	for _, stored := range u.Passwords {
+		params, salt, err := parseHash(stored)
+		if err != nil {
+			continue
+		}
+		hash, err := hashPassword(password, salt, params)
+		if err == nil && subtle.ConstantTimeCompare([]byte(hash), []byte(stored)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// hashPassword returns the scrypt hash of password with salt and the N, r
+// and p in params
+func hashPassword(password string, salt []byte, params [3]int) (string, error) {
+	key, err := scrypt.Key([]byte(password), salt, params[0], params[1], params[2], scryptKeySize)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("scrypt$%d$%d$%d$%s$%s", params[0], params[1], params[2], hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// parseHash returns the scrypt N, r and p and the salt of a password hash.
+// A hash is checked on every AUTH, so none may cost more than the ones this
+// node makes: about 32 MiB and a tenth of a second.
+func parseHash(hash string) ([3]int, []byte, error) {
+	var params [3]int
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[0] != "scrypt" {
+		return params, nil, errors.New("expected scrypt$N$r$p$salt$key")
+	}
+	for i := range params {
+		n, err := strconv.Atoi(fields[i+1])
+		if err != nil || n < 1 {
+			return params, nil, errors.New("invalid scrypt parameters")
+		}
+		params[i] = n
+	}
+	if params[0] > scryptN || params[1] > scryptR || params[2] > scryptP {
+		return params, nil, errors.New("scrypt parameters too costly")
+	}
+	salt, err := hex.DecodeString(fields[4])
+	if err != nil || len(salt) == 0 {
+		return params, nil, errors.New("invalid salt")
+	}
+	if key, err := hex.DecodeString(fields[5]); err != nil || len(key) != scryptKeySize {
+		return params, nil, errors.New("invalid key")
+	}
+	return params, salt, nil
+}
+
+// hashRules replaces the clear text passwords of rules, >password adds one
+// and <password removes it, with their hashes
+func (u *user) hashRules(rules []string) ([]string, error) {
+	hashed := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		switch {
+		case strings.HasPrefix(rule, ">"):
+			salt := make([]byte, scryptSaltSize)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+			hash, err := hashPassword(rule[1:], salt, [3]int{scryptN, scryptR, scryptP})
+			if err != nil {
+				return nil, err
+			}
+			rule = "#" + hash
+		case strings.HasPrefix(rule, "<"):
+			match := ""
+			for _, stored := range u.Passwords {
+				if (&user{Passwords: []string{stored}}).checkPassword(rule[1:]) {
+					match = stored
+				}
+			}
+			if match == "" {
+				return nil, errors.New("the user has no such password")
+			}
+			rule = "!" + match
+		}
+		hashed = append(hashed, rule)
+	}
+	return hashed, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	kept := list[:0]
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// aclUser returns a copy of the user called name
+func (db *Database) aclUser(name string) (*user, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok := db.users[name]
+	if !ok {
+		return nil, false
+	}
+	return u.clone(), true
+}
+
+// aclUsers returns copies of every user sorted by name
+func (db *Database) aclUsers() []*user {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	users := make([]*user, 0, len(db.users))
+	for _, name := range sortedKeys(db.users) {
+		users = append(users, db.users[name].clone())
+	}
+	return users
+}
+
+// Authenticate checks the password of username, "" is the default user
+func (h *CommandHandler) Authenticate(username, password string) error {
+	if username == "" {
+		username = defaultUser
+	}
+	u, ok := h.Database.aclUser(username)
+	if !ok || !u.Enabled || !u.checkPassword(password) {
+		return errors.New("WRONGPASS invalid username-password pair or user is disabled")
+	}
+	return nil
+}
+
+// Authorize checks that username, "" for connections that did not
+// authenticate, may run command on key, "" for commands without one
+func (h *CommandHandler) Authorize(username, command, key string) error {
+	command = strings.ToUpper(command)
+	if command == "AUTH" {
+		return nil
+	}
+	if username == "" {
+		username = defaultUser
+	}
+	u, ok := h.Database.aclUser(username)
+	if !ok && username == defaultUser {
+		// Without a default user access is open, as before users existed
+		return nil
+	}
+	if !ok || !u.Enabled {
+		if username == defaultUser {
+			return errors.New("NOAUTH Authentication required")
+		}
+		return fmt.Errorf("NOAUTH user %s was removed or disabled, authenticate again", username)
+	}
+	if connectionCommands[command] {
+		return nil
+	}
+	if !u.allowed(command) {
+		return fmt.Errorf("NOPERM user %s has no permissions to run the '%s' command", username, strings.ToLower(command))
+	}
+	if key != "" {
+		for _, pattern := range u.Keys {
+			if utils.MatchPattern(pattern, key) {
+				return nil
+			}
+		}
+		return fmt.Errorf("NOPERM user %s has no permissions to access the '%s' key", username, key)
+	}
+	return nil
+}
+
+// acl runs ACL SETUSER name rules..., ACL DELUSER name... and ACL LIST
+func (h *CommandHandler) acl(request map[string]interface{}, opts writeOptions) (map[string]interface{}, uint64, error) {
+	args := utils.StringArgs(request["args"])
+	if len(args) == 0 {
+		return nil, 0, errors.New("ACL requires a subcommand: SETUSER, DELUSER or LIST")
+	}
+
+	switch subcommand := strings.ToUpper(args[0]); subcommand {
+	case "LIST":
+		var users []interface{}
+		for _, u := range h.Database.aclUsers() {
+			users = append(users, "user "+u.Name+" "+strings.Join(u.rules(), " "))
+		}
+		return map[string]interface{}{"status": "OK", "value": users}, 0, nil
+
+	case "SETUSER":
+		if len(args) < 2 || args[1] == "" {
+			return nil, 0, errors.New("ACL SETUSER requires a user name")
+		}
+		u, ok := h.Database.aclUser(args[1])
+		if !ok {
+			u = &user{Name: args[1]}
+		}
+		rules, err := u.hashRules(args[2:])
+		if err != nil {
+			return nil, 0, err
+		}
+		// Checking the rules here answers mistakes before they are logged
+		if err := u.apply(rules); err != nil {
+			return nil, 0, err
+		}
+		value, err := msgpack.Marshal(rules)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, index, err := h.write(map[string]interface{}{"command": "ACLSETUSER", "key": args[1], "value": string(value)}, opts)
+		if err != nil {
+			return nil, 0, errors.New("ACL SETUSER failed: " + err.Error())
+		}
+		return map[string]interface{}{"status": "OK"}, index, nil
+
+	case "DELUSER":
+		if len(args) < 2 {
+			return nil, 0, errors.New("ACL DELUSER requires user names")
+		}
+		removed, index := 0, uint64(0)
+		for _, name := range args[1:] {
+			if name == defaultUser {
+				return nil, 0, errors.New("the default user cannot be removed, turn it off instead")
+			}
+			if _, ok := h.Database.aclUser(name); !ok {
+				continue
+			}
+			_, written, err := h.write(map[string]interface{}{"command": "ACLDELUSER", "key": name}, opts)
+			if err != nil {
+				return nil, 0, errors.New("ACL DELUSER failed: " + err.Error())
+			}
+			removed, index = removed+1, written
+		}
+		return map[string]interface{}{"status": "OK", "value": removed}, index, nil
+
+	default:
+		return nil, 0, fmt.Errorf("unknown ACL subcommand %q", args[0])
+	}
+}
+
+// HashPasswords replaces the clear text passwords of an ACL SETUSER request
+// with their hashes, so a follower forwarding it sends no password to the leader
+func (h *CommandHandler) HashPasswords(request map[string]interface{}) error {
+	command, _ := request["command"].(string)
+	args := utils.StringArgs(request["args"])
+	if strings.ToUpper(command) != "ACL" || len(args) < 3 || strings.ToUpper(args[0]) != "SETUSER" {
+		return nil
+	}
+	u, ok := h.Database.aclUser(args[1])
+	if !ok {
+		u = &user{Name: args[1]}
+	}
+	rules, err := u.hashRules(args[2:])
+	if err != nil {
+		return err
+	}
+	request["args"] = append(args[:2:2], rules...)
+	return nil
+}
+
+// aclRecord returns the record that recreates u
+func aclRecord(u *user) map[string]interface{} {
+	value, _ := msgpack.Marshal(append([]string{"reset"}, u.rules()...))
+	return map[string]interface{}{"command": "ACLSETUSER", "key": u.Name, "value": string(value)}
+}
+
+// setUser validates an ACLSETUSER record and returns the user it leaves,
+// callers must hold the lock
+func (db *Database) setUser(name, value string) (*user, error) {
+	var rules []string
+	if err := msgpack.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, errors.New("invalid ACL rules: " + err.Error())
+	}
+	u := &user{Name: name}
+	if existing, ok := db.users[name]; ok {
+		u = existing.clone()
+	}
+	if err := u.apply(rules); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
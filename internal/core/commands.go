@@ -2,28 +2,158 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/vskvj3/geomys/internal/persistence"
+	"github.com/vskvj3/geomys/internal/utils"
 )
 
 type CommandHandler struct {
 	Database    *Database
-	Persistence *persistence.Persistence
+	Persistence persistence.Engine
+	Replicator  Replicator // nil on a standalone node
+
+	// Defaults for writes that do not ask for a write concern or timeout
+	WriteConcern WriteConcern
+	WriteTimeout time.Duration
+
+	// Defaults for reads that do not ask for a consistency level or bounds
+	ReadConsistency ReadConsistency
+	MaxStaleness    time.Duration
+	MaxLag          uint64
 }
 
-// Create a new CommandHandler instance
-func NewCommandHandler(db *Database) *CommandHandler {
-	return &CommandHandler{Database: db}
+// Replicator agrees on the order of writes with the rest of a cluster
+type Replicator interface {
+	// Propose replicates an encoded write and returns the result of applying it and its log index
+	Propose(data []byte) (interface{}, uint64, error)
+	// Submit appends an encoded write to the log without waiting for it to commit
+	Submit(data []byte) (uint64, error)
+	// Followers returns the number of other members
+	Followers() int
+	// WaitApplied waits until replicas followers applied index or timeout
+	// passed, returning how many did
+	WaitApplied(index uint64, replicas int, timeout time.Duration) (int, error)
+
+	// ReadIndex returns the index a linearizable read must wait for, confirmed by the leader
+	ReadIndex(timeout time.Duration) (uint64, error)
+	// WaitIndex waits until this node applied index
+	WaitIndex(index uint64, timeout time.Duration) error
+	// Staleness returns how long ago this node was known to be current and
+	// how many committed entries it has yet to apply
+	Staleness() (time.Duration, uint64)
 }
 
-// HandleCommand processes client commands and sends appropriate responses
-func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[string]interface{}, error) {
-	disk, err := persistence.CreateOrReplacePersistence()
+// Create a new CommandHandler instance, a nil engine persists nothing
+func NewCommandHandler(db *Database, engine persistence.Engine) *CommandHandler {
+	if engine == nil {
+		engine = persistence.NewMemoryEngine()
+	}
+	return &CommandHandler{
+		Database:        db,
+		Persistence:     engine,
+		WriteConcern:    ConcernOne,
+		WriteTimeout:    DefaultWriteTimeout,
+		ReadConsistency: ReadEventual,
+	}
+}
+
+// Compact replaces the persisted history with a snapshot of the database
+func (h *CommandHandler) Compact() error {
+	return h.Database.SnapshotTo(func(records []map[string]interface{}, _ uint64) error {
+		return h.Persistence.Snapshot(records)
+	})
+}
+
+// Apply applies a write the cluster committed at index
+func (h *CommandHandler) Apply(index uint64, data []byte) (interface{}, error) {
+	record, err := persistence.DecodeRecord(data)
 	if err != nil {
-		return nil, errors.New("could not access disk: " + err.Error())
+		return nil, err
+	}
+	record["index"] = index
+	return h.Database.Execute(record, h.Persistence.Append)
+}
+
+// AppliedIndex returns the log index of the last write in the database
+func (h *CommandHandler) AppliedIndex() uint64 {
+	return h.Database.AppliedIndex()
+}
+
+// Snapshot writes the database to w as snapshot records
+func (h *CommandHandler) Snapshot(w io.Writer) error {
+	return h.Database.SnapshotTo(func(records []map[string]interface{}, _ uint64) error {
+		return persistence.WriteSnapshot(w, records, nil)
+	})
+}
+
+// Restore replaces the database and its persisted history with a snapshot
+// the cluster took at index
+func (h *CommandHandler) Restore(r io.Reader, index uint64) error {
+	records, err := persistence.ReadSnapshot(r, nil)
+	if err != nil {
+		return err
+	}
+
+	// The leading FLUSHDB drops what was there, and every record moves the
+	// database to index so a restart resumes after the snapshot
+	records = append([]map[string]interface{}{{"command": "FLUSHDB"}}, records...)
+	for _, record := range records {
+		record["index"] = index
+	}
+	if err := h.Persistence.Snapshot(records); err != nil {
+		return err
 	}
+	return h.Database.Restore(records)
+}
+
+// write applies a mutating request, through the replicator when there is
+// one, and returns its result and log index once opts is satisfied
+func (h *CommandHandler) write(record map[string]interface{}, opts writeOptions) (interface{}, uint64, error) {
+	if h.Replicator == nil {
+		// Without followers every write concern is met once the write is applied
+		value, err := h.Database.Execute(record, h.Persistence.Append)
+		index, _ := record["index"].(uint64)
+		return value, index, err
+	}
+	data, err := persistence.EncodeRecord(record)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch record["command"] {
+	case "INCR", "LPOP", "RPOP":
+	default:
+		if opts.concern == ConcernAsync {
+			index, err := h.Replicator.Submit(data)
+			return nil, index, err
+		}
+	}
+	value, index, err := h.Replicator.Propose(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	replicas := opts.concern.replicas(h.Replicator.Followers())
+	if replicas == 0 {
+		return value, index, nil
+	}
+	applied, err := h.Replicator.WaitApplied(index, replicas, opts.timeout)
+	if err != nil {
+		return value, index, err
+	}
+	if applied < replicas {
+		return value, index, fmt.Errorf("timeout: write concern %s not met, %d of %d followers applied the write", opts.concern, applied, replicas)
+	}
+	return value, index, nil
+}
+
+// HandleCommand processes client commands and sends appropriate responses
+func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[string]interface{}, error) {
 	// Process the command
 	command, ok := request["command"].(string)
 	if !ok {
@@ -33,6 +163,13 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 	command = strings.ToUpper(command)
 	var response map[string]interface{}
 
+	// Log index of a write, returned so clients can WAIT for it
+	var index uint64
+	opts, err := h.writeOptionsOf(request)
+	if err != nil {
+		return nil, err
+	}
+
 	switch command {
 	case "PING":
 		response = map[string]interface{}{"status": "OK", "message": "PONG"}
@@ -45,10 +182,6 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 		response = map[string]interface{}{"status": "OK", "message": message}
 
 	case "SET":
-		if err := disk.LogRequest(request); err != nil {
-			return nil, errors.New("reuest logging to disk failed")
-		}
-
 		key, keyOk := request["key"].(string)
 		value, valueOk := request["value"].(string)
 		ttlMs := int64(0)
@@ -70,8 +203,10 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 				ttlMs = int64(v)
 			case uint32:
 				ttlMs = int64(v)
+			case uint64:
+				ttlMs = int64(v)
 			default:
-				return nil, errors.New("Invalid type for TTL: " + v.(string))
+				return nil, errors.New("Invalid type for TTL")
 			}
 		}
 
@@ -79,7 +214,13 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 			return nil, errors.New("SET requires 'key', 'value' fields")
 		}
 
-		if err := h.Database.Set(key, value, ttlMs); err != nil {
+		// The log keeps the absolute expiry so a replay restores the same deadline
+		record := map[string]interface{}{"command": command, "key": key, "value": value}
+		if ttlMs > 0 {
+			record["expire_at"] = time.Now().UnixMilli() + ttlMs
+		}
+
+		if _, index, err = h.write(record, opts); err != nil {
 			return nil, errors.New("Set failed: " + err.Error())
 		}
 		response = map[string]interface{}{"status": "OK"}
@@ -89,6 +230,9 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 		if !ok {
 			return nil, errors.New("GET requires a 'key' field")
 		}
+		if err := h.readBarrier(request); err != nil {
+			return nil, err
+		}
 		value, err := h.Database.Get(key)
 		if err != nil {
 			return nil, errors.New("Get failed: " + err.Error())
@@ -101,10 +245,6 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 		}
 
 	case "INCR":
-		if err := disk.LogRequest(request); err != nil {
-			return nil, errors.New("reuest logging to disk failed")
-		}
-
 		key, keyOk := request["key"].(string)
 		offset, offsetOk := request["offset"].(string)
 
@@ -116,13 +256,14 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 		}
 
 		// Convert offset to int
-		intOffset, err := strconv.Atoi(offset)
-		if err != nil {
+		if _, err := strconv.Atoi(offset); err != nil {
 			return nil, errors.New(err.Error())
 		}
 
 		// Call the Incr function
-		newValue, err := h.Database.Incr(key, intOffset)
+		record := map[string]interface{}{"command": command, "key": key, "offset": offset}
+		newValue, written, err := h.write(record, opts)
+		index = written
 		if err != nil {
 			return nil, errors.New(err.Error())
 		}
@@ -134,10 +275,6 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 		}
 
 	case "PUSH":
-		if err := disk.LogRequest(request); err != nil {
-			return nil, errors.New("Push failed: " + "Reuest logging to disk failed: " + err.Error())
-		}
-
 		key, keyOk := request["key"].(string)
 		value, valueOk := request["value"].(string)
 
@@ -145,42 +282,25 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 			return nil, errors.New("PUSH requires 'key', 'value' fields")
 		}
 
-		if err := h.Database.Push(key, value); err != nil {
+		record := map[string]interface{}{"command": command, "key": key, "value": value}
+		if _, index, err = h.write(record, opts); err != nil {
 			return nil, errors.New("Push failed: " + err.Error())
 		}
 		response = map[string]interface{}{"status": "OK"}
 
-	case "LPOP":
-		if err := disk.LogRequest(request); err != nil {
-			return nil, errors.New("reuest logging to disk failed")
-		}
-
+	case "LPOP", "RPOP":
 		key, ok := request["key"].(string)
 		if !ok {
-			return nil, errors.New("LPOP requires a 'key' field")
-		}
-		value, err := h.Database.Lpop(key)
-		if err != nil {
-			return nil, errors.New("Lpop failed: " + err.Error())
-		}
-
-		if value == "" {
-			return nil, errors.New("no value returned")
-		} else {
-			response = map[string]interface{}{"status": "OK", "value": value}
-		}
-
-	case "RPOP":
-		if err := disk.LogRequest(request); err != nil {
-			return nil, errors.New("reuest logging to disk failed")
+			return nil, errors.New(command + " requires a 'key' field")
 		}
 
-		key, ok := request["key"].(string)
-		if !ok {
-			return nil, errors.New("LPOP requires a 'key' field")
-		}
-		value, err := h.Database.Rpop(key)
+		record := map[string]interface{}{"command": command, "key": key}
+		value, written, err := h.write(record, opts)
+		index = written
 		if err != nil {
+			if command == "LPOP" {
+				return nil, errors.New("Lpop failed: " + err.Error())
+			}
 			return nil, errors.New("Rpop failed: " + err.Error())
 		}
 
@@ -190,20 +310,51 @@ func (h *CommandHandler) HandleCommand(request map[string]interface{}) (map[stri
 			response = map[string]interface{}{"status": "OK", "value": value}
 		}
 
-	// warning: there should be some auth to perform this!!
+	// FLUSHDB is in the dangerous category, users need a permission for it (see acl.go)
 	case "FLUSHDB":
-		if err := disk.Clear(); err != nil {
-			return nil, errors.New("Clearing persisted data failed: " + err.Error())
+		// Flushing is logged like any other write so replay and replication
+		// see it in order instead of losing the history behind it
+		record := map[string]interface{}{"command": command}
+		if _, index, err = h.write(record, opts); err != nil {
+			return nil, errors.New("Flush failed: " + err.Error())
 		}
 
-		h.Database.Clear()
-
 		response = map[string]interface{}{"status": "OK"}
 
+	case "ACL":
+		if response, index, err = h.acl(request, opts); err != nil {
+			return nil, err
+		}
+
+	case "WAIT":
+		replicas, ok := utils.ToInt64(request["replicas"])
+		if !ok || replicas < 0 {
+			return nil, errors.New("WAIT requires a 'replicas' field (integer)")
+		}
+		// index is the client's last write, the network server fills it in
+		waitFor, _ := utils.ToInt64(request["index"])
+
+		applied := 0
+		if h.Replicator != nil && waitFor > 0 {
+			// WAIT is bounded by its own timeout only, 0 blocks until enough followers applied the write
+			timeout := time.Duration(0)
+			if _, ok := request["timeout"]; ok {
+				timeout = opts.timeout
+			}
+			if applied, err = h.Replicator.WaitApplied(uint64(waitFor), int(replicas), timeout); err != nil {
+				return nil, errors.New("Wait failed: " + err.Error())
+			}
+		}
+		response = map[string]interface{}{"status": "OK", "value": applied}
+
 	default:
 		return nil, errors.New("unknown command")
 	}
 
+	if index > 0 {
+		response["index"] = index
+	}
+
 	// Send the response
 	return response, nil
 }
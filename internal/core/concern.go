@@ -0,0 +1,77 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// WriteConcern says how many nodes must apply a write before it is acknowledged
+type WriteConcern string
+
+const (
+	// ConcernAsync acknowledges once the write is in the leader's log.
+	// Writes returning a value (INCR, LPOP, RPOP) still wait to be applied.
+	ConcernAsync WriteConcern = "async"
+	// ConcernOne acknowledges once the leader applied the write, which in a
+	// cluster means a majority stored it
+	ConcernOne WriteConcern = "one"
+	// ConcernQuorum acknowledges once a majority of the members applied the write
+	ConcernQuorum WriteConcern = "quorum"
+	// ConcernAll acknowledges once every member applied the write
+	ConcernAll WriteConcern = "all"
+)
+
+// DefaultWriteTimeout bounds how long a write waits for its write concern
+const DefaultWriteTimeout = 5 * time.Second
+
+// ParseWriteConcern returns the write concern named s
+func ParseWriteConcern(s string) (WriteConcern, error) {
+	switch concern := WriteConcern(strings.ToLower(s)); concern {
+	case ConcernAsync, ConcernOne, ConcernQuorum, ConcernAll:
+		return concern, nil
+	}
+	return "", fmt.Errorf("unknown write concern %q, use async, one, quorum or all", s)
+}
+
+// replicas returns how many followers out of followers must apply a write
+func (c WriteConcern) replicas(followers int) int {
+	switch c {
+	case ConcernQuorum:
+		// A majority of followers+1 members, the leader being one of them
+		return (followers + 1) / 2
+	case ConcernAll:
+		return followers
+	}
+	return 0
+}
+
+// writeOptions is the write concern and timeout a request asks for
+type writeOptions struct {
+	concern WriteConcern
+	timeout time.Duration
+}
+
+// writeOptionsOf reads the optional write_concern and timeout (milliseconds) fields of a request
+func (h *CommandHandler) writeOptionsOf(request map[string]interface{}) (writeOptions, error) {
+	opts := writeOptions{concern: h.WriteConcern, timeout: h.WriteTimeout}
+	if value, ok := request["write_concern"]; ok {
+		name, _ := value.(string)
+		concern, err := ParseWriteConcern(name)
+		if err != nil {
+			return opts, err
+		}
+		opts.concern = concern
+	}
+	if value, ok := request["timeout"]; ok {
+		ms, ok := utils.ToInt64(value)
+		if !ok || ms < 0 {
+			return opts, errors.New("'timeout' must be a non-negative number of milliseconds")
+		}
+		opts.timeout = time.Duration(ms) * time.Millisecond
+	}
+	return opts, nil
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// ReadConsistency says how fresh the data a read returns must be
+type ReadConsistency string
+
+const (
+	// ReadEventual serves whatever this node has applied
+	ReadEventual ReadConsistency = "eventual"
+	// ReadBounded refuses the read when this node is too far behind the leader
+	ReadBounded ReadConsistency = "bounded"
+	// ReadSession waits until this node applied the write named by the session token
+	ReadSession ReadConsistency = "session"
+	// ReadLinearizable waits until this node applied everything the leader
+	// had committed when the read arrived
+	ReadLinearizable ReadConsistency = "linearizable"
+)
+
+// DefaultReadTimeout bounds how long a read waits for this node to catch up
+const DefaultReadTimeout = 5 * time.Second
+
+// ParseReadConsistency returns the read consistency named s
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch consistency := ReadConsistency(strings.ToLower(s)); consistency {
+	case ReadEventual, ReadBounded, ReadSession, ReadLinearizable:
+		return consistency, nil
+	}
+	return "", fmt.Errorf("unknown read consistency %q, use eventual, bounded, session or linearizable", s)
+}
+
+// readOptions is the consistency a read asks for
+type readOptions struct {
+	consistency  ReadConsistency
+	maxStaleness time.Duration // bounded: 0 does not bound the age
+	maxLag       uint64        // bounded: 0 does not bound the entries
+	session      uint64        // session: log index of the client's last write
+	timeout      time.Duration
+}
+
+// readOptionsOf reads the optional consistency, max_staleness_ms, max_lag,
+// session and timeout fields of a request
+func (h *CommandHandler) readOptionsOf(request map[string]interface{}) (readOptions, error) {
+	opts := readOptions{consistency: h.ReadConsistency, maxStaleness: h.MaxStaleness, maxLag: h.MaxLag, timeout: DefaultReadTimeout}
+	if opts.consistency == "" {
+		opts.consistency = ReadEventual
+	}
+	if value, ok := request["consistency"]; ok {
+		name, _ := value.(string)
+		consistency, err := ParseReadConsistency(name)
+		if err != nil {
+			return opts, err
+		}
+		opts.consistency = consistency
+	}
+
+	if ms, ok, err := optionalCount(request, "max_staleness_ms"); err != nil {
+		return opts, err
+	} else if ok {
+		opts.maxStaleness = time.Duration(ms) * time.Millisecond
+	}
+	if lag, ok, err := optionalCount(request, "max_lag"); err != nil {
+		return opts, err
+	} else if ok {
+		opts.maxLag = uint64(lag)
+	}
+	if session, ok, err := optionalCount(request, "session"); err != nil {
+		return opts, err
+	} else if ok {
+		opts.session = uint64(session)
+	}
+	if ms, ok, err := optionalCount(request, "timeout"); err != nil {
+		return opts, err
+	} else if ok && ms > 0 {
+		opts.timeout = time.Duration(ms) * time.Millisecond
+	}
+	return opts, nil
+}
+
+// optionalCount reads an optional non-negative integer field
+func optionalCount(request map[string]interface{}, field string) (int64, bool, error) {
+	value, ok := request[field]
+	if !ok {
+		return 0, false, nil
+	}
+	number, ok := utils.ToInt64(value)
+	if !ok || number < 0 {
+		return 0, false, fmt.Errorf("'%s' must be a non-negative integer", field)
+	}
+	return number, true, nil
+}
+
+// readBarrier returns once this node may serve a read with the requested
+// consistency, or an error when it may not
+func (h *CommandHandler) readBarrier(request map[string]interface{}) error {
+	opts, err := h.readOptionsOf(request)
+	if err != nil {
+		return err
+	}
+	// A standalone node is always current
+	if h.Replicator == nil {
+		return nil
+	}
+
+	switch opts.consistency {
+	case ReadBounded:
+		age, behind := h.Replicator.Staleness()
+		if opts.maxLag > 0 && behind > opts.maxLag {
+			return fmt.Errorf("stale: this node is %d entries behind the leader", behind)
+		}
+		if opts.maxStaleness > 0 && age > opts.maxStaleness {
+			if age == time.Duration(math.MaxInt64) {
+				return errors.New("stale: this node has not heard from a leader")
+			}
+			return fmt.Errorf("stale: this node is %v behind the leader", age.Round(time.Millisecond))
+		}
+
+	case ReadSession:
+		if opts.session > 0 {
+			if err := h.Replicator.WaitIndex(opts.session, opts.timeout); err != nil {
+				return fmt.Errorf("session write %d is not applied on this node yet: %v", opts.session, err)
+			}
+		}
+
+	case ReadLinearizable:
+		index, err := h.Replicator.ReadIndex(opts.timeout)
+		if err != nil {
+			return errors.New("linearizable read failed: " + err.Error())
+		}
+		if err := h.Replicator.WaitIndex(index, opts.timeout); err != nil {
+			return errors.New("linearizable read failed: " + err.Error())
+		}
+	}
+	return nil
+}
@@ -1,20 +1,26 @@
 package core
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/vmihailenco/msgpack/v5"
 	"github.com/vskvj3/geomys/internal/persistence"
 	"github.com/vskvj3/geomys/internal/utils"
 )
 
 type Database struct {
-	mu     sync.Mutex
-	store  map[string]string
-	expiry map[string]int64
-	lists  map[string]*List
+	mu      sync.Mutex
+	store   map[string]string
+	expiry  map[string]int64
+	lists   map[string]*List
+	users   map[string]*user // see acl.go
+	applied uint64           // log index of the last write applied through Execute
 }
 
 // Create a new database instance
@@ -23,6 +29,7 @@ func NewDatabase() *Database {
 		store:  make(map[string]string),
 		expiry: make(map[string]int64),
 		lists:  make(map[string]*List),
+		users:  make(map[string]*user),
 	}
 }
 
@@ -38,14 +45,23 @@ func (db *Database) Set(key string, value string, ttlMs int64) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.store[key] = value
+	var expireAt int64
 	if ttlMs > 0 {
-		db.expiry[key] = time.Now().UnixMilli() + ttlMs
+		expireAt = time.Now().UnixMilli() + ttlMs
 	}
+	db.set(key, value, expireAt)
 
 	return nil
 }
 
+// set stores a value with an absolute expiry, callers must hold the lock
+func (db *Database) set(key string, value string, expireAt int64) {
+	db.store[key] = value
+	if expireAt > 0 {
+		db.expiry[key] = expireAt
+	}
+}
+
 // Get retrieves the value associated with the given key
 func (db *Database) Get(key string) (string, error) {
 	if key == "" {
@@ -71,6 +87,19 @@ func (db *Database) Incr(key string, offset int) (int, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	currentValue, err := db.intValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	newValue := currentValue + offset
+	db.store[key] = strconv.Itoa(newValue)
+
+	return newValue, nil
+}
+
+// intValue returns the integer stored at key, callers must hold the lock
+func (db *Database) intValue(key string) (int, error) {
 	value, exists := db.store[key]
 	if !exists {
 		return 0, errors.New("key not found")
@@ -80,11 +109,7 @@ func (db *Database) Incr(key string, offset int) (int, error) {
 	if err != nil {
 		return 0, errors.New("value is not an integer")
 	}
-
-	newValue := currentValue + offset
-	db.store[key] = strconv.Itoa(newValue)
-
-	return newValue, nil
+	return currentValue, nil
 }
 
 // LPush adds an item to the left of the list
@@ -115,6 +140,12 @@ func (db *Database) Push(key string, value interface{}) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	db.push(key, value)
+	return nil
+}
+
+// push appends to a list, callers must hold the lock
+func (db *Database) push(key string, value interface{}) {
 	// Initialize the list if it doesn't exist
 	if _, exists := db.lists[key]; !exists {
 		db.lists[key] = NewList()
@@ -122,7 +153,6 @@ func (db *Database) Push(key string, value interface{}) error {
 
 	// Add the value to the right of the list
 	db.lists[key].RPush(value)
-	return nil
 }
 
 // LPop removes and returns the item from the left of the list
@@ -134,9 +164,9 @@ func (db *Database) Lpop(key string) (interface{}, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	list, exists := db.lists[key]
-	if !exists {
-		return nil, errors.New("list does not exist")
+	list, err := db.nonEmptyList(key)
+	if err != nil {
+		return nil, err
 	}
 
 	leftValue, err := list.LPop()
@@ -157,9 +187,9 @@ func (db *Database) Rpop(key string) (interface{}, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	list, exists := db.lists[key]
-	if !exists {
-		return nil, errors.New("list does not exist")
+	list, err := db.nonEmptyList(key)
+	if err != nil {
+		return nil, err
 	}
 
 	rightValue, err := list.RPop()
@@ -171,6 +201,19 @@ func (db *Database) Rpop(key string) (interface{}, error) {
 	return rightValue, nil
 }
 
+// nonEmptyList returns the list stored at key if it has anything to pop,
+// callers must hold the lock
+func (db *Database) nonEmptyList(key string) (*List, error) {
+	list, exists := db.lists[key]
+	if !exists {
+		return nil, errors.New("list does not exist")
+	}
+	if list.Len() == 0 {
+		return nil, errors.New("list is empty")
+	}
+	return list, nil
+}
+
 // Len returns the length of a list
 func (db *Database) Len(key string) (int, error) {
 	if key == "" {
@@ -188,6 +231,96 @@ func (db *Database) Len(key string) (int, error) {
 	return list.Len(), nil
 }
 
+// Exists reports whether a value or a list is stored at key
+func (db *Database) Exists(key string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.store[key]; exists {
+		return true
+	}
+	_, exists := db.lists[key]
+	return exists
+}
+
+// keyDump is everything stored at a key, a key may hold a value and a list
+type keyDump struct {
+	Value  *string       `msgpack:"value"`
+	List   []interface{} `msgpack:"list"`
+	IsList bool          `msgpack:"is_list"`
+}
+
+// Keys returns up to limit keys that match, all of them when limit is
+// negative, in no particular order
+func (db *Database) Keys(match func(key string) bool, limit int) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var keys []string
+	for key := range db.store {
+		if len(keys) == limit {
+			return keys
+		}
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range db.lists {
+		if len(keys) == limit {
+			return keys
+		}
+		if _, dup := db.store[key]; !dup && match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// DumpKey serializes everything stored at key for a RESTORE record, along
+// with its expiry. It reports false when nothing is stored there.
+func (db *Database) DumpKey(key string) (string, int64, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var dump keyDump
+	if value, exists := db.store[key]; exists {
+		dump.Value = &value
+	}
+	if list, exists := db.lists[key]; exists {
+		dump.List, dump.IsList = list.Values(), true
+	}
+	if dump.Value == nil && !dump.IsList {
+		return "", 0, false
+	}
+	data, err := msgpack.Marshal(&dump)
+	if err != nil {
+		return "", 0, false
+	}
+	return string(data), db.expiry[key], true
+}
+
+// remove deletes everything stored at key, callers must hold the lock
+func (db *Database) remove(key string) {
+	delete(db.store, key)
+	delete(db.expiry, key)
+	delete(db.lists, key)
+}
+
+// restoreKey replaces what is stored at key with dump, callers must hold the lock
+func (db *Database) restoreKey(key string, dump keyDump, expireAt int64) {
+	db.remove(key)
+	if dump.Value != nil {
+		db.set(key, *dump.Value, expireAt)
+	}
+	if dump.IsList {
+		list := NewList()
+		for _, value := range dump.List {
+			list.RPush(value)
+		}
+		db.lists[key] = list
+	}
+}
+
 // StartCleanup starts a background goroutine to clean up expired keys
 func (db *Database) StartCleanup(interval time.Duration) {
 	go func() {
@@ -207,43 +340,351 @@ func (db *Database) StartCleanup(interval time.Duration) {
 	}()
 }
 
-// rebuild database at the run time
-func (db *Database) RebuildFromPersistence() error {
-	// Load stored requests
-	disk, err := persistence.CreateOrReplacePersistence()
-	logger := utils.GetLogger()
-	if err != nil {
-		return err
+// Execute validates a mutating request, hands it to logFn and applies it,
+// all while holding the database lock. Nothing is logged if validation fails
+// and nothing is applied if logging fails, so the log holds exactly the
+// applied writes in the order they were applied. logFn may be nil.
+//
+// A request without an "index" is given the next log index before it is
+// logged, one with an index (replicated or replayed) moves the database to it.
+func (db *Database) Execute(req map[string]interface{}, logFn func(map[string]interface{}) error) (interface{}, error) {
+	command, _ := req["command"].(string)
+	key, _ := req["key"].(string)
+	value, _ := req["value"].(string)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Validate
+	var offset int
+	var dump keyDump
+	var account *user
+	switch command {
+	case "SET":
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+		if value == "" {
+			return nil, errors.New("value cannot be empty")
+		}
+	case "INCR":
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+		var err error
+		offset, err = strconv.Atoi(fmt.Sprint(req["offset"]))
+		if err != nil {
+			return nil, errors.New("offset is not an integer")
+		}
+		if _, err := db.intValue(key); err != nil {
+			return nil, err
+		}
+	case "PUSH":
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+	case "LPOP", "RPOP":
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+		if _, err := db.nonEmptyList(key); err != nil {
+			return nil, err
+		}
+	case "DEL":
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+	case "RESTORE":
+		if key == "" {
+			return nil, errors.New("key cannot be empty")
+		}
+		if err := msgpack.Unmarshal([]byte(value), &dump); err != nil {
+			return nil, errors.New("invalid key dump: " + err.Error())
+		}
+	case "ACLSETUSER":
+		if key == "" {
+			return nil, errors.New("user name cannot be empty")
+		}
+		var err error
+		if account, err = db.setUser(key, value); err != nil {
+			return nil, err
+		}
+	case "ACLDELUSER":
+		if key == "" {
+			return nil, errors.New("user name cannot be empty")
+		}
+	case "FLUSHDB":
+	default:
+		return nil, errors.New("not a write command: " + command)
 	}
-	requests, err := disk.LoadRequests()
-	if err != nil {
-		return err
-	}
-
-	// Replay each request using correct database function
-	for _, req := range requests {
-		switch req["command"] {
-		case "SET":
-			db.Set(req["key"].(string), req["value"].(string), 0) // Assuming no TTL
-		case "INCR":
-			key := req["key"].(string)
-			offset, err := strconv.Atoi(req["offset"].(string))
-			if err != nil {
-				logger.Error("Offset conversion failed in databse rebuild")
-				break
+
+	index, ok := req["index"].(uint64)
+	if !ok || index == 0 {
+		index = db.applied + 1
+		req["index"] = index
+	}
+
+	if logFn != nil {
+		if err := logFn(req); err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply, none of these can fail after validation
+	db.applied = index
+	switch command {
+	case "SET":
+		expireAt, _ := req["expire_at"].(int64)
+		db.set(key, value, expireAt)
+		return nil, nil
+	case "INCR":
+		current, _ := db.intValue(key)
+		db.store[key] = strconv.Itoa(current + offset)
+		return current + offset, nil
+	case "PUSH":
+		db.push(key, value)
+		return nil, nil
+	case "LPOP":
+		return db.lists[key].LPop()
+	case "RPOP":
+		return db.lists[key].RPop()
+	case "DEL":
+		db.remove(key)
+		return nil, nil
+	case "RESTORE":
+		expireAt, _ := req["expire_at"].(int64)
+		db.restoreKey(key, dump, expireAt)
+		return nil, nil
+	case "ACLSETUSER":
+		db.users[key] = account
+		return nil, nil
+	case "ACLDELUSER":
+		delete(db.users, key)
+		return nil, nil
+	default: // FLUSHDB
+		db.clear()
+		return nil, nil
+	}
+}
+
+// RebuildFrom replays every stored write from the persistence engine
+func (db *Database) RebuildFrom(engine persistence.Engine) error {
+	// Replay each request through the same path used for live writes.
+	// Logs written by older versions may hold writes that failed live,
+	// they fail again here and are skipped.
+	return engine.Replay(func(req map[string]interface{}) error {
+		db.Execute(req, nil)
+		return nil
+	})
+}
+
+// AppliedIndex returns the log index of the last applied write
+func (db *Database) AppliedIndex() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.applied
+}
+
+// SnapshotTo hands save the shortest list of writes that rebuilds the
+// current state, along with the log index it reflects. The lock
+// is held throughout so no write can slip between the snapshot and
+// whatever save does with it.
+func (db *Database) SnapshotTo(save func(records []map[string]interface{}, applied uint64) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return save(db.records(), db.applied)
+}
+
+// records expresses the database as SET, PUSH and ACLSETUSER requests, callers must hold
+// the lock. Every record carries the applied index so a replay resumes from
+// the same position, an empty database is a lone FLUSHDB carrying it.
+func (db *Database) records() []map[string]interface{} {
+	records := make([]map[string]interface{}, 0, len(db.store)+len(db.lists))
+
+	for _, key := range sortedKeys(db.store) {
+		record := map[string]interface{}{"command": "SET", "key": key, "value": db.store[key]}
+		if expireAt, ok := db.expiry[key]; ok {
+			record["expire_at"] = expireAt
+		}
+		records = append(records, record)
+	}
+
+	for _, key := range sortedKeys(db.lists) {
+		values := db.lists[key].Values()
+		if len(values) == 0 {
+			// An emptied list still exists, push and pop to recreate it
+			records = append(records,
+				map[string]interface{}{"command": "PUSH", "key": key},
+				map[string]interface{}{"command": "LPOP", "key": key})
+			continue
+		}
+		for _, value := range values {
+			records = append(records, map[string]interface{}{"command": "PUSH", "key": key, "value": value})
+		}
+	}
+
+	for _, name := range sortedKeys(db.users) {
+		records = append(records, aclRecord(db.users[name]))
+	}
+
+	if len(records) == 0 && db.applied > 0 {
+		records = append(records, map[string]interface{}{"command": "FLUSHDB"})
+	}
+	for _, record := range records {
+		record["index"] = db.applied
+	}
+	return records
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Entry is one key with its type, value and remaining time to live
+type Entry struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+	TTL   int64       `json:"ttl,omitempty"` // milliseconds, 0 means no expiry
+}
+
+// Entry types
+const (
+	TypeString = "string"
+	TypeList   = "list"
+)
+
+// Requests returns the writes that recreate an entry on a server, lists
+// are appended to and keep the elements the server already holds
+func (e Entry) Requests() ([]map[string]interface{}, error) {
+	switch e.Type {
+	case TypeString:
+		value, ok := e.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("value of string key %q is not a string", e.Key)
+		}
+		request := map[string]interface{}{"command": "SET", "key": e.Key, "value": value}
+		if e.TTL > 0 {
+			request["exp"] = e.TTL
+		}
+		return []map[string]interface{}{request}, nil
+
+	case TypeList:
+		var values []string
+		switch list := e.Value.(type) {
+		case []string:
+			values = list
+		case []interface{}:
+			for _, value := range list {
+				values = append(values, fmt.Sprint(value))
 			}
-			db.Incr(key, offset)
-		case "PUSH":
-			db.Push(req["key"].(string), req["value"])
-		case "RPOP":
-			db.Rpop(req["key"].(string))
-		case "LPOP":
-			db.Lpop(req["key"].(string))
 		default:
-			continue
+			return nil, fmt.Errorf("value of list key %q is not an array", e.Key)
+		}
+		requests := make([]map[string]interface{}, 0, len(values))
+		for _, value := range values {
+			requests = append(requests, map[string]interface{}{"command": "PUSH", "key": e.Key, "value": value})
+		}
+		return requests, nil
+
+	default:
+		return nil, fmt.Errorf("unknown type %q", e.Type)
+	}
+}
+
+// EntryFilter selects entries by key pattern, * matching any run of
+// characters and ? one, and by type. Empty fields take every entry.
+type EntryFilter struct {
+	Match string
+	Type  string
+}
+
+// Accepts reports whether an entry passes the filter
+func (f EntryFilter) Accepts(e Entry) bool {
+	if f.Type != "" && e.Type != f.Type {
+		return false
+	}
+	return f.Match == "" || utils.MatchPattern(f.Match, e.Key)
+}
+
+// Entries lists every live key sorted by type and name, expired keys that
+// have not been cleaned up yet are left out
+func (db *Database) Entries() []Entry {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	entries := make([]Entry, 0, len(db.store)+len(db.lists))
+
+	for _, key := range sortedKeys(db.store) {
+		entry := Entry{Key: key, Type: TypeString, Value: db.store[key]}
+		if expireAt, ok := db.expiry[key]; ok {
+			if expireAt <= now {
+				continue
+			}
+			entry.TTL = expireAt - now
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, key := range sortedKeys(db.lists) {
+		entries = append(entries, Entry{Key: key, Type: TypeList, Value: db.lists[key].Values()})
+	}
+
+	return entries
+}
+
+// Dump serializes the whole database into a deterministic byte slice,
+// two databases with the same contents produce the same bytes
+func (db *Database) Dump() ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// msgpack only sorts keys of map[string]interface{}
+	store := make(map[string]interface{}, len(db.store))
+	for key, value := range db.store {
+		store[key] = value
+	}
+	expiry := make(map[string]interface{}, len(db.expiry))
+	for key, expireAt := range db.expiry {
+		expiry[key] = expireAt
+	}
+	lists := make(map[string]interface{}, len(db.lists))
+	for key, list := range db.lists {
+		lists[key] = list.Values()
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetSortMapKeys(true)
+	err := enc.Encode(map[string]interface{}{
+		"store":  store,
+		"expiry": expiry,
+		"lists":  lists,
+	})
+	return buf.Bytes(), err
+}
+
+// Restore replaces the whole database with the state records build up, in
+// one step so readers see either the old or the new data
+func (db *Database) Restore(records []map[string]interface{}) error {
+	fresh := NewDatabase()
+	for _, record := range records {
+		if _, err := fresh.Execute(record, nil); err != nil {
+			return err
 		}
 	}
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.store, db.expiry, db.lists, db.users, db.applied = fresh.store, fresh.expiry, fresh.lists, fresh.users, fresh.applied
 	return nil
 }
 
@@ -253,6 +694,11 @@ func (db *Database) Clear() {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	db.clear()
+}
+
+// clear resets every map but the users, callers must hold the lock
+func (db *Database) clear() {
 	// WHY: reassigning the entire databse might cause broken references?
 	// *db = *NewDatabase()
 	db.store = make(map[string]string)
@@ -95,6 +95,15 @@ func (l *List) Size() int {
 	return l.Len()
 }
 
+// Values returns the elements from left to right.
+func (l *List) Values() []interface{} {
+	values := make([]interface{}, 0, l.length)
+	for n := l.head; n != nil; n = n.next {
+		values = append(values, n.value)
+	}
+	return values
+}
+
 // Clear removes all elements from the list.
 func (l *List) Clear() {
 	l.head = nil
@@ -0,0 +1,56 @@
+package core
+
+// KeyDump is everything stored at a key, as it moves from one group to another
+type KeyDump struct {
+	Key      string
+	Value    string // serialized by Database.DumpKey
+	ExpireAt int64
+}
+
+// DumpKeys returns what is stored at keys, keys holding nothing are left out
+func (h *CommandHandler) DumpKeys(keys []string) []KeyDump {
+	dumps := make([]KeyDump, 0, len(keys))
+	for _, key := range keys {
+		if value, expireAt, ok := h.Database.DumpKey(key); ok {
+			dumps = append(dumps, KeyDump{Key: key, Value: value, ExpireAt: expireAt})
+		}
+	}
+	return dumps
+}
+
+// RestoreKeys replaces what is stored at every key with its dump
+func (h *CommandHandler) RestoreKeys(dumps []KeyDump) error {
+	records := make([]map[string]interface{}, 0, len(dumps))
+	for _, dump := range dumps {
+		record := map[string]interface{}{"command": "RESTORE", "key": dump.Key, "value": dump.Value}
+		if dump.ExpireAt > 0 {
+			record["expire_at"] = dump.ExpireAt
+		}
+		records = append(records, record)
+	}
+	return h.writeBatch(records)
+}
+
+// DeleteKeys removes everything stored at keys
+func (h *CommandHandler) DeleteKeys(keys []string) error {
+	records := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, map[string]interface{}{"command": "DEL", "key": key})
+	}
+	return h.writeBatch(records)
+}
+
+// writeBatch writes records in order without waiting for each, and returns
+// once the last one, and with it every other, is applied
+func (h *CommandHandler) writeBatch(records []map[string]interface{}) error {
+	for i, record := range records {
+		opts := writeOptions{concern: ConcernAsync}
+		if i == len(records)-1 {
+			opts = writeOptions{concern: ConcernOne}
+		}
+		if _, _, err := h.write(record, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
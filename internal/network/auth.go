@@ -0,0 +1,25 @@
+package network
+
+import "net"
+
+// handleAuth answers AUTH [username] password and returns the user the
+// connection runs as from now on, a failed attempt keeps the current one
+func (s *Server) handleAuth(conn net.Conn, request map[string]interface{}, current string) string {
+	username, _ := request["username"].(string)
+	password, _ := request["password"].(string)
+	if err := s.CommandHandler.Authenticate(username, password); err != nil {
+		s.logger.Warn("Failed authentication from " + conn.RemoteAddr().String())
+		s.sendError(conn, err.Error())
+		return current
+	}
+	s.sendResponse(conn, map[string]interface{}{"status": "OK"})
+	return username
+}
+
+// whoami names the user of a connection
+func whoami(user string) string {
+	if user == "" {
+		return "default"
+	}
+	return user
+}
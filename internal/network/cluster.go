@@ -0,0 +1,321 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// handleCluster answers the CLUSTER command, its arguments come in 'args':
+//
+//	CLUSTER SLOTS                         ranges of slots and the nodes serving them
+//	CLUSTER SHARDS                        every group with its slots and nodes
+//	CLUSTER KEYSLOT key                   the slot of key
+//	CLUSTER ADDSLOTS range...             this group serves the slots from now on
+//	CLUSTER DELSLOTS range...             this group stops serving the slots
+//	CLUSTER SETSLOT slot state [group]    MIGRATING, IMPORTING, STABLE or NODE
+//	CLUSTER MIGRATE range... group        move slots and their keys to group
+//	CLUSTER REBALANCE [EXCLUDE group...]  even out slots between the groups
+//	CLUSTER MEMBERS                       members of this cluster with their roles and lag
+//	CLUSTER ADDLEARNER id address client  add a node that receives the log without voting
+//	CLUSTER PROMOTE id                    make a caught up learner a voter
+//	CLUSTER REMOVE id                     take a node out of the cluster
+//	CLUSTER TRANSFER id                   hand leadership to a voter
+func (s *Server) handleCluster(conn net.Conn, request map[string]interface{}) {
+	args := utils.StringArgs(request["args"])
+	if len(args) == 0 {
+		s.sendError(conn, "CLUSTER requires a subcommand")
+		return
+	}
+
+	subcommand := strings.ToUpper(args[0])
+	if subcommand == "KEYSLOT" {
+		if len(args) != 2 {
+			s.sendError(conn, "CLUSTER KEYSLOT requires a key")
+			return
+		}
+		s.sendResponse(conn, map[string]interface{}{"status": "OK", "value": shard.Slot(args[1])})
+		return
+	}
+	switch subcommand {
+	case "MEMBERS", "ADDLEARNER", "PROMOTE", "REMOVE", "TRANSFER":
+		if s.cluster == nil {
+			s.sendError(conn, "cluster mode is not enabled")
+			return
+		}
+		s.membership(conn, subcommand, args[1:])
+		return
+	}
+	if s.cluster == nil || !s.config.Sharding {
+		s.sendError(conn, "sharding is not enabled")
+		return
+	}
+
+	var err error
+	switch subcommand {
+	case "SLOTS":
+		s.sendResponse(conn, map[string]interface{}{"status": "OK", "value": s.clusterSlots()})
+		return
+	case "SHARDS":
+		s.sendResponse(conn, map[string]interface{}{"status": "OK", "value": s.clusterShards()})
+		return
+	case "ADDSLOTS", "DELSLOTS":
+		if len(args) < 2 {
+			s.sendError(conn, "CLUSTER "+subcommand+" requires slots, as numbers or start-end ranges")
+			return
+		}
+		if subcommand == "ADDSLOTS" {
+			err = s.cluster.AddSlots(strings.Join(args[1:], ","))
+		} else {
+			err = s.cluster.DelSlots(strings.Join(args[1:], ","))
+		}
+	case "SETSLOT":
+		err = s.setSlot(args[1:])
+	case "MIGRATE":
+		s.migrate(conn, args[1:])
+		return
+	case "REBALANCE":
+		s.rebalance(conn, args[1:])
+		return
+	default:
+		err = fmt.Errorf("unknown CLUSTER subcommand %q", args[0])
+	}
+
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+	s.sendResponse(conn, map[string]interface{}{"status": "OK"})
+}
+
+// setSlot runs CLUSTER SETSLOT slot MIGRATING|IMPORTING|NODE group or CLUSTER SETSLOT slot STABLE
+func (s *Server) setSlot(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("CLUSTER SETSLOT requires a slot and a state")
+	}
+	slot, _, err := shard.ParseRange(args[0])
+	if err != nil {
+		return err
+	}
+	state := strings.ToUpper(args[1])
+	var group int
+	if state != "STABLE" {
+		if len(args) != 3 {
+			return fmt.Errorf("CLUSTER SETSLOT %s requires a group", state)
+		}
+		if group, err = strconv.Atoi(args[2]); err != nil {
+			return fmt.Errorf("invalid group %q", args[2])
+		}
+	}
+	return s.cluster.SetSlot(slot, state, int32(group))
+}
+
+// migrate runs CLUSTER MIGRATE range... group and answers with the number of keys moved
+func (s *Server) migrate(conn net.Conn, args []string) {
+	if len(args) < 2 {
+		s.sendError(conn, "CLUSTER MIGRATE requires slots and the group to move them to")
+		return
+	}
+	group, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		s.sendError(conn, fmt.Sprintf("invalid group %q", args[len(args)-1]))
+		return
+	}
+	moved, err := s.cluster.Migrate(strings.Join(args[:len(args)-1], ","), int32(group))
+	if err != nil {
+		s.sendError(conn, fmt.Sprintf("migration failed after moving %d keys: %v", moved, err))
+		return
+	}
+	s.sendResponse(conn, map[string]interface{}{"status": "OK", "value": moved})
+}
+
+// rebalance runs CLUSTER REBALANCE [EXCLUDE group...] and answers with the moves made
+func (s *Server) rebalance(conn net.Conn, args []string) {
+	var exclude []int32
+	if len(args) > 0 {
+		if strings.ToUpper(args[0]) != "EXCLUDE" || len(args) == 1 {
+			s.sendError(conn, "CLUSTER REBALANCE takes EXCLUDE and the groups to empty")
+			return
+		}
+		for _, arg := range args[1:] {
+			group, err := strconv.Atoi(arg)
+			if err != nil {
+				s.sendError(conn, fmt.Sprintf("invalid group %q", arg))
+				return
+			}
+			exclude = append(exclude, int32(group))
+		}
+	}
+
+	moves, moved, err := s.cluster.Rebalance(exclude)
+	if err != nil {
+		s.sendError(conn, fmt.Sprintf("rebalance failed after %d moves and %d keys: %v", len(moves), moved, err))
+		return
+	}
+	done := []interface{}{}
+	for _, move := range moves {
+		done = append(done, map[string]interface{}{"from": move.From, "to": move.To, "start": move.Start, "end": move.End})
+	}
+	s.sendResponse(conn, map[string]interface{}{"status": "OK", "value": done, "keys": moved})
+}
+
+// membership runs the CLUSTER subcommands that list and change the members of this cluster
+func (s *Server) membership(conn net.Conn, subcommand string, args []string) {
+	if subcommand == "MEMBERS" {
+		s.members(conn)
+		return
+	}
+
+	want := 1
+	if subcommand == "ADDLEARNER" {
+		want = 3
+	}
+	if len(args) != want {
+		usage := "a node id"
+		if want == 3 {
+			usage = "a node id, its gRPC address and its client address"
+		}
+		s.sendError(conn, "CLUSTER "+subcommand+" requires "+usage)
+		return
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		s.sendError(conn, fmt.Sprintf("invalid node id %q", args[0]))
+		return
+	}
+
+	switch subcommand {
+	case "ADDLEARNER":
+		err = s.cluster.AddLearner(int32(id), args[1], args[2])
+	case "PROMOTE":
+		err = s.cluster.Promote(int32(id))
+	case "REMOVE":
+		err = s.cluster.RemoveMember(int32(id))
+	case "TRANSFER":
+		err = s.cluster.TransferLeadership(int32(id))
+	}
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+	s.sendResponse(conn, map[string]interface{}{"status": "OK"})
+}
+
+// members lists the members of this cluster as its leader sees them
+func (s *Server) members(conn net.Conn) {
+	resp, err := s.cluster.Members()
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return
+	}
+	members := []interface{}{}
+	for _, m := range resp.Members {
+		members = append(members, map[string]interface{}{
+			"id":              m.NodeId,
+			"address":         m.ClientAddress,
+			"grpc_address":    m.Address,
+			"role":            m.Role,
+			"match_index":     m.MatchIndex,
+			"applied_index":   m.AppliedIndex,
+			"lag":             m.Lag,
+			"last_contact_ms": m.LastContactMs,
+		})
+	}
+	s.sendResponse(conn, map[string]interface{}{
+		"status": "OK",
+		"value":  members,
+		"leader": resp.LeaderId,
+		"term":   resp.Term,
+		"joint":  resp.Joint,
+	})
+}
+
+// clusterSlots lists the ranges of slots with the nodes serving them, the leader first
+func (s *Server) clusterSlots() []interface{} {
+	shards := s.cluster.Shards
+	slots := []interface{}{}
+	for _, r := range shards.Map() {
+		nodes := []interface{}{}
+		for _, info := range shards.Members(r.Group) {
+			nodes = append(nodes, map[string]interface{}{
+				"id":      info.NodeId,
+				"address": info.ClientAddress,
+				"role":    role(info.Leader),
+			})
+		}
+		slots = append(slots, map[string]interface{}{
+			"start": r.Start,
+			"end":   r.End,
+			"group": r.Group,
+			"nodes": nodes,
+		})
+	}
+	return slots
+}
+
+// clusterShards lists every group with the slots it serves and its nodes
+func (s *Server) clusterShards() []interface{} {
+	shards := s.cluster.Shards
+	ranges := make(map[int32][]interface{})
+	for _, r := range shards.Map() {
+		ranges[r.Group] = append(ranges[r.Group], map[string]interface{}{"start": r.Start, "end": r.End})
+	}
+
+	groups := []interface{}{}
+	seen := make(map[int32]bool)
+	for _, info := range shards.Nodes() {
+		if seen[info.GroupId] {
+			continue
+		}
+		seen[info.GroupId] = true
+
+		members := shards.Members(info.GroupId)
+		nodes := []interface{}{}
+		for _, member := range members {
+			nodes = append(nodes, map[string]interface{}{
+				"id":           member.NodeId,
+				"address":      member.ClientAddress,
+				"grpc_address": member.Address,
+				"role":         role(member.Leader),
+				"term":         member.Term,
+			})
+		}
+		slots := ranges[info.GroupId]
+		if slots == nil {
+			slots = []interface{}{}
+		}
+		group := map[string]interface{}{"group": info.GroupId, "slots": slots, "nodes": nodes}
+		// The leader knows the newest state of slots on the move
+		if config := members[0].Configuration; config != nil {
+			if len(config.Migrating) > 0 {
+				group["migrating"] = slotGroups(config.Migrating)
+			}
+			if len(config.Importing) > 0 {
+				group["importing"] = slotGroups(config.Importing)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// slotGroups keys a slot to group map by strings, which every client can decode
+func slotGroups(m map[uint32]int32) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for slot, group := range m {
+		out[strconv.Itoa(int(slot))] = group
+	}
+	return out
+}
+
+// role names a node's role in its group
+func role(leader bool) string {
+	if leader {
+		return "leader"
+	}
+	return "follower"
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/vskvj3/geomys/internal/pubsub"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// subscribedCommands are the only commands a connection with subscriptions may run
+var subscribedCommands = map[string]bool{"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "PING": true}
+
+// lockedConn serializes writes, replies and pushed messages share a connection
+type lockedConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *lockedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// publish answers PUBLISH with the number of subscribers that received the
+// message, on every node in cluster mode
+func (s *Server) publish(conn net.Conn, request map[string]interface{}) {
+	channel, ok := request["channel"].(string)
+	if !ok || channel == "" {
+		s.sendError(conn, "PUBLISH requires a 'channel' field")
+		return
+	}
+	message, ok := request["message"].(string)
+	if !ok {
+		s.sendError(conn, "PUBLISH requires a 'message' field")
+		return
+	}
+	var receivers int
+	if s.cluster != nil {
+		receivers = s.cluster.Publish(channel, message)
+	} else {
+		receivers = s.pubsub.Publish(channel, message)
+	}
+	s.sendResponse(conn, map[string]interface{}{"status": "OK", "value": receivers})
+}
+
+// subscribe changes the subscriptions of a connection, their names come in
+// 'args', and confirms each of them with the number of subscriptions left.
+// The first call puts the connection in push mode and returns its subscriber.
+func (s *Server) subscribe(conn net.Conn, sub *pubsub.Subscriber, command string, request map[string]interface{}) *pubsub.Subscriber {
+	names := utils.StringArgs(request["args"])
+	if len(names) == 0 && (command == "SUBSCRIBE" || command == "PSUBSCRIBE") {
+		s.sendError(conn, command+" requires at least one channel or pattern")
+		return sub
+	}
+	if sub == nil {
+		sub = s.pubsub.NewSubscriber(s.config.PubSubBufferLimit)
+		go s.push(conn, sub)
+	}
+
+	var counts []int
+	switch command {
+	case "SUBSCRIBE":
+		counts = sub.Subscribe(names...)
+	case "PSUBSCRIBE":
+		counts = sub.PSubscribe(names...)
+	case "UNSUBSCRIBE":
+		names, counts = sub.Unsubscribe(names...)
+	case "PUNSUBSCRIBE":
+		names, counts = sub.PUnsubscribe(names...)
+	}
+	kind := strings.ToLower(command)
+	if len(names) == 0 {
+		// Nothing was subscribed to
+		s.sendResponse(conn, map[string]interface{}{"status": "OK", "type": kind, "value": 0})
+	}
+	for i, name := range names {
+		s.sendResponse(conn, map[string]interface{}{"status": "OK", "type": kind, "channel": name, "value": counts[i]})
+	}
+	return sub
+}
+
+// push sends the messages of sub to the connection until the subscriber is
+// closed. A subscriber over its buffer limit loses its connection.
+func (s *Server) push(conn net.Conn, sub *pubsub.Subscriber) {
+	go func() {
+		<-sub.Done()
+		if sub.Overflowed() {
+			s.logger.Warn("Closing subscriber " + conn.RemoteAddr().String() + ", its output buffer limit was exceeded")
+			conn.Close()
+		}
+	}()
+	for {
+		m, ok := sub.Next()
+		if !ok {
+			return
+		}
+		response := map[string]interface{}{"status": "OK", "type": m.Kind, "channel": m.Channel, "value": m.Payload}
+		if m.Pattern != "" {
+			response["pattern"] = m.Pattern
+		}
+		s.sendResponse(conn, response)
+	}
+}
@@ -1,70 +1,88 @@
 package network
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/vskvj3/geomys/internal/backup"
 	"github.com/vskvj3/geomys/internal/cluster"
+	"github.com/vskvj3/geomys/internal/cluster/proto"
 	"github.com/vskvj3/geomys/internal/cluster/replication"
 	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"github.com/vskvj3/geomys/internal/pubsub"
+	"github.com/vskvj3/geomys/internal/security"
 	"github.com/vskvj3/geomys/internal/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
 	CommandHandler *core.CommandHandler
 	cluster        *cluster.ClusterServer
+	config         *utils.Config
+	logger         *utils.Logger
+	listener       net.Listener
+	tls            *security.Reloader // certificates of the client port
+	pubsub         *pubsub.Hub        // subscribers, shared with the cluster server in cluster mode
 	Port           string
-}
-
-func NewServer(cluster *cluster.ClusterServer, port string, handler *core.CommandHandler) (*Server, error) {
-	logger := utils.GetLogger()
-
-	// Load configuration
-	config, err := utils.GetConfig()
-	if err != nil {
-		return nil, fmt.Errorf("failed to load config: %v", err)
-	}
 
-	var leaderAddr string
-	if cluster != nil {
-		leaderAddr = cluster.LeaderAddress
-	}
+	mu    sync.Mutex
+	conns map[net.Conn]bool // connected clients, dropped on Close
+}
 
+func NewServer(config *utils.Config, logger *utils.Logger, cluster *cluster.ClusterServer, port string, handler *core.CommandHandler) (*Server, error) {
 	if handler.Database == nil {
 		return nil, fmt.Errorf("database is not initialized")
 	}
 
-	// Rebuild from persistence if standalone mode, else sync from leader
-	if !config.IsLeader && leaderAddr != "" {
-		replicationClient, err := replication.NewReplicationClient(leaderAddr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create replication client: %v", err)
+	// Rebuild from persistence, a cluster member catches up on the rest
+	// from the raft log once it starts
+	if err := handler.Database.RebuildFrom(handler.Persistence); err != nil {
+		logger.Warn("Could not read from persistence: " + err.Error())
+	} else {
+		logger.Info("Loaded data from persistence")
+		// Replace the replayed history with a snapshot so the log stays small
+		if err := handler.Compact(); err != nil {
+			logger.Warn("Could not compact persistence: " + err.Error())
 		}
+	}
 
-		logger.Info("Re-syncing from leader at " + leaderAddr)
-		if err := replicationClient.SyncRequest(handler); err != nil {
-			return nil, fmt.Errorf("sync request failed: %v", err)
+	reloader := security.NewReloader(config.ClientTLS)
+	if reloader.Enabled() {
+		// Without a CA client certificates would be checked against the system roots
+		if config.ClientTLS.ClientAuth != "" && config.ClientTLS.ClientAuth != "none" && config.ClientTLS.CAFile == "" {
+			return nil, fmt.Errorf("client_tls needs a ca_file to verify client certificates with client_auth %s", config.ClientTLS.ClientAuth)
 		}
-	} else {
-		if err := handler.Database.RebuildFromPersistence(); err != nil {
-			logger.Warn("Could not read from persistence: " + err.Error())
-		} else {
-			logger.Info("Loaded data from persistence")
+		if err := reloader.Reload(); err != nil {
+			return nil, err
 		}
 	}
 
 	handler.Database.StartCleanup(100 * time.Millisecond)
 	logger.Info("TCP server initialized on port " + port)
 
-	return &Server{CommandHandler: handler, cluster: cluster, Port: port}, nil
+	hub := pubsub.NewHub()
+	if cluster != nil {
+		hub = cluster.PubSub
+	}
+
+	return &Server{CommandHandler: handler, cluster: cluster, config: config, logger: logger, tls: reloader, pubsub: hub, Port: port, conns: make(map[net.Conn]bool)}, nil
 }
 
-// Start the TCP server and listen for client connections
-func (s *Server) Start() {
-	logger := utils.GetLogger()
+// Listen binds the TCP listener, falling back to a random port if the
+// configured one is taken
+func (s *Server) Listen() error {
+	logger := s.logger
 
 	// Attempt to bind to the configured port
 	listener, err := net.Listen("tcp", ":"+s.Port)
@@ -72,17 +90,61 @@ func (s *Server) Start() {
 		logger.Warn("Port " + s.Port + " unavailable. Selecting a random port...")
 		listener, err = net.Listen("tcp", ":0")
 		if err != nil {
+			return err
+		}
+	}
+	if s.tls.Enabled() {
+		listener = tls.NewListener(listener, s.tls.ServerConfig(nil))
+		logger.Info("Client connections use TLS")
+	}
+	s.listener = listener
+	logger.Info("Server is listening on " + listener.Addr().String())
+	return nil
+}
+
+// ReloadTLS rereads the certificates of the client port, new connections use them
+func (s *Server) ReloadTLS() error {
+	if !s.tls.Enabled() {
+		return nil
+	}
+	return s.tls.Reload()
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting new clients and disconnects the connected ones
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Start the TCP server and listen for client connections
+func (s *Server) Start() {
+	logger := s.logger
+
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
 			logger.Error("Error starting server: " + err.Error())
 			return
 		}
 	}
-	defer listener.Close()
-	logger.Info("Server is listening on " + listener.Addr().String())
+	defer s.listener.Close()
 
 	// Accept incoming connections
 	for {
-		conn, err := listener.Accept()
+		conn, err := s.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logger.Error("Error accepting connection: " + err.Error())
 			continue
 		}
@@ -93,18 +155,34 @@ func (s *Server) Start() {
 
 // Handle an incoming client connection
 func (s *Server) HandleConnection(conn net.Conn) {
+	logger := s.logger
+	conn = &lockedConn{Conn: conn}
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
 	defer func() {
-		logger := utils.GetLogger()
 		logger.Info("Client disconnected: " + conn.RemoteAddr().String())
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
 		conn.Close()
 	}()
 
-	logger := utils.GetLogger()
-	config, err := utils.GetConfig()
-	if err != nil {
-		logger.Error("Failed to load configuration: " + err.Error())
-		return
-	}
+	// Write concern set with WRITECONCERN and the log index of the last
+	// write, which WAIT waits for
+	var concern string
+	var lastIndex uint64
+	// ASKING lets the next command reach a slot this node's group is importing
+	var asking bool
+	// The user the connection authenticated as, "" for the default user
+	var user string
+	// The subscriptions of the connection, nil until it first subscribes
+	var sub *pubsub.Subscriber
+	defer func() {
+		if sub != nil {
+			sub.Close()
+		}
+	}()
 
 	for {
 		buffer := make([]byte, 1024)
@@ -127,74 +205,289 @@ func (s *Server) HandleConnection(conn net.Conn) {
 
 		logger.Debug("Received request from client: " + conn.RemoteAddr().String())
 
+		name, _ := request["command"].(string)
+		key, _ := request["key"].(string)
+		if err := s.CommandHandler.Authorize(user, name, key); err != nil {
+			s.sendError(conn, err.Error())
+			continue
+		}
+		// A connection with subscriptions only receives messages and changes them
+		if sub != nil && sub.Count() > 0 && !subscribedCommands[strings.ToUpper(name)] {
+			s.sendError(conn, "only SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE, PUNSUBSCRIBE and PING are allowed while subscribed")
+			continue
+		}
+		askingNow := asking
+		asking = false
+		switch strings.ToUpper(name) {
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+			sub = s.subscribe(conn, sub, strings.ToUpper(name), request)
+			continue
+		case "PUBLISH":
+			s.publish(conn, request)
+			continue
+		case "AUTH":
+			user = s.handleAuth(conn, request, user)
+			continue
+		case "ACL":
+			if args := utils.StringArgs(request["args"]); len(args) > 0 && strings.ToUpper(args[0]) == "WHOAMI" {
+				s.sendResponse(conn, map[string]interface{}{"status": "OK", "value": whoami(user)})
+				continue
+			}
+		case "ASKING":
+			asking = true
+			s.sendResponse(conn, map[string]interface{}{"status": "OK"})
+			continue
+		case "CLUSTER":
+			s.handleCluster(conn, request)
+			continue
+		case "ROLE":
+			s.sendResponse(conn, s.role())
+			continue
+		case "WRITECONCERN":
+			level, _ := request["value"].(string)
+			if _, err := core.ParseWriteConcern(level); err != nil {
+				s.sendError(conn, err.Error())
+			} else {
+				concern = level
+				s.sendResponse(conn, map[string]interface{}{"status": "OK"})
+			}
+			continue
+		case "WAIT":
+			if _, ok := request["index"]; !ok {
+				request["index"] = lastIndex
+			}
+		case "GET":
+			// Without a token, a session read follows this connection's writes
+			if _, ok := request["session"]; !ok && lastIndex > 0 {
+				request["session"] = lastIndex
+			}
+		}
+		if _, ok := request["write_concern"]; !ok && concern != "" {
+			request["write_concern"] = concern
+		}
+
 		command, err := utils.ConvertRequestToCommand(request)
 		if err != nil {
 			logger.Error("Request to command conversion failed")
 		}
 
-		var replicationClient *replication.ReplicationClient
-
-		// If not the leader and command is a write, forward it to the leader
-		if config.ClusterMode && !config.IsLeader && s.cluster != nil && isWriteCommand(command.Command) {
-			logger.Info("Forwarding write request to leader node: " + s.cluster.LeaderAddress)
+		// Backups are taken locally on whichever node receives the command
+		if strings.ToUpper(command.Command) == "BACKUP" {
+			s.handleBackup(conn, request)
+			continue
+		}
 
-			replicationClient, err = replication.NewReplicationClient(s.cluster.LeaderAddress)
-			if err != nil {
-				logger.Error("Replication client creation failed: " + err.Error())
-				s.sendError(conn, "Failed to connect to leader")
+		// With sharding, keys of slots another group serves are redirected there
+		release := func() {}
+		if key, ok := request["key"].(string); ok && s.cluster != nil {
+			exists := func() bool { return s.CommandHandler.Database.Exists(key) }
+			var redirect string
+			redirect, release = s.cluster.Route(key, isWriteCommand(command.Command), askingNow, exists)
+			if redirect != "" {
+				s.sendError(conn, redirect)
 				continue
 			}
+			// A forwarded write is routed again on the leader
+			command.Asking = askingNow
+		}
+
+		if index := s.execute(conn, request, command); index > 0 {
+			lastIndex = index
+		}
+		release()
+	}
+}
+
+// execute runs a command here, or on the leader when this node follows and
+// it is a write, and returns the log index of the write
+func (s *Server) execute(conn net.Conn, request map[string]interface{}, command *proto.Command) uint64 {
+	logger := s.logger
+
+	// A node still installing a snapshot or replaying the log would serve stale data
+	if s.cluster != nil && !s.cluster.Ready() && strings.ToUpper(command.Command) == "GET" {
+		s.sendError(conn, "LOADING node is catching up with the cluster, try again later")
+		return 0
+	}
 
-			response, err := replicationClient.ForwardRequest(int32(config.NodeID), command)
-			if err != nil {
-				logger.Error("Forward request failed: " + err.Error())
+	// If not the leader and command is a write, forward it to the leader or
+	// tell the client where the leader is
+	if s.cluster != nil && !s.cluster.IsLeader() && (isWriteCommand(command.Command) || strings.ToUpper(command.Command) == "WAIT") {
+		if s.config.FollowerWrites == "redirect" {
+			s.sendRedirect(conn)
+			return 0
+		}
+		leaderAddr := s.cluster.GetLeaderAddress()
+		if leaderAddr == "" {
+			s.sendError(conn, "No leader elected, try again later")
+			return 0
+		}
+		logger.Info("Forwarding write request to leader node: " + leaderAddr)
+
+		replicationClient, err := replication.NewReplicationClient(s.cluster.Pool, leaderAddr)
+		if err != nil {
+			logger.Error("Replication client creation failed: " + err.Error())
+			s.sendError(conn, "Failed to connect to leader")
+			return 0
+		}
+
+		// The leader runs the request as the client sent it, but for passwords
+		if err := s.CommandHandler.HashPasswords(request); err != nil {
+			s.sendError(conn, err.Error())
+			return 0
+		}
+		if command.Request, err = utils.EncodeResponse(request); err != nil {
+			s.sendError(conn, "Invalid request format")
+			return 0
+		}
+		response, err := replicationClient.ForwardRequest(int32(s.config.NodeID), s.cluster.Term(), command)
+		if err != nil {
+			logger.Error("Forward request failed: " + err.Error())
+			if st, ok := status.FromError(err); ok && st.Code() == codes.Unknown {
+				// The leader ran the command and it failed, a write concern timeout for example
+				s.sendError(conn, st.Message())
+			} else {
 				s.sendError(conn, "Failed to forward request to leader")
-				continue
 			}
+			return 0
+		}
 
-			responseMap := map[string]interface{}{"status": response.Status}
-
+		// Leaders that send the full response keep every field's type
+		responseMap, err := utils.DecodeRequest(response.Response)
+		if len(response.Response) == 0 || err != nil {
+			responseMap = map[string]interface{}{"status": response.Status}
 			if msg := response.Message; msg != "" {
-				responseMap["value"] = msg
+				responseMap["message"] = msg
 			}
 			if val := response.Value; val != "" {
 				responseMap["value"] = val
 			}
-
-			logger.Debug("Got response for forward request: ")
-			fmt.Println(response)
-			s.sendResponse(conn, responseMap)
-			continue
+			if response.Index > 0 {
+				responseMap["index"] = response.Index
+			}
 		}
 
-		// Process command normally on the leader
-		response, err := s.CommandHandler.HandleCommand(request)
-		if err != nil {
-			s.sendError(conn, err.Error())
-		} else {
-			s.sendResponse(conn, response)
-			if config.IsLeader && s.cluster.LeaderID == s.cluster.NodeID && isWriteCommand(command.Command) {
-				replication.ReplicateToFollowers(command, s.cluster.ReplicationService)
-			}
+		logger.Debug(fmt.Sprintf("Got response for forward request: %v", response))
+		s.sendResponse(conn, responseMap)
+		return response.Index
+	}
 
-		}
+	// Process command normally on the leader
+	response, err := s.CommandHandler.HandleCommand(request)
+	if err != nil {
+		s.sendError(conn, err.Error())
+		return 0
+	}
+	s.sendResponse(conn, response)
+	index, _ := response["index"].(uint64)
+	return index
+}
+
+// sendRedirect answers a write sent to a follower with where the leader
+// serves clients and its term, for the client to send it there
+func (s *Server) sendRedirect(conn net.Conn) {
+	leader := s.cluster.GetLeaderClientAddress()
+	if leader == "" {
+		s.sendError(conn, "No leader elected, try again later")
+		return
+	}
+	term := s.cluster.Term()
+	s.sendResponse(conn, map[string]interface{}{
+		"status":    "ERROR",
+		"message":   fmt.Sprintf("REDIRECT %s %d", leader, term),
+		"leader":    leader,
+		"leader_id": s.cluster.GetLeaderID(),
+		"term":      term,
+	})
+}
+
+// role tells clients whether this node leads and where they reach the
+// leader and the other members
+func (s *Server) role() map[string]interface{} {
+	response := map[string]interface{}{"status": "OK", "value": "standalone", "node_id": s.config.NodeID}
+	if s.cluster == nil {
+		return response
+	}
+	response["value"] = role(s.cluster.IsLeader())
+	response["term"] = s.cluster.Term()
+	if leader := s.cluster.GetLeaderClientAddress(); leader != "" {
+		response["leader"] = leader
+	}
+	leaderID := s.cluster.GetLeaderID()
+	addresses := s.cluster.GetClientAddresses()
+	ids := make([]int, 0, len(addresses))
+	for id := range addresses {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	nodes := []interface{}{}
+	for _, id := range ids {
+		nodes = append(nodes, map[string]interface{}{"id": id, "address": addresses[int32(id)], "role": role(int32(id) == leaderID)})
+	}
+	response["nodes"] = nodes
+	if s.config.Sharding {
+		response["group"] = s.config.ShardGroup
 	}
+	return response
+}
+
+// handleBackup writes a consistent snapshot of the database to the requested path
+func (s *Server) handleBackup(conn net.Conn, request map[string]interface{}) {
+	target, ok := request["path"].(string)
+	if !ok || target == "" {
+		s.sendError(conn, "BACKUP requires a 'path' field")
+		return
+	}
+	// Clients only name a backup, it is written below the backup directory
+	if !filepath.IsLocal(target) {
+		s.sendError(conn, "BACKUP path must be relative to the backup directory and must not contain '..'")
+		return
+	}
+	dir := s.config.GetBackupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		s.sendError(conn, "Backup failed: "+err.Error())
+		return
+	}
+	target = filepath.Join(dir, target)
+
+	term := int64(-1)
+	if s.cluster != nil {
+		term = int64(s.cluster.Term())
+	}
+
+	meta, err := backup.Create(s.CommandHandler.Database, persistence.CodecOf(s.CommandHandler.Persistence), s.config.NodeID, term, target)
+	if err != nil {
+		s.logger.Error("Backup failed: " + err.Error())
+		s.sendError(conn, "Backup failed: "+err.Error())
+		return
+	}
+
+	s.logger.Info(fmt.Sprintf("Backup written to %s at log position %d", target, meta.LogPosition))
+	s.sendResponse(conn, map[string]interface{}{
+		"status":       "OK",
+		"message":      target,
+		"node_id":      meta.NodeID,
+		"term":         meta.Term,
+		"log_position": meta.LogPosition,
+		"created_at":   meta.CreatedAt.Format(time.RFC3339),
+	})
 }
 
 func isWriteCommand(command string) bool {
 	writeCommands := map[string]bool{
-		"SET":  true,
-		"INCR": true,
-		"PUSH": true,
-		"LPOP": true,
-		"RPOP": true,
+		"SET":     true,
+		"INCR":    true,
+		"PUSH":    true,
+		"LPOP":    true,
+		"RPOP":    true,
+		"FLUSHDB": true,
+		"ACL":     true,
 	}
 	return writeCommands[command]
 }
 
 // sendResponse serializes the response and sends it to the client
 func (s *Server) sendResponse(conn net.Conn, response map[string]interface{}) {
-	logger := utils.GetLogger()
+	logger := s.logger
 	data, err := utils.EncodeResponse(response)
 	if err != nil {
 		logger.Error("Failed to encode response: " + err.Error())
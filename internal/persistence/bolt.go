@@ -0,0 +1,172 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// logBucket holds frames keyed by a big endian sequence number,
+// metaBucket the layout version of those frames
+var (
+	logBucket  = []byte("log")
+	metaBucket = []byte("meta")
+	formatKey  = []byte("format")
+)
+
+// Bolt is an engine backed by an embedded bbolt B-tree
+type Bolt struct {
+	db    *bolt.DB
+	codec *Codec
+}
+
+// OpenBolt opens (or creates) a bbolt database at the given path.
+// Records are compressed and encrypted as codec says.
+func OpenBolt(path string, codec *Codec) (*Bolt, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create persistence directory: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database: %v", err)
+	}
+
+	b := &Bolt{db: db, codec: codec}
+	if err := db.Update(b.upgrade); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// upgrade creates the buckets and wraps bare records from older versions into frames
+func (b *Bolt) upgrade(tx *bolt.Tx) error {
+	bucket, err := tx.CreateBucketIfNotExists(logBucket)
+	if err != nil {
+		return err
+	}
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(meta.Get(formatKey), fileMagic) {
+		return nil
+	}
+
+	var keys, frames [][]byte
+	err = bucket.ForEach(func(k, v []byte) error {
+		frame, err := encodeFrame(v, 0, b.codec)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, append([]byte(nil), k...))
+		frames = append(frames, frame)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if err := bucket.Put(keys[i], frames[i]); err != nil {
+			return err
+		}
+	}
+	return meta.Put(formatKey, fileMagic)
+}
+
+// Codec returns the codec records are written with, nil when stored as is
+func (b *Bolt) Codec() *Codec {
+	return b.codec
+}
+
+// Append stores a request under the next sequence number
+func (b *Bolt) Append(req map[string]interface{}) error {
+	record, err := encodeRecord(req)
+	if err != nil {
+		return err
+	}
+	frame, err := encodeFrame(record, flagIndexed, b.codec)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx.Bucket(logBucket), frame)
+	})
+}
+
+// Replay iterates the log bucket in sequence order
+func (b *Bolt) Replay(apply func(req map[string]interface{}) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(logBucket).ForEach(func(_, v []byte) error {
+			flags, payload, err := readFrame(bytes.NewReader(v), b.codec)
+			if err != nil {
+				return err
+			}
+			return decodeRecords(flags, payload, apply)
+		})
+	})
+}
+
+// Snapshot replaces the log bucket with records in a single transaction.
+// Everything is written with the current key, which is how keys are rotated.
+func (b *Bolt) Snapshot(records []map[string]interface{}) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := recreateBucket(tx)
+		if err != nil {
+			return err
+		}
+		for _, req := range records {
+			record, err := encodeRecord(req)
+			if err != nil {
+				return err
+			}
+			frame, err := encodeFrame(record, flagIndexed, b.codec)
+			if err != nil {
+				return err
+			}
+			if err := putRecord(bucket, frame); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Truncate drops every record
+func (b *Bolt) Truncate() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		_, err := recreateBucket(tx)
+		return err
+	})
+}
+
+// Close closes the bolt database
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// putRecord appends a frame under the bucket's next sequence number
+func putRecord(bucket *bolt.Bucket, record []byte) error {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return bucket.Put(key, record)
+}
+
+// recreateBucket empties the log bucket
+func recreateBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	if err := tx.DeleteBucket(logBucket); err != nil && err != bolt.ErrBucketNotFound {
+		return nil, err
+	}
+	return tx.CreateBucket(logBucket)
+}
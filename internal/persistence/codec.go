@@ -0,0 +1,102 @@
+package persistence
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Codec controls how frames are written: compressed, encrypted with AES-GCM,
+// or both. Frames written under any known key or algorithm can be read.
+type Codec struct {
+	compression uint8
+	currentID   uint32
+	keys        map[uint32]cipher.AEAD
+}
+
+// NewCodec builds a codec from a compression name and raw AES keys.
+// The first key encrypts new data, without keys nothing is encrypted.
+func NewCodec(compression string, keys ...[]byte) (*Codec, error) {
+	flag, err := compressionFlag(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := &Codec{compression: flag}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %v", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		if codec.keys == nil {
+			codec.keys = make(map[uint32]cipher.AEAD)
+		}
+		id := KeyID(key)
+		codec.keys[id] = aead
+		if i == 0 {
+			codec.currentID = id
+		}
+	}
+	return codec, nil
+}
+
+// LoadCodec reads the current key from keyFile or the environment variable
+// keyEnv, and older keys from previousKeyFiles. It returns nil when neither
+// compression nor a key is configured, which means frames are stored as is.
+func LoadCodec(compression string, keyFile string, keyEnv string, previousKeyFiles []string) (*Codec, error) {
+	var keys [][]byte
+	switch {
+	case keyFile != "":
+		key, err := readKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	case keyEnv != "":
+		value, ok := os.LookupEnv(keyEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", keyEnv)
+		}
+		key, err := parseKey([]byte(value))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	case len(previousKeyFiles) > 0:
+		return nil, errors.New("previous encryption keys are configured without a current key")
+	}
+
+	for _, path := range previousKeyFiles {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 && (compression == "" || compression == CompressionNone) {
+		return nil, nil
+	}
+	return NewCodec(compression, keys...)
+}
+
+// Encrypted reports whether new frames are encrypted
+func (c *Codec) Encrypted() bool {
+	return c != nil && c.keys != nil
+}
+
+// WithoutKeys returns a codec that compresses like c but never encrypts,
+// used for data leaving the node
+func (c *Codec) WithoutKeys() *Codec {
+	if c == nil || c.compression == 0 {
+		return nil
+	}
+	return &Codec{compression: c.compression}
+}
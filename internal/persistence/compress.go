@@ -0,0 +1,94 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms accepted in the "compression" config key
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+	CompressionS2     = "s2"
+)
+
+// The algorithm of a frame is stored in bits 1 and 2 of its flags
+const (
+	compressionMask   uint8 = 3 << 1
+	compressionSnappy uint8 = 1 << 1
+	compressionZstd   uint8 = 2 << 1
+	compressionS2     uint8 = 3 << 1
+)
+
+// zstd encoders and decoders are expensive to create but safe to share
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxFrameSize))
+}
+
+// compressionFlag maps an algorithm name to its frame flag, 0 for none
+func compressionFlag(name string) (uint8, error) {
+	switch name {
+	case CompressionNone, "":
+		return 0, nil
+	case CompressionSnappy:
+		return compressionSnappy, nil
+	case CompressionZstd:
+		return compressionZstd, nil
+	case CompressionS2:
+		return compressionS2, nil
+	default:
+		return 0, fmt.Errorf("unknown compression: %s", name)
+	}
+}
+
+// compress encodes data with the algorithm of flag
+func compress(flag uint8, data []byte) []byte {
+	switch flag {
+	case compressionSnappy:
+		return snappy.Encode(nil, data)
+	case compressionZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(data, nil)
+	case compressionS2:
+		return s2.Encode(nil, data)
+	default:
+		return data
+	}
+}
+
+// decompress reverses compress, whatever algorithm the frame was written with
+func decompress(flag uint8, data []byte) ([]byte, error) {
+	var out []byte
+	var err error
+	switch flag {
+	case compressionSnappy, compressionS2:
+		// s2 reads snappy blocks too
+		var n int
+		if n, err = s2.DecodedLen(data); err == nil && n > maxFrameSize {
+			return nil, errors.New("corrupt frame: length out of range")
+		}
+		out, err = s2.Decode(nil, data)
+	case compressionZstd:
+		zstdOnce.Do(initZstd)
+		out, err = zstdDecoder.DecodeAll(data, nil)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress frame: %v", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyID derives the identifier stored next to data encrypted with key
+func KeyID(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+// readKeyFile loads a key from disk
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %v", err)
+	}
+	return parseKey(data)
+}
+
+// parseKey accepts a 16, 24 or 32 byte key encoded as hex or base64, or the
+// raw bytes of a binary key. Text is always decoded, so a key reads the same
+// with or without a trailing newline.
+func parseKey(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && isKeySize(len(key)) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && isKeySize(len(key)) {
+		return key, nil
+	}
+	if isKeySize(len(data)) && !isText(data) {
+		return data, nil
+	}
+	return nil, errors.New("encryption key must be 16, 24 or 32 bytes, encoded as hex or base64 or as a binary file")
+}
+
+// isText reports whether data only holds printable ASCII and white space
+func isText(data []byte) bool {
+	for _, b := range data {
+		if (b < 0x20 && b != '\n' && b != '\r' && b != '\t') || b >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isKeySize(n int) bool {
+	return n == 16 || n == 24 || n == 32
+}
+
+// seal encrypts plaintext with the current key, header is authenticated but not encrypted
+func (c *Codec) seal(header []byte, plaintext []byte) ([]byte, error) {
+	aead := c.keys[c.currentID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, header), nil
+}
+
+// open decrypts data written by seal under the key with the given ID
+func (c *Codec) open(keyID uint32, header []byte, data []byte) ([]byte, error) {
+	if !c.Encrypted() {
+		return nil, errors.New("data is encrypted but no encryption key is configured")
+	}
+	aead, ok := c.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("data is encrypted with unknown key %08x", keyID)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted frame is too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt frame: %v", err)
+	}
+	return plaintext, nil
+}
+
+// headerBytes is the part of a frame used as additional authenticated data
+func headerBytes(flags uint8, keyID uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.LittleEndian, keyID)
+	return buf.Bytes()
+}
@@ -0,0 +1,78 @@
+package persistence
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Engine stores the write history of a node.
+// Records are request maps as produced by core.CommandHandler.
+type Engine interface {
+	// Append durably stores one applied write
+	Append(req map[string]interface{}) error
+	// Replay calls apply for every stored record in order
+	Replay(apply func(req map[string]interface{}) error) error
+	// Snapshot atomically replaces the stored history with records
+	Snapshot(records []map[string]interface{}) error
+	// Truncate removes every stored record
+	Truncate() error
+	// Close releases the underlying storage
+	Close() error
+}
+
+// Engine names accepted in the "persistence" config key
+const (
+	EngineBinlog = "writethroughdisk"
+	EngineMemory = "memory"
+	EngineBolt   = "bolt"
+)
+
+// NewEngine opens the named engine inside dir, compressing and encrypting
+// records as codec says
+func NewEngine(name string, dir string, codec *Codec) (Engine, error) {
+	path, err := EngineFile(name, dir)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case EngineMemory:
+		return NewMemoryEngine(), nil
+	case EngineBolt:
+		return OpenBolt(path, codec)
+	default:
+		return OpenBinlog(path, codec)
+	}
+}
+
+// EngineFile returns the file the named engine keeps its records in inside
+// dir, "" for the memory engine
+func EngineFile(name string, dir string) (string, error) {
+	switch name {
+	case EngineBinlog, "bufferedwrite", "":
+		return filepath.Join(dir, "binlog.dat"), nil
+	case EngineMemory:
+		return "", nil
+	case EngineBolt:
+		return filepath.Join(dir, "data.bolt"), nil
+	default:
+		return "", fmt.Errorf("unknown persistence engine: %s", name)
+	}
+}
+
+// CodecOf returns the codec an engine writes with, nil when stored as is
+func CodecOf(engine Engine) *Codec {
+	if e, ok := engine.(interface{ Codec() *Codec }); ok {
+		return e.Codec()
+	}
+	return nil
+}
+
+// LoadRequests collects every record of an engine into a slice
+func LoadRequests(engine Engine) ([]map[string]interface{}, error) {
+	var requests []map[string]interface{}
+	err := engine.Replay(func(req map[string]interface{}) error {
+		requests = append(requests, req)
+		return nil
+	})
+	return requests, err
+}
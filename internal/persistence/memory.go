@@ -0,0 +1,19 @@
+package persistence
+
+// MemoryEngine keeps nothing, for tests and pure cache deployments
+type MemoryEngine struct{}
+
+// NewMemoryEngine returns an engine that discards every write
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{}
+}
+
+func (*MemoryEngine) Append(map[string]interface{}) error { return nil }
+
+func (*MemoryEngine) Replay(func(map[string]interface{}) error) error { return nil }
+
+func (*MemoryEngine) Snapshot([]map[string]interface{}) error { return nil }
+
+func (*MemoryEngine) Truncate() error { return nil }
+
+func (*MemoryEngine) Close() error { return nil }
@@ -0,0 +1,241 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// endMarker terminates every record ("EOF\0")
+var endMarker = []byte{0x45, 0x4F, 0x46, 0x00}
+
+// Frame flags, bits 1 and 2 hold the compression algorithm
+const (
+	flagEncrypted uint8 = 1 << 0
+	flagIndexed   uint8 = 1 << 3 // records carry their log index
+)
+
+// maxFrameSize guards against allocating garbage lengths from a corrupt file
+const maxFrameSize = 1 << 30
+
+// Frames wrap one or more records:
+//
+//	flags   uint8    see flagEncrypted, flagIndexed and compressionMask
+//	keyID   uint32   only when encrypted
+//	length  uint32
+//	payload []byte   records, compressed and then sealed with AES-GCM
+
+// encodeFrame wraps encoded records, compressing and encrypting them as
+// codec says. Compression is skipped when it does not make the frame smaller.
+func encodeFrame(records []byte, flags uint8, codec *Codec) ([]byte, error) {
+	var keyID uint32
+	payload := records
+	if codec != nil && codec.compression != 0 {
+		if compressed := compress(codec.compression, records); len(compressed) < len(records) {
+			flags |= codec.compression
+			payload = compressed
+		}
+	}
+	if codec.Encrypted() {
+		flags |= flagEncrypted
+		keyID = codec.currentID
+		sealed, err := codec.seal(headerBytes(flags, keyID), payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = sealed
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(flags)
+	if flags&flagEncrypted != 0 {
+		binary.Write(buf, binary.LittleEndian, keyID)
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// readFrame reads one frame and returns its flags and decrypted, decompressed
+// records. io.EOF means there are no more frames, io.ErrUnexpectedEOF a torn write.
+func readFrame(r io.Reader, codec *Codec) (uint8, []byte, error) {
+	var flags [1]byte
+	if _, err := io.ReadFull(r, flags[:]); err != nil {
+		return 0, nil, err
+	}
+
+	var keyID uint32
+	if flags[0]&flagEncrypted != 0 {
+		if err := binary.Read(r, binary.LittleEndian, &keyID); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+	}
+
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if length > maxFrameSize {
+		return 0, nil, errors.New("corrupt frame: length out of range")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+
+	if flags[0]&flagEncrypted != 0 {
+		opened, err := codec.open(keyID, headerBytes(flags[0], keyID), payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		payload = opened
+	}
+	payload, err := decompress(flags[0]&compressionMask, payload)
+	return flags[0], payload, err
+}
+
+// EncodeFrame wraps arbitrary data in a frame written with codec
+func EncodeFrame(data []byte, codec *Codec) ([]byte, error) {
+	return encodeFrame(data, 0, codec)
+}
+
+// ReadFrame reads one frame written by EncodeFrame
+func ReadFrame(r io.Reader, codec *Codec) ([]byte, error) {
+	_, data, err := readFrame(r, codec)
+	return data, err
+}
+
+// decodeRecords hands every record of a frame payload to apply
+func decodeRecords(flags uint8, payload []byte, apply func(req map[string]interface{}) error) error {
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		req, err := decodeRecord(r, true, flags&flagIndexed != 0)
+		if err != nil {
+			return err
+		}
+		if err := apply(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unexpectedEOF turns an EOF in the middle of a frame into io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// EncodeRecord serializes a request the way it is logged
+func EncodeRecord(req map[string]interface{}) ([]byte, error) {
+	return encodeRecord(req)
+}
+
+// DecodeRecord parses a request serialized by EncodeRecord
+func DecodeRecord(data []byte) (map[string]interface{}, error) {
+	return decodeRecord(bytes.NewReader(data), true, true)
+}
+
+// encodeRecord serializes a request.
+// Only command is mandatory; key, value, offset, expire_at and index are
+// written as empty fields when absent.
+func encodeRecord(req map[string]interface{}) ([]byte, error) {
+	cmd, ok := req["command"].(string)
+	if !ok || cmd == "" {
+		return nil, errors.New("cannot log request without a command")
+	}
+
+	buf := new(bytes.Buffer)
+	writeField(buf, cmd)
+	writeField(buf, stringField(req, "key"))
+	writeField(buf, stringField(req, "value"))
+	writeField(buf, stringField(req, "offset"))
+
+	// Absolute expiry in unix milliseconds, 0 when the key does not expire
+	expireAt, _ := req["expire_at"].(int64)
+	binary.Write(buf, binary.LittleEndian, expireAt)
+
+	// Log index of the write, 0 when it has none
+	index, _ := req["index"].(uint64)
+	binary.Write(buf, binary.LittleEndian, index)
+
+	buf.Write(endMarker)
+	return buf.Bytes(), nil
+}
+
+// decodeRecord reads one record, older layouts carry no expiry or no index
+func decodeRecord(r io.Reader, expiry bool, indexed bool) (map[string]interface{}, error) {
+	var fields [4]string
+	for i := range fields {
+		field, err := readField(r)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = field
+	}
+
+	var expireAt int64
+	if expiry {
+		if err := binary.Read(r, binary.LittleEndian, &expireAt); err != nil {
+			return nil, err
+		}
+	}
+	var index uint64
+	if indexed {
+		if err := binary.Read(r, binary.LittleEndian, &index); err != nil {
+			return nil, err
+		}
+	}
+
+	marker := make([]byte, len(endMarker))
+	if _, err := io.ReadFull(r, marker); err != nil || !bytes.Equal(marker, endMarker) {
+		return nil, errors.New("corrupt record: missing end marker")
+	}
+
+	// Construct request map
+	req := map[string]interface{}{"command": fields[0]}
+	if fields[1] != "" {
+		req["key"] = fields[1]
+	}
+	if fields[2] != "" {
+		req["value"] = fields[2]
+	}
+	if fields[3] != "" {
+		req["offset"] = fields[3]
+	}
+	if expireAt != 0 {
+		req["expire_at"] = expireAt
+	}
+	if index != 0 {
+		req["index"] = index
+	}
+	return req, nil
+}
+
+// writeField writes a length prefixed string
+func writeField(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, int32(len(s)))
+	buf.WriteString(s)
+}
+
+// readField reads a length prefixed string
+func readField(r io.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// stringField returns req[name] if it is a string, "" otherwise
+func stringField(req map[string]interface{}, name string) string {
+	s, _ := req[name].(string)
+	return s
+}
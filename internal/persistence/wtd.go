@@ -1,42 +1,36 @@
 package persistence
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"sync"
-
-	"github.com/vskvj3/geomys/internal/utils"
 )
 
-// Singleton persistence instance and mutex for thread safety
+// File headers. Binlogs are always written as framed files, the older
+// layouts are only read and get rewritten when opened.
 var (
-	instance *Persistence
-	mu       sync.Mutex
+	fileMagic    = []byte{'G', 'B', 'L', 0x03} // framed records
+	recordMagic  = []byte{'G', 'B', 'L', 0x02} // bare records with expiry
+	snapshotSize = 64 * 1024                   // records per snapshot frame, in bytes
 )
 
-// Persistence manages binary log storage
-type Persistence struct {
-	file *os.File
-	mu   sync.Mutex
+// Binlog is the write-through disk engine, an append-only binary log
+type Binlog struct {
+	file  *os.File
+	codec *Codec
+	mu    sync.Mutex
 }
 
-// NewPersistence initializes persistence storage
-func NewPersistence() (*Persistence, error) {
-	homeDir, _ := os.UserHomeDir()
-	config, err := utils.GetConfig()
-	if err != nil {
-		return nil, errors.New("failed to load config")
-	}
-	persistenceDir := filepath.Join(homeDir, ".geomys", "Node"+strconv.Itoa(config.NodeID))
-	persistenceFile := filepath.Join(persistenceDir, "binlog.dat")
-
+// OpenBinlog opens (or creates) a binlog at the given path.
+// Records are compressed and encrypted as codec says.
+func OpenBinlog(persistenceFile string, codec *Codec) (*Binlog, error) {
 	// Ensure the directory exists
-	err = os.MkdirAll(persistenceDir, 0755)
+	err := os.MkdirAll(filepath.Dir(persistenceFile), 0755)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create persistence directory: %v", err)
 	}
@@ -47,205 +41,240 @@ func NewPersistence() (*Persistence, error) {
 		return nil, fmt.Errorf("failed to open persistence file: %v", err)
 	}
 
-	return &Persistence{file: file}, nil
+	p := &Binlog{file: file, codec: codec}
+	if err := p.writeHeaderIfEmpty(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := p.upgrade(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
 }
 
-// CreateOrReplacePersistence returns an existing persistence instance or creates a new one
-func CreateOrReplacePersistence() (*Persistence, error) {
-	mu.Lock()
-	defer mu.Unlock()
+// writeHeaderIfEmpty stamps a fresh file with the binlog magic
+func (p *Binlog) writeHeaderIfEmpty() error {
+	info, err := p.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat persistence file: %w", err)
+	}
+	if info.Size() > 0 {
+		return nil
+	}
+	_, err = p.file.Write(fileMagic)
+	return err
+}
 
-	// If an instance already exists, return it
-	if instance != nil {
-		return instance, nil
+// upgrade rewrites a binlog from an older layout as a framed file
+func (p *Binlog) upgrade() error {
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(p.file, magic); err == nil && bytes.Equal(magic, fileMagic) {
+		return nil
 	}
 
-	// Otherwise, create a new instance
-	p, err := NewPersistence()
+	var records []map[string]interface{}
+	err := p.Replay(func(req map[string]interface{}) error {
+		records = append(records, req)
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to read old binlog: %w", err)
 	}
-
-	instance = p
-	return instance, nil
+	return p.Snapshot(records)
 }
 
-// LogRequest writes a request into the disk
-func (p *Persistence) LogRequest(req map[string]interface{}) error {
-	p.mu.Lock() // Protect file writes
-	defer p.mu.Unlock()
-
-	buf := new(bytes.Buffer)
+// Codec returns the codec records are written with, nil when stored as is
+func (p *Binlog) Codec() *Codec {
+	return p.codec
+}
 
-	// Write command length and command
-	cmd := req["command"].(string)
-	if err := binary.Write(buf, binary.LittleEndian, int32(len(cmd))); err != nil {
+// Append writes a request into the disk
+func (p *Binlog) Append(req map[string]interface{}) error {
+	record, err := encodeRecord(req)
+	if err != nil {
 		return err
 	}
-	buf.WriteString(cmd)
-
-	// Write key length and key
-	key := req["key"].(string)
-	if err := binary.Write(buf, binary.LittleEndian, int32(len(key))); err != nil {
+	frame, err := encodeFrame(record, flagIndexed, p.codec)
+	if err != nil {
 		return err
 	}
-	buf.WriteString(key)
-
-	// Write value length and value (if present)
-	val, valExists := req["value"].(string)
-	if valExists {
-		binary.Write(buf, binary.LittleEndian, int32(len(val)))
-		buf.WriteString(val)
-	} else {
-		binary.Write(buf, binary.LittleEndian, int32(0)) // No value
-	}
 
-	// Write offset length and offset (if present)
-	offset, offsetExists := req["offset"].(string)
-	if offsetExists {
-		binary.Write(buf, binary.LittleEndian, int32(len(offset)))
-		buf.WriteString(offset)
-	} else {
-		binary.Write(buf, binary.LittleEndian, int32(0)) // No value
-	}
-
-	// Write End Marker (4 bytes "EOF\0")
-	buf.Write([]byte{0x45, 0x4F, 0x46, 0x00})
+	p.mu.Lock() // Protect file writes
+	defer p.mu.Unlock()
 
-	// Write to file
-	_, err := p.file.Write(buf.Bytes())
+	_, err = p.file.Write(frame)
 	return err
 }
 
-// LoadRequests reads the binary log and returns parsed requests
-func (p *Persistence) LoadRequests() ([]map[string]interface{}, error) {
+// Replay reads the binary log and hands every parsed request to apply
+func (p *Binlog) Replay(apply func(req map[string]interface{}) error) error {
 	p.mu.Lock() // Protect file reads
 	defer p.mu.Unlock()
 
 	// Move file pointer to start
-	if _, err := p.file.Seek(0, 0); err != nil {
-		return nil, err
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
+	return readLog(p.file, p.codec, apply)
+}
 
-	var requests []map[string]interface{}
-	buf := make([]byte, 1024) // Buffer for reading
-
-	for {
-		// Read command length
-		if _, err := p.file.Read(buf[:4]); err != nil {
-			break
+// readLog parses a binlog stream of any layout
+func readLog(r io.Reader, codec *Codec, apply func(req map[string]interface{}) error) error {
+	reader := bufio.NewReader(r)
+
+	magic, _ := reader.Peek(len(fileMagic))
+	switch {
+	case bytes.Equal(magic, fileMagic):
+		reader.Discard(len(fileMagic))
+		for {
+			flags, payload, err := readFrame(reader, codec)
+			if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+				// A torn write at the tail is ignored, like before
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := decodeRecords(flags, payload, apply); err != nil {
+				return err
+			}
 		}
-		cmdLen := binary.LittleEndian.Uint32(buf[:4])
 
-		// Read command
-		cmdBuf := make([]byte, cmdLen)
-		if _, err := p.file.Read(cmdBuf); err != nil {
-			break
+	default:
+		// Files written before frames were introduced, with or without the expiry field
+		expiry := false
+		if bytes.Equal(magic, recordMagic) {
+			reader.Discard(len(recordMagic))
+			expiry = true
 		}
-		command := string(cmdBuf)
-
-		// Read key length
-		if _, err := p.file.Read(buf[:4]); err != nil {
-			break
+		for {
+			req, err := decodeRecord(reader, expiry, false)
+			if err != nil {
+				return nil
+			}
+			if err := apply(req); err != nil {
+				return err
+			}
 		}
-		keyLen := binary.LittleEndian.Uint32(buf[:4])
+	}
+}
 
-		// Read key
-		keyBuf := make([]byte, keyLen)
-		if _, err := p.file.Read(keyBuf); err != nil {
-			break
-		}
-		key := string(keyBuf)
+// WriteSnapshot writes records to w in the binlog format, packing them into
+// frames of about 64KB each
+func WriteSnapshot(w io.Writer, records []map[string]interface{}, codec *Codec) error {
+	writer := bufio.NewWriter(w)
+	writer.Write(fileMagic)
 
-		// Read value length
-		if _, err := p.file.Read(buf[:4]); err != nil {
-			break
+	var block bytes.Buffer
+	flush := func() error {
+		if block.Len() == 0 {
+			return nil
 		}
-		valLen := binary.LittleEndian.Uint32(buf[:4])
-
-		// Read value (if present)
-		var value string
-		if valLen > 0 {
-			valBuf := make([]byte, valLen)
-			if _, err := p.file.Read(valBuf); err != nil {
-				break
-			}
-			value = string(valBuf)
+		frame, err := encodeFrame(block.Bytes(), flagIndexed, codec)
+		if err != nil {
+			return err
 		}
+		block.Reset()
+		_, err = writer.Write(frame)
+		return err
+	}
 
-		// Read offset length
-		if _, err := p.file.Read(buf[:4]); err != nil {
-			break
+	for _, req := range records {
+		record, err := encodeRecord(req)
+		if err != nil {
+			return err
 		}
-		offsetLen := binary.LittleEndian.Uint32(buf[:4])
-
-		// Read offset (if present)
-		var offset string
-		if offsetLen > 0 {
-			offsetBuf := make([]byte, offsetLen)
-			if _, err := p.file.Read(offsetBuf); err != nil {
-				break
+		block.Write(record)
+		if block.Len() >= snapshotSize {
+			if err := flush(); err != nil {
+				return err
 			}
-			offset = string(offsetBuf)
 		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
 
-		// Read end marker (4 bytes)
-		endMarker := make([]byte, 4)
-		if _, err := p.file.Read(endMarker); err != nil || string(endMarker) != "EOF\x00" {
-			break
-		}
+// ReadSnapshot reads records written by WriteSnapshot
+func ReadSnapshot(r io.Reader, codec *Codec) ([]map[string]interface{}, error) {
+	var records []map[string]interface{}
+	err := readLog(r, codec, func(req map[string]interface{}) error {
+		records = append(records, req)
+		return nil
+	})
+	return records, err
+}
 
-		// Construct request map
-		req := map[string]interface{}{
-			"command": command,
-			"key":     key,
-		}
-		if value != "" {
-			req["value"] = value
-		}
-		if offset != "" {
-			req["offset"] = offset
-		}
+// Snapshot writes records into a new file and swaps it in place of the log.
+// Everything is written with the current key, which is how keys are rotated.
+func (p *Binlog) Snapshot(records []map[string]interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		requests = append(requests, req)
+	tmpName := p.file.Name() + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
 	}
 
-	if len(requests) == 0 {
-		return nil, nil
+	if err := WriteSnapshot(tmp, records, p.codec); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to write snapshot: %w", err)
 	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	tmp.Close()
 
-	return requests, nil
+	// Close before renaming, windows refuses to replace an open file
+	p.file.Close()
+	if err := os.Rename(tmpName, p.file.Name()); err != nil {
+		return fmt.Errorf("failed to replace binlog: %w", err)
+	}
+	return p.reopen()
 }
 
-// Clear removes all logged requests by truncating the binary log file.
-func (p *Persistence) Clear() error {
+// Truncate removes all logged requests by truncating the binary log file.
+func (p *Binlog) Truncate() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.file != nil {
-		/**
-		Why do we need to close the file: windows acts weird if the file is not closed and we try to truncatw
-		*/
-		p.file.Close()
+	/**
+	Why do we need to close the file: windows acts weird if the file is not closed and we try to truncatw
+	*/
+	p.file.Close()
 
-		// Truncate the file to zero length
-		if err := os.Truncate(p.file.Name(), 0); err != nil {
-			return fmt.Errorf("failed to truncate file: %w", err)
-		}
+	// Truncate the file to zero length
+	if err := os.Truncate(p.file.Name(), 0); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
 
-		// Reopen the file in the same mode as before
-		file, err := os.OpenFile(p.file.Name(), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to reopen file: %w", err)
-		}
+	return p.reopen()
+}
 
-		p.file = file
+// reopen opens the log again in the same mode as before
+func (p *Binlog) reopen() error {
+	file, err := os.OpenFile(p.file.Name(), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen file: %w", err)
 	}
 
-	return nil
+	p.file = file
+	return p.writeHeaderIfEmpty()
 }
 
-// reads all commands in the disk, returns, it as a list(we already have loadRequest for that)
-func (*Persistence) ReadAllCommands() []string {
-	return make([]string, 0)
+// Close closes the underlying file
+func (p *Binlog) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file.Close()
 }
@@ -0,0 +1,240 @@
+package pubsub
+
+import (
+	"sync"
+
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// Message is a message pushed to a subscriber, Kind is "message" for a
+// channel subscription and "pmessage" for a pattern one
+type Message struct {
+	Kind    string
+	Pattern string
+	Channel string
+	Payload string
+}
+
+// size is what a queued message counts against the buffer limit
+func (m Message) size() int {
+	return len(m.Pattern) + len(m.Channel) + len(m.Payload)
+}
+
+// Hub delivers published messages to the subscribers of a node
+type Hub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*Subscriber]bool
+	patterns map[string]map[*Subscriber]bool
+}
+
+func NewHub() *Hub {
+	return &Hub{channels: make(map[string]map[*Subscriber]bool), patterns: make(map[string]map[*Subscriber]bool)}
+}
+
+// NewSubscriber returns a subscriber that is dropped once more than limit
+// bytes of messages wait to be sent to it, 0 means no limit
+func (h *Hub) NewSubscriber(limit int) *Subscriber {
+	return &Subscriber{
+		hub:      h,
+		limit:    limit,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Publish delivers payload to the subscribers of channel and of the patterns
+// matching it and returns how many received it
+func (h *Hub) Publish(channel, payload string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	receivers := 0
+	for sub := range h.channels[channel] {
+		if sub.deliver(Message{Kind: "message", Channel: channel, Payload: payload}) {
+			receivers++
+		}
+	}
+	for pattern, subs := range h.patterns {
+		if !utils.MatchPattern(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			if sub.deliver(Message{Kind: "pmessage", Pattern: pattern, Channel: channel, Payload: payload}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// add and remove keep the index of a channel or pattern up to date
+func (h *Hub) add(index map[string]map[*Subscriber]bool, name string, sub *Subscriber) {
+	if index[name] == nil {
+		index[name] = make(map[*Subscriber]bool)
+	}
+	index[name][sub] = true
+}
+
+func (h *Hub) remove(index map[string]map[*Subscriber]bool, name string, sub *Subscriber) {
+	delete(index[name], sub)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+}
+
+// Subscriber is one connection's subscriptions and the messages waiting to be sent to it
+type Subscriber struct {
+	hub   *Hub
+	limit int
+
+	// channels and patterns change under the hub's lock
+	channels map[string]bool
+	patterns map[string]bool
+
+	mu         sync.Mutex
+	queue      []Message
+	pending    int // bytes in queue
+	closed     bool
+	overflowed bool
+	ready      chan struct{} // signalled when the queue gets a message
+	done       chan struct{} // closed with the subscriber
+}
+
+// Subscribe adds channel subscriptions and returns the number of
+// subscriptions after each of them
+func (s *Subscriber) Subscribe(channels ...string) []int {
+	return s.change(s.hub.channels, s.channels, channels, true)
+}
+
+// PSubscribe adds pattern subscriptions like Subscribe
+func (s *Subscriber) PSubscribe(patterns ...string) []int {
+	return s.change(s.hub.patterns, s.patterns, patterns, true)
+}
+
+// Unsubscribe removes channel subscriptions, all of them without channels,
+// and returns the channels removed with the number of subscriptions left after each
+func (s *Subscriber) Unsubscribe(channels ...string) ([]string, []int) {
+	if len(channels) == 0 {
+		channels = s.names(s.channels)
+	}
+	return channels, s.change(s.hub.channels, s.channels, channels, false)
+}
+
+// PUnsubscribe removes pattern subscriptions like Unsubscribe
+func (s *Subscriber) PUnsubscribe(patterns ...string) ([]string, []int) {
+	if len(patterns) == 0 {
+		patterns = s.names(s.patterns)
+	}
+	return patterns, s.change(s.hub.patterns, s.patterns, patterns, false)
+}
+
+func (s *Subscriber) change(index map[string]map[*Subscriber]bool, own map[string]bool, names []string, add bool) []int {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	counts := make([]int, 0, len(names))
+	for _, name := range names {
+		if add {
+			own[name] = true
+			s.hub.add(index, name, s)
+		} else {
+			delete(own, name)
+			s.hub.remove(index, name, s)
+		}
+		counts = append(counts, len(s.channels)+len(s.patterns))
+	}
+	return counts
+}
+
+func (s *Subscriber) names(own map[string]bool) []string {
+	s.hub.mu.RLock()
+	defer s.hub.mu.RUnlock()
+	names := make([]string, 0, len(own))
+	for name := range own {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Count returns the number of channels and patterns subscribed to
+func (s *Subscriber) Count() int {
+	s.hub.mu.RLock()
+	defer s.hub.mu.RUnlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+// deliver queues a message, a subscriber that goes over its limit is closed
+func (s *Subscriber) deliver(m Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.limit > 0 && s.pending+m.size() > s.limit {
+		s.overflowed = true
+		s.shut()
+		return false
+	}
+	s.queue = append(s.queue, m)
+	s.pending += m.size()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Next waits for the next message, it returns false once the subscriber is closed
+func (s *Subscriber) Next() (Message, bool) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return Message{}, false
+		}
+		if len(s.queue) > 0 {
+			m := s.queue[0]
+			s.queue = s.queue[1:]
+			s.pending -= m.size()
+			s.mu.Unlock()
+			return m, true
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.ready:
+		case <-s.done:
+		}
+	}
+}
+
+// Done is closed with the subscriber
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Overflowed reports whether the subscriber was closed for going over its limit
+func (s *Subscriber) Overflowed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.overflowed
+}
+
+// Close removes every subscription and drops the waiting messages
+func (s *Subscriber) Close() {
+	s.Unsubscribe()
+	s.PUnsubscribe()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shut()
+}
+
+// shut marks the subscriber closed, s.mu is held
+func (s *Subscriber) shut() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	s.pending = 0
+	close(s.done)
+}
@@ -0,0 +1,216 @@
+// Package security sets up TLS for the client and cluster ports. Files are
+// read once at startup and again on Reload, connections opened afterwards
+// use the new certificates and CA while open ones keep theirs.
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// nodePrefix starts the subject common name of node certificates, followed by the node id
+const nodePrefix = "node-"
+
+// operatorName is the subject common name of operator certificates, alone
+// or followed by -<name>
+const operatorName = "operator"
+
+// Reloader holds the certificate and CA of one TLS setup
+type Reloader struct {
+	config utils.TLSConfig
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool // nil without a CA file
+}
+
+// NewReloader returns a reloader for config, nothing is read before Reload
+func NewReloader(config utils.TLSConfig) *Reloader {
+	return &Reloader{config: config}
+}
+
+// Enabled reports whether TLS is configured
+func (r *Reloader) Enabled() bool {
+	return r.config.CertFile != ""
+}
+
+// Reload reads the certificate, key and CA files again. On error the
+// certificates loaded before stay in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading the certificate %s failed: %v", r.config.CertFile, err)
+	}
+	var pool *x509.CertPool
+	if r.config.CAFile != "" {
+		data, err := os.ReadFile(r.config.CAFile)
+		if err != nil {
+			return fmt.Errorf("reading the CA %s failed: %v", r.config.CAFile, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in the CA %s", r.config.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.pool = &cert, pool
+	return nil
+}
+
+// current returns the loaded certificate and CA
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, nil, errors.New("no certificate loaded")
+	}
+	return r.cert, r.pool, nil
+}
+
+// ServerConfig returns the TLS config of a listener. Client certificates
+// are asked for and checked against the CA as the client_auth setting
+// says, check then runs on the verified certificate of the client.
+func (r *Reloader) ServerConfig(check func(cert *x509.Certificate) error) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool, err := r.current()
+			if err != nil {
+				return nil, err
+			}
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth(r.config.ClientAuth),
+			}
+			if check != nil {
+				config.VerifyConnection = func(state tls.ConnectionState) error {
+					if len(state.PeerCertificates) == 0 {
+						return nil
+					}
+					return check(state.PeerCertificates[0])
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig returns the TLS config for connecting to a server whose
+// certificate the CA signed, check then runs on that certificate. The
+// client presents its own certificate when asked for one.
+func (r *Reloader) ClientConfig(check func(cert *x509.Certificate) error) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _, err := r.current()
+			return cert, err
+		},
+		// The chain is verified below against the CA loaded last, peers
+		// are told apart by the node id in their certificates, not their host names
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool, err := r.current()
+			if err != nil {
+				return err
+			}
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("the server sent no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			leaf := state.PeerCertificates[0]
+			opts := x509.VerifyOptions{Roots: pool, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+			if _, err := leaf.Verify(opts); err != nil {
+				return err
+			}
+			if check != nil {
+				return check(leaf)
+			}
+			return nil
+		},
+	}
+}
+
+// clientAuth maps the client_auth setting to how a listener treats client certificates
+func clientAuth(setting string) tls.ClientAuthType {
+	switch setting {
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	case "request":
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// NodeID returns the node id a certificate was issued to, its subject
+// common name is node-<id>
+func NodeID(cert *x509.Certificate) (int32, bool) {
+	name, ok := strings.CutPrefix(cert.Subject.CommonName, nodePrefix)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(name, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int32(id), true
+}
+
+// RequireNode refuses certificates that were not issued to a node
+func RequireNode(cert *x509.Certificate) error {
+	if _, ok := NodeID(cert); !ok {
+		return fmt.Errorf("certificate of %q is not a node certificate (%s<id>)", cert.Subject.CommonName, nodePrefix)
+	}
+	return nil
+}
+
+// RequireNodeOrOperator refuses certificates issued to neither a node nor
+// an operator. Admin calls come from operators, and from members passing
+// them on to the leader.
+func RequireNodeOrOperator(cert *x509.Certificate) error {
+	name := cert.Subject.CommonName
+	if name == operatorName || strings.HasPrefix(name, operatorName+"-") {
+		return nil
+	}
+	if _, ok := NodeID(cert); ok {
+		return nil
+	}
+	return fmt.Errorf("certificate of %q is neither a node certificate (%s<id>) nor an operator certificate (%s or %s-<name>)", name, nodePrefix, operatorName, operatorName)
+}
+
+// ClientTLS returns the TLS config of the command line tools, verifying the
+// server with the CA in caFile and presenting the certificate in certFile when given
+func ClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,133 @@
+package security
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TokenMetadata is the gRPC metadata key calls between nodes carry the cluster token in
+const TokenMetadata = "geomys-cluster-token"
+
+// Tokens holds the shared secret nodes authenticate their calls with. The
+// current token is sent and accepted, previous ones are accepted and sent
+// along with it, separated by commas, so nodes that still only know the old
+// token or already only know the new one both accept the calls during a rollover.
+type Tokens struct {
+	file          string
+	env           string
+	previousFiles []string
+
+	mu     sync.RWMutex
+	tokens []string // the current token first
+}
+
+// NewTokens returns the tokens read from file, or else the environment
+// variable env, and those of previousFiles that exist. Nothing is read
+// before Reload.
+func NewTokens(file, env string, previousFiles []string) *Tokens {
+	return &Tokens{file: file, env: env, previousFiles: previousFiles}
+}
+
+// Enabled reports whether a cluster token is configured
+func (t *Tokens) Enabled() bool {
+	return t.file != "" || t.env != ""
+}
+
+// Reload reads the tokens again. On error the tokens loaded before stay in use.
+func (t *Tokens) Reload() error {
+	var current string
+	if t.file != "" {
+		token, err := readToken(t.file)
+		if err != nil {
+			return err
+		}
+		current = token
+	} else {
+		current = strings.TrimSpace(os.Getenv(t.env))
+		if current == "" || strings.Contains(current, ",") {
+			return fmt.Errorf("environment variable %s is empty or holds a comma", t.env)
+		}
+	}
+	tokens := []string{current}
+	for _, path := range t.previousFiles {
+		// A previous token file only exists while a rollover lasts
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		token, err := readToken(path)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = tokens
+	return nil
+}
+
+// readToken reads a token file, surrounding white space is ignored
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading the cluster token %s failed: %v", path, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" || strings.Contains(token, ",") {
+		return "", fmt.Errorf("the cluster token file %s is empty or holds a comma", path)
+	}
+	return token, nil
+}
+
+// accepts reports whether token is one of the loaded tokens
+func (t *Tokens) accepts(token string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ok := false
+	for _, known := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// Check refuses calls that carry none of the loaded tokens
+func (t *Tokens) Check(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get(TokenMetadata) {
+		for _, token := range strings.Split(value, ",") {
+			if t.accepts(token) {
+				return nil
+			}
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid cluster token")
+}
+
+// GetRequestMetadata attaches the tokens to a call, making Tokens the
+// credentials.PerRPCCredentials of connections to other nodes
+func (t *Tokens) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.tokens) == 0 {
+		return nil, errors.New("no cluster token loaded")
+	}
+	return map[string]string{TokenMetadata: strings.Join(t.tokens, ",")}, nil
+}
+
+// RequireTransportSecurity lets tokens go over plain text connections too,
+// anyone reading the traffic learns them there
+func (t *Tokens) RequireTransportSecurity() bool {
+	return false
+}
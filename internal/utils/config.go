@@ -3,9 +3,11 @@ package utils
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"net"
 	"os"
-	"sync"
+	"path/filepath"
+	"strconv"
 )
 
 // Config struct holds application configuration
@@ -16,30 +18,87 @@ type Config struct {
 	Persistence   string `json:"persistence"`
 	Replication   bool   `json:"replication_enabled"`
 	NodeID        int    `json:"node_id"`
-	IsLeader      bool   `json:"leader_id"`
 	Sharding      bool   `json:"sharding_enabled"`
 	ClusterMode   bool   `json:"cluster_mode"`
-}
+	DataDir       string `json:"data_dir"`
+	LogFile       string `json:"log_file"`
+	Debug         bool   `json:"debug"`      // also write debug logs
+	BackupDir     string `json:"backup_dir"` // BACKUP only writes below it
+	Compression   string `json:"compression"`
 
-var (
-	configInstance *Config   // Singleton configInstance
-	configOnce     sync.Once // Ensures thread-safe initialization
-)
+	// Cluster settings, AdvertiseAddress is the gRPC address other nodes
+	// reach this one at (default <hostname>:<external_port>)
+	AdvertiseAddress  string `json:"advertise_address"`
+	HeartbeatInterval int    `json:"heartbeat_interval_ms"`
+	ElectionTimeout   int    `json:"election_timeout_ms"`
+	SnapshotThreshold int    `json:"snapshot_threshold"`
+	ReplicationWindow int    `json:"replication_window"`
 
-// LoadConfig initializes the singleton configInstance
-func LoadConfig(filename string) error {
-	var err error
-	configOnce.Do(func() {
-		configInstance, err = loadConfigFromFile(filename)
-		if err != nil {
-			log.Fatalf("Failed to load config: %v", err)
-		}
-	})
-	return err
+	// gRPC addresses of members to join the cluster through, <id>@<address>
+	// for every voter of a new cluster bootstrapped from a static peer set
+	Peers []string `json:"peers"`
+
+	// Sharding: the group this node's cluster serves hash slots as, the
+	// slots a group bootstrapped by this node starts with ("0-8191,9000"),
+	// gRPC addresses of nodes in other groups to learn the slot map from,
+	// and the address clients are redirected to (default
+	// <hostname>:<internal_port>)
+	ShardGroup    int      `json:"shard_group"`
+	ShardSlots    string   `json:"shard_slots"`
+	ShardSeeds    []string `json:"shard_seeds"`
+	ClientAddress string   `json:"client_address"`
+
+	// Default write concern (async, one, quorum or all) and how long a
+	// write waits for it
+	WriteConcern string `json:"write_concern"`
+	WriteTimeout int    `json:"write_timeout_ms"`
+
+	// Default read consistency (eventual, bounded, session or
+	// linearizable) and the bounds of bounded reads. MaxStaleness defaults
+	// to 1000ms and -1 leaves it unbounded, MaxLag 0 leaves it unbounded.
+	ReadConsistency string `json:"read_consistency"`
+	MaxStaleness    int    `json:"max_staleness_ms"`
+	MaxLag          int    `json:"max_lag"`
+
+	// What a follower does with writes: "forward" runs them on the leader,
+	// "redirect" tells the client the leader's address and term
+	FollowerWrites string `json:"follower_writes"`
+
+	// Encryption at rest, the key is read from EncryptionKeyFile or else
+	// from the environment variable named by EncryptionKeyEnv
+	EncryptionKeyFile      string   `json:"encryption_key_file"`
+	EncryptionKeyEnv       string   `json:"encryption_key_env"`
+	EncryptionPreviousKeys []string `json:"encryption_previous_key_files"`
+
+	// TLS of the gRPC cluster port, whose certificate a node also presents
+	// to the others, and of the client port. Certificates are reread on SIGHUP.
+	ClusterTLS TLSConfig `json:"cluster_tls"`
+	ClientTLS  TLSConfig `json:"client_tls"`
+
+	// Shared secret every call between nodes carries, read from
+	// ClusterTokenFile or else the environment variable named by
+	// ClusterTokenEnv. Tokens of ClusterPreviousTokenFiles are accepted too
+	// while a new one rolls out. Files are reread on SIGHUP.
+	ClusterTokenFile          string   `json:"cluster_token_file"`
+	ClusterTokenEnv           string   `json:"cluster_token_env"`
+	ClusterPreviousTokenFiles []string `json:"cluster_previous_token_files"`
+
+	// Bytes of published messages that may wait for a slow subscriber
+	// before its connection is closed
+	PubSubBufferLimit int `json:"pubsub_buffer_limit"`
+}
+
+// TLSConfig names the PEM files of a TLS port, TLS is off without CertFile
+type TLSConfig struct {
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	CAFile     string `json:"ca_file"`     // verifies the certificates of the other side
+	ClientAuth string `json:"client_auth"` // none, request or require client certificates
 }
 
-// loadConfigFromFile reads and parses the config file
-func loadConfigFromFile(filename string) (*Config, error) {
+// LoadConfig reads a configuration file into a new Config.
+// A missing file yields the default configuration.
+func LoadConfig(filename string) (*Config, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -55,39 +114,177 @@ func loadConfigFromFile(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	applyDefaults(config)
+	if err := applyDefaults(config); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
-// GetConfig returns the singleton config configInstance
-func GetConfig() (*Config, error) {
-	if configInstance == nil {
-		return nil, errors.New("Config not initialized. Call LoadConfig() first")
+// DefaultConfigPath returns the path of the configuration file in the home directory
+func DefaultConfigPath() string {
+	return filepath.Join(geomysHome(), "geomys.conf")
+}
+
+// GetDataDir returns the directory this node keeps its data in
+func (c *Config) GetDataDir() string {
+	if c.DataDir != "" {
+		return c.DataDir
+	}
+	return filepath.Join(geomysHome(), "Node"+strconv.Itoa(c.NodeID))
+}
+
+// GetBackupDir returns the directory BACKUP writes to
+func (c *Config) GetBackupDir() string {
+	if c.BackupDir != "" {
+		return c.BackupDir
 	}
-	return configInstance, nil
+	return filepath.Join(c.GetDataDir(), "backups")
+}
+
+// GetLogFile returns the file this node writes logs to
+func (c *Config) GetLogFile() string {
+	if c.LogFile != "" {
+		return c.LogFile
+	}
+	return filepath.Join(geomysHome(), "server.log")
+}
+
+// GetAdvertiseAddress returns the gRPC address other nodes reach this one at
+func (c *Config) GetAdvertiseAddress() string {
+	if c.AdvertiseAddress != "" {
+		return c.AdvertiseAddress
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.ExternalPort))
+}
+
+// GetClientAddress returns the address clients reach this node at
+func (c *Config) GetClientAddress() string {
+	if c.ClientAddress != "" {
+		return c.ClientAddress
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.InternalPort))
+}
+
+// geomysHome returns ~/.geomys
+func geomysHome() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".geomys")
 }
 
 // getDefaultConfig returns default config values
 func getDefaultConfig() *Config {
 	return &Config{
-		InternalPort:  6379,
-		DefaultExpiry: 60000,
-		Persistence:   "Writethroughdisk",
-		Replication:   false,
-		Sharding:      false,
-		IsLeader:      false,
+		InternalPort:      6379,
+		DefaultExpiry:     60000,
+		Persistence:       "writethroughdisk",
+		Compression:       "none",
+		HeartbeatInterval: 200,
+		ElectionTimeout:   2000,
+		SnapshotThreshold: 8192,
+		ReplicationWindow: 8,
+		WriteConcern:      "one",
+		WriteTimeout:      5000,
+		ReadConsistency:   "eventual",
+		MaxStaleness:      1000,
+		FollowerWrites:    "forward",
+		PubSubBufferLimit: 32 << 20,
+		Replication:       false,
+		Sharding:          false,
 	}
 }
 
-// applyDefaults ensures missing values get defaults
-func applyDefaults(config *Config) {
+// applyDefaults ensures missing values get defaults and refuses unknown ones
+func applyDefaults(config *Config) error {
 	if config.InternalPort == 0 {
 		config.InternalPort = 6379
 	}
 	if config.DefaultExpiry == 0 {
 		config.DefaultExpiry = 60000
 	}
-	if config.Persistence != "writethroughdisk" && config.Persistence != "bufferedwrite" {
+	switch config.Persistence {
+	case "writethroughdisk", "bufferedwrite", "memory", "bolt":
+	case "":
 		config.Persistence = "writethroughdisk"
+	default:
+		return unknownValue("persistence", config.Persistence, "writethroughdisk, bufferedwrite, memory or bolt")
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = 200
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = 2000
+	}
+	if config.SnapshotThreshold <= 0 {
+		config.SnapshotThreshold = 8192
+	}
+	if config.ReplicationWindow <= 0 {
+		config.ReplicationWindow = 8
 	}
+	switch config.WriteConcern {
+	case "async", "one", "quorum", "all":
+	case "":
+		config.WriteConcern = "one"
+	default:
+		return unknownValue("write_concern", config.WriteConcern, "async, one, quorum or all")
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 5000
+	}
+	switch config.ReadConsistency {
+	case "eventual", "bounded", "session", "linearizable":
+	case "":
+		config.ReadConsistency = "eventual"
+	default:
+		return unknownValue("read_consistency", config.ReadConsistency, "eventual, bounded, session or linearizable")
+	}
+	if config.MaxStaleness == 0 {
+		config.MaxStaleness = 1000
+	} else if config.MaxStaleness < 0 {
+		config.MaxStaleness = -1
+	}
+	if config.MaxLag < 0 {
+		config.MaxLag = 0
+	}
+	if config.PubSubBufferLimit <= 0 {
+		config.PubSubBufferLimit = 32 << 20
+	}
+	// Nodes always check each other's certificates
+	if config.ClusterTLS.CertFile != "" {
+		config.ClusterTLS.ClientAuth = "require"
+	}
+	switch config.ClientTLS.ClientAuth {
+	case "none", "request", "require":
+	case "":
+		config.ClientTLS.ClientAuth = "none"
+	default:
+		return unknownValue("client_tls.client_auth", config.ClientTLS.ClientAuth, "none, request or require")
+	}
+	switch config.FollowerWrites {
+	case "forward", "redirect":
+	case "":
+		config.FollowerWrites = "forward"
+	default:
+		return unknownValue("follower_writes", config.FollowerWrites, "forward or redirect")
+	}
+	switch config.Compression {
+	case "none", "snappy", "zstd", "s2":
+	case "":
+		config.Compression = "none"
+	default:
+		return unknownValue("compression", config.Compression, "none, snappy, zstd or s2")
+	}
+	return nil
+}
+
+// unknownValue is the error of a setting that is none of its values
+func unknownValue(setting, value, values string) error {
+	return fmt.Errorf("unknown %s %q in config, expected %s", setting, value, values)
 }
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/vmihailenco/msgpack/v5"
 	"github.com/vskvj3/geomys/internal/cluster/proto"
@@ -21,12 +22,27 @@ func ConvertRequestToCommand(request map[string]interface{}) (*proto.Command, er
 	if value, ok := request["value"].(string); ok {
 		protoCommand.Value = value
 	}
-	if exp, ok := request["exp"].(int64); ok {
+	if exp, ok := ToInt64(request["exp"]); ok {
 		protoCommand.Exp = int32(exp)
 	}
 	if offset, ok := request["offset"].(string); ok {
 		protoCommand.Offset = offset
 	}
+	if concern, ok := request["write_concern"].(string); ok {
+		protoCommand.WriteConcern = concern
+	}
+	if timeout, ok := ToInt64(request["timeout"]); ok {
+		protoCommand.Timeout = timeout
+	}
+	if replicas, ok := ToInt64(request["replicas"]); ok {
+		protoCommand.Replicas = replicas
+	}
+	if index, ok := ToInt64(request["index"]); ok {
+		protoCommand.Index = uint64(index)
+	}
+	if asking, ok := request["asking"].(bool); ok {
+		protoCommand.Asking = asking
+	}
 
 	return protoCommand, nil
 }
@@ -48,10 +64,64 @@ func ConvertCommandToRequest(cmd *proto.Command) map[string]interface{} {
 	if cmd.Offset != "" {
 		request["offset"] = cmd.Offset
 	}
+	if cmd.WriteConcern != "" {
+		request["write_concern"] = cmd.WriteConcern
+	}
+	if cmd.Timeout != 0 {
+		request["timeout"] = cmd.Timeout
+	}
+	if cmd.Replicas != 0 {
+		request["replicas"] = cmd.Replicas
+	}
+	if cmd.Index != 0 {
+		request["index"] = cmd.Index
+	}
+	if cmd.Asking {
+		request["asking"] = true
+	}
 
 	return request
 }
 
+// ToInt64 converts any integer a msgpack request may carry to int64
+func ToInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// StringArgs returns the 'args' of a request, such as those of CLUSTER, as strings
+func StringArgs(value interface{}) []string {
+	var args []string
+	switch list := value.(type) {
+	case []interface{}:
+		for _, arg := range list {
+			args = append(args, fmt.Sprint(arg))
+		}
+	case []string:
+		args = list
+	}
+	return args
+}
+
 // EncodeResponse serializes a response map into a byte slice
 func EncodeResponse(response map[string]interface{}) ([]byte, error) {
 	return msgpack.Marshal(response)
@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"sync"
 )
 
 // Log levels
@@ -17,78 +16,59 @@ const (
 	DEBUG = "DEBUG"
 )
 
-var (
-	instance *Logger
-	once     sync.Once
-)
-
 // Logger struct
 type Logger struct {
+	file        *os.File
 	infoLogger  *log.Logger
 	warnLogger  *log.Logger
 	errorLogger *log.Logger
 	debugLogger *log.Logger
 }
 
-// getDefaultLogFilePath returns the default log file path
-func getDefaultLogFilePath() string {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("Failed to get home directory: %v", err)
+// NewLogger creates a logger writing to logFilePath and the console.
+// Every server owns its own logger, so several can run in one process.
+func NewLogger(logFilePath string, debugMode bool) (*Logger, error) {
+	if err := os.MkdirAll(filepath.Dir(logFilePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
 	}
-	logDir := filepath.Join(homeDir, ".geomys")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		log.Fatalf("Failed to create log directory: %v", err)
-	}
-	return filepath.Join(logDir, "server.log")
-}
-
-// NewLogger creates a new logger instance (singleton)
-func NewLogger(logFilePath string, debugMode bool) *Logger {
-	once.Do(func() {
-		if logFilePath == "" {
-			logFilePath = getDefaultLogFilePath()
-		}
-		fmt.Println("Starting logs in ", logFilePath)
 
-		// Open the log file
-		file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatalf("Failed to open log file: %v", err)
-		}
+	// Open the log file
+	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
 
-		// Create a multi-writer to log to both the file and console
-		multiWriter := io.MultiWriter(file, os.Stdout)
+	logger := newLogger(io.MultiWriter(file, os.Stdout), file, debugMode)
+	logger.file = file
+	return logger, nil
+}
 
-		// Create loggers
-		infoLogger := log.New(multiWriter, "[INFO] ", log.Ldate|log.Ltime)
-		warnLogger := log.New(multiWriter, "[WARN] ", log.Ldate|log.Ltime)
-		errorLogger := log.New(multiWriter, "[ERROR] ", log.Ldate|log.Ltime)
+// NewNopLogger returns a logger that discards everything
+func NewNopLogger() *Logger {
+	return newLogger(io.Discard, io.Discard, false)
+}
 
-		var debugWriter io.Writer
-		if debugMode {
-			debugWriter = multiWriter
-		} else {
-			debugWriter = file
-		}
-		debugLogger := log.New(debugWriter, "[DEBUG] ", log.Ldate|log.Ltime)
+// newLogger builds the level loggers, debug goes to debugOnly unless debugMode is set
+func newLogger(out io.Writer, debugOnly io.Writer, debugMode bool) *Logger {
+	debugWriter := debugOnly
+	if debugMode {
+		debugWriter = out
+	}
 
-		instance = &Logger{
-			infoLogger:  infoLogger,
-			warnLogger:  warnLogger,
-			errorLogger: errorLogger,
-			debugLogger: debugLogger,
-		}
-	})
-	return instance
+	return &Logger{
+		infoLogger:  log.New(out, "[INFO] ", log.Ldate|log.Ltime),
+		warnLogger:  log.New(out, "[WARN] ", log.Ldate|log.Ltime),
+		errorLogger: log.New(out, "[ERROR] ", log.Ldate|log.Ltime),
+		debugLogger: log.New(debugWriter, "[DEBUG] ", log.Ldate|log.Ltime),
+	}
 }
 
-// GetLogger retrieves the singleton logger instance
-func GetLogger() *Logger {
-	if instance == nil {
-		log.Fatalf("Logger has not been initialized. Call NewLogger() first.")
+// Close closes the log file
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
 	}
-	return instance
+	return l.file.Close()
 }
 
 // Logging methods
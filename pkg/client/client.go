@@ -0,0 +1,392 @@
+// Package client is the Go client for geomys. It keeps a pool of
+// connections to every node, finds the leader and sends writes to it, sends
+// reads to followers when asked to, retries failed requests with backoff
+// and follows the MOVED and ASK redirects of a sharded cluster and the
+// REDIRECT of a follower that does not forward writes.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for keys that hold nothing
+	ErrNotFound = errors.New("geomys: key not found")
+	// ErrClosed is returned by a closed client
+	ErrClosed = errors.New("geomys: client is closed")
+	// ErrNoNodes is returned when no node could be reached
+	ErrNoNodes = errors.New("geomys: no node is reachable")
+	// ErrRequestTooLarge is returned for requests the server cannot read in one go
+	ErrRequestTooLarge = errors.New("geomys: request is larger than 1024 bytes")
+)
+
+// Error is an error the server answered a request with
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "geomys: " + e.Message
+}
+
+// Options configures a Client, zero fields take their defaults
+type Options struct {
+	// Addrs are client addresses of nodes, the rest of the cluster is
+	// discovered from them
+	Addrs []string
+
+	// PoolSize is how many idle connections are kept per node, 8 by default
+	PoolSize int
+	// DialTimeout bounds connecting to a node, 5 seconds by default
+	DialTimeout time.Duration
+	// TLS connects to nodes over TLS with this configuration, nil connects in plain text
+	TLS *tls.Config
+	// IdleTimeout drops pooled connections unused for longer, a minute by default
+	IdleTimeout time.Duration
+	// Username and Password authenticate every new connection when the
+	// password is set, an empty username is the default user
+	Username string
+	Password string
+
+	// MaxRetries is how often a failed request is tried again, 3 by
+	// default and none when negative. Writes that are not idempotent (INCR,
+	// PUSH, LPOP and RPOP) are not tried again once sent, the server may
+	// have applied them.
+	MaxRetries int
+	// MinBackoff is the wait before the first retry, 50 milliseconds by
+	// default. It doubles with every retry up to MaxBackoff, 2 seconds by default.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// ReadFromReplicas sends reads to followers instead of the leader
+	ReadFromReplicas bool
+	// WriteConcern and ReadConsistency are sent with every write and read,
+	// "" leaves the server's default
+	WriteConcern    string
+	ReadConsistency string
+}
+
+// maxRedirects bounds the MOVED, ASK and REDIRECT redirects one request follows
+const maxRedirects = 16
+
+// Client talks to a geomys node or cluster. It is safe for concurrent use.
+type Client struct {
+	opts  Options
+	state *state // shared with the copies made by WithWriteConcern and WithReadConsistency
+}
+
+// state is what every copy of a client shares
+type state struct {
+	mu       sync.Mutex
+	pools    map[string]*pool
+	topology *topology
+	known    map[string]bool // every node seen, to discover from
+	closed   bool
+
+	// Log index of the last write to each group, for WAIT and session reads
+	written   map[int32]uint64
+	lastGroup int32
+
+	// discovering is held while the topology is rebuilt
+	discovering sync.Mutex
+}
+
+// New returns a client for the nodes in opts.Addrs. It connects lazily, on
+// the first request.
+func New(opts Options) (*Client, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("geomys: no address given")
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 8
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = time.Minute
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 50 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(2*time.Second, opts.MinBackoff)
+	}
+	return &Client{opts: opts, state: &state{pools: make(map[string]*pool), known: make(map[string]bool), written: make(map[int32]uint64), lastGroup: noGroup}}, nil
+}
+
+// Close closes every connection of the client and its copies
+func (c *Client) Close() error {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.closed = true
+	for _, p := range c.state.pools {
+		p.close()
+	}
+	return nil
+}
+
+// WithWriteConcern returns a copy of the client that sends writes with
+// the write concern level: async, one, quorum or all
+func (c *Client) WithWriteConcern(level string) *Client {
+	copied := *c
+	copied.opts.WriteConcern = level
+	return &copied
+}
+
+// WithReadConsistency returns a copy of the client that sends reads with
+// the consistency level: eventual, bounded, session or linearizable
+func (c *Client) WithReadConsistency(level string) *Client {
+	copied := *c
+	copied.opts.ReadConsistency = level
+	return &copied
+}
+
+// call is one request and how to route it
+type call struct {
+	request    map[string]interface{}
+	key        string // routes by slot when set
+	group      int32  // routes to this group when there is no key, noGroup for any
+	write      bool   // goes to the leader
+	idempotent bool   // may be sent again after it failed on the way
+}
+
+// Do sends a raw request and returns the response. Requests with a key are
+// routed like the typed methods, everything else goes to the leader.
+func (c *Client) Do(ctx context.Context, request map[string]interface{}) (map[string]interface{}, error) {
+	key, _ := request["key"].(string)
+	return c.do(ctx, call{request: request, key: key, group: noGroup, write: true})
+}
+
+// do routes a call to its node, following redirects and retrying
+// failures, and returns the response
+func (c *Client) do(ctx context.Context, cl call) (map[string]interface{}, error) {
+	var redirect string
+	asking := false
+	redirects := 0
+	backoff := c.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		addr := redirect
+		if addr == "" {
+			var err error
+			if addr, err = c.route(ctx, cl); err != nil {
+				return nil, err
+			}
+		}
+
+		response, sent, err := c.send(ctx, addr, cl.request, asking)
+		redirect, asking = "", false
+		if err == nil {
+			if response["status"] != "ERROR" {
+				return response, nil
+			}
+			message, _ := response["message"].(string)
+			if kind, to, ok := parseRedirect(message); ok {
+				if redirects++; redirects > maxRedirects {
+					return nil, &Error{Message: message}
+				}
+				// A slot that moved for good, or a leader that changed,
+				// means the topology is stale
+				if kind != "ASK" {
+					c.invalidate()
+				}
+				redirect, asking = to, kind == "ASK"
+				attempt--
+				continue
+			}
+			err = &Error{Message: message}
+			if !retryable(message) {
+				return nil, err
+			}
+		} else if errors.Is(err, ErrRequestTooLarge) || errors.Is(err, ErrClosed) || errors.As(err, new(*Error)) || ctx.Err() != nil {
+			// Refused authentication is an answer of the server too
+			return nil, err
+		} else if sent && !cl.idempotent {
+			return nil, err
+		}
+
+		if attempt >= c.opts.MaxRetries {
+			return nil, err
+		}
+		// The node may be down or no longer lead
+		c.invalidate()
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff = min(2*backoff, c.opts.MaxBackoff)
+	}
+}
+
+// route returns the node a call goes to
+func (c *Client) route(ctx context.Context, cl call) (string, error) {
+	t, err := c.topology(ctx)
+	if errors.Is(err, ErrClosed) {
+		return "", err
+	}
+	if err == nil {
+		id := cl.group
+		if cl.key != "" {
+			id = t.groupOf(cl.key)
+		} else if id == noGroup && t.sharded() {
+			// Keyless commands go to any group
+			for id = range t.groups {
+				break
+			}
+		}
+		if addr := t.pick(id, cl.write, c.opts.ReadFromReplicas); addr != "" {
+			return addr, nil
+		}
+	}
+	// Any node will do when the cluster is unknown: a node that does not
+	// serve the key redirects, and a follower forwards or redirects writes
+	return c.opts.Addrs[rand.IntN(len(c.opts.Addrs))], nil
+}
+
+// topology returns what the client knows about the cluster, discovering it when needed
+func (c *Client) topology(ctx context.Context) (*topology, error) {
+	s := c.state
+	s.mu.Lock()
+	t, closed := s.topology, s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if t != nil {
+		return t, nil
+	}
+
+	// One request discovers, the others wait for it
+	s.discovering.Lock()
+	defer s.discovering.Unlock()
+	s.mu.Lock()
+	t = s.topology
+	s.mu.Unlock()
+	if t != nil {
+		return t, nil
+	}
+
+	addrs := append([]string(nil), c.opts.Addrs...)
+	s.mu.Lock()
+	for addr := range s.known {
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	s.mu.Unlock()
+
+	t, err := c.discover(ctx, addrs)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.topology = t
+	for _, addr := range t.addrs() {
+		s.known[addr] = true
+	}
+	s.mu.Unlock()
+	return t, nil
+}
+
+// invalidate makes the next request discover the topology again
+func (c *Client) invalidate() {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.topology = nil
+}
+
+// send sends request to the node at addr, after ASKING when asking is set.
+// sent reports whether the request may have reached the node.
+func (c *Client) send(ctx context.Context, addr string, request map[string]interface{}, asking bool) (response map[string]interface{}, sent bool, err error) {
+	p, err := c.pool(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	cn, err := p.get(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if asking {
+		if _, err := cn.roundTrip(ctx, map[string]interface{}{"command": "ASKING"}); err != nil {
+			cn.Close()
+			return nil, false, err
+		}
+	}
+	response, err = cn.roundTrip(ctx, request)
+	if err != nil {
+		cn.Close()
+		return nil, !errors.Is(err, ErrRequestTooLarge), err
+	}
+	p.put(cn)
+	return response, true, nil
+}
+
+// pool returns the connection pool of the node at addr
+func (c *Client) pool(addr string) (*pool, error) {
+	s := c.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	p, ok := s.pools[addr]
+	if !ok {
+		p = newPool(addr, c.opts)
+		s.pools[addr] = p
+	}
+	return p, nil
+}
+
+// parseRedirect reads a "MOVED <slot> <addr>", "ASK <slot> <addr>" or
+// "REDIRECT <addr> <term>" error
+func parseRedirect(message string) (kind, addr string, ok bool) {
+	fields := strings.Fields(message)
+	if len(fields) != 3 {
+		return "", "", false
+	}
+	switch fields[0] {
+	case "MOVED", "ASK":
+		return fields[0], fields[2], true
+	case "REDIRECT":
+		return fields[0], fields[1], true
+	}
+	return "", "", false
+}
+
+// retryable reports whether an error the server answered with may go away:
+// the cluster is electing or handing over a leader, catching up or moving
+// slots. Commands wrap the errors of the log, "Set failed: ..." for example.
+func retryable(message string) bool {
+	for _, reason := range []string{"CLUSTERDOWN", "LOADING", "No leader elected", "Failed to connect to leader", "Failed to forward request to leader", "leadership transfer in progress", "not the leader"} {
+		if strings.Contains(message, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep waits for about d, less a random part so clients do not retry in
+// lockstep, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	d = d/2 + rand.N(d/2+1)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// KeySlot returns the hash slot of key
+func KeySlot(key string) uint32 {
+	return shard.Slot(key)
+}
+
+// Ping checks that the cluster answers
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, call{request: map[string]interface{}{"command": "PING"}, group: noGroup, idempotent: true})
+	return err
+}
+
+// Echo returns message as a node sent it back
+func (c *Client) Echo(ctx context.Context, message string) (string, error) {
+	response, err := c.do(ctx, call{request: map[string]interface{}{"command": "ECHO", "message": message}, group: noGroup, idempotent: true})
+	if err != nil {
+		return "", err
+	}
+	echoed, _ := response["message"].(string)
+	return echoed, nil
+}
+
+// Set stores value at key, expiring after ttl unless ttl is 0
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	request := c.writeRequest("SET", key)
+	request["value"] = value
+	if ttl > 0 {
+		request["exp"] = ttl.Milliseconds()
+	}
+	_, err := c.write(ctx, key, request, true)
+	return err
+}
+
+// Get returns the value at key, ErrNotFound when there is none
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	request := map[string]interface{}{"command": "GET", "key": key}
+	if consistency := c.opts.ReadConsistency; consistency != "" {
+		request["consistency"] = consistency
+		// A session read sees this client's writes to the key's group
+		if strings.EqualFold(consistency, "session") {
+			if index := c.written(key); index > 0 {
+				request["session"] = index
+			}
+		}
+	}
+	response, err := c.do(ctx, call{request: request, key: key, idempotent: true})
+	if err != nil {
+		return "", notFound(err, "key not found")
+	}
+	if response["status"] == "NOT_FOUND" {
+		return "", ErrNotFound
+	}
+	value, _ := response["value"].(string)
+	return value, nil
+}
+
+// Incr adds offset to the integer at key and returns the result
+func (c *Client) Incr(ctx context.Context, key string, offset int64) (int64, error) {
+	request := c.writeRequest("INCR", key)
+	request["offset"] = strconv.FormatInt(offset, 10)
+	response, err := c.write(ctx, key, request, false)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := number(response["value"])
+	if !ok {
+		return 0, fmt.Errorf("geomys: INCR answered with %v", response["value"])
+	}
+	return value, nil
+}
+
+// Push appends value to the list at key
+func (c *Client) Push(ctx context.Context, key, value string) error {
+	request := c.writeRequest("PUSH", key)
+	request["value"] = value
+	_, err := c.write(ctx, key, request, false)
+	return err
+}
+
+// LPop removes and returns the first item of the list at key, ErrNotFound
+// when the list is empty
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return c.pop(ctx, "LPOP", key)
+}
+
+// RPop removes and returns the last item of the list at key, ErrNotFound
+// when the list is empty
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return c.pop(ctx, "RPOP", key)
+}
+
+func (c *Client) pop(ctx context.Context, command, key string) (string, error) {
+	response, err := c.write(ctx, key, c.writeRequest(command, key), false)
+	if err != nil {
+		return "", notFound(err, "list is empty", "list does not exist")
+	}
+	if value, ok := response["value"].(string); ok {
+		return value, nil
+	}
+	return fmt.Sprint(response["value"]), nil
+}
+
+// FlushDB removes every key, from every group of a sharded cluster
+func (c *Client) FlushDB(ctx context.Context) error {
+	groups := []int32{noGroup}
+	if t, err := c.topology(ctx); err == nil && t.sharded() {
+		groups = groups[:0]
+		for id := range t.groups {
+			groups = append(groups, id)
+		}
+	}
+	for _, id := range groups {
+		request := map[string]interface{}{"command": "FLUSHDB"}
+		if c.opts.WriteConcern != "" {
+			request["write_concern"] = c.opts.WriteConcern
+		}
+		if _, err := c.do(ctx, call{request: request, group: id, write: true, idempotent: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait waits until replicas followers applied the client's last write, or
+// timeout passed, and returns how many did. A timeout of 0 waits for good.
+func (c *Client) Wait(ctx context.Context, replicas int, timeout time.Duration) (int, error) {
+	c.state.mu.Lock()
+	id := c.state.lastGroup
+	index := c.state.written[id]
+	c.state.mu.Unlock()
+
+	request := map[string]interface{}{"command": "WAIT", "replicas": replicas, "index": index}
+	if timeout > 0 {
+		request["timeout"] = timeout.Milliseconds()
+	}
+	response, err := c.do(ctx, call{request: request, group: id, write: true, idempotent: true})
+	if err != nil {
+		return 0, err
+	}
+	applied, _ := number(response["value"])
+	return int(applied), nil
+}
+
+// Backup writes a snapshot of a node's data to path, relative to the node's
+// backup directory, as a directory or a .tar or .tar.gz archive
+func (c *Client) Backup(ctx context.Context, path string) error {
+	_, err := c.do(ctx, call{request: map[string]interface{}{"command": "BACKUP", "path": path}, group: noGroup, write: true})
+	return err
+}
+
+// Cluster runs a CLUSTER subcommand, such as SLOTS or MIGRATE, and returns its answer
+func (c *Client) Cluster(ctx context.Context, args ...string) (interface{}, error) {
+	response, err := c.do(ctx, call{request: map[string]interface{}{"command": "CLUSTER", "args": args}, group: noGroup, write: true})
+	if err != nil {
+		return nil, err
+	}
+	return response["value"], nil
+}
+
+// ACL runs an ACL subcommand, such as SETUSER or LIST, and returns its answer
+func (c *Client) ACL(ctx context.Context, args ...string) (interface{}, error) {
+	response, err := c.do(ctx, call{request: map[string]interface{}{"command": "ACL", "args": args}, group: noGroup, write: true})
+	if err != nil {
+		return nil, err
+	}
+	return response["value"], nil
+}
+
+// writeRequest starts a write of command to key with the client's write concern
+func (c *Client) writeRequest(command, key string) map[string]interface{} {
+	request := map[string]interface{}{"command": command, "key": key}
+	if c.opts.WriteConcern != "" {
+		request["write_concern"] = c.opts.WriteConcern
+	}
+	return request
+}
+
+// write sends a write to the leader serving key and remembers its log index
+func (c *Client) write(ctx context.Context, key string, request map[string]interface{}, idempotent bool) (map[string]interface{}, error) {
+	response, err := c.do(ctx, call{request: request, key: key, write: true, idempotent: idempotent})
+	if err != nil {
+		return nil, err
+	}
+	if index, ok := utils.ToInt64(response["index"]); ok && index > 0 {
+		id := c.groupOf(key)
+		c.state.mu.Lock()
+		c.state.written[id] = max(c.state.written[id], uint64(index))
+		c.state.lastGroup = id
+		c.state.mu.Unlock()
+	}
+	return response, nil
+}
+
+// written returns the log index of the client's last write to the group serving key
+func (c *Client) written(key string) uint64 {
+	id := c.groupOf(key)
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	return c.state.written[id]
+}
+
+// groupOf returns the group serving key as far as the client knows
+func (c *Client) groupOf(key string) int32 {
+	c.state.mu.Lock()
+	t := c.state.topology
+	c.state.mu.Unlock()
+	if t == nil {
+		return noGroup
+	}
+	return t.groupOf(key)
+}
+
+// number reads an integer a node answered with, followers forward some as text
+func number(value interface{}) (int64, bool) {
+	if text, ok := value.(string); ok {
+		n, err := strconv.ParseInt(text, 10, 64)
+		return n, err == nil
+	}
+	return utils.ToInt64(value)
+}
+
+// notFound turns the server's errors for a missing key or an empty list into ErrNotFound
+func notFound(err error, messages ...string) error {
+	var serverErr *Error
+	if errors.As(err, &serverErr) {
+		for _, message := range messages {
+			if strings.HasSuffix(serverErr.Message, message) {
+				return ErrNotFound
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// maxRequestSize is the most a server reads for one request
+const maxRequestSize = 1024
+
+// conn is one connection to a node, used by one request at a time
+type conn struct {
+	net.Conn
+	dec      *msgpack.Decoder
+	lastUsed time.Time
+}
+
+// roundTrip sends request and reads the response, within the deadline of
+// ctx and until ctx is canceled. A connection that failed must be closed.
+func (c *conn) roundTrip(ctx context.Context, request map[string]interface{}) (map[string]interface{}, error) {
+	data, err := msgpack.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRequestSize {
+		return nil, ErrRequestTooLarge
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// Cancelling ctx wakes up the read by moving the deadline to now
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	var response map[string]interface{}
+	if _, err = c.Write(data); err == nil {
+		err = c.dec.Decode(&response)
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	c.lastUsed = time.Now()
+	return response, nil
+}
+
+// authenticate sends the AUTH request of a new connection, if any
+func (c *conn) authenticate(ctx context.Context, auth map[string]interface{}) error {
+	if auth == nil {
+		return nil
+	}
+	response, err := c.roundTrip(ctx, auth)
+	if err != nil {
+		return err
+	}
+	if status, _ := response["status"].(string); status == "ERROR" {
+		message, _ := response["message"].(string)
+		return &Error{Message: message}
+	}
+	return nil
+}
+
+// pool keeps idle connections to one node
+type pool struct {
+	addr        string
+	dialer      dialer
+	idleTimeout time.Duration
+	idle        chan *conn
+	auth        map[string]interface{} // AUTH request sent on new connections, nil without a password
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// dialer opens connections, over TLS or not
+type dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newPool(addr string, opts Options) *pool {
+	var d dialer = &net.Dialer{Timeout: opts.DialTimeout}
+	if opts.TLS != nil {
+		d = &tls.Dialer{NetDialer: &net.Dialer{Timeout: opts.DialTimeout}, Config: opts.TLS}
+	}
+	p := &pool{
+		addr:        addr,
+		dialer:      d,
+		idleTimeout: opts.IdleTimeout,
+		idle:        make(chan *conn, opts.PoolSize),
+	}
+	if opts.Password != "" {
+		p.auth = map[string]interface{}{"command": "AUTH", "username": opts.Username, "password": opts.Password}
+	}
+	return p
+}
+
+// get returns an idle connection or dials a new one. Connections idle for
+// longer than the idle timeout are dropped, the server may have closed them.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	for {
+		select {
+		case c := <-p.idle:
+			if time.Since(c.lastUsed) < p.idleTimeout {
+				return c, nil
+			}
+			c.Close()
+		default:
+			nc, err := p.dialer.DialContext(ctx, "tcp", p.addr)
+			if err != nil {
+				return nil, err
+			}
+			c := &conn{Conn: nc, dec: msgpack.NewDecoder(bufio.NewReader(nc)), lastUsed: time.Now()}
+			if err := c.authenticate(ctx, p.auth); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+}
+
+// put returns a healthy connection to the pool, closing it when the pool is full
+func (p *pool) put(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// close closes the idle connections, later ones are closed when put back
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
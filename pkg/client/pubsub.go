@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Message is a message received on a subscription
+type Message struct {
+	Channel string
+	Pattern string // the pattern the channel matched, "" for a channel subscription
+	Payload string
+}
+
+// Subscription receives the messages published on channels or patterns,
+// over a connection of its own
+type Subscription struct {
+	conn     *conn
+	messages chan Message
+	closed   chan struct{}
+	close    sync.Once
+	err      error // why the connection ended, set before messages is closed
+}
+
+// Publish sends message to the subscribers of channel, on every node of a
+// cluster, and returns how many received it. It is not retried once sent.
+func (c *Client) Publish(ctx context.Context, channel, message string) (int, error) {
+	request := map[string]interface{}{"command": "PUBLISH", "channel": channel, "message": message}
+	response, err := c.do(ctx, call{request: request, group: noGroup})
+	if err != nil {
+		return 0, err
+	}
+	receivers, _ := number(response["value"])
+	return int(receivers), nil
+}
+
+// Subscribe subscribes to channels and returns once the node confirmed
+// every subscription
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*Subscription, error) {
+	return c.subscribe(ctx, "SUBSCRIBE", channels)
+}
+
+// PSubscribe subscribes to the channels matching patterns, * matching any
+// run of characters and ? one
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*Subscription, error) {
+	return c.subscribe(ctx, "PSUBSCRIBE", patterns)
+}
+
+func (c *Client) subscribe(ctx context.Context, command string, names []string) (*Subscription, error) {
+	addr, err := c.route(ctx, call{group: noGroup})
+	if err != nil {
+		return nil, err
+	}
+	p, err := c.pool(addr)
+	if err != nil {
+		return nil, err
+	}
+	cn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(names))
+	for i, name := range names {
+		args[i] = name
+	}
+
+	// Messages of the channels confirmed first may come before the other confirmations
+	var early []Message
+	response, err := cn.roundTrip(ctx, map[string]interface{}{"command": command, "args": args})
+	for confirmed := 0; err == nil; {
+		if status, _ := response["status"].(string); status == "ERROR" {
+			message, _ := response["message"].(string)
+			err = &Error{Message: message}
+			break
+		}
+		if m, ok := pushed(response); ok {
+			early = append(early, m)
+		} else if confirmed++; confirmed == len(names) {
+			break
+		}
+		response = nil
+		err = cn.dec.Decode(&response)
+	}
+	if err == nil {
+		err = cn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		cn.Close()
+		return nil, err
+	}
+
+	s := &Subscription{conn: cn, messages: make(chan Message), closed: make(chan struct{})}
+	go s.read(early)
+	return s, nil
+}
+
+// pushed reads a message a node pushed, confirmations and replies are not messages
+func pushed(response map[string]interface{}) (Message, bool) {
+	kind, _ := response["type"].(string)
+	if kind != "message" && kind != "pmessage" {
+		return Message{}, false
+	}
+	m := Message{}
+	m.Channel, _ = response["channel"].(string)
+	m.Pattern, _ = response["pattern"].(string)
+	m.Payload, _ = response["value"].(string)
+	return m, true
+}
+
+// read passes the messages of the connection to Receive until it fails or is closed
+func (s *Subscription) read(early []Message) {
+	defer close(s.messages)
+	deliver := func(m Message) bool {
+		select {
+		case s.messages <- m:
+			return true
+		case <-s.closed:
+			return false
+		}
+	}
+	for _, m := range early {
+		if !deliver(m) {
+			s.err = ErrClosed
+			return
+		}
+	}
+	for {
+		var response map[string]interface{}
+		if err := s.conn.dec.Decode(&response); err != nil {
+			s.err = err
+			select {
+			case <-s.closed:
+				s.err = ErrClosed
+			default:
+			}
+			return
+		}
+		if m, ok := pushed(response); ok && !deliver(m) {
+			s.err = ErrClosed
+			return
+		}
+	}
+}
+
+// Receive waits for the next message. Once the connection failed, a node
+// dropping a subscriber that reads too slowly for example, it returns the error.
+func (s *Subscription) Receive(ctx context.Context) (Message, error) {
+	select {
+	case m, ok := <-s.messages:
+		if !ok {
+			return Message{}, s.err
+		}
+		return m, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Close ends the subscription and closes its connection
+func (s *Subscription) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// noGroup is the group of keys on a cluster without sharding
+const noGroup = -1
+
+// group is the leader and followers of one replication group, by client address
+type group struct {
+	leader   string
+	replicas []string
+}
+
+// topology is what the client knows about the nodes and who serves which key
+type topology struct {
+	groups map[int32]*group
+	slots  []int32 // group serving each slot when sharded, noGroup when nobody does
+}
+
+// sharded reports whether keys are spread over groups by hash slot
+func (t *topology) sharded() bool {
+	return t.slots != nil
+}
+
+// groupOf returns the group serving key
+func (t *topology) groupOf(key string) int32 {
+	if !t.sharded() {
+		return noGroup
+	}
+	return t.slots[shard.Slot(key)]
+}
+
+// pick returns the node a request for group goes to: the leader for writes,
+// a follower for reads when replicas is set. "" means no node is known.
+func (t *topology) pick(id int32, write, replicas bool) string {
+	g := t.groups[id]
+	if g == nil {
+		return ""
+	}
+	if !write && replicas && len(g.replicas) > 0 {
+		return g.replicas[rand.IntN(len(g.replicas))]
+	}
+	return g.leader
+}
+
+// addrs returns every node the topology knows
+func (t *topology) addrs() []string {
+	var addrs []string
+	for _, g := range t.groups {
+		if g.leader != "" {
+			addrs = append(addrs, g.leader)
+		}
+		addrs = append(addrs, g.replicas...)
+	}
+	return addrs
+}
+
+// discover builds the topology from the first of addrs that answers. A
+// sharded cluster describes itself through CLUSTER SHARDS, otherwise every
+// node is asked for its ROLE.
+func (c *Client) discover(ctx context.Context, addrs []string) (*topology, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		response, _, err := c.send(ctx, addr, map[string]interface{}{"command": "CLUSTER", "args": []string{"SHARDS"}}, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response["status"] == "OK" {
+			return parseShards(response["value"])
+		}
+		if message, _ := response["message"].(string); !strings.Contains(message, "sharding is not enabled") {
+			lastErr = &Error{Message: message}
+			continue
+		}
+		return c.discoverRoles(ctx, addrs)
+	}
+	if lastErr == nil {
+		lastErr = ErrNoNodes
+	}
+	return nil, lastErr
+}
+
+// discoverRoles asks the nodes of a cluster without sharding for their
+// role, the first one that answers names the leader and every member
+func (c *Client) discoverRoles(ctx context.Context, addrs []string) (*topology, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		response, _, err := c.send(ctx, addr, map[string]interface{}{"command": "ROLE"}, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response["status"] != "OK" {
+			message, _ := response["message"].(string)
+			lastErr = &Error{Message: message}
+			continue
+		}
+		if response["value"] == "standalone" {
+			return &topology{groups: map[int32]*group{noGroup: {leader: addr}}}, nil
+		}
+
+		g := &group{}
+		nodes, _ := response["nodes"].([]interface{})
+		for _, node := range nodes {
+			info, _ := node.(map[string]interface{})
+			member, _ := info["address"].(string)
+			if member == "" {
+				continue
+			}
+			if info["role"] == "leader" {
+				g.leader = member
+			} else {
+				g.replicas = append(g.replicas, member)
+			}
+		}
+		return &topology{groups: map[int32]*group{noGroup: g}}, nil
+	}
+	return nil, lastErr
+}
+
+// parseShards reads the answer to CLUSTER SHARDS
+func parseShards(value interface{}) (*topology, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected CLUSTER SHARDS answer %v", value)
+	}
+	t := &topology{groups: make(map[int32]*group), slots: make([]int32, shard.SlotCount)}
+	for i := range t.slots {
+		t.slots[i] = noGroup
+	}
+	for _, item := range list {
+		entry, _ := item.(map[string]interface{})
+		id, ok := utils.ToInt64(entry["group"])
+		if !ok {
+			return nil, fmt.Errorf("unexpected CLUSTER SHARDS entry %v", item)
+		}
+		g := &group{}
+		nodes, _ := entry["nodes"].([]interface{})
+		for _, node := range nodes {
+			info, _ := node.(map[string]interface{})
+			addr, _ := info["address"].(string)
+			if info["role"] == "leader" {
+				g.leader = addr
+			} else {
+				g.replicas = append(g.replicas, addr)
+			}
+		}
+		t.groups[int32(id)] = g
+
+		slots, _ := entry["slots"].([]interface{})
+		for _, r := range slots {
+			bounds, _ := r.(map[string]interface{})
+			start, okStart := utils.ToInt64(bounds["start"])
+			end, okEnd := utils.ToInt64(bounds["end"])
+			if !okStart || !okEnd || start < 0 || end >= shard.SlotCount {
+				return nil, fmt.Errorf("unexpected slot range %v", r)
+			}
+			for slot := start; slot <= end; slot++ {
+				t.slots[slot] = int32(id)
+			}
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,107 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vskvj3/geomys/pkg/client"
+)
+
+func TestACL(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+	follower := followerOf(nodes, leader)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	connect := func(username, password string) *client.Client {
+		c, err := client.New(client.Options{Addrs: []string{follower.clientAddr()}, Username: username, Password: password})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		return c
+	}
+	open := connect("", "")
+	defer open.Close()
+	for _, rules := range [][]string{
+		{"SETUSER", "admin", "on", ">root", "allcommands", "allkeys"},
+		{"SETUSER", "app", "on", ">secret", "+@read", "+@write", "-flushdb", "~app:*"},
+		{"SETUSER", "default", "off"},
+	} {
+		if _, err := open.ACL(ctx, rules...); err != nil {
+			t.Fatalf("ACL %v failed: %v", rules, err)
+		}
+	}
+
+	t.Run("users are replicated", func(t *testing.T) {
+		waitFor(t, "the users to reach every node", func() bool {
+			for _, node := range nodes {
+				if node.handler.Authenticate("app", "secret") != nil || node.handler.Authorize("", "GET", "app:1") == nil {
+					return false
+				}
+			}
+			return true
+		})
+	})
+
+	t.Run("connections must authenticate", func(t *testing.T) {
+		var serverErr *client.Error
+		if _, err := open.Get(ctx, "app:1"); !errors.As(err, &serverErr) || !strings.HasPrefix(serverErr.Message, "NOAUTH") {
+			t.Errorf("expected NOAUTH, got %v", err)
+		}
+		wrong := connect("app", "wrong")
+		defer wrong.Close()
+		if err := wrong.Ping(ctx); !errors.As(err, &serverErr) || !strings.HasPrefix(serverErr.Message, "WRONGPASS") {
+			t.Errorf("expected WRONGPASS, got %v", err)
+		}
+	})
+
+	t.Run("users run what their rules allow", func(t *testing.T) {
+		app := connect("app", "secret")
+		defer app.Close()
+		// The follower forwards the write to the leader
+		if err := app.Set(ctx, "app:1", "geomys", 0); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+		if value, err := app.Get(ctx, "app:1"); err != nil || value != "geomys" {
+			t.Errorf("expected geomys, got %q, %v", value, err)
+		}
+		var serverErr *client.Error
+		if err := app.Set(ctx, "other", "value", 0); !errors.As(err, &serverErr) || !strings.HasPrefix(serverErr.Message, "NOPERM") {
+			t.Errorf("expected NOPERM for a key outside the patterns, got %v", err)
+		}
+		if err := app.FlushDB(ctx); !errors.As(err, &serverErr) || !strings.HasPrefix(serverErr.Message, "NOPERM") {
+			t.Errorf("expected NOPERM for FLUSHDB, got %v", err)
+		}
+
+		admin := connect("admin", "root")
+		defer admin.Close()
+		value, err := admin.ACL(ctx, "LIST")
+		if err != nil {
+			t.Fatalf("ACL LIST failed: %v", err)
+		}
+		if users, _ := value.([]interface{}); len(users) != 3 {
+			t.Errorf("expected 3 users, got %v", value)
+		}
+		if _, err := admin.ACL(ctx, "DELUSER", "app"); err != nil {
+			t.Fatalf("ACL DELUSER failed: %v", err)
+		}
+		waitFor(t, "the removal to reach the follower", func() bool {
+			return follower.handler.Authenticate("app", "secret") != nil
+		})
+		if _, err := app.Get(ctx, "app:1"); !errors.As(err, &serverErr) || !strings.HasPrefix(serverErr.Message, "NOAUTH") {
+			t.Errorf("expected an open connection of a removed user to be refused, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,251 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+	"github.com/vskvj3/geomys/pkg/client"
+)
+
+// clientAddr returns the address node serves clients on
+func (n *clusterNode) clientAddr() string {
+	return n.server.Config.ClientAddress
+}
+
+func TestClient(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+	third := startClusterNode(t, 3, t.TempDir(), 0, false, first.addr())
+	nodes := []*clusterNode{first, second, third}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	waitForLeader(t, nodes)
+
+	// Only followers are given, the client finds the leader itself
+	c, err := client.New(client.Options{Addrs: []string{second.clientAddr(), third.clientAddr()}, MaxRetries: 20})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	t.Run("typed commands", func(t *testing.T) {
+		if err := c.Ping(ctx); err != nil {
+			t.Fatalf("PING failed: %v", err)
+		}
+		if err := c.Set(ctx, "name", "geomys", 0); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+		if value, err := c.Get(ctx, "name"); err != nil || value != "geomys" {
+			t.Errorf("expected geomys, got %q, %v", value, err)
+		}
+		if _, err := c.Get(ctx, "missing"); !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+
+		if err := c.Set(ctx, "counter", "10", 0); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+		if value, err := c.Incr(ctx, "counter", 5); err != nil || value != 15 {
+			t.Errorf("expected 15, got %d, %v", value, err)
+		}
+
+		for _, item := range []string{"a", "b", "c"} {
+			if err := c.Push(ctx, "queue", item); err != nil {
+				t.Fatalf("PUSH failed: %v", err)
+			}
+		}
+		if value, err := c.LPop(ctx, "queue"); err != nil || value != "a" {
+			t.Errorf("expected a, got %q, %v", value, err)
+		}
+		if value, err := c.RPop(ctx, "queue"); err != nil || value != "c" {
+			t.Errorf("expected c, got %q, %v", value, err)
+		}
+		if _, err := c.LPop(ctx, "nothing"); !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("expected ErrNotFound for a missing list, got %v", err)
+		}
+
+		if err := c.Set(ctx, "short", "lived", 100*time.Millisecond); err != nil {
+			t.Fatalf("SET with ttl failed: %v", err)
+		}
+		waitFor(t, "the key to expire", func() bool {
+			_, err := c.Get(ctx, "short")
+			return errors.Is(err, client.ErrNotFound)
+		})
+	})
+
+	t.Run("writes and session reads", func(t *testing.T) {
+		quorum := c.WithWriteConcern("all")
+		if err := quorum.Set(ctx, "acked", "yes", 0); err != nil {
+			t.Fatalf("SET with write concern all failed: %v", err)
+		}
+		if applied, err := c.Wait(ctx, 2, time.Second); err != nil || applied != 2 {
+			t.Errorf("expected both followers to have applied the write, got %d, %v", applied, err)
+		}
+
+		// Reads from followers still see the client's own writes
+		replicas, err := client.New(client.Options{Addrs: []string{first.clientAddr()}, ReadFromReplicas: true, ReadConsistency: "session"})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer replicas.Close()
+		for i := 0; i < 20; i++ {
+			value := fmt.Sprint(i)
+			if err := replicas.WithWriteConcern("async").Set(ctx, "session", value, 0); err != nil {
+				t.Fatalf("SET failed: %v", err)
+			}
+			if got, err := replicas.Get(ctx, "session"); err != nil || got != value {
+				t.Fatalf("expected the session read to return %s, got %q, %v", value, got, err)
+			}
+		}
+	})
+
+	t.Run("a canceled context stops the request", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := c.Set(canceled, "name", "late", 0); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("writes are retried across a leadership transfer", func(t *testing.T) {
+		stop := make(chan struct{})
+		failed := make(chan error, 1)
+		written := make(chan int, 1)
+		go func() {
+			i := 0
+			defer func() { written <- i }()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := c.Set(ctx, "transfer", fmt.Sprint(i+1), 0); err != nil {
+					failed <- err
+					return
+				}
+				i++
+			}
+		}()
+		for round := 0; round < 3; round++ {
+			target := followerOf(nodes, waitForLeader(t, nodes))
+			if _, err := c.Cluster(ctx, "TRANSFER", fmt.Sprint(target.id)); err != nil {
+				t.Fatalf("CLUSTER TRANSFER failed: %v", err)
+			}
+			waitFor(t, "the transfer to complete", func() bool { return target.server.IsLeader() })
+		}
+		close(stop)
+		count := <-written
+		select {
+		case err := <-failed:
+			t.Fatalf("expected the writes to be retried, write %d failed: %v", count+1, err)
+		default:
+		}
+		if value, err := c.WithReadConsistency("linearizable").Get(ctx, "transfer"); err != nil || value != fmt.Sprint(count) {
+			t.Errorf("expected %d, got %q, %v", count, value, err)
+		}
+	})
+
+	t.Run("the client follows a new leader", func(t *testing.T) {
+		leader := waitForLeader(t, nodes)
+		leader.stop()
+		remaining := []*clusterNode{}
+		for _, node := range nodes {
+			if node != leader {
+				remaining = append(remaining, node)
+			}
+		}
+		nodes = remaining
+
+		if err := c.Set(ctx, "after", "failover", 0); err != nil {
+			t.Fatalf("SET after the leader stopped failed: %v", err)
+		}
+		if value, err := c.WithReadConsistency("linearizable").Get(ctx, "after"); err != nil || value != "failover" {
+			t.Errorf("expected failover, got %q, %v", value, err)
+		}
+	})
+}
+
+func TestClientSharded(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "", shardGroup(1, "0-8191"))
+	second := startClusterNode(t, 2, t.TempDir(), 0, true, "", shardGroup(2, "8192-16383", first.addr()))
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	for _, node := range nodes {
+		waitFor(t, fmt.Sprintf("node %d to learn both leaders", node.id), func() bool {
+			for _, group := range []int32{1, 2} {
+				if members := node.server.Shards.Members(group); len(members) != 1 || !members[0].Leader {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	c, err := client.New(client.Options{Addrs: []string{first.clientAddr()}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+		if err := c.Set(ctx, keys[i], fmt.Sprint(i), 0); err != nil {
+			t.Fatalf("SET %s failed: %v", keys[i], err)
+		}
+	}
+
+	// Every key landed on the group serving its slot
+	for i, key := range keys {
+		node := first
+		if client.KeySlot(key) >= 8192 {
+			node = second
+		}
+		if value, err := node.handler.Database.Get(key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("expected %s on node %d, got %q, %v", key, node.id, value, err)
+		}
+	}
+
+	// The client keeps up with slots moving to the other group
+	if _, err := c.Cluster(ctx, "MIGRATE", "0-8191", "2"); err != nil {
+		t.Fatalf("CLUSTER MIGRATE failed: %v", err)
+	}
+	for i, key := range keys {
+		if value, err := c.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("expected %s to be %d after the migration, got %q, %v", key, i, value, err)
+		}
+	}
+	if err := c.Set(ctx, keys[0], "moved", 0); err != nil {
+		t.Fatalf("SET after the migration failed: %v", err)
+	}
+	if value, err := second.handler.Database.Get(keys[0]); err != nil || value != "moved" {
+		t.Errorf("expected the write to reach group 2, got %q, %v", value, err)
+	}
+	if shard.Slot(keys[0]) != client.KeySlot(keys[0]) {
+		t.Error("expected the client to hash keys like the server")
+	}
+
+	if err := c.FlushDB(ctx); err != nil {
+		t.Fatalf("FLUSHDB failed: %v", err)
+	}
+	if _, err := c.Get(ctx, keys[1]); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected every group to be flushed, got %v", err)
+	}
+}
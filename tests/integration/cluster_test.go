@@ -0,0 +1,383 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/cluster"
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/cluster/raft"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/network"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// clusterNode is one in-process cluster member
+type clusterNode struct {
+	id      int32
+	dir     string
+	engine  persistence.Engine
+	handler *core.CommandHandler
+	server  *cluster.ClusterServer
+	clients *network.Server // serves clients on a port of its own
+}
+
+// startClusterNode starts a member keeping its data in dir and serving gRPC
+// on port (0 picks one), bootstrapping a new cluster or joining the one at join.
+// setup runs on the node's handler and config before it opens its ports.
+func startClusterNode(t *testing.T, id int32, dir string, port int32, bootstrap bool, join string, setup ...func(*core.CommandHandler, *utils.Config)) *clusterNode {
+	t.Helper()
+	engine, err := persistence.NewEngine(persistence.EngineBinlog, dir, nil)
+	if err != nil {
+		t.Fatalf("node %d: failed to open engine: %v", id, err)
+	}
+	handler := core.NewCommandHandler(core.NewDatabase(), engine)
+
+	config := &utils.Config{NodeID: int(id), DataDir: dir, HeartbeatInterval: 50, ElectionTimeout: 300}
+	for _, fn := range setup {
+		fn(handler, config)
+	}
+	server := cluster.NewClusterServer(config, utils.NewNopLogger(), id, port)
+	if err := server.Listen(); err != nil {
+		t.Fatalf("node %d: listen failed: %v", id, err)
+	}
+	config.AdvertiseAddress = fmt.Sprintf("127.0.0.1:%d", server.Port)
+
+	// Like the server binary, the client server rebuilds the database before the node starts
+	clients, err := network.NewServer(config, utils.NewNopLogger(), server, "0", handler)
+	if err != nil {
+		t.Fatalf("node %d: client server failed: %v", id, err)
+	}
+	if err := clients.Listen(); err != nil {
+		t.Fatalf("node %d: client listen failed: %v", id, err)
+	}
+	_, clientPort, _ := net.SplitHostPort(clients.Addr())
+	config.ClientAddress = net.JoinHostPort("127.0.0.1", clientPort)
+	if err := server.StartServer(handler, bootstrap); err != nil {
+		t.Fatalf("node %d: start failed: %v", id, err)
+	}
+	if join != "" {
+		if err := server.Join(join); err != nil {
+			t.Fatalf("node %d: join failed: %v", id, err)
+		}
+	}
+	go clients.Start()
+	return &clusterNode{id: id, dir: dir, engine: engine, handler: handler, server: server, clients: clients}
+}
+
+func (n *clusterNode) stop() {
+	n.clients.Close()
+	n.server.Stop()
+	n.engine.Close()
+}
+
+func (n *clusterNode) addr() string {
+	return n.server.Config.AdvertiseAddress
+}
+
+// waitFor polls cond until it holds or the deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitForLeader returns the single leader among nodes
+func waitForLeader(t *testing.T, nodes []*clusterNode) *clusterNode {
+	t.Helper()
+	var leader *clusterNode
+	waitFor(t, "a leader", func() bool {
+		leader = nil
+		for _, node := range nodes {
+			if node.server.IsLeader() {
+				if leader != nil {
+					return false
+				}
+				leader = node
+			}
+		}
+		return leader != nil
+	})
+	return leader
+}
+
+func TestRaftCluster(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+	third := startClusterNode(t, 3, t.TempDir(), 0, false, first.addr())
+	nodes := []*clusterNode{first, second, third}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+
+	hasKey := func(node *clusterNode, key, want string) func() bool {
+		return func() bool {
+			value, err := node.handler.Database.Get(key)
+			return err == nil && value == want
+		}
+	}
+
+	t.Run("writes reach every member", func(t *testing.T) {
+		leader := waitForLeader(t, nodes)
+		if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "counter", "value": "10"}); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+		response, err := leader.handler.HandleCommand(map[string]interface{}{"command": "INCR", "key": "counter", "offset": "5"})
+		if err != nil || response["value"] != 15 {
+			t.Fatalf("expected INCR to return 15, got %v, %v", response, err)
+		}
+		for _, node := range nodes {
+			waitFor(t, fmt.Sprintf("node %d to apply the writes", node.id), hasKey(node, "counter", "15"))
+		}
+	})
+
+	t.Run("concurrent writes are pipelined in order", func(t *testing.T) {
+		leader := waitForLeader(t, nodes)
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for w := 0; w < 20; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "PUSH", "key": "pipelined", "value": fmt.Sprint(w, "-", i)}); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("PUSH failed: %v", err)
+		}
+
+		list := func(node *clusterNode) interface{} {
+			for _, entry := range node.handler.Database.Entries() {
+				if entry.Key == "pipelined" {
+					return entry.Value
+				}
+			}
+			return nil
+		}
+		want := list(leader)
+		if values, _ := want.([]interface{}); len(values) != 1000 {
+			t.Fatalf("expected 1000 pushes on the leader, got %v", want)
+		}
+		for _, node := range nodes {
+			waitFor(t, fmt.Sprintf("node %d to apply every push in the leader's order", node.id), func() bool {
+				return reflect.DeepEqual(list(node), want)
+			})
+		}
+	})
+
+	t.Run("write concern all waits for every follower", func(t *testing.T) {
+		leader := waitForLeader(t, nodes)
+		response, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "durable", "value": "yes", "write_concern": "all"})
+		if err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+		for _, node := range nodes {
+			if value, _ := node.handler.Database.Get("durable"); value != "yes" {
+				t.Errorf("node %d had not applied the write when it was acknowledged", node.id)
+			}
+		}
+
+		response, err = leader.handler.HandleCommand(map[string]interface{}{"command": "WAIT", "replicas": 2, "timeout": 1000, "index": response["index"]})
+		if err != nil || response["value"] != 2 {
+			t.Errorf("expected WAIT to report 2 replicas, got %v, %v", response, err)
+		}
+	})
+
+	t.Run("followers serve reads at the requested consistency", func(t *testing.T) {
+		leader := waitForLeader(t, nodes)
+		var follower *clusterNode
+		for _, node := range nodes {
+			if node != leader {
+				follower = node
+			}
+		}
+
+		for i := 0; i < 20; i++ {
+			value := fmt.Sprint(i)
+			written, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "fresh", "value": value})
+			if err != nil {
+				t.Fatalf("SET failed: %v", err)
+			}
+			response, err := follower.handler.HandleCommand(map[string]interface{}{"command": "GET", "key": "fresh", "consistency": "session", "session": written["index"]})
+			if err != nil || response["value"] != value {
+				t.Fatalf("session read returned %v, %v, want %s", response, err, value)
+			}
+
+			// A write the follower has not heard of yet is still visible to a linearizable read
+			if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "fresh", "value": value + "!"}); err != nil {
+				t.Fatalf("SET failed: %v", err)
+			}
+			response, err = follower.handler.HandleCommand(map[string]interface{}{"command": "GET", "key": "fresh", "consistency": "linearizable"})
+			if err != nil || response["value"] != value+"!" {
+				t.Fatalf("linearizable read returned %v, %v, want %s!", response, err, value)
+			}
+		}
+
+		response, err := follower.handler.HandleCommand(map[string]interface{}{"command": "GET", "key": "fresh", "consistency": "bounded", "max_staleness_ms": 5000})
+		if err != nil || response["value"] != "19!" {
+			t.Errorf("bounded read returned %v, %v", response, err)
+		}
+		if _, err := follower.handler.HandleCommand(map[string]interface{}{"command": "GET", "key": "fresh", "consistency": "strong"}); err == nil {
+			t.Errorf("expected an unknown consistency level to be refused")
+		}
+	})
+
+	t.Run("followers refuse writes", func(t *testing.T) {
+		leader := waitForLeader(t, nodes)
+		for _, node := range nodes {
+			if node == leader {
+				continue
+			}
+			if _, err := node.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "k", "value": "v"}); err == nil {
+				t.Errorf("node %d accepted a write as a follower", node.id)
+			}
+		}
+	})
+
+	t.Run("acknowledged writes survive losing the leader", func(t *testing.T) {
+		leader := waitForLeader(t, nodes)
+		if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "before", "value": "1"}); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+		leader.stop()
+
+		var rest []*clusterNode
+		for _, node := range nodes {
+			if node != leader {
+				rest = append(rest, node)
+			}
+		}
+		newLeader := waitForLeader(t, rest)
+		if _, err := newLeader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "after", "value": "2"}); err != nil {
+			t.Fatalf("SET on the new leader failed: %v", err)
+		}
+		for _, node := range rest {
+			waitFor(t, fmt.Sprintf("node %d to keep the old write", node.id), hasKey(node, "before", "1"))
+		}
+
+		// The stopped node is still a member, so not every member can apply a write
+		_, err := newLeader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "everywhere", "value": "1", "write_concern": "all", "timeout": 300})
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("expected write concern all to time out with a member down, got %v", err)
+		}
+
+		// The old leader rebuilds from its own data and catches up on the rest
+		restarted := startClusterNode(t, leader.id, leader.dir, leader.server.Port, false, "")
+		for i, node := range nodes {
+			if node == leader {
+				nodes[i] = restarted
+			}
+		}
+		waitFor(t, "the old leader to catch up", hasKey(restarted, "after", "2"))
+		if value, _ := restarted.handler.Database.Get("counter"); value != "15" {
+			t.Errorf("expected counter 15 after restart, got %q", value)
+		}
+	})
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	set := func(handler *core.CommandHandler, from, to int) {
+		for i := from; i < to; i++ {
+			if _, err := handler.HandleCommand(map[string]interface{}{"command": "SET", "key": fmt.Sprint("key", i), "value": fmt.Sprint(i)}); err != nil {
+				t.Fatalf("SET %d failed: %v", i, err)
+			}
+		}
+	}
+	compactEarly := func(_ *core.CommandHandler, config *utils.Config) {
+		config.SnapshotThreshold = 20
+	}
+
+	// Data written before the cluster existed is carried into it
+	standalone := func(handler *core.CommandHandler, config *utils.Config) {
+		compactEarly(handler, config)
+		set(handler, 0, 50)
+	}
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "", standalone)
+	defer func() { first.stop() }()
+	waitForLeader(t, []*clusterNode{first})
+	set(first.handler, 50, 100)
+
+	// The joining node is behind the compacted log and needs the snapshot
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr(), compactEarly)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key", i)
+		waitFor(t, "node 2 to receive "+key, func() bool {
+			value, err := second.handler.Database.Get(key)
+			return err == nil && value == fmt.Sprint(i)
+		})
+	}
+	waitFor(t, "node 2 to serve reads", second.server.Ready)
+	if partials, _ := filepath.Glob(filepath.Join(second.dir, "raft.snapshot.*.partial")); len(partials) != 0 {
+		t.Errorf("expected the transfer to clean up, found %v", partials)
+	}
+
+	// A restart resumes from the node's own data and log
+	second.stop()
+	second = startClusterNode(t, 2, second.dir, second.server.Port, false, "", compactEarly)
+	defer func() { second.stop() }()
+	leader := waitForLeader(t, []*clusterNode{first, second})
+	set(leader.handler, 100, 130)
+	waitFor(t, "node 2 to apply new writes", func() bool {
+		value, err := second.handler.Database.Get("key129")
+		return err == nil && value == "129"
+	})
+	if len(second.handler.Database.Entries()) != 130 {
+		t.Errorf("expected 130 keys on node 2, got %d", len(second.handler.Database.Entries()))
+	}
+}
+
+func TestReorderedHeartbeat(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+	follower := followerOf(nodes, leader)
+	for i := 0; i < 5; i++ {
+		if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": fmt.Sprint("key", i), "value": "v"}); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+	}
+	commit := leader.server.Raft.CommitIndex()
+	waitFor(t, "the follower to learn the commit index", func() bool {
+		return follower.server.Raft.CommitIndex() >= commit
+	})
+
+	// A heartbeat sent before the writes arrives late, its log ends at 0
+	// but it carries a commit index above the follower's
+	late := &pb.AppendEntriesRequest{Term: leader.server.Term(), LeaderId: leader.id, LeaderCommit: commit + 1}
+	if _, err := (&raft.Server{Node: follower.server.Raft}).AppendEntries(context.Background(), late); err != nil {
+		t.Fatalf("AppendEntries failed: %v", err)
+	}
+	if got := follower.server.Raft.CommitIndex(); got < commit {
+		t.Errorf("expected the commit index to stay at %d or above, got %d", commit, got)
+	}
+}
@@ -0,0 +1,95 @@
+package integration
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// freePort returns a port nothing listens on right now
+func freePort(t *testing.T) int32 {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer lis.Close()
+	return int32(lis.Addr().(*net.TCPAddr).Port)
+}
+
+// withPeers sets the peers a node joins through
+func withPeers(peers ...string) func(*core.CommandHandler, *utils.Config) {
+	return func(_ *core.CommandHandler, config *utils.Config) {
+		config.Peers = peers
+	}
+}
+
+func TestPeerDiscovery(t *testing.T) {
+	// Three nodes bootstrap a cluster from a static peer set
+	ports := []int32{freePort(t), freePort(t), freePort(t)}
+	var peers []string
+	for i, port := range ports {
+		peers = append(peers, fmt.Sprintf("%d@127.0.0.1:%d", i+1, port))
+	}
+	var nodes []*clusterNode
+	for i, port := range ports {
+		nodes = append(nodes, startClusterNode(t, int32(i+1), t.TempDir(), port, false, "", withPeers(peers...)))
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *clusterNode) {
+			defer wg.Done()
+			if err := node.server.JoinPeers(false); err != nil {
+				t.Errorf("node %d: joining its peers failed: %v", node.id, err)
+			}
+		}(node)
+	}
+	wg.Wait()
+	leader := waitForLeader(t, nodes)
+
+	t.Run("the static peers form one cluster", func(t *testing.T) {
+		config := leader.server.Raft.Configuration()
+		if len(config.Voters) != 3 {
+			t.Errorf("expected 3 voters, got %v", config.Voters)
+		}
+		for _, node := range nodes {
+			if got := config.ClientAddresses[node.id]; got != node.server.Config.ClientAddress {
+				t.Errorf("expected node %d to register client address %s, got %q", node.id, node.server.Config.ClientAddress, got)
+			}
+			if id := node.server.Raft.ClusterID(); id != leader.server.Raft.ClusterID() {
+				t.Errorf("expected one cluster id, node %d has %s", node.id, id)
+			}
+		}
+		if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "name", "value": "geomys"}); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+	})
+
+	t.Run("a new node finds the cluster through any reachable peer", func(t *testing.T) {
+		// The first peer listed is gone, as the original leader may be
+		dead := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		fourth := startClusterNode(t, 4, t.TempDir(), 0, false, "", withPeers(dead, followerOf(nodes, leader).addr()))
+		nodes = append(nodes, fourth)
+		if err := fourth.server.JoinPeers(false); err != nil {
+			t.Fatalf("joining through the peers failed: %v", err)
+		}
+		waitFor(t, "the new node to catch up", func() bool {
+			value, err := fourth.handler.Database.Get("name")
+			return err == nil && value == "geomys"
+		})
+		if _, member := leader.server.GetNodes()[4]; !member {
+			t.Error("expected node 4 to be a member")
+		}
+	})
+}
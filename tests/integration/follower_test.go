@@ -0,0 +1,131 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/utils"
+	"github.com/vskvj3/geomys/pkg/client"
+)
+
+// followerOf returns a node of nodes that does not lead
+func followerOf(nodes []*clusterNode, leader *clusterNode) *clusterNode {
+	for _, node := range nodes {
+		if node != leader {
+			return node
+		}
+	}
+	return nil
+}
+
+func TestFollowerWrites(t *testing.T) {
+	t.Run("forwarded responses keep their types", func(t *testing.T) {
+		first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+		waitForLeader(t, []*clusterNode{first})
+		second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+		nodes := []*clusterNode{first, second}
+		defer func() {
+			for _, node := range nodes {
+				node.stop()
+			}
+		}()
+		leader := waitForLeader(t, nodes)
+		follower := followerOf(nodes, leader)
+
+		conn, err := net.Dial("tcp", follower.clientAddr())
+		if err != nil {
+			t.Fatalf("failed to connect to the follower: %v", err)
+		}
+		defer conn.Close()
+
+		response := sendSerializedCommand(t, conn, map[string]interface{}{"command": "SET", "key": "counter", "value": "10"})
+		if response["status"] != "OK" {
+			t.Fatalf("forwarded SET failed: %v", response)
+		}
+		response = sendSerializedCommand(t, conn, map[string]interface{}{"command": "INCR", "key": "counter", "offset": "5"})
+		if value, ok := utils.ToInt64(response["value"]); !ok || value != 15 {
+			t.Errorf("expected INCR to answer the integer 15, got %#v", response["value"])
+		}
+		if _, ok := response["index"]; !ok {
+			t.Errorf("expected the log index of the forwarded write, got %v", response)
+		}
+
+		// A small TTL sent as a small msgpack integer still reaches the leader
+		response = sendSerializedCommand(t, conn, map[string]interface{}{"command": "SET", "key": "short", "value": "lived", "exp": int8(100)})
+		if response["status"] != "OK" {
+			t.Fatalf("forwarded SET with exp failed: %v", response)
+		}
+		waitFor(t, "the forwarded key to expire", func() bool {
+			_, err := leader.handler.Database.Get("short")
+			return err != nil
+		})
+	})
+
+	t.Run("followers redirect writes to the leader", func(t *testing.T) {
+		redirect := func(_ *core.CommandHandler, config *utils.Config) { config.FollowerWrites = "redirect" }
+		first := startClusterNode(t, 1, t.TempDir(), 0, true, "", redirect)
+		waitForLeader(t, []*clusterNode{first})
+		second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr(), redirect)
+		nodes := []*clusterNode{first, second}
+		defer func() {
+			for _, node := range nodes {
+				node.stop()
+			}
+		}()
+		leader := waitForLeader(t, nodes)
+		follower := followerOf(nodes, leader)
+		waitFor(t, "the follower to learn the leader's client address", func() bool {
+			return follower.server.GetLeaderClientAddress() != ""
+		})
+
+		conn, err := net.Dial("tcp", follower.clientAddr())
+		if err != nil {
+			t.Fatalf("failed to connect to the follower: %v", err)
+		}
+		defer conn.Close()
+
+		response := sendSerializedCommand(t, conn, map[string]interface{}{"command": "SET", "key": "name", "value": "geomys"})
+		want := fmt.Sprintf("REDIRECT %s %d", leader.clientAddr(), leader.server.Term())
+		if response["status"] != "ERROR" || response["message"] != want {
+			t.Fatalf("expected %q, got %v", want, response)
+		}
+		if response["leader"] != leader.clientAddr() {
+			t.Errorf("expected the leader's address, got %v", response["leader"])
+		}
+		if id, _ := utils.ToInt64(response["leader_id"]); id != int64(leader.id) {
+			t.Errorf("expected leader id %d, got %v", leader.id, response["leader_id"])
+		}
+		if _, err := follower.handler.Database.Get("name"); err == nil {
+			t.Error("expected the follower not to run the write")
+		}
+
+		// Reads are still served by the follower
+		response = sendSerializedCommand(t, conn, map[string]interface{}{"command": "GET", "key": "name"})
+		if message, _ := response["message"].(string); strings.HasPrefix(message, "REDIRECT") {
+			t.Errorf("expected the follower to serve reads, got %v", response)
+		}
+
+		// The client library follows the redirect
+		c, err := client.New(client.Options{Addrs: []string{follower.clientAddr()}})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := c.Set(ctx, "visits", "1", 0); err != nil {
+			t.Fatalf("SET through a redirecting follower failed: %v", err)
+		}
+		if value, err := c.Incr(ctx, "visits", 1); err != nil || value != 2 {
+			t.Errorf("expected 2, got %d, %v", value, err)
+		}
+		if value, err := leader.handler.Database.Get("visits"); err != nil || value != "2" {
+			t.Errorf("expected the leader to run the writes, got %q, %v", value, err)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/cluster"
+	"github.com/vskvj3/geomys/internal/cluster/raft"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// savedIdentity waits until node saved an identity with every one of peers
+func savedIdentity(t *testing.T, node *clusterNode, peers int) *cluster.Identity {
+	t.Helper()
+	var identity *cluster.Identity
+	waitFor(t, fmt.Sprintf("node %d to save its identity", node.id), func() bool {
+		var err error
+		identity, err = cluster.LoadIdentity(node.dir)
+		return err == nil && identity != nil && len(identity.Peers) == peers
+	})
+	return identity
+}
+
+func TestClusterIdentity(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+	third := startClusterNode(t, 3, t.TempDir(), 0, false, first.addr())
+	nodes := []*clusterNode{first, second, third}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+	if err := clusterWrite(nodes, map[string]interface{}{"command": "SET", "key": "name", "value": "geomys"}); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+
+	identity := savedIdentity(t, first, 3)
+	if identity.ClusterID == "" || identity.NodeID != 1 {
+		t.Fatalf("expected the cluster id and node 1, got %+v", identity)
+	}
+	for _, node := range nodes[1:] {
+		if other := savedIdentity(t, node, 3); other.ClusterID != identity.ClusterID || other.NodeID != node.id {
+			t.Errorf("expected node %d in cluster %s, got %+v", node.id, identity.ClusterID, other)
+		}
+	}
+
+	// A follower that lost its log asks the saved peers to add it back
+	follower := followerOf(nodes, leader)
+	follower.stop()
+	entries, err := os.ReadDir(follower.dir)
+	if err != nil {
+		t.Fatalf("reading the data directory failed: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "cluster.json" {
+			os.RemoveAll(filepath.Join(follower.dir, entry.Name()))
+		}
+	}
+	restarted := startClusterNode(t, follower.id, follower.dir, follower.server.Port, false, "")
+	for i, node := range nodes {
+		if node == follower {
+			nodes[i] = restarted
+		}
+	}
+
+	t.Run("a node refuses to join another cluster", func(t *testing.T) {
+		other := startClusterNode(t, 9, t.TempDir(), 0, true, "")
+		defer other.stop()
+		waitForLeader(t, []*clusterNode{other})
+
+		// A node of the first cluster the first cluster does not replicate to
+		dir := t.TempDir()
+		data, _ := json.Marshal(cluster.Identity{ClusterID: identity.ClusterID, NodeID: 8, Peers: map[int32]string{8: "127.0.0.1:1"}})
+		if err := os.WriteFile(filepath.Join(dir, "cluster.json"), data, 0644); err != nil {
+			t.Fatalf("writing the identity failed: %v", err)
+		}
+		stray := startClusterNode(t, 8, dir, 0, false, "")
+		defer stray.stop()
+		if err := stray.server.Join(other.addr()); !errors.Is(err, raft.ErrOtherCluster) {
+			t.Errorf("expected joining another cluster to fail, got %v", err)
+		}
+		if _, member := other.server.GetNodes()[stray.id]; member {
+			t.Error("expected the other cluster not to add the node")
+		}
+	})
+
+	t.Run("a node rejoins its cluster", func(t *testing.T) {
+		if err := restarted.server.Rejoin(); err != nil {
+			t.Fatalf("Rejoin failed: %v", err)
+		}
+		waitFor(t, "the rejoined node to catch up", func() bool {
+			value, err := restarted.handler.Database.Get("name")
+			return err == nil && value == "geomys"
+		})
+	})
+
+	t.Run("a data directory belongs to one node", func(t *testing.T) {
+		config := &utils.Config{NodeID: 7, DataDir: first.dir, HeartbeatInterval: 50, ElectionTimeout: 300}
+		server := cluster.NewClusterServer(config, utils.NewNopLogger(), 7, 0)
+		defer server.Stop()
+		err := server.StartServer(core.NewCommandHandler(core.NewDatabase(), nil), false)
+		if err == nil || !strings.Contains(err.Error(), "belongs to node 1") {
+			t.Errorf("expected node 7 to refuse the data directory of node 1, got %v", err)
+		}
+	})
+}
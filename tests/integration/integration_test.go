@@ -3,12 +3,15 @@ package integration
 import (
 	"bufio"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
 	"github.com/vskvj3/geomys/internal/core"
 	"github.com/vskvj3/geomys/internal/network"
+	"github.com/vskvj3/geomys/internal/persistence"
 	"github.com/vskvj3/geomys/internal/utils"
 )
 
@@ -41,14 +44,13 @@ func sendSerializedCommand(t *testing.T, conn net.Conn, command map[string]inter
 }
 
 func TestIntegration(t *testing.T) {
-	utils.NewLogger("", false)
 	db := core.NewDatabase()
-	commandHandler := core.NewCommandHandler(db)
+	commandHandler := core.NewCommandHandler(db, persistence.NewMemoryEngine())
 
 	// Start the server
 	go func() {
-		utils.LoadConfig("configPath")
-		server, _ := network.NewServer(nil, "6379", commandHandler)
+		config, _ := utils.LoadConfig("configPath")
+		server, _ := network.NewServer(config, utils.NewNopLogger(), nil, "6379", commandHandler)
 		server.Start()
 	}()
 	time.Sleep(100 * time.Millisecond)
@@ -109,3 +111,99 @@ func TestIntegration(t *testing.T) {
 		}
 	})
 }
+
+// startNode starts a standalone server persisting into its own data directory
+func startNode(t *testing.T, nodeID int) (*network.Server, *utils.Config) {
+	config, _ := utils.LoadConfig(filepath.Join(t.TempDir(), "missing.conf"))
+	config.NodeID = nodeID
+	config.DataDir = t.TempDir()
+	config.LogFile = filepath.Join(config.DataDir, "server.log")
+
+	logger, err := utils.NewLogger(config.LogFile, false)
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+	engine, err := persistence.NewEngine(config.Persistence, config.GetDataDir(), nil)
+	if err != nil {
+		t.Fatalf("failed to open persistence: %v", err)
+	}
+	t.Cleanup(func() {
+		engine.Close()
+		logger.Close()
+	})
+
+	server, err := network.NewServer(config, logger, nil, "0", core.NewCommandHandler(core.NewDatabase(), engine))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Start()
+	t.Cleanup(func() { server.Close() })
+	return server, config
+}
+
+func TestIndependentServersInOneProcess(t *testing.T) {
+	first, firstConfig := startNode(t, 1)
+	second, secondConfig := startNode(t, 2)
+
+	firstConn, err := net.Dial("tcp", first.Addr())
+	if err != nil {
+		t.Fatalf("failed to connect to first server: %v", err)
+	}
+	defer firstConn.Close()
+	secondConn, err := net.Dial("tcp", second.Addr())
+	if err != nil {
+		t.Fatalf("failed to connect to second server: %v", err)
+	}
+	defer secondConn.Close()
+
+	response := sendSerializedCommand(t, firstConn, map[string]interface{}{"command": "SET", "key": "owner", "value": "first"})
+	if response["status"] != "OK" {
+		t.Fatalf("expected {status: OK}, got %v", response)
+	}
+
+	response = sendSerializedCommand(t, secondConn, map[string]interface{}{"command": "GET", "key": "owner"})
+	if response["status"] != "ERROR" {
+		t.Errorf("expected the key to be missing on the second server, got %v", response)
+	}
+
+	if _, err := os.Stat(filepath.Join(firstConfig.DataDir, "binlog.dat")); err != nil {
+		t.Errorf("expected a binlog in the first data directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(secondConfig.DataDir, "binlog.dat")); err != nil {
+		t.Errorf("expected a binlog in the second data directory: %v", err)
+	}
+	if info, err := os.Stat(firstConfig.LogFile); err != nil || info.Size() == 0 {
+		t.Errorf("expected the first server to write its own log file: %v", err)
+	}
+}
+
+func TestBackupPathsStayInBackupDir(t *testing.T) {
+	server, config := startNode(t, 1)
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	outside := filepath.Join(t.TempDir(), "escaped.tar")
+	for _, path := range []string{outside, "../escaped.tar", "nested/../../escaped.tar"} {
+		response := sendSerializedCommand(t, conn, map[string]interface{}{"command": "BACKUP", "path": path})
+		if response["status"] != "ERROR" {
+			t.Errorf("expected %q to be refused, got %v", path, response)
+		}
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Error("expected nothing to be written outside the backup directory")
+	}
+
+	response := sendSerializedCommand(t, conn, map[string]interface{}{"command": "BACKUP", "path": "nightly.tar"})
+	if response["status"] != "OK" {
+		t.Fatalf("expected the backup to be taken, got %v", response)
+	}
+	if _, err := os.Stat(filepath.Join(config.GetBackupDir(), "nightly.tar")); err != nil {
+		t.Errorf("expected the backup in the backup directory: %v", err)
+	}
+}
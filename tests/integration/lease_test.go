@@ -0,0 +1,75 @@
+package integration
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeaderLease(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+	third := startClusterNode(t, 3, t.TempDir(), 0, false, first.addr())
+	nodes := []*clusterNode{first, second, third}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+
+	t.Run("a leader of an older term refuses forwarded writes", func(t *testing.T) {
+		term := leader.server.Term()
+		req := &pb.CommandRequest{NodeId: followerOf(nodes, leader).id, Term: term + 1, Command: &pb.Command{Command: "SET", Key: "fenced", Value: "stale"}}
+		_, err := leader.server.ReplicationService.ForwardRequest(context.Background(), req)
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected the stale leader to refuse the write, got %v", err)
+		}
+		if leader.server.Term() <= term {
+			t.Errorf("expected the stale leader to move past term %d", term)
+		}
+		if leader.handler.Database.Exists("fenced") {
+			t.Error("expected the refused write not to be applied")
+		}
+		leader = waitForLeader(t, nodes)
+	})
+
+	t.Run("a leader cut off from the others steps down", func(t *testing.T) {
+		stopped := time.Now()
+		for i, node := range nodes {
+			if node != leader {
+				node.stop()
+				defer func(i int, node *clusterNode) {
+					nodes[i] = startClusterNode(t, node.id, node.dir, node.server.Port, false, "")
+				}(i, node)
+			}
+		}
+		waitFor(t, "the isolated leader to step down", func() bool { return !leader.server.IsLeader() })
+		if elapsed := time.Since(stopped); elapsed > time.Second {
+			t.Errorf("expected the leader to step down within its lease, it took %v", elapsed)
+		}
+
+		conn, err := net.Dial("tcp", leader.clientAddr())
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+		response := sendSerializedCommand(t, conn, map[string]interface{}{"command": "SET", "key": "isolated", "value": "lost"})
+		if message, _ := response["message"].(string); !strings.HasPrefix(message, "No leader elected") {
+			t.Errorf("expected the isolated node to refuse writes, got %v", response)
+		}
+	})
+
+	// With the others back a leader is elected and takes writes again
+	leader = waitForLeader(t, nodes)
+	if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "healed", "value": "yes"}); err != nil {
+		t.Fatalf("SET after the partition healed failed: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vskvj3/geomys/internal/utils"
+	"github.com/vskvj3/geomys/pkg/client"
+)
+
+// roles returns the role of every member by id as the leader reports them
+func roles(t *testing.T, node *clusterNode) map[int32]string {
+	t.Helper()
+	resp, err := node.server.Members()
+	if err != nil {
+		t.Fatalf("members of node %d failed: %v", node.id, err)
+	}
+	roles := make(map[int32]string)
+	for _, m := range resp.Members {
+		roles[m.NodeId] = m.Role
+	}
+	return roles
+}
+
+func TestMembership(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "")
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr())
+	third := startClusterNode(t, 3, t.TempDir(), 0, false, first.addr())
+	nodes := []*clusterNode{first, second, third}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+
+	c, err := client.New(client.Options{Addrs: []string{leader.clientAddr()}, MaxRetries: 20})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		if err := c.Set(ctx, fmt.Sprintf("key:%d", i), fmt.Sprint(i), 0); err != nil {
+			t.Fatalf("SET failed: %v", err)
+		}
+	}
+
+	// A learner receives the log but does not vote
+	fourth := startClusterNode(t, 4, t.TempDir(), 0, false, "")
+	nodes = append(nodes, fourth)
+	if err := fourth.server.JoinAsLearner(second.addr()); err != nil {
+		t.Fatalf("joining as a learner failed: %v", err)
+	}
+	waitFor(t, "the learner to catch up", func() bool {
+		value, err := fourth.handler.Database.Get("key:19")
+		return err == nil && value == "19"
+	})
+	if got := roles(t, second)[4]; got != "learner" {
+		t.Errorf("expected node 4 to be a learner, got %q", got)
+	}
+	if followers := leader.server.Raft.Followers(); followers != 2 {
+		t.Errorf("expected the learner not to count as a voting follower, got %d", followers)
+	}
+
+	t.Run("members list roles and lag", func(t *testing.T) {
+		response, err := c.Do(ctx, map[string]interface{}{"command": "CLUSTER", "args": []string{"MEMBERS"}})
+		if err != nil {
+			t.Fatalf("CLUSTER MEMBERS failed: %v", err)
+		}
+		members, _ := response["value"].([]interface{})
+		if len(members) != 4 {
+			t.Fatalf("expected 4 members, got %v", response["value"])
+		}
+		for _, item := range members {
+			member, _ := item.(map[string]interface{})
+			if _, ok := utils.ToInt64(member["lag"]); !ok {
+				t.Errorf("expected the lag of every member, got %v", member)
+			}
+		}
+		if leaderID, _ := utils.ToInt64(response["leader"]); leaderID != int64(leader.id) {
+			t.Errorf("expected leader %d, got %v", leader.id, response["leader"])
+		}
+	})
+
+	t.Run("a voter cannot be promoted", func(t *testing.T) {
+		_, err := c.Cluster(ctx, "PROMOTE", fmt.Sprint(leader.id))
+		if err == nil || !strings.Contains(err.Error(), "not a learner") {
+			t.Errorf("expected promoting a voter to fail, got %v", err)
+		}
+	})
+
+	t.Run("a caught up learner is promoted", func(t *testing.T) {
+		if _, err := c.Cluster(ctx, "PROMOTE", "4"); err != nil {
+			t.Fatalf("CLUSTER PROMOTE failed: %v", err)
+		}
+		if got := roles(t, leader)[4]; got != "follower" {
+			t.Errorf("expected node 4 to vote, got %q", got)
+		}
+		if followers := leader.server.Raft.Followers(); followers != 3 {
+			t.Errorf("expected 3 voting followers, got %d", followers)
+		}
+	})
+
+	t.Run("leadership moves to a chosen node", func(t *testing.T) {
+		if _, err := c.Cluster(ctx, "TRANSFER", "4"); err != nil {
+			t.Fatalf("CLUSTER TRANSFER failed: %v", err)
+		}
+		waitFor(t, "node 4 to lead", func() bool { return fourth.server.IsLeader() })
+	})
+
+	t.Run("the old leader is removed", func(t *testing.T) {
+		if err := fourth.server.RemoveMember(leader.id); err != nil {
+			t.Fatalf("removing node %d failed: %v", leader.id, err)
+		}
+		remaining := []*clusterNode{}
+		for _, node := range nodes {
+			if node != leader {
+				remaining = append(remaining, node)
+			}
+		}
+		for _, node := range remaining {
+			waitFor(t, fmt.Sprintf("node %d to drop node %d", node.id, leader.id), func() bool {
+				_, member := node.server.GetNodes()[leader.id]
+				return !member
+			})
+		}
+		waitFor(t, "the removed node to learn it was removed", func() bool {
+			_, member := leader.server.GetNodes()[leader.id]
+			return !member
+		})
+
+		// The removed node no longer starts elections
+		term := fourth.server.Term()
+		time.Sleep(1500 * time.Millisecond)
+		if !fourth.server.IsLeader() || fourth.server.Term() != term {
+			t.Errorf("expected node 4 to keep leading in term %d, it is in term %d", term, fourth.server.Term())
+		}
+		if err := c.Set(ctx, "after", "removal", 0); err != nil {
+			t.Fatalf("SET after the removal failed: %v", err)
+		}
+		if got := roles(t, fourth); len(got) != 3 {
+			t.Errorf("expected 3 members, got %v", got)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/utils"
+	"github.com/vskvj3/geomys/pkg/client"
+)
+
+// subscriber is a raw client connection that reads pushed messages
+type subscriber struct {
+	net.Conn
+	dec *msgpack.Decoder
+}
+
+func dialSubscriber(t *testing.T, addr string) *subscriber {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	return &subscriber{Conn: conn, dec: msgpack.NewDecoder(conn)}
+}
+
+// do sends request and reads the next message of the connection
+func (s *subscriber) do(t *testing.T, request map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	data, _ := msgpack.Marshal(request)
+	if _, err := s.Write(data); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	return s.next(t)
+}
+
+func (s *subscriber) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	response, err := s.read()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return response
+}
+
+func (s *subscriber) read() (map[string]interface{}, error) {
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var response map[string]interface{}
+	err := s.dec.Decode(&response)
+	return response, err
+}
+
+func TestPubSub(t *testing.T) {
+	limit := func(_ *core.CommandHandler, config *utils.Config) {
+		config.PubSubBufferLimit = 64 << 10
+	}
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "", limit)
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr(), limit)
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+	follower := followerOf(nodes, leader)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	c, err := client.New(client.Options{Addrs: []string{leader.clientAddr()}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	t.Run("messages reach subscribers on every node", func(t *testing.T) {
+		raw := dialSubscriber(t, follower.clientAddr())
+		defer raw.Close()
+		confirmation := raw.do(t, map[string]interface{}{"command": "SUBSCRIBE", "args": []string{"news.sports"}})
+		if confirmation["type"] != "subscribe" || confirmation["channel"] != "news.sports" {
+			t.Fatalf("expected a subscribe confirmation, got %v", confirmation)
+		}
+		sub, err := c.PSubscribe(ctx, "news.*")
+		if err != nil {
+			t.Fatalf("PSubscribe failed: %v", err)
+		}
+		defer sub.Close()
+
+		receivers, err := c.Publish(ctx, "news.sports", "goal")
+		if err != nil || receivers != 2 {
+			t.Fatalf("expected 2 receivers, got %d, %v", receivers, err)
+		}
+		if message := raw.next(t); message["type"] != "message" || message["channel"] != "news.sports" || message["value"] != "goal" {
+			t.Errorf("expected the message on the follower, got %v", message)
+		}
+		message, err := sub.Receive(ctx)
+		if err != nil || message.Pattern != "news.*" || message.Channel != "news.sports" || message.Payload != "goal" {
+			t.Errorf("expected the pattern message, got %+v, %v", message, err)
+		}
+		if receivers, err := c.Publish(ctx, "weather", "rain"); err != nil || receivers != 0 {
+			t.Errorf("expected no receivers, got %d, %v", receivers, err)
+		}
+	})
+
+	t.Run("subscribed connections only change their subscriptions", func(t *testing.T) {
+		raw := dialSubscriber(t, follower.clientAddr())
+		defer raw.Close()
+		raw.do(t, map[string]interface{}{"command": "SUBSCRIBE", "args": []string{"a", "b"}})
+		second := raw.next(t)
+		if count, _ := utils.ToInt64(second["value"]); second["channel"] != "b" || count != 2 {
+			t.Fatalf("expected the second confirmation, got %v", second)
+		}
+		if response := raw.do(t, map[string]interface{}{"command": "ECHO", "message": "hi"}); response["status"] != "ERROR" {
+			t.Errorf("expected ECHO to be refused, got %v", response)
+		}
+		if response := raw.do(t, map[string]interface{}{"command": "PING"}); response["status"] != "OK" {
+			t.Errorf("expected PING to be answered, got %v", response)
+		}
+		raw.do(t, map[string]interface{}{"command": "UNSUBSCRIBE"})
+		raw.next(t)
+		if response := raw.do(t, map[string]interface{}{"command": "ECHO", "message": "hi"}); response["message"] != "hi" {
+			t.Errorf("expected ECHO to work after unsubscribing, got %v", response)
+		}
+	})
+
+	t.Run("slow subscribers are disconnected", func(t *testing.T) {
+		raw := dialSubscriber(t, leader.clientAddr())
+		defer raw.Close()
+		raw.do(t, map[string]interface{}{"command": "SUBSCRIBE", "args": []string{"flood"}})
+
+		// The subscriber reads nothing until the node gave up on it
+		payload := strings.Repeat("x", 16<<10)
+		for i := 0; i < 2000; i++ {
+			leader.server.PubSub.Publish("flood", payload)
+		}
+		waitFor(t, "the subscriber to be dropped", func() bool {
+			return leader.server.PubSub.Publish("flood", "x") == 0
+		})
+		// What the node sent before closing the connection is read first
+		for {
+			if _, err := raw.read(); err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Error("expected the connection to be closed")
+				}
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,326 @@
+package integration
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// shardGroup returns setup that makes a node part of group serving slots,
+// learning about the other groups from seeds
+func shardGroup(group int, slots string, seeds ...string) func(*core.CommandHandler, *utils.Config) {
+	return func(_ *core.CommandHandler, config *utils.Config) {
+		config.Sharding = true
+		config.ShardGroup = group
+		config.ShardSlots = slots
+		config.ShardSeeds = seeds
+	}
+}
+
+// keyInSlots returns a key whose slot lies between start and end
+func keyInSlots(t *testing.T, start, end uint32) string {
+	t.Helper()
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if slot := shard.Slot(key); slot >= start && slot <= end {
+			return key
+		}
+	}
+	t.Fatalf("no key found in slots %d-%d", start, end)
+	return ""
+}
+
+// route returns the redirect node gives a read of key, "" when it serves the key
+func route(node *clusterNode, key string, asking bool, exists func() bool) string {
+	redirect, release := node.server.Route(key, false, asking, exists)
+	release()
+	return redirect
+}
+
+func TestShardGroups(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "", shardGroup(1, "0-8191"))
+	second := startClusterNode(t, 2, t.TempDir(), 0, true, "", shardGroup(2, "8192-16383", first.addr()))
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	waitForLeader(t, []*clusterNode{first})
+	waitForLeader(t, []*clusterNode{second})
+
+	// Both nodes learn the whole slot map, the first one only through the second's exchanges
+	for _, node := range nodes {
+		waitFor(t, fmt.Sprintf("node %d to learn the slot map", node.id), func() bool {
+			return len(node.server.Shards.Map()) == 2
+		})
+	}
+
+	low, high := keyInSlots(t, 0, 8191), keyInSlots(t, 8192, 16383)
+	exists := func() bool { return false }
+
+	t.Run("keys of other groups are redirected with MOVED", func(t *testing.T) {
+		if redirect := route(first, low, false, exists); redirect != "" {
+			t.Errorf("expected node 1 to serve %s, got %q", low, redirect)
+		}
+		want := fmt.Sprintf("MOVED %d %s", shard.Slot(high), second.server.Config.ClientAddress)
+		if redirect := route(first, high, false, exists); redirect != want {
+			t.Errorf("expected %q, got %q", want, redirect)
+		}
+		// Hash tags keep related keys in one group
+		if route(first, "{"+low+"}:profile", false, exists) != "" {
+			t.Error("expected a key tagged with a local key to be served locally")
+		}
+	})
+
+	t.Run("a migrating slot sends missing keys with ASK", func(t *testing.T) {
+		slot := shard.Slot(low)
+		if err := first.server.SetSlot(slot, "MIGRATING", 2); err != nil {
+			t.Fatalf("MIGRATING failed: %v", err)
+		}
+		if err := second.server.SetSlot(slot, "IMPORTING", 1); err != nil {
+			t.Fatalf("IMPORTING failed: %v", err)
+		}
+
+		want := fmt.Sprintf("ASK %d %s", slot, second.server.Config.ClientAddress)
+		if redirect := route(first, low, false, exists); redirect != want {
+			t.Errorf("expected %q, got %q", want, redirect)
+		}
+		if redirect := route(first, low, false, func() bool { return true }); redirect != "" {
+			t.Errorf("expected keys still stored on the source to be served, got %q", redirect)
+		}
+		// The target only serves the slot right after ASKING
+		if redirect := route(second, low, false, exists); !strings.HasPrefix(redirect, "MOVED") {
+			t.Errorf("expected MOVED without ASKING, got %q", redirect)
+		}
+		if redirect := route(second, low, true, exists); redirect != "" {
+			t.Errorf("expected the target to serve the slot after ASKING, got %q", redirect)
+		}
+
+		// Ownership moves once the target claims the slot
+		if err := second.server.SetSlot(slot, "NODE", 2); err != nil {
+			t.Fatalf("NODE failed: %v", err)
+		}
+		if err := first.server.SetSlot(slot, "NODE", 2); err != nil {
+			t.Fatalf("NODE failed: %v", err)
+		}
+		waitFor(t, "node 1 to learn the new owner", func() bool {
+			group, _, _ := first.server.Shards.Owner(slot)
+			return group == 2
+		})
+		want = fmt.Sprintf("MOVED %d %s", slot, second.server.Config.ClientAddress)
+		if redirect := route(first, low, false, exists); redirect != want {
+			t.Errorf("expected %q, got %q", want, redirect)
+		}
+		if redirect := route(second, low, false, exists); redirect != "" {
+			t.Errorf("expected node 2 to serve %s, got %q", low, redirect)
+		}
+	})
+
+	t.Run("slots served by another group cannot be claimed", func(t *testing.T) {
+		if err := first.server.AddSlots("9000-9010"); err == nil {
+			t.Error("expected claiming slots of group 2 to fail")
+		}
+		if err := first.server.DelSlots("0-99"); err != nil {
+			t.Fatalf("DELSLOTS failed: %v", err)
+		}
+		if redirect := route(first, keyInSlots(t, 0, 99), false, exists); !strings.HasPrefix(redirect, "CLUSTERDOWN") {
+			t.Errorf("expected CLUSTERDOWN for an unserved slot, got %q", redirect)
+		}
+	})
+}
+
+// clusterWrite runs a write against the nodes the way a client would,
+// following MOVED and ASK redirects
+func clusterWrite(nodes []*clusterNode, request map[string]interface{}) error {
+	key := request["key"].(string)
+	node, asking := nodes[0], false
+	var trace []string
+	for attempt := 0; attempt < 10; attempt++ {
+		exists := func() bool { return node.handler.Database.Exists(key) }
+		redirect, release := node.server.Route(key, true, asking, exists)
+		if redirect == "" {
+			_, err := node.handler.HandleCommand(request)
+			release()
+			return err
+		}
+		trace = append(trace, redirect)
+		fields := strings.Fields(redirect)
+		if len(fields) != 3 {
+			return fmt.Errorf("unexpected redirect %q", redirect)
+		}
+		for _, candidate := range nodes {
+			if candidate.server.Config.ClientAddress == fields[2] {
+				node = candidate
+			}
+		}
+		asking = fields[0] == "ASK"
+	}
+	return fmt.Errorf("too many redirects for %s: %v", key, trace)
+}
+
+func TestSlotMigration(t *testing.T) {
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "", shardGroup(1, "0-16383"))
+	second := startClusterNode(t, 2, t.TempDir(), 0, true, "", shardGroup(2, "", first.addr()))
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	waitForLeader(t, []*clusterNode{first})
+	waitForLeader(t, []*clusterNode{second})
+	for _, node := range nodes {
+		waitFor(t, fmt.Sprintf("node %d to learn both groups", node.id), func() bool {
+			for _, group := range []int32{1, 2} {
+				if members := node.server.Shards.Members(group); len(members) != 1 || !members[0].Leader {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	inRange := func(key string) bool { return shard.Slot(key) <= 999 }
+	var keys []string
+	for i := 0; len(keys) < 300; i++ {
+		if key := fmt.Sprintf("key-%d", i); inRange(key) {
+			keys = append(keys, key)
+		}
+	}
+	// A list, an expiring key and plain keys, the first few of them overwritten during the migration
+	list, expiring := keys[0], keys[1]
+	for _, key := range keys[2:] {
+		if err := clusterWrite(nodes, map[string]interface{}{"command": "SET", "key": key, "value": "old"}); err != nil {
+			t.Fatalf("SET %s failed: %v", key, err)
+		}
+	}
+	if err := clusterWrite(nodes, map[string]interface{}{"command": "SET", "key": expiring, "value": "soon", "exp": int64(60000)}); err != nil {
+		t.Fatalf("SET with expiry failed: %v", err)
+	}
+	for _, value := range []string{"a", "b"} {
+		if err := clusterWrite(nodes, map[string]interface{}{"command": "PUSH", "key": list, "value": value}); err != nil {
+			t.Fatalf("PUSH failed: %v", err)
+		}
+	}
+
+	t.Run("keys move while writes continue", func(t *testing.T) {
+		// Writers keep overwriting keys until the migration is done
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		written := make([]string, 4)
+		errs := make(chan error, len(written))
+		for w := range written {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					key := keys[2+w]
+					value := fmt.Sprintf("new-%d", i)
+					if err := clusterWrite(nodes, map[string]interface{}{"command": "SET", "key": key, "value": value}); err != nil {
+						errs <- err
+						return
+					}
+					written[w] = value
+				}
+			}(w)
+		}
+
+		moved, err := second.server.Migrate("0-999", 2)
+		close(stop)
+		wg.Wait()
+		close(errs)
+		if err != nil {
+			t.Fatalf("migration failed: %v", err)
+		}
+		for err := range errs {
+			t.Errorf("write during the migration failed: %v", err)
+		}
+		if moved == 0 || moved > len(keys) {
+			t.Errorf("expected between 1 and %d keys to move, got %d", len(keys), moved)
+		}
+
+		if left := first.handler.Database.Keys(inRange, -1); len(left) != 0 {
+			t.Errorf("expected no key of the slots on the source, found %d", len(left))
+		}
+		for _, key := range keys[6:] {
+			if value, err := second.handler.Database.Get(key); err != nil || value != "old" {
+				t.Fatalf("expected %s to be at the target, got %q, %v", key, value, err)
+			}
+		}
+		for w, value := range written {
+			if got, err := second.handler.Database.Get(keys[2+w]); err != nil || got != value {
+				t.Errorf("expected the last write %q of %s, got %q, %v", value, keys[2+w], got, err)
+			}
+		}
+		if n, err := second.handler.Database.Len(list); err != nil || n != 2 {
+			t.Errorf("expected the list to move with 2 items, got %d, %v", n, err)
+		}
+		if _, expireAt, ok := second.handler.Database.DumpKey(expiring); !ok || expireAt == 0 {
+			t.Errorf("expected %s to keep its expiry", expiring)
+		}
+
+		// Ownership flipped with the last key
+		for _, node := range nodes {
+			waitFor(t, fmt.Sprintf("node %d to learn the new owner", node.id), func() bool {
+				group, _, _ := node.server.Shards.Owner(500)
+				return group == 2
+			})
+		}
+		if redirect := route(first, keys[0], false, func() bool { return false }); !strings.HasPrefix(redirect, "MOVED") {
+			t.Errorf("expected MOVED from the old owner, got %q", redirect)
+		}
+	})
+
+	t.Run("rebalance evens out the slots", func(t *testing.T) {
+		if _, _, err := first.server.Rebalance(nil); err != nil {
+			t.Fatalf("rebalance failed: %v", err)
+		}
+		count := func(group int32) int {
+			n := 0
+			for _, r := range first.server.Shards.Map() {
+				if r.Group == group {
+					n += int(r.End-r.Start) + 1
+				}
+			}
+			return n
+		}
+		waitFor(t, "both groups to serve half of the slots", func() bool {
+			return count(1) == shard.SlotCount/2 && count(2) == shard.SlotCount/2
+		})
+		for _, key := range keys[6:] {
+			if value, err := clusterGet(nodes, key); err != nil || value != "old" {
+				t.Fatalf("expected %s to survive the rebalance, got %q, %v", key, value, err)
+			}
+		}
+
+		// Removing a group hands all of its slots to the rest
+		if _, _, err := first.server.Rebalance([]int32{2}); err != nil {
+			t.Fatalf("rebalance without group 2 failed: %v", err)
+		}
+		waitFor(t, "group 1 to serve every slot", func() bool { return count(1) == shard.SlotCount })
+		if left := second.handler.Database.Keys(func(string) bool { return true }, -1); len(left) != 0 {
+			t.Errorf("expected group 2 to hold no keys, found %d", len(left))
+		}
+	})
+}
+
+// clusterGet reads key from whichever of nodes serves it
+func clusterGet(nodes []*clusterNode, key string) (string, error) {
+	for _, node := range nodes {
+		if route(node, key, false, func() bool { return node.handler.Database.Exists(key) }) == "" {
+			return node.handler.Database.Get(key)
+		}
+	}
+	return "", fmt.Errorf("no node serves %s", key)
+}
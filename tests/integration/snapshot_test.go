@@ -0,0 +1,253 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/cluster/raft"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// snapshotChunk is the size of the data chunks of a snapshot transfer
+const snapshotChunk = 64 << 10
+
+// faultyLeader streams a leader's snapshot to followers, letting a test cut
+// or damage the stream
+type faultyLeader struct {
+	raft.Server
+	addr string
+
+	mu      sync.Mutex
+	offsets []uint64                                  // where every stream a follower opened started
+	fault   func(sent int, c *pb.SnapshotChunk) error // runs before each data chunk, sent counts the earlier ones
+}
+
+func startFaultyLeader(t *testing.T, leader *clusterNode) *faultyLeader {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	f := &faultyLeader{Server: raft.Server{Node: leader.server.Raft}, addr: listener.Addr().String()}
+	server := grpc.NewServer()
+	pb.RegisterElectionServiceServer(server, f)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return f
+}
+
+func (f *faultyLeader) StreamSnapshot(req *pb.SnapshotStreamRequest, stream pb.ElectionService_StreamSnapshotServer) error {
+	f.mu.Lock()
+	f.offsets = append(f.offsets, req.Offset)
+	fault := f.fault
+	f.mu.Unlock()
+	return f.Server.StreamSnapshot(req, &faultyStream{ElectionService_StreamSnapshotServer: stream, fault: fault})
+}
+
+func (f *faultyLeader) setFault(fault func(sent int, c *pb.SnapshotChunk) error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fault = fault
+}
+
+func (f *faultyLeader) streams() []uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]uint64(nil), f.offsets...)
+}
+
+type faultyStream struct {
+	pb.ElectionService_StreamSnapshotServer
+	fault func(sent int, c *pb.SnapshotChunk) error
+	sent  int
+}
+
+func (s *faultyStream) Send(c *pb.SnapshotChunk) error {
+	if len(c.Data) > 0 {
+		if s.fault != nil {
+			if err := s.fault(s.sent, c); err != nil {
+				return err
+			}
+		}
+		s.sent++
+	}
+	return s.ElectionService_StreamSnapshotServer.Send(c)
+}
+
+// cutAfter ends the stream once n data chunks were sent
+func cutAfter(n int) func(int, *pb.SnapshotChunk) error {
+	return func(sent int, _ *pb.SnapshotChunk) error {
+		if sent == n {
+			return errors.New("connection cut")
+		}
+		return nil
+	}
+}
+
+// latestSnapshot returns the meta of the snapshot the leader sends
+func latestSnapshot(t *testing.T, leader *clusterNode) *pb.SnapshotMeta {
+	t.Helper()
+	conn, err := grpc.NewClient(leader.addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := pb.NewElectionServiceClient(conn).StreamSnapshot(ctx, &pb.SnapshotStreamRequest{})
+	if err != nil {
+		t.Fatalf("StreamSnapshot failed: %v", err)
+	}
+	chunk, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("receiving the snapshot failed: %v", err)
+	}
+	return chunk.Meta
+}
+
+func TestSnapshotTransfer(t *testing.T) {
+	value := strings.Repeat("geomys ", 1200)
+	set := func(handler *core.CommandHandler, from, to int) {
+		for i := from; i < to; i++ {
+			if _, err := handler.HandleCommand(map[string]interface{}{"command": "SET", "key": fmt.Sprint("key", i), "value": value}); err != nil {
+				t.Fatalf("SET %d failed: %v", i, err)
+			}
+		}
+	}
+	compactEarly := func(_ *core.CommandHandler, config *utils.Config) {
+		config.SnapshotThreshold = 20
+	}
+	leader := startClusterNode(t, 1, t.TempDir(), 0, true, "", compactEarly)
+	defer leader.stop()
+	waitForLeader(t, []*clusterNode{leader})
+	set(leader.handler, 0, 100)
+	proxy := startFaultyLeader(t, leader)
+
+	// A node outside the cluster takes the snapshot the test hands it
+	follower := func(t *testing.T, id int32) *clusterNode {
+		node := startClusterNode(t, id, t.TempDir(), 0, false, "")
+		t.Cleanup(node.stop)
+		return node
+	}
+	install := func(node *clusterNode, meta *pb.SnapshotMeta) *pb.InstallSnapshotResponse {
+		req := &pb.InstallSnapshotRequest{Term: leader.server.Term(), LeaderId: leader.id, Meta: meta, LeaderAddress: proxy.addr}
+		resp, err := (&raft.Server{Node: node.server.Raft}).InstallSnapshot(context.Background(), req)
+		if err != nil {
+			t.Fatalf("InstallSnapshot failed: %v", err)
+		}
+		return resp
+	}
+	// attempt waits until the node started one more transfer. A node still
+	// finishing the last one ignores the call, it is repeated after a while.
+	attempt := func(node *clusterNode, meta *pb.SnapshotMeta) {
+		t.Helper()
+		started := len(proxy.streams())
+		waitFor(t, "a transfer attempt", func() bool {
+			install(node, meta)
+			for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+				if len(proxy.streams()) > started {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	installed := func(node *clusterNode, meta *pb.SnapshotMeta) {
+		t.Helper()
+		waitFor(t, "the snapshot to be installed", func() bool {
+			return !install(node, meta).Installing && node.server.Raft.LastApplied() >= meta.Index
+		})
+	}
+	// offsetsSince returns where the streams opened after the first from started
+	offsetsSince := func(from int) []uint64 {
+		return proxy.streams()[from:]
+	}
+
+	t.Run("a cut transfer resumes where it stopped", func(t *testing.T) {
+		node := follower(t, 2)
+		meta := latestSnapshot(t, leader)
+		from := len(proxy.streams())
+		proxy.setFault(cutAfter(3))
+		attempt(node, meta)
+		proxy.setFault(nil)
+		attempt(node, meta)
+		installed(node, meta)
+
+		if offsets := offsetsSince(from); len(offsets) != 2 || offsets[0] != 0 || offsets[1] != 3*snapshotChunk {
+			t.Errorf("expected the second stream to start at byte %d, got %v", 3*snapshotChunk, offsets)
+		}
+		waitFor(t, "the data to arrive", func() bool {
+			got, err := node.handler.Database.Get("key99")
+			return err == nil && got == value
+		})
+	})
+
+	t.Run("a corrupt chunk is refused", func(t *testing.T) {
+		node := follower(t, 3)
+		meta := latestSnapshot(t, leader)
+		from := len(proxy.streams())
+		proxy.setFault(func(sent int, c *pb.SnapshotChunk) error {
+			if sent == 2 {
+				c.Data = append([]byte(nil), c.Data...)
+				c.Data[0] ^= 0xff
+			}
+			return nil
+		})
+		attempt(node, meta)
+		proxy.setFault(nil)
+		attempt(node, meta)
+		installed(node, meta)
+
+		// Only the chunks before the corrupt one were kept
+		if offsets := offsetsSince(from); len(offsets) != 2 || offsets[1] != 2*snapshotChunk {
+			t.Errorf("expected the second stream to start at byte %d, got %v", 2*snapshotChunk, offsets)
+		}
+		if got, err := node.handler.Database.Get("key0"); err != nil || got != value {
+			t.Errorf("expected the snapshot's data, got %v", err)
+		}
+	})
+
+	t.Run("a new snapshot restarts the transfer", func(t *testing.T) {
+		node := follower(t, 4)
+		old := latestSnapshot(t, leader)
+		from := len(proxy.streams())
+		proxy.setFault(cutAfter(3))
+		attempt(node, old)
+		proxy.setFault(nil)
+
+		// The leader compacts again before the follower comes back
+		set(leader.handler, 100, 150)
+		var meta *pb.SnapshotMeta
+		waitFor(t, "a newer snapshot", func() bool {
+			meta = latestSnapshot(t, leader)
+			return meta.Index > old.Index
+		})
+		attempt(node, old)
+		waitFor(t, "the old partial transfer to be dropped", func() bool {
+			partials, _ := filepath.Glob(filepath.Join(node.dir, fmt.Sprintf("raft.snapshot.%d-%d.partial", old.Index, old.Term)))
+			return len(partials) == 0
+		})
+		attempt(node, meta)
+		installed(node, meta)
+
+		if offsets := offsetsSince(from); len(offsets) != 3 || offsets[1] != 3*snapshotChunk || offsets[2] != 0 {
+			t.Errorf("expected the newer snapshot to be streamed from byte 0, got %v", offsets)
+		}
+		// Writes after the snapshot come with it
+		waitFor(t, "the log tail to be applied", func() bool {
+			got, err := node.handler.Database.Get("key149")
+			return err == nil && got == value
+		})
+	})
+}
@@ -0,0 +1,253 @@
+package integration
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/network"
+	"github.com/vskvj3/geomys/internal/persistence"
+	"github.com/vskvj3/geomys/internal/utils"
+	"github.com/vskvj3/geomys/pkg/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// testCA issues the certificates of a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // the CA certificate as PEM
+	dir  string
+}
+
+// newTestCA creates a CA keeping its files in a new directory
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating a key failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating the CA failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	ca.file = filepath.Join(ca.dir, "ca.pem")
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate for cn and its key, for servers and clients
+// at 127.0.0.1, and returns the certificate
+func (ca *testCA) issue(t *testing.T, cn string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating a key failed: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("issuing a certificate for %s failed: %v", cn, err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = filepath.Join(ca.dir, cn+".pem"), filepath.Join(ca.dir, cn+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	cert, _ = x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatalf("writing %s failed: %v", path, err)
+	}
+}
+
+// withTLS makes a node present a certificate for cn on both of its ports,
+// clients must present one too
+func withTLS(t *testing.T, ca *testCA, cn string) func(*core.CommandHandler, *utils.Config) {
+	certFile, keyFile, _ := ca.issue(t, cn)
+	return func(_ *core.CommandHandler, config *utils.Config) {
+		config.ClusterTLS = utils.TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.file}
+		config.ClientTLS = utils.TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.file, ClientAuth: "require"}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t, "geomys")
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "", withTLS(t, ca, "node-1"))
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr(), withTLS(t, ca, "node-2"))
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+	leader := waitForLeader(t, nodes)
+	if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "name", "value": "geomys"}); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	waitFor(t, "the write to reach the follower", func() bool {
+		value, err := followerOf(nodes, leader).handler.Database.Get("name")
+		return err == nil && value == "geomys"
+	})
+
+	t.Run("a node with a certificate of another CA cannot join", func(t *testing.T) {
+		rogue := startClusterNode(t, 3, t.TempDir(), 0, false, "", withTLS(t, newTestCA(t, "rogue"), "node-3"))
+		defer rogue.stop()
+		if err := rogue.server.Raft.Join(first.addr(), false, time.Second); err == nil {
+			t.Error("expected the join to fail")
+		}
+		if _, member := leader.server.GetNodes()[3]; member {
+			t.Error("expected node 3 not to be added")
+		}
+	})
+
+	t.Run("a node cannot act as another", func(t *testing.T) {
+		impostor := startClusterNode(t, 4, t.TempDir(), 0, false, "", withTLS(t, ca, "node-9"))
+		defer impostor.stop()
+		if err := impostor.server.Raft.Join(first.addr(), false, time.Second); err == nil {
+			t.Error("expected the join to fail")
+		}
+		if _, member := leader.server.GetNodes()[4]; member {
+			t.Error("expected node 4 not to be added")
+		}
+	})
+
+	t.Run("node services only take node certificates", func(t *testing.T) {
+		dial := func(cn string) *grpc.ClientConn {
+			certFile, keyFile, _ := ca.issue(t, cn)
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatalf("loading the certificate failed: %v", err)
+			}
+			creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+			conn, err := grpc.NewClient(first.addr(), grpc.WithTransportCredentials(creds))
+			if err != nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+			return conn
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		app := dial("app")
+		defer app.Close()
+		if _, err := pb.NewShardServiceClient(app).Exchange(ctx, &pb.Topology{}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected Exchange with a client certificate to be refused, got %v", err)
+		}
+		if _, err := pb.NewPubSubServiceClient(app).Publish(ctx, &pb.PublishRequest{Channel: "c"}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected Publish with a client certificate to be refused, got %v", err)
+		}
+		if _, err := pb.NewAdminServiceClient(app).Members(ctx, &pb.MembersRequest{}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected Members with a client certificate to be refused, got %v", err)
+		}
+
+		operator := dial("operator-alice")
+		defer operator.Close()
+		if _, err := pb.NewAdminServiceClient(operator).Members(ctx, &pb.MembersRequest{}); err != nil {
+			t.Errorf("expected an operator to list the members, got %v", err)
+		}
+		if _, err := pb.NewShardServiceClient(operator).Exchange(ctx, &pb.Topology{}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected Exchange with an operator certificate to be refused, got %v", err)
+		}
+	})
+
+	t.Run("clients connect over TLS with a certificate", func(t *testing.T) {
+		certFile, keyFile, _ := ca.issue(t, "app")
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatalf("loading the client certificate failed: %v", err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		c, err := client.New(client.Options{Addrs: []string{leader.clientAddr()}, TLS: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer c.Close()
+		if value, err := c.Get(ctx, "name"); err != nil || value != "geomys" {
+			t.Errorf("expected geomys, got %q, %v", value, err)
+		}
+
+		anonymous, err := client.New(client.Options{Addrs: []string{leader.clientAddr()}, MaxRetries: -1, TLS: &tls.Config{RootCAs: roots}})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		defer anonymous.Close()
+		if _, err := anonymous.Get(ctx, "name"); err == nil {
+			t.Error("expected a client without a certificate to be refused")
+		}
+	})
+
+	t.Run("certificates are reloaded", func(t *testing.T) {
+		// Reissuing writes the new certificate over the one the node loaded
+		_, _, renewed := ca.issue(t, "node-1")
+		if err := first.server.ReloadTLS(); err != nil {
+			t.Fatalf("ReloadTLS failed: %v", err)
+		}
+		certFile, keyFile, _ := ca.issue(t, "node-2")
+		cert, _ := tls.LoadX509KeyPair(certFile, keyFile)
+		conn, err := tls.Dial("tcp", first.addr(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+		if got := conn.ConnectionState().PeerCertificates[0].SerialNumber; got.Cmp(renewed.SerialNumber) != 0 {
+			t.Errorf("expected the renewed certificate %v, got %v", renewed.SerialNumber, got)
+		}
+	})
+}
+
+func TestClientTLSNeedsCA(t *testing.T) {
+	ca := newTestCA(t, "geomys")
+	certFile, keyFile, _ := ca.issue(t, "node-1")
+	for _, clientAuth := range []string{"request", "require"} {
+		config := &utils.Config{NodeID: 1, DataDir: t.TempDir(), ClientTLS: utils.TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientAuth: clientAuth}}
+		handler := core.NewCommandHandler(core.NewDatabase(), persistence.NewMemoryEngine())
+		if _, err := network.NewServer(config, utils.NewNopLogger(), nil, "0", handler); err == nil {
+			t.Errorf("expected client_auth %s without a ca_file to be refused", clientAuth)
+		}
+	}
+}
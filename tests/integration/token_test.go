@@ -0,0 +1,138 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/security"
+	"github.com/vskvj3/geomys/internal/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// withToken makes a node use the cluster token in file, and the previous one
+// in file.old while it exists
+func withToken(file string) func(*core.CommandHandler, *utils.Config) {
+	return func(_ *core.CommandHandler, config *utils.Config) {
+		config.ClusterTokenFile = file
+		config.ClusterPreviousTokenFiles = []string{file + ".old"}
+	}
+}
+
+func writeToken(t *testing.T, path, token string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		t.Fatalf("writing %s failed: %v", path, err)
+	}
+}
+
+// callWithToken asks node for a vote directly, carrying token unless it is
+// empty, and returns the status code of the answer
+func callWithToken(t *testing.T, node *clusterNode, token string) codes.Code {
+	t.Helper()
+	conn, err := grpc.NewClient(node.addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, security.TokenMetadata, token)
+	}
+	// An old term is refused without disturbing the cluster
+	_, err = pb.NewElectionServiceClient(conn).RequestVote(ctx, &pb.VoteRequest{Term: 0, NodeId: 99})
+	return status.Code(err)
+}
+
+func TestClusterToken(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "token-1"), filepath.Join(dir, "token-2")}
+	for _, file := range files {
+		writeToken(t, file, "first-secret")
+	}
+	first := startClusterNode(t, 1, t.TempDir(), 0, true, "", withToken(files[0]))
+	waitForLeader(t, []*clusterNode{first})
+	second := startClusterNode(t, 2, t.TempDir(), 0, false, first.addr(), withToken(files[1]))
+	nodes := []*clusterNode{first, second}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+
+	writes := 0
+	replicates := func(stage string) {
+		t.Helper()
+		leader := waitForLeader(t, nodes)
+		writes++
+		value := fmt.Sprint(writes)
+		if _, err := leader.handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "name", "value": value}); err != nil {
+			t.Fatalf("%s: SET failed: %v", stage, err)
+		}
+		waitFor(t, stage+": the write to reach the follower", func() bool {
+			got, err := followerOf(nodes, leader).handler.Database.Get("name")
+			return err == nil && got == value
+		})
+	}
+	replicates("start")
+
+	t.Run("calls without the token are refused", func(t *testing.T) {
+		if code := callWithToken(t, first, ""); code != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated without a token, got %v", code)
+		}
+		if code := callWithToken(t, first, "wrong"); code != codes.Unauthenticated {
+			t.Errorf("expected Unauthenticated with a wrong token, got %v", code)
+		}
+		if code := callWithToken(t, first, "first-secret"); code != codes.OK {
+			t.Errorf("expected the call with the token to go through, got %v", code)
+		}
+	})
+
+	t.Run("a node with another token cannot join", func(t *testing.T) {
+		file := filepath.Join(dir, "token-3")
+		writeToken(t, file, "guess")
+		stranger := startClusterNode(t, 3, t.TempDir(), 0, false, "", withToken(file))
+		defer stranger.stop()
+		if err := stranger.server.Raft.Join(first.addr(), false, time.Second); err == nil {
+			t.Error("expected the join to fail")
+		}
+		if _, member := first.server.GetNodes()[3]; member {
+			t.Error("expected node 3 not to be added")
+		}
+	})
+
+	t.Run("the token rolls over one node at a time", func(t *testing.T) {
+		for i, node := range nodes {
+			if err := os.Rename(files[i], files[i]+".old"); err != nil {
+				t.Fatal(err)
+			}
+			writeToken(t, files[i], "second-secret")
+			if err := node.server.ReloadTokens(); err != nil {
+				t.Fatalf("ReloadTokens failed: %v", err)
+			}
+			replicates(fmt.Sprintf("node %d rolled over", node.id))
+		}
+		for i, node := range nodes {
+			if err := os.Remove(files[i] + ".old"); err != nil {
+				t.Fatal(err)
+			}
+			if err := node.server.ReloadTokens(); err != nil {
+				t.Fatalf("ReloadTokens failed: %v", err)
+			}
+		}
+		replicates("rollover done")
+		if code := callWithToken(t, first, "first-secret"); code != codes.Unauthenticated {
+			t.Errorf("expected the old token to be refused, got %v", code)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package unit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+)
+
+func acl(t *testing.T, handler *core.CommandHandler, args ...interface{}) map[string]interface{} {
+	t.Helper()
+	response, err := handler.HandleCommand(map[string]interface{}{"command": "ACL", "args": args})
+	if err != nil {
+		t.Fatalf("ACL %v failed: %v", args, err)
+	}
+	return response
+}
+
+func TestACL(t *testing.T) {
+	engine, err := persistence.NewEngine(persistence.EngineBolt, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("failed to open the engine: %v", err)
+	}
+	defer engine.Close()
+	handler := core.NewCommandHandler(core.NewDatabase(), engine)
+
+	t.Run("access is open without a default user", func(t *testing.T) {
+		if err := handler.Authorize("", "FLUSHDB", ""); err != nil {
+			t.Errorf("expected FLUSHDB to be allowed, got %v", err)
+		}
+	})
+
+	acl(t, handler, "SETUSER", "app", "on", ">secret", "+@read", "+@write", "-flushdb", "~app:*")
+	acl(t, handler, "SETUSER", "admin", "on", ">root", "allcommands", "allkeys")
+	acl(t, handler, "SETUSER", "default", "off")
+
+	t.Run("passwords are checked", func(t *testing.T) {
+		if err := handler.Authenticate("app", "secret"); err != nil {
+			t.Errorf("expected the password to match, got %v", err)
+		}
+		for _, pair := range [][2]string{{"app", "wrong"}, {"nobody", "secret"}, {"", ""}} {
+			if err := handler.Authenticate(pair[0], pair[1]); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+				t.Errorf("expected WRONGPASS for %v, got %v", pair, err)
+			}
+		}
+	})
+
+	t.Run("permissions follow the rules", func(t *testing.T) {
+		cases := []struct {
+			user, command, key string
+			allowed            bool
+			prefix             string
+		}{
+			{"", "GET", "app:1", false, "NOAUTH"},
+			{"app", "GET", "app:1", true, ""},
+			{"app", "SET", "app:2", true, ""},
+			{"app", "PING", "", true, ""},
+			{"app", "SET", "other", false, "NOPERM"},
+			{"app", "FLUSHDB", "", false, "NOPERM"},
+			{"app", "ACL", "", false, "NOPERM"},
+			{"admin", "FLUSHDB", "", true, ""},
+			{"admin", "SET", "other", true, ""},
+		}
+		for _, c := range cases {
+			err := handler.Authorize(c.user, c.command, c.key)
+			if c.allowed && err != nil {
+				t.Errorf("expected %s to run %s on %q, got %v", c.user, c.command, c.key, err)
+			}
+			if !c.allowed && (err == nil || !strings.HasPrefix(err.Error(), c.prefix)) {
+				t.Errorf("expected %s running %s on %q to fail with %s, got %v", c.user, c.command, c.key, c.prefix, err)
+			}
+		}
+	})
+
+	t.Run("passwords are stored hashed", func(t *testing.T) {
+		value := acl(t, handler, "LIST")["value"].([]interface{})
+		if len(value) != 3 {
+			t.Fatalf("expected 3 users, got %v", value)
+		}
+		for _, line := range value {
+			if strings.Contains(line.(string), "secret") || strings.Contains(line.(string), "root") {
+				t.Errorf("expected no clear text password, got %q", line)
+			}
+			if strings.Contains(line.(string), " #") && !strings.Contains(line.(string), " #scrypt$") {
+				t.Errorf("expected scrypt password hashes, got %q", line)
+			}
+		}
+		requests, _ := persistence.LoadRequests(engine)
+		for _, request := range requests {
+			if value, _ := request["value"].(string); strings.Contains(value, "secret") {
+				t.Errorf("expected no clear text password in the log, got %v", request)
+			}
+		}
+	})
+
+	t.Run("forwarded requests carry only hashes", func(t *testing.T) {
+		request := map[string]interface{}{"command": "ACL", "args": []interface{}{"SETUSER", "app", ">other", "<secret"}}
+		if err := handler.HashPasswords(request); err != nil {
+			t.Fatalf("HashPasswords failed: %v", err)
+		}
+		args, _ := request["args"].([]string)
+		if len(args) != 4 || !strings.HasPrefix(args[2], "#scrypt$") || !strings.HasPrefix(args[3], "!scrypt$") {
+			t.Fatalf("expected hashed rules, got %v", request["args"])
+		}
+		if _, err := handler.HandleCommand(request); err != nil {
+			t.Fatalf("ACL SETUSER with the hashed rules failed: %v", err)
+		}
+		if handler.Authenticate("app", "secret") == nil || handler.Authenticate("app", "other") != nil {
+			t.Error("expected the password to be replaced")
+		}
+		acl(t, handler, "SETUSER", "app", ">secret", "<other")
+	})
+
+	t.Run("invalid rules are refused", func(t *testing.T) {
+		key := strings.Repeat("00", 32)
+		costly := []string{"#scrypt$1048576$8$1$00$" + key, "#scrypt$32768$32$1$00$" + key, "#scrypt$32768$8$16$00$" + key}
+		for _, rule := range append([]string{"+@nothing", "+nocommand", "sometimes", "<notapassword", "#0123abcd"}, costly...) {
+			if _, err := handler.HandleCommand(map[string]interface{}{"command": "ACL", "args": []interface{}{"SETUSER", "app", rule}}); err == nil {
+				t.Errorf("expected %q to be refused", rule)
+			}
+		}
+	})
+
+	t.Run("users survive FLUSHDB, replay and compaction", func(t *testing.T) {
+		handler.HandleCommand(map[string]interface{}{"command": "FLUSHDB"})
+		acl(t, handler, "SETUSER", "app", "<secret", ">changed")
+		if err := handler.Authenticate("app", "changed"); err != nil {
+			t.Fatalf("expected the new password to match, got %v", err)
+		}
+		if err := handler.Authenticate("app", "secret"); err == nil {
+			t.Error("expected the removed password to fail")
+		}
+
+		check := func(stage string) {
+			replayed := core.NewCommandHandler(core.NewDatabase(), nil)
+			if err := replayed.Database.RebuildFrom(engine); err != nil {
+				t.Fatalf("%s: replay failed: %v", stage, err)
+			}
+			if err := replayed.Authenticate("app", "changed"); err != nil {
+				t.Errorf("%s: expected the user to be restored, got %v", stage, err)
+			}
+			if err := replayed.Authorize("app", "FLUSHDB", ""); err == nil {
+				t.Errorf("%s: expected the permissions to be restored", stage)
+			}
+		}
+		check("replay")
+		if err := handler.Compact(); err != nil {
+			t.Fatalf("compaction failed: %v", err)
+		}
+		check("compaction")
+	})
+
+	t.Run("deleted users lose access", func(t *testing.T) {
+		if value := acl(t, handler, "DELUSER", "app", "nobody")["value"]; value != 1 {
+			t.Errorf("expected 1 user removed, got %v", value)
+		}
+		if err := handler.Authorize("app", "GET", "app:1"); err == nil || !strings.HasPrefix(err.Error(), "NOAUTH") {
+			t.Errorf("expected NOAUTH, got %v", err)
+		}
+		if _, err := handler.HandleCommand(map[string]interface{}{"command": "ACL", "args": []interface{}{"DELUSER", "default"}}); err == nil {
+			t.Error("expected the default user to stay")
+		}
+	})
+}
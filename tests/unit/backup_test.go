@@ -0,0 +1,84 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/backup"
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+)
+
+func TestBackupRestore(t *testing.T) {
+	db := core.NewDatabase()
+	handler := core.NewCommandHandler(db, nil)
+	handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "name", "value": "john"})
+	handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "session", "value": "abc", "exp": int64(60000)})
+	handler.HandleCommand(map[string]interface{}{"command": "PUSH", "key": "queue", "value": "first"})
+	want, _ := db.Dump()
+
+	for _, target := range []string{"backup", "backup.tar", "backup.tar.gz"} {
+		path := filepath.Join(t.TempDir(), target)
+		meta, err := backup.Create(db, nil, 7, 3, path)
+		if err != nil {
+			t.Fatalf("%s: backup failed: %v", target, err)
+		}
+		if meta.NodeID != 7 || meta.Term != 3 || meta.LogPosition != 3 {
+			t.Errorf("%s: unexpected metadata %+v", target, meta)
+		}
+		if _, err := backup.Create(db, nil, 7, 3, path); err == nil {
+			t.Errorf("%s: expected an existing backup not to be overwritten", target)
+		}
+
+		engine, err := persistence.NewEngine(persistence.EngineBinlog, t.TempDir(), nil)
+		if err != nil {
+			t.Fatalf("failed to open engine: %v", err)
+		}
+		if _, err := backup.Restore(path, engine); err != nil {
+			t.Fatalf("%s: restore failed: %v", target, err)
+		}
+		restored := core.NewDatabase()
+		restored.RebuildFrom(engine)
+		got, _ := restored.Dump()
+		engine.Close()
+
+		if !bytes.Equal(want, got) {
+			t.Errorf("%s: restored database differs from the original", target)
+		}
+	}
+}
+
+func TestRestoreRejectsNewerFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup")
+	if _, err := backup.Create(core.NewDatabase(), nil, 1, 0, path); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+
+	meta := backup.Metadata{FormatVersion: backup.FormatVersion + 1}
+	data, _ := json.Marshal(meta)
+	os.WriteFile(filepath.Join(path, "metadata.json"), data, 0644)
+
+	engine, err := persistence.NewEngine(persistence.EngineBinlog, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("failed to open engine: %v", err)
+	}
+	defer engine.Close()
+	if _, err := backup.Restore(path, engine); err == nil {
+		t.Errorf("expected a backup from a newer format to be rejected")
+	}
+}
+
+func TestRestoreRejectsMemoryEngine(t *testing.T) {
+	db := core.NewDatabase()
+	core.NewCommandHandler(db, nil).HandleCommand(map[string]interface{}{"command": "SET", "key": "name", "value": "john"})
+	path := filepath.Join(t.TempDir(), "backup")
+	if _, err := backup.Create(db, nil, 1, 0, path); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if _, err := backup.Restore(path, persistence.NewMemoryEngine()); err == nil {
+		t.Error("expected restoring into the memory engine to fail instead of starting empty")
+	}
+}
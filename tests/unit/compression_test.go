@@ -0,0 +1,98 @@
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+)
+
+func TestCompressedBinlog(t *testing.T) {
+	value := `{"name":"` + strings.Repeat("geomys ", 200) + `"}`
+	writes := func(t *testing.T, dir string, compression string, from int) {
+		codec, err := persistence.NewCodec(compression)
+		if err != nil {
+			t.Fatalf("failed to create codec: %v", err)
+		}
+		engine, err := persistence.NewEngine(persistence.EngineBinlog, dir, codec)
+		if err != nil {
+			t.Fatalf("failed to open engine: %v", err)
+		}
+		defer engine.Close()
+		handler := core.NewCommandHandler(core.NewDatabase(), engine)
+		for i := from; i < from+10; i++ {
+			handler.HandleCommand(map[string]interface{}{"command": "SET", "key": fmt.Sprint("key", i), "value": value})
+		}
+	}
+	size := func(dir string) int64 {
+		info, err := os.Stat(filepath.Join(dir, "binlog.dat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	plainDir := t.TempDir()
+	writes(t, plainDir, persistence.CompressionNone, 0)
+
+	for _, compression := range []string{persistence.CompressionSnappy, persistence.CompressionZstd, persistence.CompressionS2} {
+		dir := t.TempDir()
+		writes(t, dir, compression, 0)
+		if size(dir) >= size(plainDir) {
+			t.Errorf("%s: expected a smaller log than %d bytes, got %d", compression, size(plainDir), size(dir))
+		}
+
+		// Frames of different algorithms can follow each other in one file
+		writes(t, dir, persistence.CompressionNone, 10)
+
+		engine, err := persistence.NewEngine(persistence.EngineBinlog, dir, nil)
+		if err != nil {
+			t.Fatalf("failed to open engine: %v", err)
+		}
+		db := core.NewDatabase()
+		if err := db.RebuildFrom(engine); err != nil {
+			t.Fatalf("%s: replay failed: %v", compression, err)
+		}
+		engine.Close()
+
+		entries := db.Entries()
+		if len(entries) != 20 {
+			t.Fatalf("%s: expected 20 keys, got %d", compression, len(entries))
+		}
+		for _, entry := range entries {
+			if entry.Value != value {
+				t.Errorf("%s: value of %s was not restored", compression, entry.Key)
+			}
+		}
+	}
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	records := []map[string]interface{}{
+		{"command": "SET", "key": "a", "value": strings.Repeat("x", 1000)},
+		{"command": "PUSH", "key": "b", "value": "1"},
+	}
+	codec, _ := persistence.NewCodec(persistence.CompressionZstd)
+
+	var buf bytes.Buffer
+	if err := persistence.WriteSnapshot(&buf, records, codec); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	if buf.Len() >= 1000 {
+		t.Errorf("expected the snapshot to be compressed, got %d bytes", buf.Len())
+	}
+
+	// The reader does not need to know the algorithm
+	got, err := persistence.ReadSnapshot(&buf, nil)
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+	if len(got) != 2 || got[0]["value"] != records[0]["value"] || got[1]["key"] != "b" {
+		t.Errorf("snapshot round trip failed, got %v", got)
+	}
+}
@@ -0,0 +1,61 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/utils"
+)
+
+// loadConfig writes content to a configuration file and loads it
+func loadConfig(t *testing.T, content string) (*utils.Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "geomys.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return utils.LoadConfig(path)
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("max staleness defaults with and without a file", func(t *testing.T) {
+		missing, err := utils.LoadConfig(filepath.Join(t.TempDir(), "missing.conf"))
+		if err != nil || missing.MaxStaleness != 1000 {
+			t.Errorf("expected 1000 without a file, got %d, %v", missing.MaxStaleness, err)
+		}
+		config, err := loadConfig(t, `{"node_id": 1}`)
+		if err != nil || config.MaxStaleness != 1000 {
+			t.Errorf("expected 1000 from a file without it, got %d, %v", config.MaxStaleness, err)
+		}
+		config, err = loadConfig(t, `{"max_staleness_ms": -1}`)
+		if err != nil || config.MaxStaleness != -1 {
+			t.Errorf("expected -1 to stay unbounded, got %d, %v", config.MaxStaleness, err)
+		}
+	})
+
+	t.Run("unknown values are refused", func(t *testing.T) {
+		for _, content := range []string{
+			`{"persistence": "blot"}`,
+			`{"compression": "zsdt"}`,
+			`{"write_concern": "most"}`,
+			`{"read_consistency": "strong"}`,
+			`{"follower_writes": "drop"}`,
+			`{"client_tls": {"client_auth": "verify"}}`,
+		} {
+			if _, err := loadConfig(t, content); err == nil {
+				t.Errorf("expected %s to be refused", content)
+			}
+		}
+	})
+
+	t.Run("missing values get defaults", func(t *testing.T) {
+		config, err := loadConfig(t, `{"persistence": "bolt"}`)
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %v", err)
+		}
+		if config.Persistence != "bolt" || config.Compression != "none" || config.WriteConcern != "one" || config.ReadConsistency != "eventual" || config.FollowerWrites != "forward" || config.ClientTLS.ClientAuth != "none" {
+			t.Errorf("expected the defaults beside persistence, got %+v", config)
+		}
+	})
+}
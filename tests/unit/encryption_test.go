@@ -0,0 +1,134 @@
+package unit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+)
+
+func newCodec(t *testing.T, keys ...string) *persistence.Codec {
+	raw := make([][]byte, len(keys))
+	for i, key := range keys {
+		raw[i] = []byte(key)
+	}
+	codec, err := persistence.NewCodec(persistence.CompressionNone, raw...)
+	if err != nil {
+		t.Fatalf("failed to create codec: %v", err)
+	}
+	return codec
+}
+
+func TestEncryptedBinlog(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := "0123456789abcdef0123456789abcdef"
+	newKey := "fedcba9876543210fedcba9876543210"
+
+	engine, err := persistence.NewEngine(persistence.EngineBinlog, dir, newCodec(t, oldKey))
+	if err != nil {
+		t.Fatalf("failed to open engine: %v", err)
+	}
+	handler := core.NewCommandHandler(core.NewDatabase(), engine)
+	handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "secret", "value": "plaintext-value"})
+	engine.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "binlog.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("plaintext-value")) {
+		t.Error("expected the value to be encrypted on disk")
+	}
+
+	// Without the key the log must not be readable
+	plain, err := persistence.NewEngine(persistence.EngineBinlog, dir, nil)
+	if err != nil {
+		t.Fatalf("failed to open engine: %v", err)
+	}
+	if err := core.NewDatabase().RebuildFrom(plain); err == nil {
+		t.Error("expected replay without a key to fail")
+	}
+	plain.Close()
+
+	// Rotate: new key first, old key still known, then compact
+	engine, err = persistence.NewEngine(persistence.EngineBinlog, dir, newCodec(t, newKey, oldKey))
+	if err != nil {
+		t.Fatalf("failed to open engine: %v", err)
+	}
+	handler = core.NewCommandHandler(core.NewDatabase(), engine)
+	if err := handler.Database.RebuildFrom(engine); err != nil {
+		t.Fatalf("replay with the previous key failed: %v", err)
+	}
+	if err := handler.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	engine.Close()
+
+	// After compaction the old key is no longer needed
+	engine, err = persistence.NewEngine(persistence.EngineBinlog, dir, newCodec(t, newKey))
+	if err != nil {
+		t.Fatalf("failed to open engine: %v", err)
+	}
+	defer engine.Close()
+	db := core.NewDatabase()
+	if err := db.RebuildFrom(engine); err != nil {
+		t.Fatalf("replay after rotation failed: %v", err)
+	}
+	entries := db.Entries()
+	if len(entries) != 1 || entries[0].Value != "plaintext-value" {
+		t.Errorf("expected the secret to survive rotation, got %v", entries)
+	}
+}
+
+func TestKeyFileEncoding(t *testing.T) {
+	dir := t.TempDir()
+	key := "000102030405060708090a0b0c0d0e0f" // 16 bytes as hex
+	load := func(name, content string) *persistence.Codec {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		codec, err := persistence.LoadCodec(persistence.CompressionNone, path, "", nil)
+		if err != nil {
+			t.Fatalf("loading %s failed: %v", name, err)
+		}
+		return codec
+	}
+	bare := load("bare.key", key)
+	newline := load("newline.key", key+"\n")
+
+	// Data written with the key without a newline must be read with the
+	// key with one, and with the decoded bytes
+	engine, err := persistence.NewEngine(persistence.EngineBinlog, dir, bare)
+	if err != nil {
+		t.Fatalf("failed to open engine: %v", err)
+	}
+	core.NewCommandHandler(core.NewDatabase(), engine).HandleCommand(map[string]interface{}{"command": "SET", "key": "k", "value": "v"})
+	engine.Close()
+
+	decoded := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	raw, err := persistence.NewCodec(persistence.CompressionNone, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, codec := range map[string]*persistence.Codec{"newline": newline, "decoded": raw} {
+		engine, err := persistence.NewEngine(persistence.EngineBinlog, dir, codec)
+		if err != nil {
+			t.Fatalf("failed to open engine: %v", err)
+		}
+		db := core.NewDatabase()
+		if err := db.RebuildFrom(engine); err != nil {
+			t.Errorf("%s: replay failed: %v", name, err)
+		}
+		engine.Close()
+	}
+
+	path := filepath.Join(dir, "text.key")
+	os.WriteFile(path, []byte("not-a-key-but-thirty-two-chars!!"), 0600)
+	if _, err := persistence.LoadCodec(persistence.CompressionNone, path, "", nil); err == nil {
+		t.Error("expected a 32 character text key that is neither hex nor base64 to be refused")
+	}
+}
@@ -0,0 +1,100 @@
+package unit
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+)
+
+func TestEntryRequests(t *testing.T) {
+	run := func(handler *core.CommandHandler, request map[string]interface{}) {
+		t.Helper()
+		if _, err := handler.HandleCommand(request); err != nil {
+			t.Fatalf("%v failed: %v", request, err)
+		}
+	}
+	source := core.NewCommandHandler(core.NewDatabase(), persistence.NewMemoryEngine())
+	run(source, map[string]interface{}{"command": "SET", "key": "user:1/name", "value": "ada"})
+	run(source, map[string]interface{}{"command": "SET", "key": "session:9", "value": "token", "exp": int64(60000)})
+	for _, value := range []string{"a", "b", "c"} {
+		run(source, map[string]interface{}{"command": "PUSH", "key": "queue", "value": value})
+	}
+	entries := source.Database.Entries()
+
+	t.Run("entries survive export and import", func(t *testing.T) {
+		target := core.NewCommandHandler(core.NewDatabase(), persistence.NewMemoryEngine())
+		for _, entry := range entries {
+			// As the tool writes and reads them
+			data, err := json.Marshal(entry)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			var decoded core.Entry
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			requests, err := decoded.Requests()
+			if err != nil {
+				t.Fatalf("Requests of %q failed: %v", entry.Key, err)
+			}
+			for _, request := range requests {
+				run(target, request)
+			}
+		}
+
+		imported := target.Database.Entries()
+		if len(imported) != len(entries) {
+			t.Fatalf("expected %d entries, got %v", len(entries), imported)
+		}
+		for i, entry := range entries {
+			got := imported[i]
+			if got.Key != entry.Key || got.Type != entry.Type || !reflect.DeepEqual(got.Value, entry.Value) {
+				t.Errorf("expected %+v, got %+v", entry, got)
+			}
+			// The time to live keeps running between export and import
+			if (entry.TTL == 0) != (got.TTL == 0) || got.TTL > entry.TTL || got.TTL < entry.TTL-1000 {
+				t.Errorf("expected %q to keep a TTL near %d, got %d", entry.Key, entry.TTL, got.TTL)
+			}
+		}
+	})
+
+	t.Run("invalid entries are refused", func(t *testing.T) {
+		for _, entry := range []core.Entry{
+			{Key: "k", Type: "hash", Value: "v"},
+			{Key: "k", Type: core.TypeString, Value: []interface{}{"v"}},
+			{Key: "k", Type: core.TypeList, Value: "v"},
+		} {
+			if _, err := entry.Requests(); err == nil {
+				t.Errorf("expected %+v to be refused", entry)
+			}
+		}
+	})
+
+	t.Run("filters select by pattern and type", func(t *testing.T) {
+		cases := []struct {
+			filter core.EntryFilter
+			keys   []string
+		}{
+			{core.EntryFilter{Match: "*"}, []string{"session:9", "user:1/name", "queue"}},
+			{core.EntryFilter{}, []string{"session:9", "user:1/name", "queue"}},
+			{core.EntryFilter{Match: "user:*"}, []string{"user:1/name"}},
+			{core.EntryFilter{Match: "session:?"}, []string{"session:9"}},
+			{core.EntryFilter{Match: "*", Type: core.TypeList}, []string{"queue"}},
+			{core.EntryFilter{Match: "user:*", Type: core.TypeList}, nil},
+		}
+		for _, c := range cases {
+			var keys []string
+			for _, entry := range entries {
+				if c.filter.Accepts(entry) {
+					keys = append(keys, entry.Key)
+				}
+			}
+			if !reflect.DeepEqual(keys, c.keys) {
+				t.Errorf("expected %+v to select %v, got %v", c.filter, c.keys, keys)
+			}
+		}
+	})
+}
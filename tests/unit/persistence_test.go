@@ -0,0 +1,134 @@
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/vskvj3/geomys/internal/core"
+	"github.com/vskvj3/geomys/internal/persistence"
+)
+
+// operation is a randomly generated client request
+type operation struct {
+	Kind  uint8
+	Key   uint8
+	Value int8
+}
+
+// Generate implements quick.Generator so keys collide often enough to be interesting
+func (operation) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(operation{
+		Kind:  uint8(r.Intn(8)),
+		Key:   uint8(r.Intn(4)),
+		Value: int8(r.Intn(21) - 10),
+	})
+}
+
+func (o operation) request() map[string]interface{} {
+	key := fmt.Sprintf("key%d", o.Key)
+	switch o.Kind {
+	case 0:
+		return map[string]interface{}{"command": "SET", "key": key, "value": fmt.Sprint(o.Value)}
+	case 1:
+		return map[string]interface{}{"command": "SET", "key": key, "value": "text", "exp": int64(60000)}
+	case 2, 3:
+		return map[string]interface{}{"command": "INCR", "key": key, "offset": fmt.Sprint(o.Value)}
+	case 4:
+		return map[string]interface{}{"command": "PUSH", "key": key, "value": fmt.Sprint(o.Value)}
+	case 5:
+		return map[string]interface{}{"command": "LPOP", "key": key}
+	case 6:
+		return map[string]interface{}{"command": "RPOP", "key": key}
+	default:
+		if o.Value == 0 {
+			return map[string]interface{}{"command": "FLUSHDB"}
+		}
+		return map[string]interface{}{"command": "GET", "key": key}
+	}
+}
+
+// engines opens every disk backed engine inside dir
+func engines(t *testing.T, dir string) map[string]persistence.Engine {
+	result := make(map[string]persistence.Engine)
+	for _, name := range []string{persistence.EngineBinlog, persistence.EngineBolt} {
+		engine, err := persistence.NewEngine(name, dir, nil)
+		if err != nil {
+			t.Fatalf("failed to open %s engine: %v", name, err)
+		}
+		result[name] = engine
+	}
+	return result
+}
+
+func TestReplayReproducesLiveState(t *testing.T) {
+	dir := t.TempDir()
+	run := 0
+
+	replayMatches := func(ops []operation) bool {
+		run++
+		for name, engine := range engines(t, filepath.Join(dir, fmt.Sprint(run))) {
+			live := core.NewDatabase()
+			handler := core.NewCommandHandler(live, engine)
+			for _, op := range ops {
+				// Rejected commands are expected, they must simply not reach the log
+				handler.HandleCommand(op.request())
+			}
+			want, _ := live.Dump()
+
+			replayed := core.NewDatabase()
+			if err := replayed.RebuildFrom(engine); err != nil {
+				t.Fatalf("%s: replay failed: %v", name, err)
+			}
+			got, _ := replayed.Dump()
+
+			// A compacted history must rebuild the same state
+			if err := handler.Compact(); err != nil {
+				t.Fatalf("%s: compaction failed: %v", name, err)
+			}
+			compacted := core.NewDatabase()
+			if err := compacted.RebuildFrom(engine); err != nil {
+				t.Fatalf("%s: replay after compaction failed: %v", name, err)
+			}
+			gotCompacted, _ := compacted.Dump()
+			engine.Close()
+
+			if !bytes.Equal(want, got) || !bytes.Equal(want, gotCompacted) {
+				t.Logf("%s engine diverged", name)
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := quick.Check(replayMatches, &quick.Config{MaxCount: 100}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRejectedWritesAreNotLogged(t *testing.T) {
+	for name, engine := range engines(t, t.TempDir()) {
+		handler := core.NewCommandHandler(core.NewDatabase(), engine)
+		handler.HandleCommand(map[string]interface{}{"command": "SET", "key": "name", "value": "john"})
+		if _, err := handler.HandleCommand(map[string]interface{}{"command": "INCR", "key": "name", "offset": "1"}); err == nil {
+			t.Errorf("%s: expected INCR on a non-integer to fail", name)
+		}
+		if _, err := handler.HandleCommand(map[string]interface{}{"command": "LPOP", "key": "nolist"}); err == nil {
+			t.Errorf("%s: expected LPOP on a missing list to fail", name)
+		}
+		handler.HandleCommand(map[string]interface{}{"command": "FLUSHDB"})
+
+		requests, err := persistence.LoadRequests(engine)
+		if err != nil {
+			t.Fatalf("%s: failed to load requests: %v", name, err)
+		}
+		if len(requests) != 2 || requests[0]["command"] != "SET" || requests[1]["command"] != "FLUSHDB" {
+			t.Errorf("%s: expected [SET FLUSHDB] in the log, got %v", name, requests)
+		}
+		engine.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package unit
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	pb "github.com/vskvj3/geomys/internal/cluster/proto"
+	"github.com/vskvj3/geomys/internal/cluster/shard"
+)
+
+func TestSlot(t *testing.T) {
+	// The same slots Redis Cluster assigns
+	for key, want := range map[string]uint32{"foo": 12182, "123456789": 12739, "bar": 5061} {
+		if got := shard.Slot(key); got != want {
+			t.Errorf("expected slot %d for %q, got %d", want, key, got)
+		}
+	}
+
+	// Only a non-empty hash tag is hashed
+	if shard.Slot("{user}:1") != shard.Slot("{user}:2") || shard.Slot("{user}:1") != shard.Slot("user") {
+		t.Error("expected keys with the same hash tag to share a slot")
+	}
+	if shard.Slot("{}foo") == shard.Slot("foo") {
+		t.Error("expected an empty hash tag to hash the whole key")
+	}
+}
+
+func TestSlotRanges(t *testing.T) {
+	ranges, err := shard.ParseRanges("0-99,100, 200-299", 1)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if got := shard.FormatRanges(ranges); got != "0-100,200-299" {
+		t.Errorf("expected adjacent ranges to merge, got %s", got)
+	}
+
+	ranges = shard.Remove(ranges, 50, 60)
+	ranges = shard.Assign(ranges, 250, 250, 2)
+	if got := shard.FormatRanges(ranges); got != "0-49,61-100,200-249,250,251-299" {
+		t.Errorf("unexpected ranges %s", got)
+	}
+	if r := shard.Find(ranges, 250); r == nil || r.Epoch != 2 {
+		t.Errorf("expected slot 250 at epoch 2, got %v", r)
+	}
+	if shard.Find(ranges, 55) != nil {
+		t.Error("expected slot 55 to be removed")
+	}
+
+	for _, bad := range []string{"16384", "10-5", "x"} {
+		if _, err := shard.ParseRanges(bad, 1); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestTopologyOwner(t *testing.T) {
+	topology := shard.NewTopology()
+	claim := func(node, group int32, ranges string, epoch uint64, version int64) *pb.NodeInfo {
+		slots, err := shard.ParseRanges(ranges, epoch)
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		return &pb.NodeInfo{NodeId: node, GroupId: group, ClientAddress: fmt.Sprintf("node%d", node), Leader: true,
+			Configuration: &pb.Configuration{Slots: slots}, Version: version}
+	}
+	topology.Update(claim(1, 1, "0-8191", 1, 1), claim(2, 2, "8192-16383", 1, 1))
+
+	if group, _, ok := topology.Owner(100); !ok || group != 1 {
+		t.Errorf("expected group 1 to own slot 100, got %d", group)
+	}
+	if got := topology.Address(2); got != "node2" {
+		t.Errorf("expected node2 to serve group 2, got %s", got)
+	}
+
+	// A claim with a higher epoch wins even while the old owner still lists the slot
+	topology.Update(claim(2, 2, "100,8192-16383", 2, 2))
+	if group, epoch, _ := topology.Owner(100); group != 2 || epoch != 2 {
+		t.Errorf("expected group 2 to own slot 100 at epoch 2, got %d at %d", group, epoch)
+	}
+
+	// Older versions of what a node said are ignored
+	if topology.Update(claim(2, 2, "8192-16383", 1, 1)) {
+		t.Error("expected an older version to be ignored")
+	}
+	if ranges := topology.Map(); len(ranges) != 4 {
+		t.Errorf("expected 4 ranges in the slot map, got %v", ranges)
+	}
+}
+
+func TestRebalancePlan(t *testing.T) {
+	// A new group gets its share from the one serving everything
+	moves := shard.Plan([]shard.SlotRange{{Start: 0, End: 16383, Group: 1}}, []int32{1, 2, 3})
+	want := []shard.Move{{From: 1, To: 2, Start: 5462, End: 10922}, {From: 1, To: 3, Start: 10923, End: 16383}}
+	if !reflect.DeepEqual(moves, want) {
+		t.Errorf("expected %v, got %v", want, moves)
+	}
+
+	// A group left out gives all of its slots to the rest
+	slotMap := []shard.SlotRange{{Start: 0, End: 5461, Group: 1}, {Start: 5462, End: 10922, Group: 2}, {Start: 10923, End: 16383, Group: 3}}
+	moves = shard.Plan(slotMap, []int32{1, 3})
+	want = []shard.Move{{From: 2, To: 1, Start: 5462, End: 8191}, {From: 2, To: 3, Start: 8192, End: 10922}}
+	if !reflect.DeepEqual(moves, want) {
+		t.Errorf("expected %v, got %v", want, moves)
+	}
+
+	if moves := shard.Plan(slotMap, []int32{1, 2, 3}); len(moves) != 0 {
+		t.Errorf("expected balanced groups to stay as they are, got %v", moves)
+	}
+}
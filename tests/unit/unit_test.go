@@ -162,3 +162,28 @@ func TestCoreCommands(t *testing.T) {
 		}
 	})
 }
+
+func TestEntries(t *testing.T) {
+	db := core.NewDatabase()
+	db.Set("name", "john", 0)
+	db.Set("session", "abc", 60000)
+	db.Set("gone", "soon", 1)
+	db.Push("queue", "first")
+	db.Push("queue", "second")
+	time.Sleep(5 * time.Millisecond)
+
+	entries := db.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries without the expired key, got %v", entries)
+	}
+	if entries[0].Key != "name" || entries[0].Type != core.TypeString || entries[0].TTL != 0 {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+	if entries[1].Key != "session" || entries[1].TTL <= 0 || entries[1].TTL > 60000 {
+		t.Errorf("expected session to carry its remaining TTL, got %+v", entries[1])
+	}
+	values, ok := entries[2].Value.([]interface{})
+	if entries[2].Type != core.TypeList || !ok || len(values) != 2 || values[0] != "first" {
+		t.Errorf("unexpected list entry %+v", entries[2])
+	}
+}